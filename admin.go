@@ -0,0 +1,103 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import "time"
+
+// Maximum number of locks returned by a single ListLocks call when no limit is given.
+const DefaultListLocksMaxEntries = 1000
+
+// ListLocksArgs - arguments for the ListLocks rpc call of a lock server.
+type ListLocksArgs struct {
+	Token       string
+	Timestamp   time.Time
+	Incarnation uint64
+	Version     uint32
+	Namespace   string // Namespace to list the locks of
+	Prefix      string // Only list locks whose name starts with prefix
+	Marker      string // Only list locks whose name sorts after marker (for pagination)
+	MaxEntries  int    // Maximum number of locks to return (DefaultListLocksMaxEntries when zero)
+}
+
+func (l *ListLocksArgs) SetToken(token string) {
+	l.Token = token
+}
+
+func (l *ListLocksArgs) SetTimestamp(tstamp time.Time) {
+	l.Timestamp = tstamp
+}
+
+func (l *ListLocksArgs) SetIncarnation(incarnation uint64) {
+	l.Incarnation = incarnation
+}
+
+func (l *ListLocksArgs) SetVersion(version uint32) {
+	l.Version = version
+}
+
+// LockHolder - describes a single grant of a lock as held by a lock server.
+type LockHolder struct {
+	Writer     bool          // Whether this is a write or read lock
+	Node       string        // Network address of client holding the lock
+	RPCPath    string        // RPC path of client holding the lock
+	UID        string        // Uid of the request that acquired the lock
+	Since      time.Time     // Time at which the lock was granted (server clock)
+	Age        time.Duration // Time the lock has been held for
+	LastCheck  time.Time     // Time of last check of validity of the lock (server clock)
+	Persistent bool          // Whether this is a persistent lock, held until its TTL also when its client is gone
+}
+
+// LockInfo - describes all holders of a lock.
+type LockInfo struct {
+	Name    string
+	Holders []LockHolder
+}
+
+// ListLocksReply - reply of the ListLocks rpc call, sorted by name.
+type ListLocksReply struct {
+	Locks      []LockInfo
+	Truncated  bool   // Set when more locks match beyond the ones returned
+	NextMarker string // Marker to pass in to continue listing when truncated
+}
+
+// ForceUnlockArgs - arguments for the ForceUnlockMatching rpc call of a lock server,
+// exactly one of Prefix or Pattern must be set.
+type ForceUnlockArgs struct {
+	Token       string
+	Timestamp   time.Time
+	Incarnation uint64
+	Version     uint32
+	Namespace   string // Namespace to release the locks of
+	Prefix      string // Release all locks whose name starts with prefix
+	Pattern     string // Release all locks whose name matches the glob pattern (see path.Match)
+}
+
+func (f *ForceUnlockArgs) SetToken(token string) {
+	f.Token = token
+}
+
+func (f *ForceUnlockArgs) SetTimestamp(tstamp time.Time) {
+	f.Timestamp = tstamp
+}
+
+func (f *ForceUnlockArgs) SetIncarnation(incarnation uint64) {
+	f.Incarnation = incarnation
+}
+
+func (f *ForceUnlockArgs) SetVersion(version uint32) {
+	f.Version = version
+}
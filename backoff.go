@@ -0,0 +1,100 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// Factor by which the default policy scales up the back-off of the hottest names
+const maxBackOffScale = 2
+
+// BackOffState - what a BackOffPolicy decides the back-off before the next attempt to acquire a lock on.
+type BackOffState struct {
+	Namespace      string
+	Name           string
+	Attempt        int     // Failed attempts of this acquisition so far, 1 after the first one
+	RecentFailures float64 // Failed attempts on the name by this client recently (including this one), decaying with a half-life of 10 seconds
+}
+
+// BackOffPolicy - decides how long a client waits before the next attempt to acquire a lock.
+type BackOffPolicy interface {
+	BackOff(state BackOffState) time.Duration
+}
+
+// BackOffFunc - adapts a function to a BackOffPolicy.
+type BackOffFunc func(state BackOffState) time.Duration
+
+func (f BackOffFunc) BackOff(state BackOffState) time.Duration {
+	return f(state)
+}
+
+// AdaptiveBackOff - the default back-off policy: a randomized back-off that grows with every attempt
+// (up to 128 milliseconds), halved for names that are cold (nothing but the attempt that just failed
+// failed on them recently) and scaled up (by at most two) with the recent failures on names that are
+// hot, so that contended names are retried less aggressively while other names are acquired quickly.
+var AdaptiveBackOff BackOffPolicy = BackOffFunc(adaptiveBackOff)
+
+func adaptiveBackOff(state BackOffState) time.Duration {
+	attempt := state.Attempt
+	if attempt > 7 {
+		attempt = 7
+	}
+	ceiling := float64(time.Millisecond << uint(attempt))
+	if earlier := state.RecentFailures - 1; earlier < 1 {
+		ceiling /= 2 // Cold, nothing but the attempt that just failed failed on it recently
+	} else {
+		ceiling *= math.Min(math.Log2(1+earlier), maxBackOffScale)
+	}
+	return time.Duration(rand.Float64() * ceiling)
+}
+
+type backOffHolder struct {
+	policy BackOffPolicy
+}
+
+// Back-off policy of the client, set via SetBackOffPolicy
+var dbackOff atomic.Value
+
+func init() {
+	dbackOff.Store(backOffHolder{policy: AdaptiveBackOff})
+}
+
+// SetBackOffPolicy - replaces the policy deciding the back-off between the attempts to acquire a
+// lock, nil restores AdaptiveBackOff.
+func SetBackOffPolicy(policy BackOffPolicy) {
+	if policy == nil {
+		policy = AdaptiveBackOff
+	}
+	dbackOff.Store(backOffHolder{policy: policy})
+}
+
+// backOff waits before the next attempt to acquire the lock on name, after attempt failed attempts,
+// but not beyond deadline (unless zero) nor once ctx is done.
+func backOff(ctx context.Context, name string, attempt int, deadline time.Time) {
+	state := BackOffState{Namespace: getNamespace(), Name: name, Attempt: attempt, RecentFailures: recentFailures(name)}
+	if d := remaining(dbackOff.Load().(backOffHolder).policy.BackOff(state), deadline); d > 0 {
+		select {
+		case <-getClock().After(d):
+		case <-ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DRWMutexBatch - a write lock on a set of names that is acquired (and released) with a single
+// request per node, using the LockBatch and UnlockBatch handlers, rather than a request per name.
+// It is meant for callers that need many related locks at once (eg. on the parts of an erasure-coded
+// object). Every node grants either all names or none, so that a caller never holds just some of them.
+type DRWMutexBatch struct {
+	Names       []string
+	Owner       string       // Actor on whose behalf the locks are held (the node when empty)
+	writeLocks  []string     // Uids of the locks per node, empty for the nodes that did not grant them
+	lastAttempt *QuorumError // Outcome at every node of the most recent attempt, when it failed
+	m           sync.Mutex
+}
+
+// NewDRWMutexBatch returns a batch of write locks on names.
+func NewDRWMutexBatch(names ...string) *DRWMutexBatch {
+	return &DRWMutexBatch{
+		Names:      names,
+		writeLocks: make([]string, dnodeCount),
+	}
+}
+
+// Lock holds write locks on all names of dm.
+//
+// If any of the names is already locked, the calling go routine
+// blocks until all of them are available.
+func (dm *DRWMutexBatch) Lock() {
+
+	start := getClock().Now()
+	locks := make([]string, dnodeCount)
+
+	for attempts := 1; ; attempts++ {
+		dmetrics.attempted(false)
+		dstats.attempted()
+		success, attempt := lockBatch(&locks, dm.Names, dm.Owner)
+		if success {
+			dmetrics.acquired(false, attempts, start)
+			dstats.acquired(false, attempts)
+			dm.m.Lock()
+			defer dm.m.Unlock()
+			dm.lastAttempt = nil
+			copy(dm.writeLocks, locks)
+			return
+		}
+
+		logf(LogDebug, "Unable to acquire batch of locks", "names", len(dm.Names), "err", attempt)
+		dm.m.Lock()
+		dm.lastAttempt = attempt
+		dm.m.Unlock()
+
+		backOff(context.Background(), strings.Join(dm.Names, ","), attempts, time.Time{})
+	}
+}
+
+// LastAttempt returns which nodes granted, denied or failed the most recent attempt to acquire
+// the locks, or nil if they were granted (or not requested yet).
+func (dm *DRWMutexBatch) LastAttempt() *QuorumError {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	return dm.lastAttempt
+}
+
+// Unlock releases the write locks on all names of dm.
+//
+// It is a run-time error if dm is not locked on entry to Unlock.
+func (dm *DRWMutexBatch) Unlock() {
+
+	locks := make([]string, dnodeCount)
+	{
+		dm.m.Lock()
+		defer dm.m.Unlock()
+
+		lockFound := false
+		for _, uid := range dm.writeLocks {
+			lockFound = lockFound || isLocked(uid)
+		}
+		if !lockFound {
+			panic("Trying to Unlock() while no Lock() is active")
+		}
+		copy(locks, dm.writeLocks)
+		dm.writeLocks = make([]string, dnodeCount)
+	}
+
+	dmetrics.released(false, 1)
+	for index, c := range clnts {
+		if isLocked(locks[index]) {
+			sendReleaseBatch(c, dm.Names, locks[index])
+		}
+	}
+}
+
+// lockBatch tries to acquire write locks on all names with a single request to every node,
+// returning true once a quorum of the nodes (including the own node) granted them, or false
+// along with the outcome at every node otherwise.
+func lockBatch(locks *[]string, names []string, owner string) (bool, *QuorumError) {
+
+	ch := make(chan Granted, dnodeCount)
+	for index, c := range clnts {
+		go func(index int, c RPC) {
+			var locked bool
+			args := LockArgs{Namespace: getNamespace(), Names: names, Source: ownIdentity(), Owner: owner, UID: newUID(), Epoch: getEpoch(), Version: ProtocolVersion}
+			err := CallServer(context.Background(), c, "Dsync.LockBatch", &args, &locked)
+			if err != nil {
+				logf(LogWarn, "Unable to call", "method", "Dsync.LockBatch", "node", c.Node(), "err", err)
+			}
+			dstats.answered(c.Node(), locked, err)
+
+			g := Granted{index: index, err: err}
+			if locked {
+				g.lockUid = args.UID
+			}
+			ch <- g
+		}(index, c)
+	}
+
+	answers := make([]*Granted, dnodeCount) // Answers received before the attempt was decided
+	var order []int                         // Index of the nodes in order of answering
+	timeout := getClock().After(getAttemptTimeout())
+	received := 0
+wait:
+	for ; received < dnodeCount; received++ {
+		select {
+		case grant := <-ch:
+			answers[grant.index] = &grant
+			order = append(order, grant.index)
+			if grant.isLocked() {
+				(*locks)[grant.index] = grant.lockUid
+			}
+		case <-timeout:
+			break wait
+		}
+	}
+
+	if received < dnodeCount {
+		// Release the locks granted by the nodes that answer after the timeout
+		go func(late int) {
+			for ; late > 0; late-- {
+				if grant := <-ch; grant.isLocked() {
+					sendReleaseBatch(clnts[grant.index], names, grant.lockUid)
+				}
+			}
+		}(dnodeCount - received)
+	}
+
+	if quorumMet(locks, false) && isLocked((*locks)[ownNode]) {
+		return true, nil
+	}
+	for index, uid := range *locks {
+		if isLocked(uid) {
+			sendReleaseBatch(clnts[index], names, uid)
+			(*locks)[index] = ""
+		}
+	}
+	return false, newQuorumError(clnts, strings.Join(names, ","), answers, order)
+}
+
+// sendReleaseBatch sends a release of the write locks on names to a node that previously granted them
+func sendReleaseBatch(c RPC, names []string, uid string) {
+
+	go func() {
+		for _, backOff := range releaseBackOffs {
+			var unlocked bool
+			args := LockArgs{Namespace: getNamespace(), Names: names, UID: uid, Epoch: getEpoch(), Version: ProtocolVersion}
+			err := CallServer(context.Background(), c, "Dsync.UnlockBatch", &args, &unlocked)
+			if err == nil || errors.Is(err, ErrLockNotHeld) {
+				// Released (or no longer held by the node), exit out
+				return
+			}
+			logf(LogWarn, "Unable to call", "method", "Dsync.UnlockBatch", "node", c.Node(), "err", err)
+			dmetrics.unlockFailed()
+			if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+				// UnlockBatch possibly failed with server timestamp mismatch, server may have restarted.
+				return
+			}
+
+			// Wait..
+			getClock().Sleep(backOff)
+		}
+	}()
+}
@@ -0,0 +1,95 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/minio/dsync"
+	"github.com/minio/dsync/server"
+)
+
+// adminStatus is the JSON document served by the admin endpoint.
+type adminStatus struct {
+	Node        string                  `json:"node"`
+	StartTime   time.Time               `json:"startTime"`
+	Uptime      string                  `json:"uptime"`
+	Incarnation uint64                  `json:"incarnation"`
+	Epoch       uint64                  `json:"epoch"`
+	Draining    bool                    `json:"draining"`
+	Locks       []dsync.LockInfo        `json:"locks"`
+	Truncated   bool                    `json:"truncated"`
+	Namespaces  map[string]int          `json:"namespaces"` // Number of locks held per namespace
+	Waiters     map[string]int          `json:"waiters"`    // Number of requests parked per namespace
+	Maintenance server.MaintenanceStats `json:"maintenance"`
+}
+
+// adminHandler serves the current state of the lock server as JSON, the locks listed are those
+// of the 'namespace' query parameter and can be narrowed down with 'prefix', 'marker' and 'max'.
+func (l *lockServer) adminHandler(self string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats, err := l.stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status := adminStatus{
+			Node:        self,
+			StartTime:   stats.StartTime.UTC(),
+			Uptime:      stats.Uptime.String(),
+			Incarnation: stats.Incarnation,
+			Epoch:       stats.Epoch,
+			Draining:    stats.Draining,
+			Namespaces:  stats.Namespaces,
+			Waiters:     stats.Waiters,
+			Maintenance: stats.Maintenance,
+		}
+		args := dsync.ListLocksArgs{Token: *tokenFlag, Version: dsync.ProtocolVersion, Incarnation: stats.Incarnation}
+		args.Namespace = r.URL.Query().Get("namespace")
+		args.Prefix = r.URL.Query().Get("prefix")
+		args.Marker = r.URL.Query().Get("marker")
+		args.MaxEntries, _ = strconv.Atoi(r.URL.Query().Get("max"))
+		var reply dsync.ListLocksReply
+		if err := l.ListLocks(&args, &reply); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		status.Locks, status.Truncated = reply.Locks, reply.Truncated
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(&status)
+	})
+}
+
+// startAdminServer serves the admin endpoint on its own port, separate from the rpc traffic.
+func (l *lockServer) startAdminServer(self string, port int) {
+	mux := http.NewServeMux()
+	mux.Handle("/", l.adminHandler(self))
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatal("admin listen error:", err)
+	}
+	logger.Log(dsync.LogInfo, "Admin endpoint listening", "port", port)
+	go http.Serve(ln, mux)
+}
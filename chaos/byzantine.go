@@ -0,0 +1,175 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/minio/dsync"
+)
+
+// byzantineServer is a lock server that answers incorrectly, as served by the server selected with
+// -byzantine-server. It keeps track of the locks like an honest server, but lies about them in its
+// answers: granting every lock (and acknowledging every unlock), reporting every lock as expired,
+// and/or handling write locks as read locks and vice versa.
+type byzantineServer struct {
+	*lockServer
+	grantAll   bool // Grant every lock and acknowledge every unlock
+	lieExpired bool // Report every lock as expired
+	flipRW     bool // Handle a write lock as a read lock and vice versa
+}
+
+// newByzantineServer returns the lock server l answering incorrectly in the ways of spec, a comma
+// separated list of grant-all, lie-expired and flip-rw.
+func newByzantineServer(l *lockServer, spec string) (*byzantineServer, error) {
+	b := &byzantineServer{lockServer: l}
+	for _, behaviour := range strings.Split(spec, ",") {
+		switch behaviour {
+		case "grant-all":
+			b.grantAll = true
+		case "lie-expired":
+			b.lieExpired = true
+		case "flip-rw":
+			b.flipRW = true
+		default:
+			return nil, fmt.Errorf("Unknown byzantine behaviour %q (want grant-all, lie-expired or flip-rw)", behaviour)
+		}
+	}
+	return b, nil
+}
+
+// answer handles a lock request with handler (or with flipped, when flipping read and write locks),
+// granting it regardless of the outcome when granting all.
+func (b *byzantineServer) answer(handler, flipped func(*dsync.LockArgs, *bool) error, args *dsync.LockArgs, reply *bool) error {
+	if b.flipRW {
+		handler = flipped
+	}
+	err := handler(args, reply)
+	if b.grantAll {
+		*reply, err = true, nil
+	}
+	return err
+}
+
+// answerLock handles a request acquiring a lock like answer.
+func (b *byzantineServer) answerLock(handler, flipped func(*dsync.LockArgs, *dsync.LockReply) error, args *dsync.LockArgs, reply *dsync.LockReply) error {
+	if b.flipRW {
+		handler = flipped
+	}
+	err := handler(args, reply)
+	if b.grantAll {
+		reply.Granted, err = true, nil
+	}
+	return err
+}
+
+// Lock - rpc handler for (single) write lock operation, answering incorrectly.
+func (b *byzantineServer) Lock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return b.answerLock(b.lockServer.Lock, b.lockServer.RLock, args, reply)
+}
+
+// RLock - rpc handler for read lock operation, answering incorrectly.
+func (b *byzantineServer) RLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return b.answerLock(b.lockServer.RLock, b.lockServer.Lock, args, reply)
+}
+
+// Unlock - rpc handler for (single) write unlock operation, answering incorrectly.
+func (b *byzantineServer) Unlock(args *dsync.LockArgs, reply *bool) error {
+	return b.answer(b.lockServer.Unlock, b.lockServer.RUnlock, args, reply)
+}
+
+// RUnlock - rpc handler for read unlock operation, answering incorrectly.
+func (b *byzantineServer) RUnlock(args *dsync.LockArgs, reply *bool) error {
+	return b.answer(b.lockServer.RUnlock, b.lockServer.Unlock, args, reply)
+}
+
+// LockWait - rpc handler for a write lock that may be parked, answering incorrectly.
+func (b *byzantineServer) LockWait(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return b.answerLock(b.lockServer.LockWait, b.lockServer.RLockWait, args, reply)
+}
+
+// RLockWait - rpc handler for a read lock that may be parked, answering incorrectly.
+func (b *byzantineServer) RLockWait(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return b.answerLock(b.lockServer.RLockWait, b.lockServer.LockWait, args, reply)
+}
+
+// PrepareLock - rpc handler for reserving a write lock, answering incorrectly.
+func (b *byzantineServer) PrepareLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return b.answerLock(b.lockServer.PrepareLock, b.lockServer.PrepareRLock, args, reply)
+}
+
+// PrepareRLock - rpc handler for reserving a read lock, answering incorrectly.
+func (b *byzantineServer) PrepareRLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return b.answerLock(b.lockServer.PrepareRLock, b.lockServer.PrepareLock, args, reply)
+}
+
+// Commit - rpc handler for committing a reservation, answering incorrectly.
+func (b *byzantineServer) Commit(args *dsync.LockArgs, reply *bool) error {
+	return b.answer(b.lockServer.Commit, b.lockServer.Commit, args, reply)
+}
+
+// LockBatch - rpc handler for write locking many names at once, answering incorrectly.
+func (b *byzantineServer) LockBatch(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return b.answerLock(b.lockServer.LockBatch, b.lockServer.LockBatch, args, reply)
+}
+
+// UnlockBatch - rpc handler for releasing many write locks at once, answering incorrectly.
+func (b *byzantineServer) UnlockBatch(args *dsync.LockArgs, reply *bool) error {
+	return b.answer(b.lockServer.UnlockBatch, b.lockServer.UnlockBatch, args, reply)
+}
+
+// Expired - rpc handler for expired lock status, answering incorrectly.
+func (b *byzantineServer) Expired(args *dsync.LockArgs, reply *bool) error {
+	err := b.lockServer.Expired(args, reply)
+	if b.lieExpired {
+		*reply, err = true, nil
+	}
+	return err
+}
+
+// ExpiredBatch - rpc handler for the expired lock status of many locks at once, answering incorrectly.
+func (b *byzantineServer) ExpiredBatch(args *dsync.ExpiredBatchArgs, reply *dsync.ExpiredBatchReply) error {
+	if !b.lieExpired {
+		return b.lockServer.ExpiredBatch(args, reply)
+	}
+	for i := range args.Entries {
+		reply.SetExpired(i)
+	}
+	return nil
+}
+
+// ConfirmExpired - rpc handler by which a peer asks whether this server agrees that locks are stale,
+// answering incorrectly.
+func (b *byzantineServer) ConfirmExpired(args *dsync.ConfirmExpiredArgs, reply *dsync.ConfirmExpiredReply) error {
+	if !b.lieExpired {
+		return b.lockServer.ConfirmExpired(args, reply)
+	}
+	for i := range args.Entries {
+		reply.SetExpired(i)
+	}
+	return nil
+}
+
+// isByzantine returns whether the server on port answers incorrectly, as selected with -byzantine-server.
+func isByzantine(port int) bool {
+	index := *byzantineServerFlag
+	if index < 0 {
+		index = n - 1
+	}
+	return *byzantineFlag != "" && port == portStart+index
+}
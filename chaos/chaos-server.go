@@ -19,51 +19,204 @@ package main
 import (
 	"fmt"
 	"github.com/minio/dsync"
+	"github.com/minio/dsync/server"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"path/filepath"
 	"strconv"
-	"sync"
 	"time"
 )
 
-// For this test framework we have short lock timings
-// Production should use eg following values
+// For this test framework we have short lock timings by default (see the -maintenance-interval
+// and -stale-after flags). Production should use eg following values
 //
 // const LockMaintenanceLoop       = 1 * time.Minute
 // const LockCheckValidityInterval = 2 * time.Minute
-//
 const LockMaintenanceLoop = 1 * time.Second
 const LockCheckValidityInterval = 5 * time.Second
 
+// Number of rotated audit logs kept per server
+const auditBackups = 5
+
+// Logger for all messages of the lock server, writing to the standard logger (prefixed with the port).
+var logger = dsync.NewStdLogger(nil, dsync.LogInfo)
+
+// validateMaintenanceFlags verifies that the lock maintenance timings are consistent.
+func validateMaintenanceFlags() error {
+	if *maintenanceIntervalFlag <= 0 {
+		return fmt.Errorf("-maintenance-interval must be positive, got %v", *maintenanceIntervalFlag)
+	}
+	if *sweepFlag < 0 {
+		return fmt.Errorf("-sweep must not be negative, got %v", *sweepFlag)
+	}
+	if *maintenanceWorkersFlag < 1 {
+		return fmt.Errorf("-maintenance-workers must be at least 1, got %d", *maintenanceWorkersFlag)
+	}
+	if *staleAfterFlag < *maintenanceIntervalFlag {
+		return fmt.Errorf("-stale-after (%v) must not be shorter than -maintenance-interval (%v)", *staleAfterFlag, *maintenanceIntervalFlag)
+	}
+	if *ttlFlag > 0 && *ttlFlag <= *staleAfterFlag+*maintenanceIntervalFlag {
+		// A lease is only renewed once a lock is checked, so it would lapse before its first renewal
+		return fmt.Errorf("-ttl (%v) must be longer than -stale-after plus -maintenance-interval (%v)", *ttlFlag, *staleAfterFlag+*maintenanceIntervalFlag)
+	}
+	return nil
+}
+
+// lockServerConfig returns the configuration of a lock server by the flags that apply to the
+// handlers and the lock maintenance.
+func lockServerConfig() server.Config {
+	return server.Config{
+		Epoch:      *epochFlag,
+		LeaseTTL:   *ttlFlag,
+		Quota:      *quotaFlag,
+		MaxReaders: *maxReadersFlag,
+		Resolver:   &clientPool{},
+		Clock:      clock,
+		Logger:     logger,
+		Maintenance: server.MaintenanceConfig{
+			Interval:      *maintenanceIntervalFlag,
+			SweepInterval: *sweepFlag,
+			StaleAfter:    *staleAfterFlag,
+			Workers:       *maintenanceWorkersFlag,
+		},
+	}
+}
+
 func startRPCServer(port int) {
 	log.SetPrefix(fmt.Sprintf("[%d] ", port))
 	log.SetFlags(log.Lmicroseconds)
 
-	server := rpc.NewServer()
-	locker := &lockServer{
-		mutex:   sync.Mutex{},
-		lockMap: make(map[string][]lockRequesterInfo),
-		// timestamp: leave uninitialized for testing (set to real timestamp for actual usage)
+	rpcServer := rpc.NewServer()
+	// For some reason the registration paths need to be different (even for different server objs)
+	rpcPath := dsync.RpcPath + "-" + strconv.Itoa(port)
+	config := lockServerConfig()
+	config.Self = dsync.Identity{Node: fmt.Sprintf("127.0.0.1:%d", port), Path: rpcPath}
+	incarnationPath := ""
+	if *incarnationFlag != "" {
+		incarnationPath = filepath.Join(*incarnationFlag, fmt.Sprintf("%s-%d.incarnation", chaosName, port))
+	}
+	incarnation, err := server.NextIncarnation(incarnationPath)
+	if err != nil {
+		log.Fatal("incarnation error:", err)
+	}
+	config.Incarnation = incarnation
+	if *purgeQuorumFlag {
+		for i := 0; i < n; i++ {
+			if portStart+i != port {
+				config.Peers = append(config.Peers, newClient(fmt.Sprintf("127.0.0.1:%d", portStart+i), dsync.RpcPath+"-"+strconv.Itoa(portStart+i)))
+			}
+		}
+	}
+	if *rateFlag > 0 {
+		config.RateLimit, config.RateBurst = *rateFlag, *burstFlag
+	}
+	if *auditFlag != "" {
+		f, err := server.NewRotatingFile(filepath.Join(*auditFlag, fmt.Sprintf("%s-%d.audit", chaosName, port)), *auditMaxSizeFlag, auditBackups)
+		if err != nil {
+			log.Fatal("audit log error:", err)
+		}
+		config.Sinks = append(config.Sinks, server.NewAuditLog(f))
+	}
+	if *aclFlag != "" {
+		acl, err := server.LoadACL(*aclFlag)
+		if err != nil {
+			log.Fatal("acl error:", err)
+		}
+		config.ACL = acl
+	}
+	if *webhookFlag != "" {
+		config.Sinks = append(config.Sinks, server.NewWebhookSink(*webhookFlag, logger))
+	}
+	locker := newLockServer(config)
+	if locker.faults, err = newFaultInjector(*faultDropFlag, *faultDelayFlag, *faultErrorFlag, *faultSeedFlag+int64(port)); err != nil {
+		log.Fatal("fault injection error:", err)
+	}
+	if *walFlag != "" {
+		if err := locker.OpenWAL(filepath.Join(*walFlag, fmt.Sprintf("%s-%d.wal", chaosName, port)), *walSyncFlag); err != nil {
+			log.Fatal("write-ahead log error:", err)
+		}
+	}
+	if *restoreFlag != "" {
+		data, err := ioutil.ReadFile(*restoreFlag)
+		if err == nil {
+			err = locker.Restore(data)
+		}
+		if err != nil {
+			log.Fatal("restore error:", err)
+		}
+	}
+	if *backupFlag != "" {
+		err := locker.StartBackups(server.BackupConfig{
+			Endpoint:  *backupFlag,
+			Name:      fmt.Sprintf("%s-%d", chaosName, port),
+			Interval:  *backupIntervalFlag,
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Region:    os.Getenv("AWS_REGION"),
+		})
+		if err != nil {
+			log.Fatal("backup error:", err)
+		}
 	}
 	go func() {
 		// Start with random sleep time, so as to avoid "synchronous checks" between servers
-		time.Sleep(time.Duration(rand.Float64() * float64(LockMaintenanceLoop)))
-		for {
-			time.Sleep(LockMaintenanceLoop)
-			locker.lockMaintenance(LockCheckValidityInterval)
-		}
+		time.Sleep(time.Duration(rand.Float64() * float64(*maintenanceIntervalFlag)))
+		locker.Start()
 	}()
-	server.RegisterName("Dsync", locker)
-	// For some reason the registration paths need to be different (even for different server objs)
-	rpcPath := dsync.RpcPath + "-" + strconv.Itoa(port)
-	server.HandleHTTP(rpcPath, fmt.Sprintf("%s-debug", rpcPath))
+	locker.dumpSnapshotOnSignal(fmt.Sprintf("%s-%d.snapshot.json", chaosName, port))
+	locker.shutdownOnSignal(*drainFlag)
+	if *adminFlag != 0 {
+		locker.startAdminServer(fmt.Sprintf("127.0.0.1:%d", port), port+*adminFlag)
+	}
+	if *debugFlag != 0 {
+		locker.startDebugServer(port + *debugFlag)
+	}
+	if *deadlockFlag > 0 && port == portStart {
+		go runDeadlockDetector(*deadlockFlag)
+	}
+	if isByzantine(port) {
+		b, err := newByzantineServer(locker, *byzantineFlag)
+		if err != nil {
+			log.Fatal("byzantine error:", err)
+		}
+		log.Println("Answering incorrectly:", *byzantineFlag)
+		rpcServer.RegisterName("Dsync", b)
+	} else {
+		rpcServer.RegisterName("Dsync", locker)
+	}
+	if *gossipFlag {
+		g := newGossip(fmt.Sprintf("127.0.0.1:%d", port), rpcPath)
+		rpcServer.RegisterName("Gossip", g)
+		if port != portStart {
+			go func() {
+				// Join via the first server, retry until it is up
+				for g.join(fmt.Sprintf("127.0.0.1:%d", portStart), dsync.RpcPath+"-"+strconv.Itoa(portStart)) != nil {
+					time.Sleep(gossipInterval)
+				}
+				g.run()
+			}()
+		} else {
+			go g.run()
+		}
+	}
+	if *recordFlag != "" {
+		recorder, err := newRPCRecorder(filepath.Join(*recordFlag, fmt.Sprintf("%s-%d.rpc", chaosName, port)), locker)
+		if err != nil {
+			log.Fatal("record error:", err)
+		}
+		http.Handle(rpcPath, &recordingHandler{server: rpcServer, recorder: recorder})
+	} else {
+		rpcServer.HandleHTTP(rpcPath, fmt.Sprintf("%s-debug", rpcPath))
+	}
 	l, e := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if e != nil {
 		log.Fatal("listen error:", e)
 	}
-	log.Println("RPC server listening at port", port, "under", rpcPath)
-	http.Serve(l, nil)
+	logger.Log(dsync.LogInfo, "RPC server listening", "port", port, "rpcPath", rpcPath)
+	http.Serve(l, rpcHandler)
 }
@@ -34,13 +34,69 @@ var (
 	portFlag = flag.Int("p", portStart, "Port for server to listen on")
 	writeLockFlag = flag.String("w", "", "Name of write lock to acquire")
 	readLockFlag = flag.String("r", "", "Name of read lock to acquire")
+	epochFlag = flag.Uint64("epoch", 0, "Cluster configuration epoch of servers and clients")
+	twoPhaseFlag = flag.Duration("two-phase", 0, "Reservation after which a lock lapses unless committed, to acquire locks in two phases (0 disables)")
+	gossipFlag = flag.Bool("gossip", false, "Run gossip based membership among the servers")
+	ttlFlag = flag.Duration("ttl", 0, "Lease after which a lock expires unless renewed by lock maintenance (0 disables)")
+	sweepFlag = flag.Duration("sweep", 1*time.Second, "Interval at which locks with an expired lease are swept (0 sweeps every -maintenance-interval)")
+	maintenanceIntervalFlag = flag.Duration("maintenance-interval", LockMaintenanceLoop, "Interval at which lock maintenance runs")
+	staleAfterFlag = flag.Duration("stale-after", LockCheckValidityInterval, "Age after which a lock is checked for staleness with the client holding it (and rechecked thereafter)")
+	purgeQuorumFlag = flag.Bool("purge-quorum", true, "Only purge a stale lock once a quorum of the lock servers agrees that it is stale")
+	maintenanceWorkersFlag = flag.Int("maintenance-workers", 16, "Maximum number of originating servers checked for stale locks concurrently")
+	walFlag = flag.String("wal", "", "Directory for write-ahead logs of lock state, so restarted servers reload their locks (disabled when empty)")
+	walSyncFlag = flag.Bool("wal-sync", false, "Sync write-ahead log to disk after every change")
+	incarnationFlag = flag.String("incarnation-dir", "", "Directory in which servers persist their boot counter, raised on every start to form their incarnation (time based when empty)")
+	restoreFlag = flag.String("restore", "", "Snapshot file to restore the lock state of the server from")
+	rateFlag = flag.Float64("rate", 0, "Maximum number of lock requests per second per client (0 disables rate limiting)")
+	burstFlag = flag.Int("burst", 20, "Maximum burst of lock requests per client when rate limiting")
+	quotaFlag = flag.Int("quota", 0, "Maximum number of locks held simultaneously per client (0 is unlimited)")
+	auditFlag = flag.String("audit", "", "Directory for audit logs of all lock lifecycle events (disabled when empty)")
+	auditMaxSizeFlag = flag.Int64("audit-max-size", 100<<20, "Size in bytes after which an audit log is rotated")
+	webhookFlag = flag.String("webhook", "", "URL to POST all lock lifecycle events to as JSON (disabled when empty)")
+	aclFlag = flag.String("acl", "", "JSON file configuring which clients may lock, unlock and force unlock per namespace (disabled when empty)")
+	tokenFlag = flag.String("token", "", "Token that clients authenticate with to the servers")
+	deadlockFlag = flag.Duration("deadlock", 0, "Interval at which the first server checks all servers for deadlocks (0 disables)")
+	maxReadersFlag = flag.Int("max-readers", 0, "Maximum number of read locks held simultaneously per name on every server (0 is unlimited)")
+	adminFlag = flag.Int("admin", 0, "Offset from the rpc port at which to serve the JSON admin endpoint (0 disables)")
+	debugFlag = flag.Int("debug", 0, "Offset from the rpc port at which to serve pprof profiles and expvars under /debug/ (0 disables)")
+	drainFlag = flag.Duration("drain", 10*time.Second, "Maximum time to wait for locks to be released when shutting down on SIGTERM")
+	faultDropFlag = flag.String("fault-drop", "", "Percentage of requests dropped per handler, eg. Lock=5,Unlock=1 or *=5 (disabled when empty)")
+	faultDelayFlag = flag.String("fault-delay", "", "Distribution of the delay of requests per handler, eg. *=exp:5ms,Unlock=uniform:1ms:20ms (disabled when empty)")
+	faultErrorFlag = flag.String("fault-error", "", "Percentage of requests failing with a spurious error per handler, eg. Expired=10 (disabled when empty)")
+	faultSeedFlag = flag.Int64("fault-seed", 1, "Seed of the injected faults (combined with the port), so that runs inject the same faults")
+	scenarioFlag = flag.String("scenario", "", "JSON file with a scenario to run instead of the built-in tests (see scenario.go)")
+	clockSkewFlag = flag.String("clock-skew", "", "Offset and drift (in parts per million) of the clocks of servers by index, eg. 1=250ms,2=-1s:100 (disabled when empty)")
+	churnFlag = flag.String("churn", "", "Schedule by which to kill and restart servers while clients contend on locks, instead of the built-in tests: rolling, crash-loop or random (disabled when empty)")
+	churnDurationFlag = flag.Duration("churn-duration", 60*time.Second, "Duration of killing and restarting servers")
+	churnIntervalFlag = flag.Duration("churn-interval", 2*time.Second, "Interval between kills and restarts of servers")
+	soakFlag = flag.Duration("soak", 0, "Run mixed workloads for this long while periodically injecting faults, failing on leaks of locks, goroutines or memory, instead of the built-in tests (0 disables)")
+	soakSampleFlag = flag.Duration("soak-sample", 30*time.Second, "Interval at which the resource usage of the servers is sampled during a soak")
+	soakFaultIntervalFlag = flag.Duration("soak-fault-interval", 2*time.Minute, "Interval at which faults are injected into a random server (for a quarter of the interval) during a soak")
+	soakMaxGoroutinesFlag = flag.Int("soak-max-goroutines", 200, "Growth of the number of goroutines of a server after which a soak fails")
+	soakMaxHeapFlag = flag.Int("soak-max-heap", 64, "Growth of the heap of a server in MB after which a soak fails")
+	byzantineFlag = flag.String("byzantine", "", "Ways in which the server of -byzantine-server answers incorrectly, comma separated: grant-all, lie-expired and/or flip-rw (disabled when empty)")
+	byzantineServerFlag = flag.Int("byzantine-server", -1, "Index of the server answering incorrectly with -byzantine, any but the first (hosting the clients), the last one when negative")
+	byzantineToleranceFlag = flag.Int("byzantine-tolerance", 0, "Number of servers answering incorrectly that the clients tolerate by raising their quorums (see dsync.SetByzantineTolerance)")
+	nodesFlag = flag.Int("nodes", 4, "Number of lock servers, on consecutive ports from 12345")
+	serveFlag = flag.Bool("serve", false, "Only serve locks on the port (also for the first port), as launched by dsync-chaos")
+	workloadFlag = flag.Duration("workload", 0, "Run a workload of clients for this long against the servers, attached to the server on the port as their own node, instead of serving locks (as launched by dsync-chaos)")
+	verifierFlag = flag.String("verifier", "", "Address of the verifier that clients of churn runs and workloads enter the shared resource of a name on while holding its lock (disabled when empty)")
+	verifyFlag = flag.Bool("verify", false, "Only run the verifier on the address of -verifier until terminated, exiting with a non-zero status on any violation (as launched by dsync-chaos)")
+	recordFlag = flag.String("record", "", "Directory to record all requests to the lock servers and their responses in, for replaying with -replay (disabled when empty)")
+	replayFlag = flag.String("replay", "", "Only replay the requests recorded in this file into a fresh lock server, reporting responses that differ from the recorded ones")
+	checkHistoryFlag = flag.String("check-history", "", "Only check the histories recorded in this directory for linearizability (as run by dsync-chaos)")
+	backupFlag = flag.String("backup", "", "URL of a bucket (and prefix) of an S3-compatible endpoint to back up lock snapshots and events to, eg. http://127.0.0.1:9000/backups (disabled when empty)")
+	backupIntervalFlag = flag.Duration("backup-interval", 5*time.Minute, "Interval at which lock snapshots and events are backed up with -backup")
+	historyFlag = flag.String("history", "", "Directory to record the history of all lock operations in, verified to be linearizable at the end of the run (disabled when empty)")
 	servers  []*exec.Cmd
 )
 
 const chaosName = "chaos"
-const n = 4
 const portStart = 12345
 
+// Number of lock servers (set with -nodes)
+var n = 4
+
 // testNotEnoughServersForQuorum verifies that when quorum cannot be achieved that locking will block.
 // Once another server comes up and quorum becomes possible, the lock will be granted
 func testNotEnoughServersForQuorum(wg *sync.WaitGroup) {
@@ -64,7 +120,7 @@ func testNotEnoughServersForQuorum(wg *sync.WaitGroup) {
 		servers = append(servers, launchTestServers(n/2, 1)...)
 	}()
 
-	dm := dsync.NewDRWMutex("test")
+	dm := newDRWMutex("test")
 
 	log.Println("Trying to acquire lock but too few servers active...")
 	dm.Lock()
@@ -112,7 +168,7 @@ func testServerGoingDown(wg *sync.WaitGroup) {
 	log.Println("")
 	log.Println("**STARTING** testServerGoingDown")
 
-	dm := dsync.NewDRWMutex("test")
+	dm := newDRWMutex("test")
 
 	dm.Lock()
 	log.Println("Acquired lock")
@@ -167,7 +223,7 @@ func testSingleServerOverQuorumDownDuringLock(wg *sync.WaitGroup) {
 	}
 	log.Println("Killed just enough servers to keep quorum")
 
-	dm := dsync.NewDRWMutex("test")
+	dm := newDRWMutex("test")
 
 	// acquire lock
 	dm.Lock()
@@ -194,7 +250,7 @@ func testSingleServerOverQuorumDownDuringLock(wg *sync.WaitGroup) {
 		dm.Unlock()
 	}()
 
-	dm2 := dsync.NewDRWMutex("test")
+	dm2 := newDRWMutex("test")
 
 	// try to acquire same lock -- only granted after first lock released
 	log.Println("Trying to acquire new lock on same resource...")
@@ -219,7 +275,7 @@ func testMultipleServersOverQuorumDownDuringLockKnownError(wg *sync.WaitGroup) {
 	log.Println("")
 	log.Println("**STARTING** testMultipleServersOverQuorumDownDuringLockKnownError")
 
-	dm := dsync.NewDRWMutex("test")
+	dm := newDRWMutex("test-known-error")
 
 	// acquire lock
 	dm.Lock()
@@ -248,7 +304,7 @@ func testMultipleServersOverQuorumDownDuringLockKnownError(wg *sync.WaitGroup) {
 		dm.Unlock()
 	}()
 
-	dm2 := dsync.NewDRWMutex("test")
+	dm2 := newDRWMutex("test-known-error")
 
 	// try to acquire same lock -- granted once killed servers are up again
 	log.Println("Trying to acquire new lock on same resource...")
@@ -294,7 +350,7 @@ func testSingleStaleLock(wg *sync.WaitGroup, beforeMaintenanceKicksIn bool) {
 	time.Sleep(500 * time.Millisecond)
 
 	// lock on same resource can be acquired despite single server having a stale lock
-	dm := dsync.NewDRWMutex(lockName)
+	dm := newDRWMutex(lockName)
 
 	ch := make(chan struct{})
 
@@ -363,7 +419,7 @@ func testMultipleStaleLocks(wg *sync.WaitGroup, beforeMaintenanceKicksIn bool) {
 	time.Sleep(500 * time.Millisecond)
 
 	// lock on same resource can not be acquired due to too many servers having a stale lock
-	dm := dsync.NewDRWMutex(lockName)
+	dm := newDRWMutex(lockName)
 
 	ch := make(chan struct{})
 
@@ -428,7 +484,7 @@ func testClientThatHasLockCrashes(wg *sync.WaitGroup) {
 	servers = append(servers, launchTestServers(len(servers), 1)...)
 	log.Println("Crashed server restarted")
 
-	dm := dsync.NewDRWMutex("test-stale")
+	dm := newDRWMutex("test-stale")
 
 	ch := make(chan struct{})
 
@@ -481,7 +537,7 @@ func testTwoClientsThatHaveReadLocksCrash(wg *sync.WaitGroup) {
 	servers = append(servers, launchTestServers(len(servers), 2)...)
 	log.Println("Crashed servers restarted")
 
-	dm := dsync.NewDRWMutex("test-stale")
+	dm := newDRWMutex("test-stale")
 
 	ch := make(chan struct{})
 
@@ -513,14 +569,14 @@ type RWLocker interface {
 }
 
 type DRWMutexNoWriterStarvation struct {
-	excl *dsync.DRWMutex
-	rw   *dsync.DRWMutex
+	excl *recordedMutex
+	rw   *recordedMutex
 }
 
 func NewDRWMutexNoWriterStarvation(name string) *DRWMutexNoWriterStarvation {
 	return &DRWMutexNoWriterStarvation{
-		excl: dsync.NewDRWMutex(name + "-excl-no-writer-starvation"),
-		rw: dsync.NewDRWMutex(name),
+		excl: newDRWMutex(name + "-excl-no-writer-starvation"),
+		rw: newDRWMutex(name),
 	}
 }
 
@@ -561,7 +617,7 @@ func testWriterStarvation(wg *sync.WaitGroup, noWriterStarvation bool) {
 	if noWriterStarvation {
 		m = NewDRWMutexNoWriterStarvation("test") // sync.RWMutex{} behaves identical
 	} else {
-		m = dsync.NewDRWMutex("test")
+		m = newDRWMutex("test")
 	}
 
 	m.RLock()
@@ -637,7 +693,83 @@ func main() {
 
 	flag.Parse()
 
-	if *portFlag != portStart {
+	n = *nodesFlag
+	if n < 2 || n > 16 || n%2 == 1 {
+		log.Fatalln("Invalid flags: number of nodes must be even and between 2 and 16")
+	}
+	if err := validateMaintenanceFlags(); err != nil {
+		log.Fatalln("Invalid flags:", err)
+	}
+	if _, err := newFaultInjector(*faultDropFlag, *faultDelayFlag, *faultErrorFlag, *faultSeedFlag); err != nil {
+		log.Fatalln("Invalid flags:", err)
+	}
+	offset, drift, err := parseClockSkew(*clockSkewFlag, *portFlag-portStart)
+	if err != nil {
+		log.Fatalln("Invalid flags:", err)
+	}
+	clock.offset, clock.drift = offset, drift
+	if err := validateChurn(*churnFlag); err != nil {
+		log.Fatalln("Invalid flags:", err)
+	}
+	if *byzantineFlag != "" {
+		if _, err := newByzantineServer(nil, *byzantineFlag); err != nil {
+			log.Fatalln("Invalid flags:", err)
+		}
+		if *byzantineServerFlag == 0 || *byzantineServerFlag >= n {
+			log.Fatalln("Invalid flags: -byzantine-server must be the index of a server other than the first")
+		}
+	}
+	var scenario *scenario
+	if *scenarioFlag != "" && *portFlag == portStart {
+		if scenario, err = loadScenario(*scenarioFlag); err != nil {
+			log.Fatalln("Invalid scenario:", err)
+		}
+	}
+
+	if *verifyFlag {
+		if *verifierFlag == "" {
+			log.Fatalln("Invalid flags: -verify needs the address of -verifier")
+		}
+		if !runVerifier(*verifierFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *replayFlag != "" {
+		ok, err := replayRecording(*replayFlag)
+		if err != nil {
+			log.Fatalln("replay error:", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *checkHistoryFlag != "" {
+		if !verifyHistory(*checkHistoryFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *workloadFlag > 0 {
+		if *historyFlag != "" {
+			var err error
+			if history, err = openHistory(*historyFlag); err != nil {
+				log.Fatalln("history error:", err)
+			}
+		}
+		log.SetPrefix(fmt.Sprintf("[workload %d] ", os.Getpid()))
+		log.SetFlags(log.Lmicroseconds)
+		if !runWorkload(*portFlag, *workloadFlag, *faultSeedFlag) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *portFlag != portStart || *serveFlag {
 
 		if *writeLockFlag != "" || *readLockFlag != "" {
 			go func() {
@@ -650,17 +782,26 @@ func main() {
 				if err := dsync.SetNodesWithClients(clnts, getSelfNode(clnts, *portFlag)); err != nil {
 					log.Fatalf("set nodes failed with %v", err)
 				}
+				dsync.SetEpoch(*epochFlag)
+				dsync.SetTwoPhase(*twoPhaseFlag)
+
+				if *historyFlag != "" {
+					var err error
+					if history, err = openHistory(*historyFlag); err != nil {
+						log.Fatalln("history error:", err)
+					}
+				}
 
 				// Give servers some time to start
 				time.Sleep(100 * time.Millisecond)
 
 				if *writeLockFlag != "" {
-					lock := dsync.NewDRWMutex(*writeLockFlag)
+					lock := newDRWMutex(*writeLockFlag)
 					lock.Lock()
 					log.Println("Acquired write lock:", *writeLockFlag, "(never to be released)")
 				}
 				if *readLockFlag != "" {
-					lock := dsync.NewDRWMutex(*readLockFlag)
+					lock := newDRWMutex(*readLockFlag)
 					lock.RLock()
 					log.Println("Acquired read lock:", *readLockFlag, "(never to be released)")
 				}
@@ -678,6 +819,16 @@ func main() {
 		os.Exit(-1)
 	}
 
+	if *historyFlag != "" {
+		err := resetHistory(*historyFlag)
+		if err == nil {
+			history, err = openHistory(*historyFlag)
+		}
+		if err != nil {
+			log.Fatalln("history error:", err)
+		}
+	}
+
 	// For first client, start server and continue
 	go startRPCServer(*portFlag)
 
@@ -698,9 +849,37 @@ func main() {
 	if err := dsync.SetNodesWithClients(clnts, getSelfNode(clnts, *portFlag)); err != nil {
 		log.Fatalf("set nodes failed with %v", err)
 	}
+	if err := dsync.SetByzantineTolerance(*byzantineToleranceFlag); err != nil {
+		log.Fatalln("Invalid flags:", err)
+	}
+	dsync.SetEpoch(*epochFlag)
+	dsync.SetTwoPhase(*twoPhaseFlag)
 
 	time.Sleep(100 * time.Millisecond)
 
+	if scenario != nil || *churnFlag != "" || *soakFlag > 0 {
+		var passed bool
+		if scenario != nil {
+			passed = runScenario(scenario, clnts)
+		} else if *churnFlag != "" {
+			passed = runChurn(*churnFlag, *churnDurationFlag, *churnIntervalFlag, *faultSeedFlag)
+		} else {
+			passed = runSoak(*soakFlag, *soakSampleFlag, *soakFaultIntervalFlag, *faultSeedFlag)
+		}
+		if *historyFlag != "" {
+			passed = verifyHistory(*historyFlag) && passed
+		}
+		for _, cmd := range servers[1:] {
+			if cmd != nil {
+				killProcess(cmd)
+			}
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		return
+	}
+
 	wg := sync.WaitGroup{}
 
 	wg.Add(1)
@@ -757,6 +936,13 @@ func main() {
 	testWriterStarvation(&wg, noWriterStarvation)
 	wg.Wait()
 
+	if *historyFlag != "" && !verifyHistory(*historyFlag) {
+		for _, cmd := range servers[1:] {
+			killProcess(cmd)
+		}
+		os.Exit(1)
+	}
+
 	// Kill any launched processes
 	killStaleProcesses(chaosName)
 }
@@ -807,6 +993,12 @@ func launchProcess(port int, name string, writeLock bool) *exec.Cmd {
 	} else {
 		cmd = exec.Command("./"+chaosName, "-p", fmt.Sprintf("%d", port), "-r", name)
 	}
+	// Forward flags that were explicitly set (such as -epoch or -gossip) to the launched server
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "p" && f.Name != "w" && f.Name != "r" && f.Name != "restore" && f.Name != "scenario" {
+			cmd.Args = append(cmd.Args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
 
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -827,7 +1019,9 @@ func killLastServer() {
 }
 
 func killProcess(cmd *exec.Cmd) {
+	call := time.Now()
 	if err := cmd.Process.Kill(); err != nil {
 		log.Fatal("failed to kill: ", err)
 	}
+	history.recordCrash(cmd.Process.Pid, call)
 }
@@ -0,0 +1,249 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedules by which servers are killed and restarted (on the same port) during a churn run
+const (
+	churnRolling   = "rolling"    // Kill one server at a time, restarting it after the interval before moving on to the next
+	churnCrashLoop = "crash-loop" // Keep killing a single server, restarting it right away, every interval
+	churnRandom    = "random"     // Every interval, kill a random server or restart a killed one, keeping a write quorum up
+)
+
+const (
+	churnWorkers  = 4 // Number of clients locking during the churn
+	churnNames    = 2 // Number of lock names the clients contend on
+	churnMaxHold  = 200 * time.Millisecond
+	churnRecovery = 60 * time.Second // Time the clients get to finish once all servers are up again
+	churnPrefix   = "churn-"         // Prefix of the lock names
+)
+
+func validateChurn(mode string) error {
+	switch mode {
+	case "", churnRolling, churnCrashLoop, churnRandom:
+		return nil
+	}
+	return fmt.Errorf("Unknown churn schedule %q (want %s, %s or %s)", mode, churnRolling, churnCrashLoop, churnRandom)
+}
+
+// churnRun tracks the holders of the locks of a churn run and the violations found.
+type churnRun struct {
+	mutex      sync.Mutex
+	writers    map[string]int
+	readers    map[string]int
+	acquired   int
+	latency    *latencyHistogram // Time taken to acquire the locks
+	grants     map[string]int    // Number of locks granted per client
+	violations []string
+	resource   *resourceClient // Verifier the clients enter the resource of a name on while holding its lock (if any)
+}
+
+// violate records a violation, should be called with the mutex held.
+func (r *churnRun) violate(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println("Churn failure:", msg)
+	r.violations = append(r.violations, msg)
+}
+
+// granted records that a lock on name was granted to client after latency, checking that no
+// conflicting lock is held.
+func (r *churnRun) granted(client, name string, readLock bool, latency time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.acquired++
+	r.latency.add(latency)
+	r.grants[client]++
+	if r.writers[name] > 0 {
+		r.violate("Lock on %s granted while a write lock is held", name)
+	} else if !readLock && r.readers[name] > 0 {
+		r.violate("Write lock on %s granted while %d read locks are held", name, r.readers[name])
+	}
+	if readLock {
+		r.readers[name]++
+	} else {
+		r.writers[name]++
+	}
+}
+
+// verify records a failure to reach the verifier as a violation, as its check is incomplete.
+func (r *churnRun) verify(err error) {
+	if err != nil {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.violate("Unable to reach verifier: %v", err)
+	}
+}
+
+func (r *churnRun) releasing(name string, readLock bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if readLock {
+		r.readers[name]--
+	} else {
+		r.writers[name]--
+	}
+}
+
+func newChurnRun() *churnRun {
+	r := &churnRun{
+		writers: make(map[string]int),
+		readers: make(map[string]int),
+		latency: newLatencyHistogram(),
+		grants:  make(map[string]int),
+	}
+	if *verifierFlag != "" {
+		r.resource = newResourceClient(*verifierFlag)
+	}
+	return r
+}
+
+// start starts the clients, returning a function that stops them and waits for them to finish
+// (recording a violation when they do not within churnRecovery).
+func (r *churnRun) start(seed int64) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < churnWorkers; i++ {
+		client := fmt.Sprintf("%d/%d", os.Getpid(), i)
+		r.grants[client] = 0 // Count clients that never get a lock as well
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.worker(client, seed+int64(i), done)
+		}(i)
+	}
+	return func() {
+		close(done)
+		finished := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(finished)
+		}()
+		select {
+		case <-finished:
+		case <-time.After(churnRecovery):
+			r.mutex.Lock()
+			r.violate("Clients did not recover within %v of all servers being up again", churnRecovery)
+			r.mutex.Unlock()
+		}
+	}
+}
+
+// worker keeps locking random names as client until stopped.
+func (r *churnRun) worker(client string, seed int64, stop chan struct{}) {
+	random := rand.New(rand.NewSource(seed))
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		name := fmt.Sprintf("%s%d", churnPrefix, random.Intn(churnNames))
+		readLock := random.Intn(3) == 0
+		hold := time.Duration(random.Int63n(int64(churnMaxHold)))
+		dm := newDRWMutex(name)
+		start := time.Now()
+		if readLock {
+			dm.RLock()
+		} else {
+			dm.Lock()
+		}
+		r.granted(client, name, readLock, time.Since(start))
+		r.verify(r.resource.enter(name, client, !readLock))
+		time.Sleep(hold)
+		r.verify(r.resource.leave(name, client, !readLock))
+		r.releasing(name, readLock)
+		if readLock {
+			dm.RUnlock()
+		} else {
+			dm.Unlock()
+		}
+	}
+}
+
+// runChurn lets clients contend on a few locks while servers are killed and restarted per mode
+// every interval for duration, returning whether no conflicting locks were ever granted and all
+// clients recovered once all servers were up again.
+func runChurn(mode string, duration, interval time.Duration, seed int64) bool {
+	log.Println("")
+	log.Printf("**STARTING** churn %s for %v every %v", mode, duration, interval)
+
+	r := newChurnRun()
+	stop := r.start(seed)
+
+	random := rand.New(rand.NewSource(seed))
+	down := make(map[int]bool)
+	kill := func(index int) {
+		log.Println("Killing server", index)
+		killProcess(servers[index])
+		servers[index].Wait() // Free the port before restarting on it
+		servers[index] = nil
+		down[index] = true
+	}
+	restart := func(index int) {
+		log.Println("Restarting server", index)
+		servers[index] = launchTestServers(index, 1)[0]
+		delete(down, index)
+	}
+
+	end := time.Now().Add(duration)
+	for round := 0; time.Now().Before(end); round++ {
+		switch mode {
+		case churnRolling:
+			index := 1 + round%(n-1)
+			kill(index)
+			time.Sleep(interval)
+			restart(index)
+		case churnCrashLoop:
+			kill(1)
+			restart(1)
+		case churnRandom:
+			if index := 1 + random.Intn(n-1); down[index] {
+				restart(index)
+			} else if len(down) < n-(n/2+1) {
+				kill(index)
+			}
+		}
+		time.Sleep(interval)
+	}
+	for index := range down {
+		restart(index)
+	}
+
+	// All servers are up again, so every client must get to finish its current lock
+	stop()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	min, max := grantRange(r.grants)
+	log.Printf("Latency of acquiring locks: %v", r.latency)
+	log.Printf("Fairness: %.2f (%d to %d locks granted per client)", fairness(r.grants), min, max)
+	if len(r.violations) > 0 {
+		log.Printf("**FAILED** churn %s: %s", mode, strings.Join(r.violations, "; "))
+		return false
+	}
+	log.Printf("**PASSED** churn %s (%d locks granted)", mode, r.acquired)
+	return true
+}
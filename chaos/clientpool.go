@@ -0,0 +1,57 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"sync"
+
+	"github.com/minio/dsync"
+	"github.com/minio/dsync/server"
+)
+
+// clientPool keeps a single client per node, shared by all callers and kept across calls,
+// rather than dialing (and closing) a connection for every call. server.Client reconnects by
+// itself after a failure, so clients never need to be replaced.
+type clientPool struct {
+	mutex   sync.Mutex
+	clients map[string]*server.Client
+}
+
+// get returns the client for node, creating it on first use.
+func (p *clientPool) get(node, rpcPath string) *server.Client {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.clients == nil {
+		p.clients = make(map[string]*server.Client)
+	}
+	key := node + rpcPath
+	c, ok := p.clients[key]
+	if !ok {
+		c = newClient(node, rpcPath)
+		p.clients[key] = c
+	}
+	return c
+}
+
+// Resolve returns the client for a client of the lock server to call it back, as a dsync.Resolver.
+func (p *clientPool) Resolve(id dsync.Identity) (dsync.RPC, error) {
+	if !id.Callable() {
+		return nil, dsync.ErrNotCallable
+	}
+	return p.get(id.Node, id.Path), nil
+}
@@ -0,0 +1,100 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// skewedClock is the clock of a process, off from the wall clock by an offset and running
+// faster or slower by a drift (in parts per million), to simulate the error of NTP between nodes.
+// Times it returns carry a monotonic reading that runs at the skewed rate, so durations between
+// them should be measured with Since rather than time.Since. It is the dsync.Clock of the lock server.
+type skewedClock struct {
+	start  time.Time // Time at which the clock started (with monotonic reading)
+	offset time.Duration
+	drift  float64 // In parts per million, positive runs fast
+}
+
+// Clock of this process, used by the lock server (as its Clock) for the timestamps, staleness
+// checks, leases and reservations of locks and for the timestamps of the requests of the client
+var clock = &skewedClock{start: time.Now()}
+
+// Now returns the skewed time.
+func (c *skewedClock) Now() time.Time {
+	elapsed := time.Since(c.start)
+	return c.start.Add(elapsed + time.Duration(float64(elapsed)*c.drift/1e6) + c.offset)
+}
+
+// Since returns the skewed time elapsed since t.
+func (c *skewedClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// After waits for the duration to elapse on the wall clock, the drift is negligible over the
+// intervals waited for.
+func (c *skewedClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Sleep pauses for the duration, see After.
+func (c *skewedClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// set moves the clock to t by changing its offset (keeping its drift), eg. to replay requests at
+// the times they were recorded.
+func (c *skewedClock) set(t time.Time) {
+	c.offset = 0
+	c.offset = t.Sub(c.Now())
+}
+
+// parseClockSkew returns the offset and drift of the server with the given index from a comma
+// separated list of <index>=<offset>[:<drift in ppm>], eg. 1=250ms,2=-1s:100 (zero when absent).
+func parseClockSkew(spec string, index int) (offset time.Duration, drift float64, err error) {
+	if spec == "" {
+		return 0, 0, nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return 0, 0, fmt.Errorf("Clock skew %q is not of the form <index>=<offset>[:<drift>]", entry)
+		}
+		i, err := strconv.Atoi(kv[0])
+		if err != nil || i < 0 || i >= n {
+			return 0, 0, fmt.Errorf("No server %q for clock skew (want 0 to %d)", kv[0], n-1)
+		}
+		parts := strings.SplitN(kv[1], ":", 2)
+		o, err := time.ParseDuration(parts[0])
+		if err != nil {
+			return 0, 0, err
+		}
+		var d float64
+		if len(parts) == 2 {
+			if d, err = strconv.ParseFloat(parts[1], 64); err != nil || d <= -1e6 {
+				return 0, 0, fmt.Errorf("Drift of server %d must be a number of parts per million above -1000000, got %q", i, parts[1])
+			}
+		}
+		if i == index {
+			offset, drift = o, d
+		}
+	}
+	return offset, drift, nil
+}
@@ -0,0 +1,40 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/minio/dsync"
+	"github.com/minio/dsync/server"
+)
+
+// runDeadlockDetector breaks the deadlocks across the servers on consecutive ports every
+// interval (see server.DetectDeadlocks), does not return.
+func runDeadlockDetector(interval time.Duration) {
+	servers := []dsync.RPC{}
+	for i := 0; i < n; i++ {
+		servers = append(servers, newClient(fmt.Sprintf("127.0.0.1:%d", portStart+i), dsync.RpcPath+"-"+strconv.Itoa(portStart+i)))
+	}
+	for {
+		time.Sleep(interval)
+		server.DetectDeadlocks(context.Background(), servers, *epochFlag, logger)
+	}
+}
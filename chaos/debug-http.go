@@ -0,0 +1,75 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+
+	"github.com/minio/dsync"
+)
+
+// rpcHandler serves the rpc traffic from the default mux, on which net/http/pprof and expvar
+// register their endpoints as well: these are kept off the rpc port and only served with -debug.
+var rpcHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/debug/") {
+		http.NotFound(w, r)
+		return
+	}
+	http.DefaultServeMux.ServeHTTP(w, r)
+})
+
+// publishVars publishes the state of the lock server as expvars, next to the memory statistics
+// and command line published by expvar itself.
+func (l *lockServer) publishVars() {
+	expvar.Publish("locks", expvar.Func(func() interface{} {
+		// Number of locks held per namespace
+		stats, _ := l.stats()
+		return stats.Namespaces
+	}))
+	expvar.Publish("maintenance", expvar.Func(func() interface{} {
+		return l.Maintenance().Stats()
+	}))
+	expvar.Publish("draining", expvar.Func(func() interface{} {
+		stats, _ := l.stats()
+		return stats.Draining
+	}))
+}
+
+// startDebugServer serves the pprof profiles (under /debug/pprof/) and the expvars (at /debug/vars)
+// of the process on their own port, so that profiles can be pulled from a live server.
+func (l *lockServer) startDebugServer(port int) {
+	l.publishVars()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		log.Fatal("debug listen error:", err)
+	}
+	logger.Log(dsync.LogInfo, "Debug endpoints listening", "port", port)
+	go http.Serve(ln, mux)
+}
@@ -0,0 +1,234 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Time a dropped request is held before failing, well beyond the time clients wait for a lock
+// (a dropped request must look like one that never arrived, rather than like a quick failure)
+const faultDropHold = 10 * time.Second
+
+// Handlers into which faults can be injected, eg. -fault-drop Lock=5,Unlock=1 (or *=5 for all of them)
+var faultHandlers = []string{
+	"Lock", "RLock", "Unlock", "RUnlock", "ForceUnlock", "Expired", "ExpiredBatch",
+	"LockWait", "RLockWait", "Watch", "PrepareLock", "PrepareRLock", "Commit", "LockBatch", "UnlockBatch", "Revoke",
+	"RequestRevocation",
+}
+
+// faultDelay is a distribution of the delay of handling a request, one of fixed:<d>,
+// uniform:<min>:<max>, exp:<mean> or normal:<mean>:<stddev> (negative samples count as no delay).
+type faultDelay struct {
+	kind string
+	a, b time.Duration
+}
+
+func parseFaultDelay(s string) (faultDelay, error) {
+	parts := strings.Split(s, ":")
+	var d faultDelay
+	d.kind = parts[0]
+	want := map[string]int{"fixed": 1, "uniform": 2, "exp": 1, "normal": 2}[d.kind]
+	if want == 0 {
+		return d, fmt.Errorf("Unknown delay distribution %q (want fixed, uniform, exp or normal)", d.kind)
+	}
+	if len(parts) != want+1 {
+		return d, fmt.Errorf("Delay distribution %q takes %d duration(s), got %q", d.kind, want, s)
+	}
+	var err error
+	if d.a, err = time.ParseDuration(parts[1]); err != nil {
+		return d, err
+	}
+	if want == 2 {
+		if d.b, err = time.ParseDuration(parts[2]); err != nil {
+			return d, err
+		}
+	}
+	if d.kind == "uniform" && d.b < d.a {
+		return d, fmt.Errorf("Uniform delay with maximum %v below minimum %v", d.b, d.a)
+	}
+	return d, nil
+}
+
+func (d faultDelay) sample(r *rand.Rand) time.Duration {
+	var v float64
+	switch d.kind {
+	case "fixed":
+		v = float64(d.a)
+	case "uniform":
+		v = float64(d.a) + r.Float64()*float64(d.b-d.a)
+	case "exp":
+		v = r.ExpFloat64() * float64(d.a)
+	case "normal":
+		v = float64(d.a) + r.NormFloat64()*float64(d.b)
+	}
+	return time.Duration(math.Max(v, 0))
+}
+
+// faultInjector drops, delays or fails requests per handler, drawing from a seeded source so that
+// a run with the same seed injects the same sequence of faults.
+type faultInjector struct {
+	mutex  sync.Mutex
+	rand   *rand.Rand
+	drop   map[string]float64 // Percentage of requests dropped per handler ("*" for any handler)
+	fail   map[string]float64 // Percentage of requests failing with a spurious error per handler
+	delays map[string]faultDelay
+}
+
+// parseFaultSpec parses a comma separated list of <handler>=<value> (with * for any handler).
+func parseFaultSpec(spec string, parse func(handler, value string) error) error {
+	if spec == "" {
+		return nil
+	}
+	for _, entry := range strings.Split(spec, ",") {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Fault %q is not of the form <handler>=<value>", entry)
+		}
+		known := kv[0] == "*"
+		for _, h := range faultHandlers {
+			known = known || kv[0] == h
+		}
+		if !known {
+			return fmt.Errorf("Unknown handler %q for fault injection (want one of %s or *)", kv[0], strings.Join(faultHandlers, ", "))
+		}
+		if err := parse(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parsePercentages(spec string) (map[string]float64, error) {
+	percentages := make(map[string]float64)
+	err := parseFaultSpec(spec, func(handler, value string) error {
+		p, err := strconv.ParseFloat(value, 64)
+		if err != nil || p < 0 || p > 100 {
+			return fmt.Errorf("Percentage for %s must be between 0 and 100, got %q", handler, value)
+		}
+		percentages[handler] = p
+		return nil
+	})
+	return percentages, err
+}
+
+// newFaultInjector returns an injector for the -fault-drop, -fault-delay and -fault-error specs,
+// or nil when no faults are configured.
+func newFaultInjector(drop, delay, fail string, seed int64) (*faultInjector, error) {
+	if drop == "" && delay == "" && fail == "" {
+		return nil, nil
+	}
+	f := &faultInjector{rand: rand.New(rand.NewSource(seed)), delays: make(map[string]faultDelay)}
+	var err error
+	if f.drop, err = parsePercentages(drop); err != nil {
+		return nil, err
+	}
+	if f.fail, err = parsePercentages(fail); err != nil {
+		return nil, err
+	}
+	err = parseFaultSpec(delay, func(handler, value string) (err error) {
+		f.delays[handler], err = parseFaultDelay(value)
+		return err
+	})
+	return f, err
+}
+
+// draw decides the fate of a request to handler: whether it is dropped, fails, and how long it is delayed.
+func (f *faultInjector) draw(handler string) (drop, fail bool, delay time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	percentage := func(m map[string]float64) float64 {
+		if p, ok := m[handler]; ok {
+			return p
+		}
+		return m["*"]
+	}
+	drop = f.rand.Float64()*100 < percentage(f.drop)
+	fail = f.rand.Float64()*100 < percentage(f.fail)
+	d, ok := f.delays[handler]
+	if !ok {
+		d, ok = f.delays["*"]
+	}
+	if ok {
+		delay = d.sample(f.rand)
+	}
+	return drop, fail, delay
+}
+
+// FaultArgs - arguments for the InjectFaults rpc call, by which a chaos run injects faults into a
+// server for a while (eg. dropping all requests to partition it), specified like the -fault-* flags.
+type FaultArgs struct {
+	Token     string
+	Timestamp time.Time
+	Drop      string
+	Delay     string
+	Error     string
+	Duration  time.Duration
+}
+
+func (f *FaultArgs) SetToken(token string) {
+	f.Token = token
+}
+
+func (f *FaultArgs) SetTimestamp(tstamp time.Time) {
+	f.Timestamp = tstamp
+}
+
+// InjectFaults - rpc handler that injects the faults of args instead of those configured with the
+// -fault-* flags, until args.Duration has elapsed.
+func (l *lockServer) InjectFaults(args *FaultArgs, reply *bool) error {
+	faults, err := newFaultInjector(args.Drop, args.Delay, args.Error, *faultSeedFlag)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.injected, l.injectEnd = faults, time.Now().Add(args.Duration)
+	*reply = true
+	return nil
+}
+
+// injectFault applies the faults configured for handler to a request before it is handled: it
+// is delayed, and then held and failed as if it never arrived when dropped, or failed right away
+// with a spurious error. Must be called without holding any mutex.
+func (l *lockServer) injectFault(handler string) error {
+	l.mutex.RLock()
+	faults := l.faults
+	if time.Now().Before(l.injectEnd) {
+		faults = l.injected
+	}
+	l.mutex.RUnlock()
+	if faults == nil {
+		return nil
+	}
+	drop, fail, delay := faults.draw(handler)
+	time.Sleep(delay)
+	if drop {
+		time.Sleep(faultDropHold)
+		return fmt.Errorf("Request to %s dropped by fault injection", handler)
+	}
+	if fail {
+		return fmt.Errorf("Spurious error injected into %s", handler)
+	}
+	return nil
+}
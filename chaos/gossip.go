@@ -0,0 +1,278 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// For this test framework we have short gossip timings
+const (
+	gossipInterval       = 1 * time.Second        // Protocol period, a single member is probed every period
+	gossipProbeTimeout   = 500 * time.Millisecond // Time to wait for a direct probe to be answered
+	gossipIndirectProbes = 2                      // Number of members asked to probe a member that failed to answer
+	gossipSuspectTimeout = 5 * time.Second        // Time after which a suspect member is declared dead
+)
+
+var errProbeTimeout = errors.New("Probe timed out")
+
+type memberInfo struct {
+	dsync.Member
+	suspectSince time.Time // Time at which the member became suspect
+}
+
+// gossip implements a SWIM-style membership and failure detection protocol among
+// lock servers, so that clients can bootstrap the full membership from any server.
+type gossip struct {
+	mutex      sync.Mutex
+	self       dsync.Member
+	members    map[string]*memberInfo // Other members keyed by node
+	probeOrder []string               // Remaining members to probe in the current round
+}
+
+func newGossip(node, rpcPath string) *gossip {
+	return &gossip{
+		self:    dsync.Member{Node: node, RPCPath: rpcPath, State: dsync.MemberAlive},
+		members: make(map[string]*memberInfo),
+	}
+}
+
+// Ping - rpc handler for a direct probe, returns all members known to this server.
+func (g *gossip) Ping(args *dsync.MembershipArgs, reply *[]dsync.Member) error {
+	g.merge(append(args.Members, args.From))
+	*reply = g.snapshot()
+	return nil
+}
+
+// PingReq - rpc handler for an indirect probe of args.Target on behalf of args.From.
+func (g *gossip) PingReq(args *dsync.MembershipArgs, reply *[]dsync.Member) error {
+	g.merge(append(args.Members, args.From))
+	members, err := g.call(args.Target, "Gossip.Ping", dsync.Member{}, gossipProbeTimeout)
+	if err != nil {
+		return err
+	}
+	g.merge(members)
+	*reply = g.snapshot()
+	return nil
+}
+
+// Members - rpc handler returning all members known to this server (used by clients to bootstrap).
+func (g *gossip) Members(args *dsync.MembershipArgs, reply *[]dsync.Member) error {
+	*reply = g.snapshot()
+	return nil
+}
+
+// join introduces this server to the cluster via a seed server.
+func (g *gossip) join(node, rpcPath string) error {
+	members, err := g.call(dsync.Member{Node: node, RPCPath: rpcPath}, "Gossip.Ping", dsync.Member{}, gossipProbeTimeout)
+	if err != nil {
+		return err
+	}
+	g.merge(members)
+	return nil
+}
+
+// run executes the protocol periods, does not return.
+func (g *gossip) run() {
+	for {
+		time.Sleep(gossipInterval)
+		g.protocolPeriod()
+	}
+}
+
+// protocolPeriod probes the next member directly and, failing that, indirectly via
+// some other members before declaring it suspect.
+func (g *gossip) protocolPeriod() {
+	g.expireSuspects()
+
+	target, ok := g.nextTarget()
+	if !ok {
+		return
+	}
+
+	members, err := g.call(target, "Gossip.Ping", dsync.Member{}, gossipProbeTimeout)
+	if err == nil {
+		g.merge(members)
+		return
+	}
+
+	for _, helper := range g.randomMembers(gossipIndirectProbes, target.Node) {
+		members, err = g.call(helper, "Gossip.PingReq", target, 2*gossipProbeTimeout)
+		if err == nil {
+			g.merge(members)
+			return
+		}
+	}
+
+	g.suspect(target)
+}
+
+// call sends a gossip message with all known members piggybacked, giving up after timeout.
+func (g *gossip) call(m dsync.Member, serviceMethod string, target dsync.Member, timeout time.Duration) ([]dsync.Member, error) {
+	c := newClient(m.Node, m.RPCPath)
+	defer c.Close()
+
+	g.mutex.Lock()
+	args := &dsync.MembershipArgs{From: g.self, Target: target}
+	g.mutex.Unlock()
+	args.Members = g.snapshot()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var members []dsync.Member
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Call(ctx, serviceMethod, args, &members)
+	}()
+
+	select {
+	case err := <-done:
+		return members, err
+	case <-ctx.Done():
+		return nil, errProbeTimeout
+	}
+}
+
+// merge incorporates the members as known by another server: a higher incarnation always
+// wins, and for an equal incarnation the more severe state (alive < suspect < dead) wins.
+func (g *gossip) merge(incoming []dsync.Member) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, m := range incoming {
+		if m.Node == "" {
+			continue
+		}
+		if m.Node == g.self.Node {
+			// Refute any suspicion about ourselves by raising our incarnation
+			if m.State != dsync.MemberAlive && m.Incarnation >= g.self.Incarnation {
+				g.self.Incarnation = m.Incarnation + 1
+				logger.Log(dsync.LogInfo, "Refuting suspicion", "state", m.State, "incarnation", g.self.Incarnation)
+			}
+			continue
+		}
+		cur, ok := g.members[m.Node]
+		if !ok {
+			g.members[m.Node] = &memberInfo{Member: m}
+			if m.State == dsync.MemberSuspect {
+				g.members[m.Node].suspectSince = time.Now()
+			}
+			logger.Log(dsync.LogInfo, "New member", "node", m.Node, "state", m.State)
+			continue
+		}
+		if m.Incarnation > cur.Incarnation || m.Incarnation == cur.Incarnation && m.State > cur.State {
+			if m.State != cur.State {
+				logger.Log(dsync.LogInfo, "Member changed state", "node", m.Node, "state", m.State)
+			}
+			if m.State == dsync.MemberSuspect && cur.State != dsync.MemberSuspect {
+				cur.suspectSince = time.Now()
+			}
+			cur.Member = m
+		}
+	}
+}
+
+// suspect marks a member that failed to answer both direct and indirect probes as suspect.
+func (g *gossip) suspect(target dsync.Member) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if cur, ok := g.members[target.Node]; ok && cur.State == dsync.MemberAlive && cur.Incarnation == target.Incarnation {
+		cur.State = dsync.MemberSuspect
+		cur.suspectSince = time.Now()
+		logger.Log(dsync.LogWarn, "Member changed state", "node", target.Node, "state", cur.State)
+	}
+}
+
+// expireSuspects declares members dead that have not refuted their suspicion in time.
+func (g *gossip) expireSuspects() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, cur := range g.members {
+		if cur.State == dsync.MemberSuspect && time.Since(cur.suspectSince) >= gossipSuspectTimeout {
+			cur.State = dsync.MemberDead
+			logger.Log(dsync.LogWarn, "Member changed state", "node", cur.Node, "state", cur.State)
+		}
+	}
+}
+
+// nextTarget returns the next member to probe, visiting all members in a random order per round.
+func (g *gossip) nextTarget() (dsync.Member, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for {
+		if len(g.probeOrder) == 0 {
+			for node, cur := range g.members {
+				if cur.State != dsync.MemberDead {
+					g.probeOrder = append(g.probeOrder, node)
+				}
+			}
+			if len(g.probeOrder) == 0 {
+				return dsync.Member{}, false
+			}
+			rand.Shuffle(len(g.probeOrder), func(i, j int) {
+				g.probeOrder[i], g.probeOrder[j] = g.probeOrder[j], g.probeOrder[i]
+			})
+		}
+		node := g.probeOrder[0]
+		g.probeOrder = g.probeOrder[1:]
+		if cur, ok := g.members[node]; ok && cur.State != dsync.MemberDead {
+			return cur.Member, true
+		}
+	}
+}
+
+// randomMembers returns up to k random live members, excluding the given node.
+func (g *gossip) randomMembers(k int, exclude string) []dsync.Member {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	candidates := []dsync.Member{}
+	for node, cur := range g.members {
+		if node != exclude && cur.State == dsync.MemberAlive {
+			candidates = append(candidates, cur.Member)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > k {
+		candidates = candidates[:k]
+	}
+	return candidates
+}
+
+// snapshot returns all known members including ourselves.
+func (g *gossip) snapshot() []dsync.Member {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	members := make([]dsync.Member, 0, len(g.members)+1)
+	members = append(members, g.self)
+	for _, cur := range g.members {
+		members = append(members, cur.Member)
+	}
+	return members
+}
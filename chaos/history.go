@@ -0,0 +1,336 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Operations in a lock history
+const (
+	opLock    = "lock"
+	opRLock   = "rlock"
+	opUnlock  = "unlock"
+	opRUnlock = "runlock"
+	opCrash   = "crash" // Process killed, releasing all locks held by its clients
+)
+
+// Names of locks that are known to violate mutual exclusion in the built-in tests
+var knownViolations = map[string]bool{"test-known-error": true}
+
+// historyOp is a completed operation in a lock history, called and returned at the given times
+// (as the wall clock of all chaos processes on a machine is shared, histories of all processes
+// can be merged).
+type historyOp struct {
+	Process int    `json:"process"` // Pid of the process of the client (or of the killed process for a crash)
+	Client  string `json:"client,omitempty"`
+	Op      string `json:"op"`
+	Name    string `json:"name,omitempty"`
+	Call    int64  `json:"call"`   // Unix time in nanoseconds
+	Return  int64  `json:"return"` // Unix time in nanoseconds
+}
+
+// historyLog appends the operations of the clients of a process to <dir>/history-<pid>.json
+// (an operation that has not returned when the process is killed is never written).
+type historyLog struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+// Log of lock operations of this process (nil unless enabled by -history)
+var history *historyLog
+
+// Counter for the ids of the clients in this process
+var historyClients uint64
+
+func openHistory(dir string) (*historyLog, error) {
+	f, err := os.OpenFile(filepath.Join(dir, fmt.Sprintf("history-%d.json", os.Getpid())), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &historyLog{enc: json.NewEncoder(f)}, nil
+}
+
+// resetHistory removes the histories of an earlier run from dir.
+func resetHistory(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "history-*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *historyLog) record(op historyOp) {
+	if h == nil {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if err := h.enc.Encode(&op); err != nil {
+		log.Println("Unable to write to history:", err)
+	}
+}
+
+// recordCrash records that the process pid was killed by a call at the given time.
+func (h *historyLog) recordCrash(pid int, call time.Time) {
+	h.record(historyOp{Process: pid, Op: opCrash, Call: call.UnixNano(), Return: time.Now().UnixNano()})
+}
+
+// recordedMutex is a DRWMutex whose operations are recorded in the history, each instance
+// being a separate client.
+type recordedMutex struct {
+	*dsync.DRWMutex
+	name   string
+	client string
+}
+
+func newDRWMutex(name string) *recordedMutex {
+	return &recordedMutex{
+		DRWMutex: dsync.NewDRWMutex(name),
+		name:     name,
+		client:   fmt.Sprintf("%d/%d", os.Getpid(), atomic.AddUint64(&historyClients, 1)),
+	}
+}
+
+func (m *recordedMutex) recorded(op string, f func()) {
+	call := time.Now().UnixNano()
+	f()
+	history.record(historyOp{Process: os.Getpid(), Client: m.client, Op: op, Name: m.name, Call: call, Return: time.Now().UnixNano()})
+}
+
+func (m *recordedMutex) Lock()    { m.recorded(opLock, m.DRWMutex.Lock) }
+func (m *recordedMutex) RLock()   { m.recorded(opRLock, m.DRWMutex.RLock) }
+func (m *recordedMutex) Unlock()  { m.recorded(opUnlock, m.DRWMutex.Unlock) }
+func (m *recordedMutex) RUnlock() { m.recorded(opRUnlock, m.DRWMutex.RUnlock) }
+
+// loadHistory reads and merges the histories of all processes in dir.
+func loadHistory(dir string) ([]historyOp, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "history-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var ops []historyOp
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var op historyOp
+			if err := json.Unmarshal(scanner.Bytes(), &op); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			ops = append(ops, op)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// checkHistory verifies that the history is linearizable with respect to a readers-writer lock,
+// returning the names of the locks whose history is not. As the operations on different names
+// are independent, the history of every name is checked separately (including the crashes of
+// the processes with clients that used the name).
+func checkHistory(ops []historyOp) (violations []string) {
+	names := make(map[string][]historyOp)
+	processes := make(map[string]map[int]bool)
+	for _, op := range ops {
+		if op.Op == opCrash {
+			continue
+		}
+		names[op.Name] = append(names[op.Name], op)
+		if processes[op.Name] == nil {
+			processes[op.Name] = make(map[int]bool)
+		}
+		processes[op.Name][op.Process] = true
+	}
+	for name, nameOps := range names {
+		for _, op := range ops {
+			if op.Op == opCrash && processes[name][op.Process] {
+				nameOps = append(nameOps, op)
+			}
+		}
+		if !linearizable(nameOps) {
+			violations = append(violations, name)
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+// lockState is the state of a single readers-writer lock: the client holding the write lock or
+// the number of read locks held per client (a client being "<pid>/<n>").
+type lockState struct {
+	writer  string
+	readers map[string]int
+}
+
+func (s lockState) key() string {
+	readers := make([]string, 0, len(s.readers))
+	for client, count := range s.readers {
+		readers = append(readers, fmt.Sprintf("%s*%d", client, count))
+	}
+	sort.Strings(readers)
+	return s.writer + "|" + strings.Join(readers, ",")
+}
+
+// apply returns the state after op, and whether op is allowed in state s.
+func (s lockState) apply(op historyOp) (lockState, bool) {
+	next := lockState{writer: s.writer, readers: make(map[string]int, len(s.readers))}
+	for client, count := range s.readers {
+		next.readers[client] = count
+	}
+	switch op.Op {
+	case opLock:
+		if s.writer != "" || len(s.readers) > 0 {
+			return s, false
+		}
+		next.writer = op.Client
+	case opRLock:
+		if s.writer != "" {
+			return s, false
+		}
+		next.readers[op.Client]++
+	case opUnlock:
+		if s.writer != op.Client {
+			return s, false
+		}
+		next.writer = ""
+	case opRUnlock:
+		if s.readers[op.Client] == 0 {
+			return s, false
+		}
+		if next.readers[op.Client]--; next.readers[op.Client] == 0 {
+			delete(next.readers, op.Client)
+		}
+	case opCrash:
+		prefix := fmt.Sprintf("%d/", op.Process)
+		if strings.HasPrefix(next.writer, prefix) {
+			next.writer = ""
+		}
+		for client := range s.readers {
+			if strings.HasPrefix(client, prefix) {
+				delete(next.readers, client)
+			}
+		}
+	}
+	return next, true
+}
+
+// linearizable searches for an order of ops, each taking effect at an instant between its call
+// and return, that is allowed by the lock (following Wing & Gong with the memoization of Lowe, as
+// done by Porcupine).
+func linearizable(ops []historyOp) bool {
+	sort.Slice(ops, func(i, j int) bool { return ops[i].Call < ops[j].Call })
+	done := make([]bool, len(ops))
+	seen := make(map[string]bool)
+
+	var search func(state lockState, remaining int) bool
+	search = func(state lockState, remaining int) bool {
+		if remaining == 0 {
+			return true
+		}
+		mark := make([]byte, len(ops))
+		for i := range done {
+			if done[i] {
+				mark[i] = '1'
+			}
+		}
+		key := string(mark) + state.key()
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+
+		// Only operations called before the first return of the remaining operations can go next
+		first := int64(-1)
+		for i, op := range ops {
+			if !done[i] && (first == -1 || op.Return < first) {
+				first = op.Return
+			}
+		}
+		for i, op := range ops {
+			if done[i] || op.Call > first {
+				continue
+			}
+			next, ok := state.apply(op)
+			if !ok {
+				continue
+			}
+			done[i] = true
+			if search(next, remaining-1) {
+				return true
+			}
+			done[i] = false
+		}
+		return false
+	}
+	return search(lockState{}, len(ops))
+}
+
+// verifyHistory checks the histories in dir, returning whether mutual exclusion held (apart from
+// the known violations of the built-in tests).
+func verifyHistory(dir string) bool {
+	log.Println("")
+	log.Println("**STARTING** verifyHistory")
+
+	ops, err := loadHistory(dir)
+	if err != nil {
+		log.Println("**FAILED** verifyHistory:", err)
+		return false
+	}
+	passed := true
+	for _, name := range checkHistory(ops) {
+		if knownViolations[name] {
+			log.Printf("History of %s not linearizable (known error)", name)
+		} else {
+			log.Printf("History of %s not linearizable", name)
+			passed = false
+		}
+	}
+	if !passed {
+		log.Println("**FAILED** verifyHistory")
+		return false
+	}
+	log.Printf("**PASSED** verifyHistory (%d operations)", len(ops))
+	return true
+}
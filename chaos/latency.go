@@ -0,0 +1,105 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Number of buckets of a latency histogram, with upper bounds doubling from 1ms (the last
+// bucket counts all latencies above the bound of the one before)
+const latencyBuckets = 18
+
+// latencyHistogram counts the latencies of acquiring locks in buckets, as emitted by workloads
+// (with the bounds included so that dsync-chaos can aggregate them).
+type latencyHistogram struct {
+	Bounds []time.Duration `json:"bounds"` // Upper bounds of all but the last bucket
+	Counts []int           `json:"counts"`
+	Max    time.Duration   `json:"max"`
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	h := &latencyHistogram{Counts: make([]int, latencyBuckets)}
+	for bound := time.Millisecond; len(h.Bounds) < latencyBuckets-1; bound *= 2 {
+		h.Bounds = append(h.Bounds, bound)
+	}
+	return h
+}
+
+// add counts a latency.
+func (h *latencyHistogram) add(d time.Duration) {
+	i := sort.Search(len(h.Bounds), func(i int) bool { return d <= h.Bounds[i] })
+	h.Counts[i]++
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// quantile returns the upper bound of the bucket holding the latency at quantile q (0 to 1),
+// or the maximum for the last bucket.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	total := 0
+	for _, c := range h.Counts {
+		total += c
+	}
+	seen := 0
+	for i, c := range h.Counts {
+		seen += c
+		if c > 0 && float64(seen) >= q*float64(total) {
+			if i < len(h.Bounds) && h.Bounds[i] < h.Max {
+				return h.Bounds[i]
+			}
+			return h.Max
+		}
+	}
+	return 0
+}
+
+func (h *latencyHistogram) String() string {
+	return fmt.Sprintf("p50 %v, p90 %v, p99 %v, max %v", h.quantile(0.5), h.quantile(0.9), h.quantile(0.99), h.Max)
+}
+
+// fairness returns Jain's fairness index of the number of locks granted per client, from 1/n
+// when a single client got all locks to 1 when all clients got the same number of locks.
+func fairness(grants map[string]int) float64 {
+	sum, squares := 0.0, 0.0
+	for _, g := range grants {
+		sum += float64(g)
+		squares += float64(g) * float64(g)
+	}
+	if squares == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(grants)) * squares)
+}
+
+// grantRange returns the lowest and highest number of locks granted to a client.
+func grantRange(grants map[string]int) (min, max int) {
+	first := true
+	for _, g := range grants {
+		if first || g < min {
+			min = g
+		}
+		if first || g > max {
+			max = g
+		}
+		first = false
+	}
+	return min, max
+}
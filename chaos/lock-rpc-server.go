@@ -17,266 +17,172 @@
 package main
 
 import (
-	"errors"
-	"fmt"
-	"github.com/minio/dsync"
-	"log"
 	"sync"
 	"time"
-)
-
-// used when cached timestamp do not match with what client remembers.
-var errInvalidTimestamp = errors.New("Timestamps don't match, server may have restarted.")
 
-type lockRequesterInfo struct {
-	writer        bool      // Bool whether write or read lock
-	node          string    // Network address of client claiming lock
-	rpcPath       string    // RPC path of client claiming lock
-	uid           string    // Uid to uniquely identify request of client
-	timestamp     time.Time // Timestamp set at the time of initialization
-	timeLastCheck time.Time // Timestamp for last check of validity of lock
-}
+	"github.com/minio/dsync"
+	"github.com/minio/dsync/server"
+)
 
-func isWriteLock(lri []lockRequesterInfo) bool {
-	return len(lri) == 1 && lri[0].writer
+// lockServer is the lock server of the chaos harness: the lock server of the server package,
+// with faults injected into its handlers as configured by the -fault-* flags or InjectFaults.
+// All handlers that are not subject to fault injection are those of the embedded server.
+type lockServer struct {
+	*server.Server
+	mutex     sync.RWMutex   // Guards the faults injected.
+	faults    *faultInjector // Faults injected into the handlers as configured by flags (nil when disabled).
+	injected  *faultInjector // Faults injected by InjectFaults instead until injectEnd (nil for none).
+	injectEnd time.Time      // Time until which the faults injected by InjectFaults apply.
 }
 
-type lockServer struct {
-	mutex sync.Mutex
-	lockMap   map[string][]lockRequesterInfo
-	timestamp time.Time // Timestamp set at the time of initialization. Resets naturally on minio server restart.
+// newLockServer returns a lock server without locks, which runs no lock maintenance until started.
+func newLockServer(config server.Config) *lockServer {
+	return &lockServer{Server: server.New(config)}
 }
 
-func (l *lockServer) validateLockArgs(args *dsync.LockArgs) error {
-	if !l.timestamp.Equal(args.Timestamp) {
-		return errInvalidTimestamp
+// stats returns the statistics of the server, as served by its Stats handler.
+func (l *lockServer) stats() (server.Stats, error) {
+	var stats server.Stats
+	args := server.StatsArgs{Incarnation: l.Incarnation(), Version: dsync.ProtocolVersion}
+	if *tokenFlag != "" {
+		args.Token = *tokenFlag
 	}
-	return nil
+	err := l.Server.Stats(&args, &stats)
+	return stats, err
 }
 
 // Lock - rpc handler for (single) write lock operation.
-func (l *lockServer) Lock(args *dsync.LockArgs, reply *bool) error {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	if err := l.validateLockArgs(args); err != nil {
+func (l *lockServer) Lock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	if err := l.injectFault("Lock"); err != nil {
 		return err
 	}
-	_, *reply = l.lockMap[args.Name]
-	if !*reply { // No locks held on the given name, so claim write lock
-		l.lockMap[args.Name] = []lockRequesterInfo{
-			{
-				writer:        true,
-				node:          args.Node,
-				rpcPath:       args.RPCPath,
-				uid:           args.UID,
-				timestamp:     time.Now().UTC(),
-				timeLastCheck: time.Now().UTC(),
-			},
-		}
-	}
-	*reply = !*reply // Negate *reply to return true when lock is granted or false otherwise
-	return nil
+	return l.Server.Lock(args, reply)
 }
 
 // Unlock - rpc handler for (single) write unlock operation.
 func (l *lockServer) Unlock(args *dsync.LockArgs, reply *bool) error {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	if err := l.validateLockArgs(args); err != nil {
+	if err := l.injectFault("Unlock"); err != nil {
 		return err
 	}
-	var lri []lockRequesterInfo
-	if lri, *reply = l.lockMap[args.Name]; !*reply { // No lock is held on the given name
-		return fmt.Errorf("Unlock attempted on an unlocked entity: %s", args.Name)
-	}
-	if *reply = isWriteLock(lri); !*reply { // Unless it is a write lock
-		return fmt.Errorf("Unlock attempted on a read locked entity: %s (%d read locks active)", args.Name, len(lri))
-	}
-	if !l.removeEntry(args.Name, args.UID, &lri) {
-		return fmt.Errorf("Unlock unable to find corresponding lock for uid: %s", args.UID)
-	}
-	return nil
+	return l.Server.Unlock(args, reply)
 }
 
 // RLock - rpc handler for read lock operation.
-func (l *lockServer) RLock(args *dsync.LockArgs, reply *bool) error {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	if err := l.validateLockArgs(args); err != nil {
+func (l *lockServer) RLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	if err := l.injectFault("RLock"); err != nil {
 		return err
 	}
-	lrInfo := lockRequesterInfo{
-		writer:        false,
-		node:          args.Node,
-		rpcPath:       args.RPCPath,
-		uid:           args.UID,
-		timestamp:     time.Now().UTC(),
-		timeLastCheck: time.Now().UTC(),
-	}
-	if lri, ok := l.lockMap[args.Name]; ok {
-		if *reply = !isWriteLock(lri); *reply { // Unless there is a write lock
-			l.lockMap[args.Name] = append(l.lockMap[args.Name], lrInfo)
-		}
-	} else { // No locks held on the given name, so claim (first) read lock
-		l.lockMap[args.Name] = []lockRequesterInfo{lrInfo}
-		*reply = true
-	}
-	return nil
+	return l.Server.RLock(args, reply)
 }
 
 // RUnlock - rpc handler for read unlock operation.
 func (l *lockServer) RUnlock(args *dsync.LockArgs, reply *bool) error {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	if err := l.validateLockArgs(args); err != nil {
+	if err := l.injectFault("RUnlock"); err != nil {
 		return err
 	}
-	var lri []lockRequesterInfo
-	if lri, *reply = l.lockMap[args.Name]; !*reply { // No lock is held on the given name
-		return fmt.Errorf("RUnlock attempted on an unlocked entity: %s", args.Name)
-	}
-	if *reply = !isWriteLock(lri); !*reply { // A write-lock is held, cannot release a read lock
-		return fmt.Errorf("RUnlock attempted on a write locked entity: %s", args.Name)
-	}
-	if !l.removeEntry(args.Name, args.UID, &lri) {
-		return fmt.Errorf("RUnlock unable to find corresponding read lock for uid: %s", args.UID)
-	}
-	return nil
+	return l.Server.RUnlock(args, reply)
 }
 
 // ForceUnlock - rpc handler for force unlock operation.
 func (l *lockServer) ForceUnlock(args *dsync.LockArgs, reply *bool) error {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	if err := l.validateLockArgs(args); err != nil {
+	if err := l.injectFault("ForceUnlock"); err != nil {
 		return err
 	}
-	if len(args.UID) != 0 {
-		return fmt.Errorf("ForceUnlock called with non-empty UID: %s", args.UID)
-	}
-	if _, ok := l.lockMap[args.Name]; ok { // Only clear lock when set
-		delete(l.lockMap, args.Name) // Remove the lock (irrespective of write or read lock)
-	}
-	*reply = true
-	return nil
+	return l.Server.ForceUnlock(args, reply)
 }
 
 // Expired - rpc handler for expired lock status.
-func (l* lockServer) Expired(args *dsync.LockArgs, reply *bool) error {
-	l.mutex.Lock()
-	defer l.mutex.Unlock()
-	if err := l.validateLockArgs(args); err != nil {
+func (l *lockServer) Expired(args *dsync.LockArgs, reply *bool) error {
+	if err := l.injectFault("Expired"); err != nil {
 		return err
 	}
-	if lri, ok := l.lockMap[args.Name]; ok {
-		// Check whether uid is still active for this name
-		for _, entry := range lri {
-			if entry.uid == args.UID {
-				*reply = false // When uid found, lock is still active so return not expired
-				return nil
-			}
-		}
-	}
-	// When we get here, lock is no longer active due to either args.Name being absent from map
-	// or uid not found for given args.Name
-	*reply = true
-	return nil
+	return l.Server.Expired(args, reply)
 }
 
-// removeEntry either, based on the uid of the lock message, removes a single entry from the
-// lockRequesterInfo array or the whole array from the map (in case of a write lock or last read lock)
-func (l *lockServer) removeEntry(name, uid string, lri *[]lockRequesterInfo) bool {
-	// Find correct entry to remove based on uid
-	for index, entry := range *lri {
-		if entry.uid == uid {
-			if len(*lri) == 1 {
-				delete(l.lockMap, name) // Remove the (last) lock
-			} else {
-				// Remove the appropriate read lock
-				*lri = append((*lri)[:index], (*lri)[index+1:]...)
-				l.lockMap[name] = *lri
-			}
-			return true
-		}
+// ExpiredBatch - rpc handler for the expired lock status of many locks at once.
+func (l *lockServer) ExpiredBatch(args *dsync.ExpiredBatchArgs, reply *dsync.ExpiredBatchReply) error {
+	if err := l.injectFault("ExpiredBatch"); err != nil {
+		return err
 	}
-	return false
+	return l.Server.ExpiredBatch(args, reply)
 }
 
-// Similar to removeEntry but only removes an entry only if the lock entry exists in map.
-func (l *lockServer) removeEntryIfExists(nlrip nameLockRequesterInfoPair) {
-	// Check if entry is still in map (could have been removed altogether by 'concurrent' (R)Unlock of last entry)
-	if lri, ok := l.lockMap[nlrip.name]; ok {
-		if !l.removeEntry(nlrip.name, nlrip.lri.uid, &lri) {
-			// Remove failed, in case it is a:
-			if nlrip.lri.writer {
-				// Writer: this should never happen as the whole (mapped) entry should have been deleted
-				log.Println("Lock maintenance failed to remove entry for write lock (should never happen)", nlrip.name, nlrip.lri.uid, lri)
-			} // Reader: this can happen if multiple read locks were active and
-			// the one we are looking for has been released concurrently (so it is fine)
-		} // Remove went okay, all is fine
+// LockWait - rpc handler for a write lock operation that is parked until the lock frees up.
+func (l *lockServer) LockWait(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	if err := l.injectFault("LockWait"); err != nil {
+		return err
 	}
+	return l.Server.LockWait(args, reply)
 }
 
-type nameLockRequesterInfoPair struct {
-	name string
-	lri  lockRequesterInfo
+// RLockWait - rpc handler for a read lock operation that is parked like LockWait.
+func (l *lockServer) RLockWait(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	if err := l.injectFault("RLockWait"); err != nil {
+		return err
+	}
+	return l.Server.RLockWait(args, reply)
 }
 
-// getLongLivedLocks returns locks that are older than a certain time and
-// have not been 'checked' for validity too soon enough
-func getLongLivedLocks(m map[string][]lockRequesterInfo, interval time.Duration) []nameLockRequesterInfoPair {
-
-	rslt := []nameLockRequesterInfoPair{}
-
-	for name, lriArray := range m {
+// Watch - rpc handler that waits until (any lock on) args.Name is released.
+func (l *lockServer) Watch(args *dsync.LockArgs, reply *bool) error {
+	if err := l.injectFault("Watch"); err != nil {
+		return err
+	}
+	return l.Server.Watch(args, reply)
+}
 
-		for idx := range lriArray {
-			// Check whether enough time has gone by since last check
-			if time.Since(lriArray[idx].timeLastCheck) >= interval {
-				rslt = append(rslt, nameLockRequesterInfoPair{name: name, lri: lriArray[idx]})
-				lriArray[idx].timeLastCheck = time.Now()
-			}
-		}
+// PrepareLock - rpc handler for reserving a write lock until committed.
+func (l *lockServer) PrepareLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	if err := l.injectFault("PrepareLock"); err != nil {
+		return err
 	}
+	return l.Server.PrepareLock(args, reply)
+}
 
-	return rslt
+// PrepareRLock - rpc handler for reserving a read lock until committed.
+func (l *lockServer) PrepareRLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	if err := l.injectFault("PrepareRLock"); err != nil {
+		return err
+	}
+	return l.Server.PrepareRLock(args, reply)
 }
 
-// lockMaintenance loops over locks that have been active for some time and checks back
-// with the original server whether it is still alive or not
-//
-// Following logic inside ignores the errors generated for Dsync.Active operation.
-// - server at client down
-// - some network error (and server is up normally)
-//
-// We will ignore the error, and we will retry later to get a resolve on this lock
-func (l *lockServer) lockMaintenance(interval time.Duration) {
-	l.mutex.Lock()
-	// Get list of long lived locks to check for staleness.
-	nlripLongLived := getLongLivedLocks(l.lockMap, interval)
-	l.mutex.Unlock()
+// Commit - rpc handler that turns a reservation into a lock.
+func (l *lockServer) Commit(args *dsync.LockArgs, reply *bool) error {
+	if err := l.injectFault("Commit"); err != nil {
+		return err
+	}
+	return l.Server.Commit(args, reply)
+}
 
-	// Validate if long lived locks are indeed clean.
-	for _, nlrip := range nlripLongLived {
-		// Initialize client based on the long live locks.
-		c := newClient(nlrip.lri.node, nlrip.lri.rpcPath)
+// LockBatch - rpc handler for write locking many names at once.
+func (l *lockServer) LockBatch(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	if err := l.injectFault("LockBatch"); err != nil {
+		return err
+	}
+	return l.Server.LockBatch(args, reply)
+}
 
-		var expired bool
+// UnlockBatch - rpc handler for releasing the write locks of a LockBatch.
+func (l *lockServer) UnlockBatch(args *dsync.LockArgs, reply *bool) error {
+	if err := l.injectFault("UnlockBatch"); err != nil {
+		return err
+	}
+	return l.Server.UnlockBatch(args, reply)
+}
 
-		// Call back to original server to verify whether the lock is still active (based on name & uid)
-		// We will ignore any errors (see above for reasons), such locks will be retried later to get resolved
-		c.Call("Dsync.Expired", &dsync.LockArgs{
-			Name: nlrip.name,
-			UID:  nlrip.lri.uid,
-		}, &expired)
-		c.Close()
+// Revoke - rpc handler for having a client of this node hand back a retained lock.
+func (l *lockServer) Revoke(args *dsync.LockArgs, reply *bool) error {
+	if err := l.injectFault("Revoke"); err != nil {
+		return err
+	}
+	return l.Server.Revoke(args, reply)
+}
 
-		if expired {
-			// The lock is no longer active at server that originated the lock
-			// So remove the lock from the map.
-			l.mutex.Lock()
-			l.removeEntryIfExists(nlrip) // Purge the stale entry if it exists.
-			l.mutex.Unlock()
-		}
+// RequestRevocation - rpc handler for asking a client of this node to release a lock.
+func (l *lockServer) RequestRevocation(args *dsync.LockArgs, reply *bool) error {
+	if err := l.injectFault("RequestRevocation"); err != nil {
+		return err
 	}
+	return l.Server.RequestRevocation(args, reply)
 }
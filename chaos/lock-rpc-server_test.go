@@ -0,0 +1,37 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/minio/dsync"
+)
+
+func TestResolveCallbacks(t *testing.T) {
+	resolver := &clientPool{}
+	if _, err := resolver.Resolve(dsync.Identity{Node: "127.0.0.1:9000"}); err != dsync.ErrNotCallable {
+		t.Fatalf("Expected a client without path not to be callable, got %v", err)
+	}
+	c, err := resolver.Resolve(dsync.Identity{Node: "127.0.0.1:9000", Path: "/dsync"})
+	if err != nil || c.Node() != "127.0.0.1:9000" || c.RPCPath() != "/dsync" {
+		t.Fatalf("Expected a client for 127.0.0.1:9000/dsync, got %v (error %v)", c, err)
+	}
+	if again, _ := resolver.Resolve(dsync.Identity{Node: "127.0.0.1:9000", Path: "/dsync"}); again != c {
+		t.Fatal("Expected the client to be pooled")
+	}
+}
@@ -0,0 +1,317 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/rpc"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Time a replayed request may block (eg. LockWait) before the replay moves on to the next one
+const replayTimeout = 1 * time.Second
+
+// Handlers that wait for a lock to be released or on another server, which are handled
+// concurrently while recording (as handling them one at a time could deadlock)
+var waitingHandlers = map[string]bool{
+	"Dsync.LockWait":       true,
+	"Dsync.RLockWait":      true,
+	"Dsync.Watch":          true,
+	"Dsync.ConfirmExpired": true,
+}
+
+// rpcRecord is a request to a lock server together with its response, as recorded with -record.
+// Every (re)start of the server is recorded as well, without a method.
+type rpcRecord struct {
+	Method      string          `json:"method,omitempty"`      // Service method, eg. Dsync.Lock (empty for a start)
+	Incarnation uint64          `json:"incarnation,omitempty"` // Incarnation of the server (for a start)
+	Epoch       uint64          `json:"epoch,omitempty"`       // Configuration epoch of the server (for a start)
+	Args        json.RawMessage `json:"args,omitempty"`
+	Reply       json.RawMessage `json:"reply,omitempty"` // Absent when the request failed
+	Error       string          `json:"error,omitempty"`
+	Call        int64           `json:"call"`             // Unix time in nanoseconds on the clock of the server
+	Return      int64           `json:"return,omitempty"` // Unix time in nanoseconds on the clock of the server
+}
+
+// rpcRecorder appends the requests to a lock server and their responses to a file, one line of
+// JSON per request written once it has been responded to. So that the order of the recording is
+// the order in which the requests took effect, requests are handled one at a time while recording
+// (other than those that wait, which take effect once they return).
+type rpcRecorder struct {
+	turn  sync.Mutex // Held while a request is handled
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+// newRPCRecorder opens the recording at path for appending, recording the start of the server.
+func newRPCRecorder(path string, l *lockServer) (*rpcRecorder, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &rpcRecorder{enc: json.NewEncoder(f)}
+	r.record(&rpcRecord{Incarnation: l.Incarnation(), Epoch: *epochFlag, Call: clock.Now().UnixNano()})
+	return r, nil
+}
+
+// record writes a record, failures are logged but do not fail the request.
+func (r *rpcRecorder) record(rec *rpcRecord) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		logger.Log(dsync.LogError, "Unable to write to rpc recording", "err", err)
+	}
+}
+
+// recordingHandler serves net/rpc over HTTP like rpc.Server.HandleHTTP, recording all requests.
+type recordingHandler struct {
+	server   *rpc.Server
+	recorder *rpcRecorder
+}
+
+func (h *recordingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	buf := bufio.NewWriter(conn)
+	h.server.ServeCodec(&recordingCodec{
+		rwc:      conn,
+		dec:      gob.NewDecoder(conn),
+		enc:      gob.NewEncoder(buf),
+		encBuf:   buf,
+		recorder: h.recorder,
+		pending:  make(map[uint64]*rpcRecord),
+	})
+}
+
+// recordingCodec is the gob codec of net/rpc, recording every request with its response.
+type recordingCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+
+	recorder *rpcRecorder
+	header   rpc.Request // Header of the request whose body is read next
+	mutex    sync.Mutex
+	pending  map[uint64]*rpcRecord // Requests being handled, by sequence number
+}
+
+func (c *recordingCodec) ReadRequestHeader(r *rpc.Request) error {
+	err := c.dec.Decode(r)
+	c.header = *r
+	return err
+}
+
+func (c *recordingCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	if body == nil { // Body of an invalid request is discarded
+		return nil
+	}
+	args, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	if !waitingHandlers[c.header.ServiceMethod] {
+		c.recorder.turn.Lock() // Released once responded to
+	}
+	c.mutex.Lock()
+	c.pending[c.header.Seq] = &rpcRecord{Method: c.header.ServiceMethod, Args: args, Call: clock.Now().UnixNano()}
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *recordingCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	c.mutex.Lock()
+	rec := c.pending[r.Seq]
+	delete(c.pending, r.Seq)
+	c.mutex.Unlock()
+	if rec != nil {
+		rec.Return = clock.Now().UnixNano()
+		if r.Error != "" {
+			rec.Error = r.Error
+		} else if reply, err := json.Marshal(body); err != nil {
+			logger.Log(dsync.LogError, "Unable to record reply", "method", rec.Method, "err", err)
+		} else {
+			rec.Reply = reply
+		}
+		c.recorder.record(rec)
+		if !waitingHandlers[rec.Method] {
+			c.recorder.turn.Unlock()
+		}
+	}
+
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header. Should not happen, so if it does,
+			// shut down the connection to signal that the connection is broken.
+			log.Println("rpc: gob error encoding response:", err)
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header has been written.
+			// Shut down the connection to signal that the connection is broken.
+			log.Println("rpc: gob error encoding body:", err)
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *recordingCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// replayRecording feeds the requests of a recording into a fresh lock server (a new one for every
+// recorded start), one at a time in the order in which they were recorded with the clock of the
+// server set to the time of the call, and reports every response that differs from the recorded
+// one. Returns whether all responses matched.
+func replayRecording(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var recs []*rpcRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		rec := &rpcRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			// A killed server may leave a truncated record behind, which is skipped
+			log.Printf("Skipping invalid record on line %d: %v", line, err)
+			continue
+		}
+		recs = append(recs, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	log.Println("")
+	log.Printf("**STARTING** replay of %d records from %s", len(recs), path)
+	var l *lockServer
+	replayed, diverged := 0, 0
+	for i, rec := range recs {
+		if rec.Method == "" {
+			config := lockServerConfig()
+			config.Incarnation, config.Epoch = rec.Incarnation, rec.Epoch
+			l = newLockServer(config)
+			log.Printf("Server started (incarnation %d)", rec.Incarnation)
+			continue
+		}
+		if l == nil {
+			return false, fmt.Errorf("%s: record %d precedes the start of the server", path, i)
+		}
+		if !strings.HasPrefix(rec.Method, "Dsync.") || rec.Method == "Dsync.ConfirmExpired" {
+			// Only the lock service is replayed (not eg. gossip), without requests that call other servers
+			continue
+		}
+		clock.set(time.Unix(0, rec.Call))
+		reply, errMsg, err := replayRequest(l, rec)
+		if err != nil {
+			return false, fmt.Errorf("%s: record %d: %v", path, i, err)
+		}
+		replayed++
+		if errMsg != rec.Error || (rec.Error == "" && !bytes.Equal(reply, rec.Reply)) {
+			diverged++
+			log.Printf("Diverged at record %d: %s %s at %s", i, rec.Method, rec.Args, time.Unix(0, rec.Call).Format("15:04:05.000000"))
+			log.Printf("  recorded: reply %s, error %q", rec.Reply, rec.Error)
+			log.Printf("  replayed: reply %s, error %q", reply, errMsg)
+		}
+	}
+	clock.set(time.Now())
+
+	if diverged > 0 {
+		log.Printf("**FAILED** replay (%d of %d responses diverged)", diverged, replayed)
+		return false, nil
+	}
+	log.Printf("**PASSED** replay (%d responses)", replayed)
+	return true, nil
+}
+
+// replayRequest calls the handler of the recorded request on the lock server, returning its
+// reply as JSON and its error message.
+func replayRequest(l *lockServer, rec *rpcRecord) (reply json.RawMessage, errMsg string, err error) {
+	parts := strings.SplitN(rec.Method, ".", 2)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("Unknown service method %q", rec.Method)
+	}
+	method := reflect.ValueOf(l).MethodByName(parts[1])
+	if !method.IsValid() || method.Type().NumIn() != 2 || method.Type().NumOut() != 1 {
+		return nil, "", fmt.Errorf("Unknown service method %q", rec.Method)
+	}
+	args := reflect.New(method.Type().In(0).Elem())
+	if err := json.Unmarshal(rec.Args, args.Interface()); err != nil {
+		return nil, "", fmt.Errorf("Invalid arguments of %s: %v", rec.Method, err)
+	}
+	replyValue := reflect.New(method.Type().In(1).Elem())
+
+	done := make(chan error, 1)
+	go func() {
+		out := method.Call([]reflect.Value{args, replyValue})
+		err, _ := out[0].Interface().(error)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			errMsg = err.Error()
+		} else if reply, err = json.Marshal(replyValue.Interface()); err != nil {
+			return nil, "", err
+		}
+		return reply, errMsg, nil
+	case <-time.After(replayTimeout):
+		// Leave it blocked, as a later request may still release it
+		return nil, "(did not return within " + replayTimeout.String() + ")", nil
+	}
+}
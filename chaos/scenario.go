@@ -0,0 +1,288 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// States of a lock in a scenario
+const (
+	stateWaiting  = "waiting"
+	stateHeld     = "held"
+	stateReleased = "released"
+)
+
+// scenario is a declarative chaos run, loaded with -scenario from a JSON file such as
+//
+//	{
+//	  "name": "lock waits for quorum after a majority restarts",
+//	  "steps": [
+//	    { "at": "0s", "do": "lock", "id": "a", "name": "x" },
+//	    { "at": "500ms", "do": "expect", "id": "a", "state": "held" },
+//	    { "at": "1s", "do": "kill", "servers": [2, 3] },
+//	    { "at": "1s", "do": "partition", "servers": [1], "for": "3s" },
+//	    { "at": "1s", "do": "latency", "servers": [0], "delay": "exp:20ms", "for": "3s" },
+//	    { "at": "1500ms", "do": "unlock", "id": "a" },
+//	    { "at": "2s", "do": "lock", "id": "b", "name": "x" },
+//	    { "at": "3s", "do": "expect", "id": "b", "state": "waiting" },
+//	    { "at": "3s", "do": "restart", "servers": [2, 3] },
+//	    { "at": "6s", "do": "expect", "id": "b", "state": "held" }
+//	  ]
+//	}
+//
+// Steps run at their offset from the start of the scenario (steps at the same offset in the order
+// given). Servers are identified by index, 0 being the server within the chaos process itself
+// (which cannot be killed). A partition drops all requests to the servers, a latency spike delays
+// them by a distribution as taken by -fault-delay. Besides the expectations of the scenario, no
+// lock may ever be granted while a conflicting lock of the scenario is held.
+type scenario struct {
+	Name  string         `json:"name"`
+	Steps []scenarioStep `json:"steps"`
+}
+
+type scenarioStep struct {
+	At      scenarioDuration `json:"at"`      // Offset from the start of the scenario
+	Do      string           `json:"do"`      // One of lock, rlock, unlock, kill, restart, partition, latency or expect
+	ID      string           `json:"id"`      // Lock of lock, rlock, unlock and expect
+	Name    string           `json:"name"`    // Name of the lock of lock and rlock
+	Servers []int            `json:"servers"` // Servers of kill, restart, partition and latency
+	For     scenarioDuration `json:"for"`     // Duration of partition and latency
+	Delay   string           `json:"delay"`   // Delay distribution of latency
+	State   string           `json:"state"`   // Expected state of the lock: waiting, held or released
+}
+
+// scenarioDuration is a duration written as a string (eg. "1.5s") in scenario files.
+type scenarioDuration time.Duration
+
+func (d *scenarioDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = scenarioDuration(v)
+	return err
+}
+
+// loadScenario reads and validates a scenario file.
+func loadScenario(path string) (*scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &scenario{}
+	if err = json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(s.Steps, func(i, j int) bool { return s.Steps[i].At < s.Steps[j].At })
+
+	ids := make(map[string]bool)
+	for i, step := range s.Steps {
+		if err := step.validate(ids); err != nil {
+			return nil, fmt.Errorf("Step %d (%s at %v): %v", i+1, step.Do, time.Duration(step.At), err)
+		}
+	}
+	return s, nil
+}
+
+// validate checks a step, given the ids of the locks of the steps before it.
+func (step scenarioStep) validate(ids map[string]bool) error {
+	for _, index := range step.Servers {
+		if index < 0 || index >= n {
+			return fmt.Errorf("No server %d (want 0 to %d)", index, n-1)
+		}
+		if index == 0 && (step.Do == "kill" || step.Do == "restart") {
+			return fmt.Errorf("Server 0 runs the scenario and cannot be killed or restarted")
+		}
+	}
+	switch step.Do {
+	case "lock", "rlock":
+		if step.ID == "" || step.Name == "" || ids[step.ID] {
+			return fmt.Errorf("Needs a new id and a name")
+		}
+		ids[step.ID] = true
+	case "unlock":
+		if !ids[step.ID] {
+			return fmt.Errorf("Unknown lock %q", step.ID)
+		}
+	case "expect":
+		if !ids[step.ID] {
+			return fmt.Errorf("Unknown lock %q", step.ID)
+		}
+		if step.State != stateWaiting && step.State != stateHeld && step.State != stateReleased {
+			return fmt.Errorf("Unknown state %q (want %s, %s or %s)", step.State, stateWaiting, stateHeld, stateReleased)
+		}
+	case "kill", "restart":
+		if len(step.Servers) == 0 {
+			return fmt.Errorf("Needs servers")
+		}
+	case "partition", "latency":
+		if len(step.Servers) == 0 || step.For <= 0 {
+			return fmt.Errorf("Needs servers and a duration")
+		}
+		if step.Do == "latency" {
+			if _, err := parseFaultDelay(step.Delay); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown action")
+	}
+	return nil
+}
+
+// scenarioLock is a lock requested by a scenario.
+type scenarioLock struct {
+	name     string
+	readLock bool
+	dm       *recordedMutex
+	state    string
+}
+
+// scenarioRun tracks the locks of a running scenario and the failures found.
+type scenarioRun struct {
+	clnts    []dsync.RPC
+	mutex    sync.Mutex
+	locks    map[string]*scenarioLock
+	failures []string
+}
+
+func (r *scenarioRun) fail(format string, args ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	msg := fmt.Sprintf(format, args...)
+	log.Println("Scenario failure:", msg)
+	r.failures = append(r.failures, msg)
+}
+
+// runScenario runs s against the servers (clnts being the clients of all of them), returning
+// whether all expectations and invariants held.
+func runScenario(s *scenario, clnts []dsync.RPC) bool {
+	log.Println("")
+	log.Println("**STARTING** scenario", s.Name)
+
+	r := &scenarioRun{clnts: clnts, locks: make(map[string]*scenarioLock)}
+	start := time.Now()
+	for _, step := range s.Steps {
+		time.Sleep(time.Duration(step.At) - time.Since(start))
+		log.Printf("Step at %v: %s %s%v", time.Duration(step.At), step.Do, step.ID, step.Servers)
+		r.run(step)
+	}
+
+	if len(r.failures) > 0 {
+		log.Printf("**FAILED** scenario %s: %s", s.Name, strings.Join(r.failures, "; "))
+		return false
+	}
+	log.Println("**PASSED** scenario", s.Name)
+	return true
+}
+
+func (r *scenarioRun) run(step scenarioStep) {
+	switch step.Do {
+	case "lock", "rlock":
+		lock := &scenarioLock{name: step.Name, readLock: step.Do == "rlock", dm: newDRWMutex(step.Name), state: stateWaiting}
+		r.mutex.Lock()
+		r.locks[step.ID] = lock
+		r.mutex.Unlock()
+		go r.acquire(step.ID, lock)
+	case "unlock":
+		r.mutex.Lock()
+		lock := r.locks[step.ID]
+		held := lock.state == stateHeld
+		if held {
+			lock.state = stateReleased
+		}
+		r.mutex.Unlock()
+		if !held {
+			r.fail("Unlock of %s while %s", step.ID, lock.state)
+		} else if lock.readLock {
+			lock.dm.RUnlock()
+		} else {
+			lock.dm.Unlock()
+		}
+	case "expect":
+		r.mutex.Lock()
+		state := r.locks[step.ID].state
+		r.mutex.Unlock()
+		if state != step.State {
+			r.fail("Expected %s to be %s at %v, but it is %s", step.ID, step.State, time.Duration(step.At), state)
+		}
+	case "kill":
+		for _, index := range step.Servers {
+			if servers[index] == nil {
+				r.fail("Server %d is not running", index)
+				continue
+			}
+			killProcess(servers[index])
+			servers[index] = nil
+		}
+	case "restart":
+		for _, index := range step.Servers {
+			if servers[index] != nil {
+				r.fail("Server %d is still running", index)
+				continue
+			}
+			servers[index] = launchTestServers(index, 1)[0]
+		}
+	case "partition":
+		r.injectFaults(step.Servers, &FaultArgs{Drop: "*=100", Duration: time.Duration(step.For)})
+	case "latency":
+		r.injectFaults(step.Servers, &FaultArgs{Delay: "*=" + step.Delay, Duration: time.Duration(step.For)})
+	}
+}
+
+// acquire waits for a lock of the scenario, verifying that no conflicting lock is held when granted.
+func (r *scenarioRun) acquire(id string, lock *scenarioLock) {
+	if lock.readLock {
+		lock.dm.RLock()
+	} else {
+		lock.dm.Lock()
+	}
+	r.mutex.Lock()
+	lock.state = stateHeld
+	var conflicts []string
+	for other, l := range r.locks {
+		if other != id && l.name == lock.name && l.state == stateHeld && (!lock.readLock || !l.readLock) {
+			conflicts = append(conflicts, other)
+		}
+	}
+	r.mutex.Unlock()
+	log.Printf("Acquired %s (%s)", id, lock.name)
+	if len(conflicts) > 0 {
+		r.fail("Mutual exclusion violated: %s granted while %s held", id, strings.Join(conflicts, ", "))
+	}
+}
+
+func (r *scenarioRun) injectFaults(indices []int, args *FaultArgs) {
+	for _, index := range indices {
+		var ok bool
+		if err := r.clnts[index].Call(context.Background(), "Dsync.InjectFaults", args, &ok); err != nil {
+			r.fail("Unable to inject faults into server %d: %v", index, err)
+		}
+	}
+}
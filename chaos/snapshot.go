@@ -0,0 +1,46 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/minio/dsync"
+)
+
+// dumpSnapshotOnSignal writes a snapshot of the lock map to path whenever SIGUSR1 is received,
+// for point-in-time debugging of a running server.
+func (l *lockServer) dumpSnapshotOnSignal(path string) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	go func() {
+		for range c {
+			data, err := l.Snapshot()
+			if err == nil {
+				err = ioutil.WriteFile(path, data, 0644)
+			}
+			if err != nil {
+				logger.Log(dsync.LogError, "Unable to dump snapshot", "err", err)
+			} else {
+				logger.Log(dsync.LogInfo, "Dumped snapshot", "path", path)
+			}
+		}
+	}()
+}
@@ -0,0 +1,262 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/dsync"
+	"github.com/minio/dsync/server"
+)
+
+const (
+	soakUniqueWorkers = 2                // Number of clients locking names that are used only once, besides the churn clients
+	soakMaxLocks      = 1000             // Number of locks a server may hold at any time before it counts as leaking
+	soakSettle        = 30 * time.Second // Time the servers get to drop all locks once the clients have stopped
+)
+
+// UsageArgs - arguments of the Usage rpc handler.
+type UsageArgs struct {
+	Token     string
+	Timestamp time.Time
+}
+
+func (u *UsageArgs) SetToken(token string) {
+	u.Token = token
+}
+
+func (u *UsageArgs) SetTimestamp(tstamp time.Time) {
+	u.Timestamp = tstamp
+}
+
+// ServerUsage is the resource usage of a lock server, as tracked by soak runs.
+type ServerUsage struct {
+	Names      int    // Number of names locks are held on
+	Entries    int    // Number of locks held
+	Unlocked   int    // Number of unlocks remembered to deduplicate retries
+	Clients    int    // Number of clients remembered
+	Goroutines int    // Number of goroutines of the process
+	HeapAlloc  uint64 // Bytes of heap allocated by the process
+}
+
+// Usage - rpc handler for the resource usage of the lock server.
+func (l *lockServer) Usage(args *UsageArgs, reply *ServerUsage) error {
+	usage, err := l.stats()
+	if err != nil {
+		return err
+	}
+	reply.Names, reply.Entries = usage.Names, usage.WriteLocks+usage.ReadLocks
+	reply.Unlocked, reply.Clients = usage.Unlocks, usage.Clients
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	reply.Goroutines, reply.HeapAlloc = runtime.NumGoroutine(), stats.HeapAlloc
+	return nil
+}
+
+// soakRun tracks the resource usage of the servers during a soak run.
+type soakRun struct {
+	clnts      []*server.Client
+	baseline   []*ServerUsage // Usage of every server once warmed up
+	violations []string
+}
+
+// sample fetches the usage of all servers, logging it together with the activity of the clients
+// since the previous sample. Unless faults may still be affecting the servers (as requests dropped
+// by them are held for a while), a violation is recorded for every threshold exceeded.
+func (s *soakRun) sample(elapsed time.Duration, grants, failed int64, quiet bool) {
+	var locks, goroutines, heap []string
+	for i, c := range s.clnts {
+		var usage ServerUsage
+		if err := c.Call(context.Background(), "Dsync.Usage", &UsageArgs{}, &usage); err != nil {
+			log.Printf("Unable to get usage of server %d: %v", i, err)
+			locks, goroutines, heap = append(locks, "?"), append(goroutines, "?"), append(heap, "?")
+			continue
+		}
+		locks = append(locks, strconv.Itoa(usage.Entries))
+		goroutines = append(goroutines, strconv.Itoa(usage.Goroutines))
+		heap = append(heap, fmt.Sprintf("%.1fMB", float64(usage.HeapAlloc)/(1<<20)))
+		if usage.Entries > soakMaxLocks {
+			s.violations = append(s.violations, fmt.Sprintf("Server %d holds %d locks (at most %d expected)", i, usage.Entries, soakMaxLocks))
+		}
+		if !quiet {
+			continue
+		} else if s.baseline[i] == nil {
+			s.baseline[i] = &usage
+		} else {
+			s.check(i, &usage)
+		}
+	}
+	errorRate := 0.0
+	if grants+failed > 0 {
+		errorRate = float64(failed) / float64(grants+failed)
+	}
+	log.Printf("Soak %v: %d locks granted, %.1f%% failed rounds; locks held %s, goroutines %s, heap %s",
+		elapsed.Truncate(time.Second), grants, 100*errorRate, strings.Join(locks, "/"), strings.Join(goroutines, "/"), strings.Join(heap, "/"))
+}
+
+// check records a violation for every threshold of growth exceeded by the usage of server index.
+func (s *soakRun) check(index int, usage *ServerUsage) {
+	base := s.baseline[index]
+	if growth := usage.Goroutines - base.Goroutines; growth > *soakMaxGoroutinesFlag {
+		s.violations = append(s.violations, fmt.Sprintf("Goroutines of server %d grew by %d (from %d to %d)", index, growth, base.Goroutines, usage.Goroutines))
+	}
+	if growth := int64(usage.HeapAlloc) - int64(base.HeapAlloc); growth > int64(*soakMaxHeapFlag)<<20 {
+		s.violations = append(s.violations, fmt.Sprintf("Heap of server %d grew by %.1fMB (from %.1fMB to %.1fMB)", index,
+			float64(growth)/(1<<20), float64(base.HeapAlloc)/(1<<20), float64(usage.HeapAlloc)/(1<<20)))
+	}
+}
+
+// uniqueWorker keeps locking names that are used only once until stopped, so that leaks of names
+// show up in the lock map.
+func uniqueWorker(index int, seed int64, grants *int64, stop chan struct{}) {
+	random := rand.New(rand.NewSource(seed))
+	for i := 0; ; i++ {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		dm := newDRWMutex(fmt.Sprintf("soak-%d-%d-%d", index, seed, i))
+		readLock := random.Intn(2) == 0
+		if readLock {
+			dm.RLock()
+		} else {
+			dm.Lock()
+		}
+		atomic.AddInt64(grants, 1)
+		time.Sleep(time.Duration(random.Int63n(int64(10 * time.Millisecond))))
+		if readLock {
+			dm.RUnlock()
+		} else {
+			dm.Unlock()
+		}
+	}
+}
+
+// runSoak runs the churn clients together with clients locking unique names for duration, while
+// injecting faults into a random server every faultInterval, sampling the resource usage of the
+// servers every sampleInterval. Returns whether no threshold was exceeded, no conflicting locks
+// were granted and all servers dropped their locks once the clients stopped.
+func runSoak(duration, sampleInterval, faultInterval time.Duration, seed int64) bool {
+	log.Println("")
+	log.Printf("**STARTING** soak for %v", duration)
+
+	counter := &roundCounter{}
+	dsync.SetLogger(counter)
+	s := &soakRun{baseline: make([]*ServerUsage, n)}
+	for i := 0; i < n; i++ {
+		s.clnts = append(s.clnts, newClient(fmt.Sprintf("127.0.0.1:%d", portStart+i), dsync.RpcPath+"-"+strconv.Itoa(portStart+i)))
+	}
+
+	r := newChurnRun()
+	stop := r.start(seed)
+	var uniqueGrants int64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < soakUniqueWorkers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			uniqueWorker(i, seed, &uniqueGrants, done)
+		}(i)
+	}
+	grants := func() int64 {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		return int64(r.acquired) + atomic.LoadInt64(&uniqueGrants)
+	}
+
+	random := rand.New(rand.NewSource(seed))
+	start := time.Now()
+	samples, faults := time.NewTicker(sampleInterval), time.NewTicker(faultInterval)
+	defer samples.Stop()
+	defer faults.Stop()
+	var lastGrants, lastFailed int64
+	var faultsAffectUntil time.Time // Time until which requests dropped by injected faults may be held
+	for time.Since(start) < duration && len(s.violations) == 0 {
+		select {
+		case <-samples.C:
+			g, f := grants(), atomic.LoadInt64(&counter.failed)
+			s.sample(time.Since(start), g-lastGrants, f-lastFailed, time.Now().After(faultsAffectUntil))
+			lastGrants, lastFailed = g, f
+		case <-faults.C:
+			index := random.Intn(n)
+			log.Printf("Injecting faults into server %d for %v", index, faultInterval/4)
+			var ok bool
+			// Only lock requests are dropped: dsync retries a lost release for hours (first after 30s),
+			// which would show up as growth of the goroutines of this process, hosting the clients
+			args := &FaultArgs{Drop: "Lock=20,RLock=20", Delay: "*=exp:5ms", Duration: faultInterval / 4}
+			if err := s.clnts[index].Call(context.Background(), "Dsync.InjectFaults", args, &ok); err != nil {
+				log.Printf("Unable to inject faults into server %d: %v", index, err)
+			}
+			faultsAffectUntil = time.Now().Add(faultInterval/4 + faultDropHold)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+	stop()
+	time.Sleep(time.Until(faultsAffectUntil))
+
+	// Once the clients have stopped, every server must drop all locks (purging those whose
+	// release was lost) and get back to its goroutines and heap from before
+	var usages []*ServerUsage
+	for deadline := time.Now().Add(soakSettle); len(s.violations) == 0; time.Sleep(time.Second) {
+		var held []string
+		usages = make([]*ServerUsage, n)
+		for i, c := range s.clnts {
+			usage := &ServerUsage{}
+			if err := c.Call(context.Background(), "Dsync.Usage", &UsageArgs{}, usage); err != nil {
+				held = append(held, fmt.Sprintf("Unable to get usage of server %d: %v", i, err))
+			} else if usage.Entries > 0 || usage.Names > 0 {
+				held = append(held, fmt.Sprintf("Server %d still holds %d locks on %d names after the clients stopped", i, usage.Entries, usage.Names))
+			}
+			usages[i] = usage
+		}
+		if len(held) == 0 {
+			for i, usage := range usages {
+				if s.baseline[i] != nil {
+					s.check(i, usage)
+				}
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			s.violations = append(s.violations, held...)
+		}
+	}
+
+	total := grants()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s.violations = append(s.violations, r.violations...)
+	if len(s.violations) > 0 {
+		log.Printf("**FAILED** soak: %s", strings.Join(s.violations, "; "))
+		return false
+	}
+	log.Printf("**PASSED** soak for %v (%d locks granted)", time.Since(start).Truncate(time.Second), total)
+	return true
+}
@@ -0,0 +1,219 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Path the verifier serves its rpc handlers on
+const verifierPath = "/verifier"
+
+// ResourceArgs identifies a client entering or leaving the shared resource of a lock name.
+type ResourceArgs struct {
+	Name   string
+	Client string // Unique per client of all workloads, eg. <pid>/<index>
+	Write  bool   // Entered under a write lock (rather than a read lock)
+}
+
+// resourceHolder is a client holding the shared resource of a name since a time.
+type resourceHolder struct {
+	client string
+	write  bool
+	since  time.Time
+}
+
+func (h resourceHolder) String() string {
+	if h.write {
+		return h.client + " (writer)"
+	}
+	return h.client + " (reader)"
+}
+
+// resourceOverlap is a violation that is still going on, two conflicting holders of the resource.
+type resourceOverlap struct {
+	name  string
+	a, b  resourceHolder
+	start time.Time
+}
+
+// verifier owns the shared resources that clients enter once they hold the lock on its name and
+// leave before releasing the lock, checking at all times that a resource has at most one writer
+// and never a writer together with readers. Every overlap of conflicting holders is reported
+// with the interval during which both held the resource.
+type verifier struct {
+	mutex      sync.Mutex
+	holders    map[string][]resourceHolder
+	overlaps   []resourceOverlap
+	entered    int
+	violations []string
+}
+
+func newVerifier() *verifier {
+	return &verifier{holders: make(map[string][]resourceHolder)}
+}
+
+// Enter - rpc handler for a client entering the shared resource of a name.
+func (v *verifier) Enter(args *ResourceArgs, reply *bool) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	now := time.Now()
+	holder := resourceHolder{client: args.Client, write: args.Write, since: now}
+	for _, h := range v.holders[args.Name] {
+		if h.write || holder.write {
+			log.Printf("Violation on %s: %v entered while held by %v", args.Name, holder, h)
+			v.overlaps = append(v.overlaps, resourceOverlap{name: args.Name, a: h, b: holder, start: now})
+		}
+	}
+	v.holders[args.Name] = append(v.holders[args.Name], holder)
+	v.entered++
+	*reply = true
+	return nil
+}
+
+// Leave - rpc handler for a client leaving the shared resource of a name, closing the interval
+// of every overlap it was part of.
+func (v *verifier) Leave(args *ResourceArgs, reply *bool) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	holders := v.holders[args.Name]
+	for i, h := range holders {
+		if h.client == args.Client {
+			holders = append(holders[:i], holders[i+1:]...)
+			break
+		}
+	}
+	if len(holders) == 0 {
+		delete(v.holders, args.Name)
+	} else {
+		v.holders[args.Name] = holders
+	}
+	v.closeOverlaps(func(o resourceOverlap) bool {
+		return o.name == args.Name && (o.a.client == args.Client || o.b.client == args.Client)
+	}, time.Now())
+	*reply = true
+	return nil
+}
+
+// closeOverlaps reports the overlaps matching as violations ending at end, should be called with
+// the mutex held.
+func (v *verifier) closeOverlaps(matching func(resourceOverlap) bool, end time.Time) {
+	open := v.overlaps[:0]
+	for _, o := range v.overlaps {
+		if !matching(o) {
+			open = append(open, o)
+			continue
+		}
+		msg := fmt.Sprintf("%s held by %v and %v from %s to %s (%v)", o.name, o.a, o.b,
+			o.start.Format("15:04:05.000000"), end.Format("15:04:05.000000"), end.Sub(o.start))
+		log.Println("Violation:", msg)
+		v.violations = append(v.violations, msg)
+	}
+	v.overlaps = open
+}
+
+// runVerifier serves the verifier on addr until terminated, returning whether no violation was
+// found (overlaps still going on are reported as ending at termination).
+func runVerifier(addr string) bool {
+	log.SetPrefix("[verifier] ")
+	log.SetFlags(log.Lmicroseconds)
+
+	v := newVerifier()
+	server := rpc.NewServer()
+	server.RegisterName("Verifier", v)
+	server.HandleHTTP(verifierPath, verifierPath+"-debug")
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("listen error:", err)
+	}
+	log.Println("Verifier listening on", addr)
+	go http.Serve(l, rpcHandler)
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, os.Interrupt)
+	<-c
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.closeOverlaps(func(resourceOverlap) bool { return true }, time.Now())
+	if len(v.violations) > 0 {
+		log.Printf("**FAILED** verifier (%d violations in %d entries)", len(v.violations), v.entered)
+		return false
+	}
+	log.Printf("**PASSED** verifier (%d entries)", v.entered)
+	return true
+}
+
+// resourceClient enters and leaves shared resources on the verifier.
+type resourceClient struct {
+	mutex sync.Mutex
+	addr  string
+	rpc   *rpc.Client
+}
+
+func newResourceClient(addr string) *resourceClient {
+	return &resourceClient{addr: addr}
+}
+
+func (c *resourceClient) call(method, name, client string, write bool) error {
+	c.mutex.Lock()
+	if c.rpc == nil {
+		var err error
+		if c.rpc, err = rpc.DialHTTPPath("tcp", c.addr, verifierPath); err != nil {
+			c.mutex.Unlock()
+			return err
+		}
+	}
+	rpcClient := c.rpc
+	c.mutex.Unlock()
+
+	var reply bool
+	err := rpcClient.Call("Verifier."+method, &ResourceArgs{Name: name, Client: client, Write: write}, &reply)
+	if err == rpc.ErrShutdown {
+		c.mutex.Lock()
+		if c.rpc == rpcClient {
+			c.rpc = nil // Redial on the next call
+		}
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+// enter enters the resource of name, a nil resourceClient does nothing.
+func (c *resourceClient) enter(name, client string, write bool) error {
+	if c == nil {
+		return nil
+	}
+	return c.call("Enter", name, client, write)
+}
+
+// leave leaves the resource of name, a nil resourceClient does nothing.
+func (c *resourceClient) leave(name, client string, write bool) error {
+	if c == nil {
+		return nil
+	}
+	return c.call("Leave", name, client, write)
+}
@@ -0,0 +1,90 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Prefix of the line with the summary of a workload process, as parsed by dsync-chaos
+const workloadSummaryPrefix = "WORKLOAD "
+
+// workloadSummary is printed by a workload process once its clients have finished.
+type workloadSummary struct {
+	Acquired     int               `json:"acquired"`     // Number of locks granted
+	FailedRounds int64             `json:"failedRounds"` // Number of attempts to acquire a lock that did not reach quorum
+	Latency      *latencyHistogram `json:"latency"`      // Time taken to acquire the locks
+	Grants       map[string]int    `json:"grants"`       // Number of locks granted per client
+	Violations   []string          `json:"violations,omitempty"`
+	Seconds      float64           `json:"seconds"`
+}
+
+// roundCounter - a dsync.Logger that counts the attempts to acquire a lock that failed.
+type roundCounter struct {
+	failed int64
+}
+
+func (c *roundCounter) Log(level dsync.LogLevel, msg string, keysAndValues ...interface{}) {
+	if msg == "Unable to acquire lock" {
+		atomic.AddInt64(&c.failed, 1)
+	}
+}
+
+// runWorkload runs the clients of a churn run for duration as a separate process (without serving
+// locks itself), attached to the server at port as their own node, and prints a summary line.
+func runWorkload(port int, duration time.Duration, seed int64) bool {
+	var clnts []dsync.RPC
+	for i := 0; i < n; i++ {
+		clnts = append(clnts, newClient(fmt.Sprintf("127.0.0.1:%d", portStart+i), dsync.RpcPath+"-"+strconv.Itoa(portStart+i)))
+	}
+	if err := dsync.SetNodesWithClients(clnts, getSelfNode(clnts, port)); err != nil {
+		log.Fatalf("set nodes failed with %v", err)
+	}
+	if err := dsync.SetByzantineTolerance(*byzantineToleranceFlag); err != nil {
+		log.Fatalln("Invalid flags:", err)
+	}
+	dsync.SetEpoch(*epochFlag)
+	dsync.SetTwoPhase(*twoPhaseFlag)
+	counter := &roundCounter{}
+	dsync.SetLogger(counter)
+
+	start := time.Now()
+	r := newChurnRun()
+	stop := r.start(seed)
+	time.Sleep(duration)
+	stop()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	summary, _ := json.Marshal(workloadSummary{
+		Acquired:     r.acquired,
+		FailedRounds: atomic.LoadInt64(&counter.failed),
+		Latency:      r.latency,
+		Grants:       r.grants,
+		Violations:   r.violations,
+		Seconds:      time.Since(start).Seconds(),
+	})
+	fmt.Println(workloadSummaryPrefix + string(summary))
+	return len(r.violations) == 0
+}
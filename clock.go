@@ -0,0 +1,59 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Clock - the source of time for the timeouts and back-offs of DRWMutexes and for the LocalLocker,
+// so that a simulation can run them on a virtual clock instead of sleeping for real.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// Clock of this client (wrapped, as an atomic.Value only holds values of a single type)
+var dclock atomic.Value
+
+type clockValue struct {
+	Clock
+}
+
+// SetClock - replaces the clock used by dsync (the wall clock by default), nil restores the wall clock.
+// N B - This function should be called before any locking.
+func SetClock(c Clock) {
+	if c == nil {
+		c = realClock{}
+	}
+	dclock.Store(clockValue{c})
+}
+
+func getClock() Clock {
+	if c, ok := dclock.Load().(clockValue); ok {
+		return c.Clock
+	}
+	return realClock{}
+}
@@ -0,0 +1,143 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrDeadlock - returned by a lock server for a request that has been aborted to break a deadlock.
+var ErrDeadlock = errors.New("Deadlock detected, lock request aborted")
+
+// WaitForEdge - a single lock held by (or waited for by) an owner.
+type WaitForEdge struct {
+	Owner     string
+	Namespace string
+	Name      string
+	Since     time.Time // Time at which the lock was granted (or the owner started waiting for it)
+}
+
+// WaitForGraph - reply of the WaitForGraph rpc call of a lock server, listing which owners
+// hold which locks and which owners are waiting for which locks on that server.
+type WaitForGraph struct {
+	Holds []WaitForEdge
+	Waits []WaitForEdge
+}
+
+type lockRef struct {
+	namespace, name string
+}
+
+// FindDeadlocks - merges the wait-for graphs of all lock servers and returns, for every cycle of
+// owners waiting for each other, the youngest of the waits in the cycle as the one to abort.
+func FindDeadlocks(graphs []WaitForGraph) []WaitForEdge {
+
+	holders := make(map[lockRef]map[string]bool)
+	waits := make(map[string]map[lockRef]WaitForEdge) // Waits per owner, keeping the oldest report
+	for _, g := range graphs {
+		for _, h := range g.Holds {
+			ref := lockRef{h.Namespace, h.Name}
+			if holders[ref] == nil {
+				holders[ref] = make(map[string]bool)
+			}
+			holders[ref][h.Owner] = true
+		}
+		for _, w := range g.Waits {
+			ref := lockRef{w.Namespace, w.Name}
+			if waits[w.Owner] == nil {
+				waits[w.Owner] = make(map[lockRef]WaitForEdge)
+			}
+			if cur, ok := waits[w.Owner][ref]; !ok || w.Since.Before(cur.Since) {
+				waits[w.Owner][ref] = w
+			}
+		}
+	}
+
+	victims := []WaitForEdge{}
+	for {
+		cycle := findCycle(holders, waits)
+		if cycle == nil {
+			return victims
+		}
+		youngest := cycle[0]
+		for _, w := range cycle[1:] {
+			if w.Since.After(youngest.Since) {
+				youngest = w
+			}
+		}
+		victims = append(victims, youngest)
+		delete(waits[youngest.Owner], lockRef{youngest.Namespace, youngest.Name})
+	}
+}
+
+// findCycle returns the waits making up a cycle in the graph of owners waiting for the
+// holders of locks, or nil when there is none.
+func findCycle(holders map[lockRef]map[string]bool, waits map[string]map[lockRef]WaitForEdge) []WaitForEdge {
+
+	// Visit owners in a deterministic order
+	owners := make([]string, 0, len(waits))
+	for owner := range waits {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+
+	const (
+		unvisited = iota
+		onPath
+		done
+	)
+	state := make(map[string]int)
+	path := []WaitForEdge{} // Waits along the current path of the depth-first search
+	var visit func(owner string) []WaitForEdge
+	visit = func(owner string) []WaitForEdge {
+		state[owner] = onPath
+		for _, w := range waits[owner] {
+			for holder := range holders[lockRef{w.Namespace, w.Name}] {
+				if holder == owner {
+					continue
+				}
+				path = append(path, w)
+				switch state[holder] {
+				case onPath:
+					// Found a cycle, consisting of the waits since holder was entered
+					for i := range path {
+						if path[i].Owner == holder {
+							return append([]WaitForEdge{}, path[i:]...)
+						}
+					}
+				case unvisited:
+					if cycle := visit(holder); cycle != nil {
+						return cycle
+					}
+				}
+				path = path[:len(path)-1]
+			}
+		}
+		state[owner] = done
+		return nil
+	}
+	for _, owner := range owners {
+		if state[owner] == unvisited {
+			if cycle := visit(owner); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
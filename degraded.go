@@ -0,0 +1,140 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DegradedPolicy - what acquiring a lock does once a quorum of the nodes has been unreachable for
+// a while, see SetDegradedMode.
+type DegradedPolicy int
+
+const (
+	// DegradedBlock - keep trying until a quorum of the nodes is reachable again (the default).
+	DegradedBlock DegradedPolicy = iota
+	// DegradedFailFast - give up with ErrQuorumUnreachable. Lock and RLock, which cannot fail,
+	// keep trying.
+	DegradedFailFast
+	// DegradedLocal - grant the lock within this process only, excluding the other holders of this
+	// process but not those of other processes, and report it (see SetDegradedMode).
+	DegradedLocal
+)
+
+// Prefix of the uids of the locks granted within this process only, under DegradedLocal
+const localOnlyPrefix = "local-only-"
+
+// State of the degraded mode
+var degraded = struct {
+	sync.Mutex
+	policy      DegradedPolicy
+	after       time.Duration
+	report      func(LockEvent)
+	unreachable time.Time    // Time since which a quorum of the nodes has been unreachable, zero while reachable
+	locker      *LocalLocker // Grants the locks under DegradedLocal
+}{locker: NewLocalLocker("", "")}
+
+// SetDegradedMode - sets what acquiring a lock does once a quorum of the nodes has been unreachable
+// (as opposed to denying the lock) for at least after: keep trying (DegradedBlock, the default),
+// give up (DegradedFailFast) or grant the lock within this process only (DegradedLocal). Every lock
+// granted within this process only is reported to report, or logged as an error when report is nil.
+// Such a lock stays local until it is unlocked, also when a quorum becomes reachable again, and
+// until then keeps this process from acquiring conflicting locks on the name by quorum.
+func SetDegradedMode(policy DegradedPolicy, after time.Duration, report func(LockEvent)) {
+	degraded.Lock()
+	defer degraded.Unlock()
+	degraded.policy, degraded.after, degraded.report = policy, after, report
+}
+
+// reachedQuorum records that a quorum of the nodes was reachable.
+func reachedQuorum() {
+	degraded.Lock()
+	defer degraded.Unlock()
+	degraded.unreachable = time.Time{}
+}
+
+// degradedPolicy records the outcome of a failed attempt to acquire a lock, returning the policy
+// that applies (DegradedBlock unless a quorum of the nodes has been unreachable for long enough).
+func degradedPolicy(attempt *QuorumError, isReadLock bool) DegradedPolicy {
+	answered := make(map[string]bool)
+	for _, node := range append(append([]string(nil), attempt.Granted...), attempt.Denied...) {
+		answered[node] = true
+	}
+	weight := 0
+	for index, c := range clnts {
+		if answered[c.Node()] {
+			weight += dnodeWeights[index]
+		}
+	}
+	quorum := dquorum
+	if isReadLock {
+		quorum = dquorumReads
+	}
+
+	degraded.Lock()
+	defer degraded.Unlock()
+	now := getClock().Now()
+	if weight >= quorum {
+		degraded.unreachable = time.Time{}
+		return DegradedBlock
+	}
+	if degraded.unreachable.IsZero() {
+		degraded.unreachable = now
+	}
+	if now.Sub(degraded.unreachable) < degraded.after {
+		return DegradedBlock
+	}
+	return degraded.policy
+}
+
+// lockLocally tries to grant a lock on name within this process only until deadline, returning
+// its uid (empty when not granted). It excludes the other locks granted within this process only,
+// the locks held by quorum are excluded once it is registered (see acquiredUnlessConflicting).
+func lockLocally(ctx context.Context, name string, isReadLock bool, deadline time.Time) string {
+	if uid := degraded.locker.acquire(ctx, getNamespace(), name, isReadLock, deadline); isLocked(uid) {
+		return localOnlyPrefix + uid
+	}
+	return ""
+}
+
+// grantedLocally reports a lock granted within this process only.
+func grantedLocally(ev LockEvent) {
+	degraded.Lock()
+	report := degraded.report
+	degraded.Unlock()
+	if report != nil {
+		report(ev)
+		return
+	}
+	logf(LogError, "Quorum unreachable, lock granted within this process only", "name", ev.Name, "readLock", ev.ReadLock)
+}
+
+// isLocalOnly returns whether uid is the uid of a lock granted within this process only.
+func isLocalOnly(uid string) bool {
+	return strings.HasPrefix(uid, localOnlyPrefix)
+}
+
+// unlockLocally releases a lock granted within this process only.
+func unlockLocally(name, uid string, isReadLock bool) {
+	if err := degraded.locker.unlockDirect(getNamespace(), name, strings.TrimPrefix(uid, localOnlyPrefix), isReadLock); err != nil {
+		logf(LogWarn, "Unable to unlock", "name", name, "err", err)
+		dmetrics.unlockFailed()
+	}
+}
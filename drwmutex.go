@@ -17,39 +17,90 @@
 package dsync
 
 import (
+	"context"
 	cryptorand "crypto/rand"
-	"fmt"
-	"log"
-	"math"
-	"math/rand"
+	"errors"
 	"net"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Indicator if logging is enabled.
-var dsyncLog bool
-
-func init() {
-	// Check for DSYNC_LOG env variable, if set logging will be enabled for failed RPC operations.
-	dsyncLog = os.Getenv("DSYNC_LOG") == "1"
-}
-
-// DRWMutexAcquireTimeout - tolerance limit to wait for lock acquisition before.
+// DRWMutexAcquireTimeout - tolerance limit to wait for lock acquisition before (the default
+// time that an attempt waits for the answers of the nodes, see SetAttemptTimeout).
 const DRWMutexAcquireTimeout = 25 * time.Millisecond // 25ms.
 
 // A DRWMutex is a distributed mutual exclusion lock.
 type DRWMutex struct {
 	Name         string
-	writeLocks   []string   // Array of nodes that granted a write lock
-	readersLocks [][]string // Array of array of nodes that granted reader locks
-	m            sync.Mutex // Mutex to prevent multiple simultaneous locks from this node
+	Owner        string       // Actor the lock is acquired for, for deadlock detection (defaults to the node)
+	writeLocks   []string     // Array of nodes that granted a write lock
+	readersLocks [][]string   // Array of array of nodes that granted reader locks
+	lastErr      error        // Error that caused the most recent lock round to fail (if any)
+	lastAttempt  *QuorumError // Outcome at every node of the most recent lock round, when it failed
+	hold         *heldLock    // The lock most recently acquired, see Lost and Revoked
+	m            sync.Mutex   // Mutex to prevent multiple simultaneous locks from this node
+	stats        statsCollector
 }
 
 type Granted struct {
 	index   int
 	lockUid string // Locked if set with UID string, unlocked if empty
+	err     error  // Error returned by the node (if any)
+}
+
+// lockRound is the state of a round of lock requests to all nodes. It is pooled to spare the
+// allocations of every round, as the number of nodes never changes.
+type lockRound struct {
+	ch      chan Granted // Answers of the nodes
+	args    []LockArgs   // Request to every node
+	locked  []bool       // Reply of every node
+	grants  []Granted    // Answers received before the round was decided
+	answers []*Granted   // Pointing into grants (or at the outcome of a commit), nil for nodes that did not answer in time
+	order   []int        // Index of the nodes in order of answering
+	decided sync.WaitGroup
+	refs    int32 // Released by lock and by the goroutine collecting the answers
+}
+
+var lockRounds = sync.Pool{New: func() interface{} {
+	return &lockRound{
+		ch:      make(chan Granted, dnodeCount),
+		args:    make([]LockArgs, dnodeCount),
+		locked:  make([]bool, dnodeCount),
+		grants:  make([]Granted, dnodeCount),
+		answers: make([]*Granted, dnodeCount),
+		order:   make([]int, 0, dnodeCount),
+	}
+}}
+
+func getLockRound() *lockRound {
+	round := lockRounds.Get().(*lockRound)
+	round.refs = 2
+	for index := range round.answers {
+		round.answers[index] = nil
+	}
+	round.order = round.order[:0]
+	return round
+}
+
+// release returns the round to the pool once both lock and the goroutine collecting the answers
+// (which outlives lock to release late grants) are done with it.
+func (round *lockRound) release() {
+	if atomic.AddInt32(&round.refs, -1) == 0 {
+		lockRounds.Put(round)
+	}
+}
+
+// newUID returns a random uid for a lock request, as 32 upper case hexadecimal digits.
+func newUID() string {
+	const digits = "0123456789ABCDEF"
+	var random [16]byte
+	cryptorand.Read(random[:])
+	var uid [32]byte
+	for i, b := range random {
+		uid[2*i], uid[2*i+1] = digits[b>>4], digits[b&0xf]
+	}
+	return string(uid[:])
 }
 
 func (g *Granted) isLocked() bool {
@@ -61,12 +112,28 @@ func isLocked(uid string) bool {
 }
 
 type LockArgs struct {
-	Token     string
-	Timestamp time.Time
-	Name      string
-	Node      string
-	RPCPath   string
-	UID       string
+	Token         string
+	Timestamp     time.Time
+	Incarnation   uint64 // Incarnation of the lock server the request is addressed to
+	Namespace     string // Namespace that Name belongs to, see SetNamespace
+	Name          string
+	Source        Identity // Client the request comes from, called back by lock servers (see Resolver)
+	Owner         string   // Actor on whose behalf the lock is requested, for deadlock detection (the node when empty)
+	UID           string
+	Epoch         uint64
+	Version       uint32
+	WaitTimeout   time.Duration // Time the server may park a LockWait, RLockWait or Watch request
+	Reservation   time.Duration // Time a PrepareLock or PrepareRLock reservation is held unless committed
+	TraceContext  string        // Context of the span of the request at the client (W3C traceparent), empty when not traced
+	Names         []string      // Names locked or unlocked at once by LockBatch and UnlockBatch (instead of Name)
+	Retainable    bool          // Set when the client may retain the lock, so that it is called back (Revoke) when the lock is denied to someone else
+	Persist       time.Duration // TTL of a LockPersistent lock, or the TTL it is held for from a TakeOver (see PersistentLock)
+	Grace         time.Duration // Time the holder has to release the lock when asked to by RequestRevocation
+	RecoveryToken string        // Secret that a TakeOver of a persistent lock must present, as set by its LockPersistent
+
+	// Source of requests of protocol version 2, see SetVersion and Upgrade
+	Node    string
+	RPCPath string
 }
 
 func (l *LockArgs) SetToken(token string) {
@@ -77,6 +144,73 @@ func (l *LockArgs) SetTimestamp(tstamp time.Time) {
 	l.Timestamp = tstamp
 }
 
+func (l *LockArgs) SetIncarnation(incarnation uint64) {
+	l.Incarnation = incarnation
+}
+
+// SetVersion - sets the protocol version of the request, filling in the fields that lock servers of
+// that version expect (Node and RPCPath for version 2).
+func (l *LockArgs) SetVersion(version uint32) {
+	l.Version = version
+	l.Node, l.RPCPath = "", ""
+	if version < 3 {
+		l.Node, l.RPCPath = l.Source.Node, l.Source.Path
+	}
+}
+
+// Upgrade - fills in the fields of a request of an older protocol version as carried by the current
+// version (Source from Node and RPCPath of version 2), for use by lock servers accepting older versions.
+func (l *LockArgs) Upgrade() {
+	if l.Version < 3 && l.Source == (Identity{}) {
+		l.Source = Identity{Node: l.Node, Path: l.RPCPath}
+	}
+}
+
+// LockReply - reply of a lock server to a request acquiring a lock as of protocol version 4 (see
+// acquiringMethods): whether the lock was granted, stamped with the cluster configuration epoch of
+// the server so that the client can tell a server of another configuration apart (see SetEpoch).
+type LockReply struct {
+	Granted bool
+	Epoch   uint64
+}
+
+// GrantedReply - returns the flag to set to whether the request of args was granted, given the
+// reply passed to the Call of an RPC, which is either a bool or a LockReply (then stamped with the
+// epoch of args), or false when it is neither. For lock servers without an epoch of their own,
+// such as the LocalLocker.
+func GrantedReply(reply interface{}, args *LockArgs) (*bool, bool) {
+	switch r := reply.(type) {
+	case *bool:
+		return r, true
+	case *LockReply:
+		r.Epoch = args.Epoch
+		return &r.Granted, true
+	}
+	return nil, false
+}
+
+// LockOptions - limits of a single call to GetLock or GetRLock, zero fields default to the limits
+// set by SetAcquireTimeout, SetMaxRounds and SetAttemptTimeout.
+type LockOptions struct {
+	Timeout        time.Duration // Time to try to acquire the lock before giving up, across all attempts
+	MaxRounds      int           // Attempts to acquire the lock before giving up
+	AttemptTimeout time.Duration // Time a single attempt waits for the answers of the nodes
+}
+
+// withDefaults returns the options with the zero fields set to the limits of the client.
+func (opts LockOptions) withDefaults() LockOptions {
+	if opts.Timeout == 0 {
+		opts.Timeout = getAcquireTimeout()
+	}
+	if opts.MaxRounds == 0 {
+		opts.MaxRounds = getMaxRounds()
+	}
+	if opts.AttemptTimeout == 0 {
+		opts.AttemptTimeout = getAttemptTimeout()
+	}
+	return opts
+}
+
 func NewDRWMutex(name string) *DRWMutex {
 	return &DRWMutex{
 		Name:       name,
@@ -91,7 +225,7 @@ func NewDRWMutex(name string) *DRWMutex {
 func (dm *DRWMutex) Lock() {
 
 	isReadLock := false
-	dm.lockBlocking(isReadLock)
+	dm.lockBlocking(context.Background(), isReadLock, false, LockOptions{})
 }
 
 // RLock holds a read lock on dm.
@@ -101,27 +235,182 @@ func (dm *DRWMutex) Lock() {
 func (dm *DRWMutex) RLock() {
 
 	isReadLock := true
-	dm.lockBlocking(isReadLock)
+	dm.lockBlocking(context.Background(), isReadLock, false, LockOptions{})
+}
+
+// LockUnlessDeadlock holds a write lock on dm like Lock, unless the lock servers abort the
+// request to break a deadlock, in which case ErrDeadlock is returned without holding the lock.
+// The caller should then release the locks it holds before trying again.
+//
+// Deadlocks are detected among owners, so all locks acquired by one actor should carry the same Owner.
+func (dm *DRWMutex) LockUnlessDeadlock() error {
+
+	isReadLock := false
+	return dm.lockBlocking(context.Background(), isReadLock, true, LockOptions{})
+}
+
+// RLockUnlessDeadlock holds a read lock on dm like RLock, unless the request is aborted to
+// break a deadlock (see LockUnlessDeadlock).
+func (dm *DRWMutex) RLockUnlessDeadlock() error {
+
+	isReadLock := true
+	return dm.lockBlocking(context.Background(), isReadLock, true, LockOptions{})
+}
+
+// GetLock holds a write lock on dm like LockUnlessDeadlock, unless the lock is not acquired within
+// the timeout or maximum number of attempts of opts (or of the client, see SetAcquireTimeout and
+// SetMaxRounds), in which case ErrAcquireTimeout or ErrMaxRounds is returned without holding the lock.
+// Once ctx is done the acquisition is abandoned likewise (returning the error of ctx), releasing
+// any lock that the nodes grant afterwards.
+//
+// On the single node fast path the lock is waited for in memory, so only the timeout and ctx apply.
+func (dm *DRWMutex) GetLock(ctx context.Context, opts LockOptions) error {
+
+	isReadLock := false
+	return dm.lockBlocking(ctx, isReadLock, true, opts.withDefaults())
+}
+
+// GetRLock holds a read lock on dm like RLockUnlessDeadlock, unless the lock is not acquired within
+// the limits of opts or ctx is done (see GetLock).
+func (dm *DRWMutex) GetRLock(ctx context.Context, opts LockOptions) error {
+
+	isReadLock := true
+	return dm.lockBlocking(ctx, isReadLock, true, opts.withDefaults())
 }
 
 // lockBlocking will acquire either a read or a write lock
 //
 // The call will block until the lock is granted using a built-in
 // timing randomized back-off algorithm to try again until successful
-func (dm *DRWMutex) lockBlocking(isReadLock bool) {
+// (or until the request is aborted to break a deadlock when abortOnDeadlock is set,
+// or until the timeout or maximum number of attempts of limits is reached, or ctx is done)
+func (dm *DRWMutex) lockBlocking(ctx context.Context, isReadLock, abortOnDeadlock bool, limits LockOptions) error {
+
+	start := getClock().Now()
+	var deadline time.Time // Zero when not limited
+	if limits.Timeout > 0 {
+		deadline = start.Add(limits.Timeout)
+	}
+	if limits.AttemptTimeout == 0 {
+		limits.AttemptTimeout = getAttemptTimeout()
+	}
+	spanName := "dsync.Lock"
+	if isReadLock {
+		spanName = "dsync.RLock"
+	}
+	span := StartSpan("", spanName, "name", dm.Name)
+	acquisition := startAcquisition(dm, isReadLock, start)
+	defer endAcquisition(acquisition)
+	if dlocal != nil {
+		// Single node fast path: wait for the lock in memory (there are no deadlocks to abort
+		// as the local locker does not detect any)
+		dmetrics.attempted(isReadLock)
+		dstats.attempted()
+		dm.stats.attempted()
+		uid := dlocal.acquire(ctx, getNamespace(), dm.Name, isReadLock, deadline)
+		if !isLocked(uid) {
+			err := ctx.Err()
+			if err == nil {
+				err = ErrAcquireTimeout
+			}
+			contended(dm.Name, true, 1)
+			span.SetAttributes("attempts", 1)
+			span.End(err)
+			return err
+		}
+		dmetrics.acquired(isReadLock, 1, start)
+		for _, s := range []*statsCollector{&dstats, &dm.stats} {
+			s.answered(dlocal.Node(), true, nil)
+			s.acquired(isReadLock, 1)
+		}
+		contended(dm.Name, false, 0)
+		waited(dm.Name, getClock().Now().Sub(start))
+		span.SetAttributes("attempts", 1)
+		span.End(nil)
+		hold := acquiredLock(dm, []string{uid}, isReadLock)
+		dm.m.Lock()
+		defer dm.m.Unlock()
+		dm.hold = hold
+		dm.lastErr = nil
+		dm.lastAttempt = nil
+		if isReadLock {
+			dm.readersLocks = append(dm.readersLocks, []string{uid})
+		} else {
+			dm.writeLocks[0] = uid
+		}
+		return nil
+	}
+
+	if !isReadLock {
+		if locks := takeRetained(dm.Name, dm.Owner); locks != nil {
+			// Still held at the lock servers since it was unlocked, so granted locally
+			span.SetAttributes("attempts", 0)
+			span.End(nil)
+			hold := acquiredLock(dm, locks, isReadLock)
+			dm.m.Lock()
+			defer dm.m.Unlock()
+			dm.hold = hold
+			dm.lastErr = nil
+			dm.lastAttempt = nil
+			copy(dm.writeLocks, locks)
+			return nil
+		}
+	}
+
+	// Uids granted per node, reused by every attempt (a failed attempt releases and clears them)
+	locks := make([]string, dnodeCount)
 
-	runs, backOff := 1, 1
+	giveUp := func(attempts int, err error) error {
+		logf(LogDebug, "Giving up on lock", "name", dm.Name, "attempts", attempts, "err", err)
+		span.SetAttributes("attempts", attempts)
+		span.End(err)
+		return err
+	}
 
-	for {
-		// create temp array on stack
-		locks := make([]string, dnodeCount)
+	for attempts := 1; ; attempts++ {
+		if err := ctx.Err(); err != nil {
+			return giveUp(attempts-1, err)
+		}
+		if attempts > 1 && !deadline.IsZero() && !getClock().Now().Before(deadline) {
+			return giveUp(attempts-1, ErrAcquireTimeout)
+		}
+		for index := range locks {
+			locks[index] = ""
+		}
 
 		// try to acquire the lock
-		success := lock(clnts, &locks, dm.Name, isReadLock)
+		dmetrics.attempted(isReadLock)
+		dstats.attempted()
+		dm.stats.attempted()
+		success, attempt := lock(ctx, clnts, &locks, dm.Name, dm.Owner, isReadLock, limits.AttemptTimeout, deadline, span.Context(), &dm.stats)
 		if success {
+			reachedQuorum()
+			hold := acquiredUnlessConflicting(dm, locks, isReadLock)
+			if hold == nil {
+				// Still held within this process only (see DegradedLocal), which the lock
+				// servers do not know of, so hand the lock back and try again later
+				logf(LogDebug, "Lock held within this process only", "name", dm.Name)
+				releaseAll(clnts, &locks, dm.Name, isReadLock)
+				if limits.MaxRounds > 0 && attempts >= limits.MaxRounds {
+					return giveUp(attempts, ErrMaxRounds)
+				}
+				backOff(ctx, dm.Name, attempts, deadline)
+				continue
+			}
+			dmetrics.acquired(isReadLock, attempts, start)
+			dstats.acquired(isReadLock, attempts)
+			dm.stats.acquired(isReadLock, attempts)
+			contended(dm.Name, false, 0)
+			waited(dm.Name, getClock().Now().Sub(start))
+			span.SetAttributes("attempts", attempts)
+			span.End(nil)
 			dm.m.Lock()
 			defer dm.m.Unlock()
 
+			dm.hold = hold
+			dm.lastErr = nil
+			dm.lastAttempt = nil
+
 			// if success, copy array to object
 			if isReadLock {
 				// append new array of strings at the end
@@ -132,93 +421,274 @@ func (dm *DRWMutex) lockBlocking(isReadLock bool) {
 				copy(dm.writeLocks, locks[:])
 			}
 
-			return
+			return nil
+		}
+
+		logf(LogDebug, "Unable to acquire lock", "name", dm.Name, "err", attempt)
+		err := attempt.cause()
+		dm.m.Lock()
+		dm.lastErr = err
+		dm.lastAttempt = attempt
+		dm.m.Unlock()
+		failedAcquisition(acquisition, attempt)
+		contended(dm.Name, true, len(attempt.Denied))
+
+		if abortOnDeadlock && err == ErrDeadlock {
+			span.SetAttributes("attempts", attempts)
+			span.End(err)
+			return err
 		}
 
-		// We timed out on the previous lock, incrementally wait for a longer back-off time,
-		// and try again afterwards
-		time.Sleep(time.Duration(backOff) * time.Millisecond)
+		switch degradedPolicy(attempt, isReadLock) {
+		case DegradedFailFast:
+			if abortOnDeadlock { // Unless called by Lock or RLock, which cannot fail
+				return giveUp(attempts, ErrQuorumUnreachable)
+			}
+		case DegradedLocal:
+			localDeadline := getClock().Now().Add(remaining(limits.AttemptTimeout, deadline))
+			var hold *heldLock
+			if uid := lockLocally(ctx, dm.Name, isReadLock, localDeadline); isLocked(uid) {
+				for index := range locks {
+					locks[index] = ""
+				}
+				locks[ownNode] = uid
+				if hold = acquiredUnlessConflicting(dm, locks, isReadLock); hold == nil {
+					unlockLocally(dm.Name, uid, isReadLock) // Held by quorum by another holder of this process
+				}
+			}
+			if hold != nil {
+				uid := hold.uid
+				dmetrics.acquired(isReadLock, attempts, start)
+				dstats.acquired(isReadLock, attempts)
+				dm.stats.acquired(isReadLock, attempts)
+				span.SetAttributes("attempts", attempts, "localOnly", true)
+				span.End(nil)
+				grantedLocally(LockEvent{Namespace: getNamespace(), Name: dm.Name, Owner: dm.Owner, UID: uid, ReadLock: isReadLock, Since: getClock().Now()})
+				dm.m.Lock()
+				defer dm.m.Unlock()
+				dm.hold = hold
+				dm.lastErr = nil
+				dm.lastAttempt = nil
+				if isReadLock {
+					dm.readersLocks = append(dm.readersLocks, append([]string(nil), locks...))
+				} else {
+					copy(dm.writeLocks, locks)
+				}
+				return nil
+			}
+		}
 
-		backOff += int(rand.Float64() * math.Pow(2, float64(runs)))
-		if backOff > 1024 {
-			backOff = backOff % 64
+		if limits.MaxRounds > 0 && attempts >= limits.MaxRounds {
+			return giveUp(attempts, ErrMaxRounds)
+		}
 
-			runs = 1 // reset runs
-		} else if runs < 10 {
-			runs++
+		if watchTimeout := remaining(getWatchTimeout(), deadline); watchTimeout > 0 && watch(ctx, clnts, dm.Name, watchTimeout) {
+			// Lock was released in the mean time, so try again immediately
+			continue
 		}
+
+		// We timed out on the previous lock, wait for a back-off time (as decided by the
+		// back-off policy, but not beyond the deadline) and try again afterwards
+		backOff(ctx, dm.Name, attempts, deadline)
 	}
 }
 
-// lock tries to acquire the distributed lock, returning true or false
-//
-func lock(clnts []RPC, locks *[]string, lockName string, isReadLock bool) bool {
+// remaining returns d, cut short to the time left until deadline (unless zero).
+func remaining(d time.Duration, deadline time.Time) time.Duration {
+	if !deadline.IsZero() {
+		if left := deadline.Sub(getClock().Now()); left < d {
+			return left
+		}
+	}
+	return d
+}
 
-	// Create buffered channel of quorum size
-	ch := make(chan Granted, dnodeCount)
+// LastError returns the error that caused the most recent attempt to acquire the lock
+// to fail, such as an EpochMismatchError or VersionMismatchError, or nil if the lock was granted.
+func (dm *DRWMutex) LastError() error {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	return dm.lastErr
+}
 
-	for index, c := range clnts {
+// LastAttempt returns which nodes granted, denied or failed the most recent attempt to acquire
+// the lock, or nil if the lock was granted (or not requested yet).
+func (dm *DRWMutex) LastAttempt() *QuorumError {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	return dm.lastAttempt
+}
+
+// Lost returns a channel that is closed once the client detects that it no longer holds the lock
+// most recently acquired by dm: when lock servers that granted it restart (or drop it, see
+// SetLockValidator) so that it is no longer held by a quorum of the nodes, or when it is force
+// unlocked. Holders select on it to stop mutating the protected state promptly. It is nil (so never
+// ready) until a lock is acquired, and is not closed by unlocking.
+func (dm *DRWMutex) Lost() <-chan struct{} {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	if dm.hold == nil {
+		return nil
+	}
+	return dm.hold.lostCh
+}
+
+// Revoked returns a channel that is closed once a lock server asks the holder of the lock most
+// recently acquired by dm to release it (see RequestRevocation), which the holder should do before
+// RevokeDeadline, after which the lock server releases it forcibly. It is nil (so never ready)
+// until a lock is acquired, and is not closed by unlocking.
+func (dm *DRWMutex) Revoked() <-chan struct{} {
+	dm.m.Lock()
+	defer dm.m.Unlock()
+	if dm.hold == nil {
+		return nil
+	}
+	return dm.hold.revokedCh
+}
+
+// RevokeDeadline returns the time by which the lock most recently acquired by dm is to be released
+// as asked by a lock server (see Revoked), zero when it has not been asked to.
+func (dm *DRWMutex) RevokeDeadline() time.Time {
+	dm.m.Lock()
+	hold := dm.hold
+	dm.m.Unlock()
+	if hold == nil {
+		return time.Time{}
+	}
+	held.Lock()
+	defer held.Unlock()
+	return hold.revokeBy
+}
 
-		// broadcast lock request to all nodes
+// lock tries to acquire the distributed lock, returning true or false (along with the outcome
+// at every node when quorum was not reached), the request to every node being traced as a child
+// of the span with context trace and the answers recorded in the statistics of the client and in stats.
+// The attempt waits for the answers of the nodes for up to attemptTimeout (on top of the time that
+// servers may park it), but not beyond deadline (unless zero) nor once ctx is done.
+func lock(ctx context.Context, clnts []RPC, locks *[]string, lockName, owner string, isReadLock bool, attemptTimeout time.Duration, deadline time.Time, trace string, stats *statsCollector) (bool, *QuorumError) {
+
+	round := getLockRound()
+	defer round.release()
+	ch := round.ch
+
+	serverWait := remaining(getServerWait(), deadline) // Not parked beyond the deadline
+	reservation := getReservation()
+	if reservation > 0 || serverWait < 0 {
+		serverWait = 0 // Reservations are not parked
+	}
+
+	// Spans are only started when traced, sparing the allocations of their attributes otherwise
+	traced := tracing()
+
+	// Nodes sent a request at once, the others are sent one as answers come in
+	fanOut := getFanOut()
+	limited := fanOut > 0 && fanOut < dnodeCount
+	if !limited {
+		fanOut = dnodeCount
+	}
+
+	request := func(index int) {
+		// send lock request to the node
 		go func(index int, isReadLock bool, c RPC) {
 			// All client methods issuing RPCs are thread-safe and goroutine-safe,
 			// i.e. it is safe to call them from multiple concurrently running go routines.
-			var locked bool
-			bytesUid := [16]byte{}
-			cryptorand.Read(bytesUid[:])
-			uid := fmt.Sprintf("%X", bytesUid[:])
-			args := LockArgs{Name: lockName, Node: clnts[ownNode].Node(), RPCPath: clnts[ownNode].RPCPath(), UID: uid}
+			locked := &round.locked[index]
+			*locked = false
+			uid := newUID()
+			args := &round.args[index]
+			*args = LockArgs{Namespace: getNamespace(), Name: lockName, Source: ownIdentity(), Owner: owner, UID: uid, Epoch: getEpoch(), Version: ProtocolVersion,
+				Retainable: !isReadLock && getRetainLease() > 0}
+			method := "Dsync.Lock"
 			if isReadLock {
-				if err := c.Call("Dsync.RLock", &args, &locked); err != nil {
-					if dsyncLog {
-						log.Println("Unable to call Dsync.RLock", err)
-					}
-				}
-			} else {
-				if err := c.Call("Dsync.Lock", &args, &locked); err != nil {
-					if dsyncLog {
-						log.Println("Unable to call Dsync.Lock", err)
-					}
+				method = "Dsync.RLock"
+			}
+			if reservation > 0 {
+				// Only reserve the lock, it is committed once quorum is reached
+				method = "Dsync.PrepareLock"
+				if isReadLock {
+					method = "Dsync.PrepareRLock"
 				}
+				args.Reservation = reservation
+			} else if serverWait > 0 {
+				// Let the server park the request until the lock frees up (or the wait elapses)
+				method += "Wait"
+				args.WaitTimeout = serverWait
+			}
+			var span Span = noopSpan{}
+			if traced {
+				span = StartSpan(trace, method, "name", lockName, "node", c.Node(), "uid", uid)
+				args.TraceContext = span.Context()
+			}
+			var err error
+			// Not cancelled along with ctx, as a lock granted after the request has been abandoned
+			// would be left behind at the node: answers that come in late are released instead
+			if err = CallServer(context.WithoutCancel(ctx), c, method, args, locked); err != nil {
+				logf(LogWarn, "Unable to call", "method", method, "node", c.Node(), "err", err)
 			}
+			if traced {
+				span.SetAttributes("granted", *locked)
+			}
+			span.End(err)
+			dstats.answered(c.Node(), *locked, err)
+			stats.answered(c.Node(), *locked, err)
 
-			g := Granted{index: index}
-			if locked {
+			g := Granted{index: index, err: err}
+			if *locked {
 				g.lockUid = args.UID
 			}
 			ch <- g
 
-		}(index, isReadLock, c)
+		}(index, isReadLock, clnts[index])
+	}
+
+	sent := 0
+	for ; sent < fanOut; sent++ {
+		request(fanOutIndex(sent))
 	}
 
 	quorum := false
+	answers := round.answers // Answers received before the attempt was decided
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	round.decided.Add(1)
 	go func(isReadLock bool) {
+		defer round.release()
 
 		// Wait until we have either a) received all lock responses, b) received too many 'non-'locks for quorum to be or c) time out
-		i, locksFailed := 0, 0
+		i, weightFailed := 0, 0
 		done := false
-		timeout := time.After(DRWMutexAcquireTimeout)
+		timeout := getClock().After(remaining(attemptTimeout+serverWait, deadline))
 
-		for ; i < dnodeCount; i++ { // Loop until we acquired all locks
+		for i < sent { // Loop until we acquired all locks
 
 			select {
 			case grant := <-ch:
+				i++ // Count the answer here, as breaking out of the loop below skips any post statement
+				round.grants[grant.index] = grant
+				answers[grant.index] = &round.grants[grant.index]
+				round.order = append(round.order, grant.index)
 				if grant.isLocked() {
 					// Mark that this node has acquired the lock
 					(*locks)[grant.index] = grant.lockUid
+					if (serverWait > 0 || limited && isLocked((*locks)[ownNode])) && quorumMet(locks, isReadLock) {
+						// Do not wait for servers that have parked the request (nor contact the
+						// remaining nodes), any late grants will be released below
+						done = true
+					}
 				} else {
-					locksFailed++
-					if !isReadLock && locksFailed > dnodeCount-dquorum ||
-						isReadLock && locksFailed > dnodeCount-dquorumReads {
-						// We know that we are not going to get the lock anymore, so exit out
-						// and release any locks that did get acquired
+					weightFailed += dnodeWeights[grant.index]
+					if !isReadLock && weightFailed > dtotalWeight-dquorum ||
+						isReadLock && weightFailed > dtotalWeight-dquorumReads ||
+						limited && grant.index == ownNode {
+						// We know that we are not going to get the lock anymore (the own node
+						// must hold it), so exit out and release any locks that did get acquired
 						done = true
 						releaseAll(clnts, locks, lockName, isReadLock)
 					}
 				}
+				if !done && sent < dnodeCount {
+					request(fanOutIndex(sent))
+					sent++
+				}
 
 			case <-timeout:
 				done = true
@@ -227,6 +697,11 @@ func lock(clnts []RPC, locks *[]string, lockName string, isReadLock bool) bool {
 				if !quorumMet(locks, isReadLock) {
 					releaseAll(clnts, locks, lockName, isReadLock)
 				}
+
+			case <-ctx.Done():
+				// Lock no longer wanted, release what has been granted so far
+				done = true
+				releaseAll(clnts, locks, lockName, isReadLock)
 			}
 
 			if done {
@@ -237,13 +712,21 @@ func lock(clnts []RPC, locks *[]string, lockName string, isReadLock bool) bool {
 		// Count locks in order to determine whterh we have quorum or not
 		quorum = quorumMet(locks, isReadLock)
 
+		// Record the nodes that the attempt was decided without
+		for p := sent; p < dnodeCount; p++ {
+			index := fanOutIndex(p)
+			round.grants[index] = Granted{index: index, err: ErrNotContacted}
+			answers[index] = &round.grants[index]
+			round.order = append(round.order, index)
+		}
+
 		// Signal that we have the quorum
-		wg.Done()
+		round.decided.Done()
 
 		// Wait for the other responses and immediately release the locks
 		// (do not add them to the locks array because the DRWMutex could
 		//  already has been unlocked again by the original calling thread)
-		for ; i < dnodeCount; i++ {
+		for ; i < sent; i++ {
 			grantToBeReleased := <-ch
 			if grantToBeReleased.isLocked() {
 				// release lock
@@ -252,7 +735,7 @@ func lock(clnts []RPC, locks *[]string, lockName string, isReadLock bool) bool {
 		}
 	}(isReadLock)
 
-	wg.Wait()
+	round.decided.Wait()
 
 	// Verify that localhost server is actively participating in the lock (the lock maintenance relies on this fact)
 	if quorum && !isLocked((*locks)[ownNode]) {
@@ -261,23 +744,132 @@ func lock(clnts []RPC, locks *[]string, lockName string, isReadLock bool) bool {
 		quorum = false
 	}
 
-	return quorum
+	if quorum && reservation > 0 {
+		commitAll(clnts, locks, lockName, answers)
+		if !quorumMet(locks, isReadLock) || !isLocked((*locks)[ownNode]) {
+			// Too many reservations lapsed before being committed
+			releaseAll(clnts, locks, lockName, isReadLock)
+			quorum = false
+		}
+	}
+
+	if quorum {
+		return true, nil
+	}
+	return false, newQuorumError(clnts, lockName, answers, round.order)
+}
+
+// fanOutIndex returns the index of the node that is sent a lock request in position p, the own
+// node first (as the lock must be held by it) followed by the others in order.
+func fanOutIndex(p int) int {
+	if p == 0 {
+		return ownNode
+	} else if p <= ownNode {
+		return p - 1
+	}
+	return p
 }
 
-// quorumMet determines whether we have acquired the required quorum of underlying locks or not
+// commitAll turns the reservations granted by the nodes into locks, clearing the nodes whose
+// reservation could not be committed from locks (and recording their outcome in answers).
+// A reservation that failed to commit because of an error lapses by itself, so it is not released.
+func commitAll(clnts []RPC, locks *[]string, lockName string, answers []*Granted) {
+
+	var wg sync.WaitGroup
+	for index, uid := range *locks {
+		if !isLocked(uid) {
+			continue
+		}
+		wg.Add(1)
+		go func(index int, uid string) {
+			defer wg.Done()
+			var committed bool
+			args := LockArgs{Namespace: getNamespace(), Name: lockName, UID: uid, Epoch: getEpoch(), Version: ProtocolVersion}
+			err := CallServer(context.Background(), clnts[index], "Dsync.Commit", &args, &committed)
+			if err != nil {
+				logf(LogWarn, "Unable to call", "method", "Dsync.Commit", "node", clnts[index].Node(), "err", err)
+			}
+			if !committed {
+				(*locks)[index] = ""
+				answers[index] = &Granted{index: index, err: err}
+			}
+		}(index, uid)
+	}
+	wg.Wait()
+}
+
+// watch waits until any of the nodes reports that a lock on lockName has been released (returning
+// true), or all nodes have answered otherwise, timeout has elapsed or ctx is done (returning false).
+func watch(ctx context.Context, clnts []RPC, lockName string, timeout time.Duration) bool {
+
+	ch := make(chan bool, dnodeCount)
+	for index, c := range clnts {
+
+		go func(index int, c RPC) {
+			var released bool
+			args := LockArgs{Namespace: getNamespace(), Name: lockName, Epoch: getEpoch(), Version: ProtocolVersion, WaitTimeout: timeout}
+			if err := CallServer(ctx, c, "Dsync.Watch", &args, &released); err != nil {
+				logf(LogDebug, "Unable to call", "method", "Dsync.Watch", "node", c.Node(), "err", err)
+			}
+			ch <- released
+		}(index, c)
+	}
+
+	expired := getClock().After(timeout + DRWMutexAcquireTimeout)
+	for range clnts {
+		select {
+		case released := <-ch:
+			if released {
+				return true
+			}
+		case <-expired:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return false
+}
+
+// toRoundError returns the typed error carried by err when it explains why a node
+// denied the lock (EpochMismatchError, VersionMismatchError, QuotaExceededError, AccessDeniedError
+// or ErrDeadlock), or nil otherwise.
+func toRoundError(err error) error {
+	if e := toVersionMismatchError(err); e != nil {
+		return *e
+	}
+	if e := toEpochMismatchError(err); e != nil {
+		return *e
+	}
+	if e := toIncarnationMismatchError(err); e != nil {
+		return *e
+	}
+	if e := toQuotaExceededError(err); e != nil {
+		return *e
+	}
+	if e := toAccessDeniedError(err); e != nil {
+		return *e
+	}
+	if err != nil && err.Error() == ErrDeadlock.Error() {
+		return ErrDeadlock
+	}
+	return nil
+}
+
+// quorumMet determines whether we have acquired the required quorum (by weight) of underlying locks or not
 func quorumMet(locks *[]string, isReadLock bool) bool {
 
-	count := 0
-	for _, uid := range *locks {
+	weight := 0
+	for index, uid := range *locks {
 		if isLocked(uid) {
-			count++
+			weight += dnodeWeights[index]
 		}
 	}
 
 	if isReadLock {
-		return count >= dquorumReads
+		return weight >= dquorumReads
 	} else {
-		return count >= dquorum
+		return weight >= dquorum
 	}
 }
 
@@ -322,7 +914,7 @@ func (dm *DRWMutex) Unlock() {
 	}
 
 	isReadLock := false
-	unlock(locks, dm.Name, isReadLock)
+	unlock(locks, dm.Name, dm.Owner, isReadLock)
 }
 
 // RUnlock releases a read lock held on dm.
@@ -346,10 +938,31 @@ func (dm *DRWMutex) RUnlock() {
 	}
 
 	isReadLock := true
-	unlock(locks, dm.Name, isReadLock)
+	unlock(locks, dm.Name, dm.Owner, isReadLock)
 }
 
-func unlock(locks []string, name string, isReadLock bool) {
+func unlock(locks []string, name, owner string, isReadLock bool) {
+
+	dmetrics.released(isReadLock, 1)
+	locks = releasedLock(locks)
+	if uid := ownUID(locks); isLocalOnly(uid) {
+		// Granted within this process only while quorum was unreachable
+		unlockLocally(name, uid, isReadLock)
+		return
+	}
+	if dlocal != nil {
+		// Single node fast path, release synchronously in memory
+		if err := dlocal.unlockDirect(getNamespace(), name, locks[0], isReadLock); err != nil {
+			logf(LogWarn, "Unable to unlock", "name", name, "err", err)
+			dmetrics.unlockFailed()
+		}
+		return
+	}
+
+	if !isReadLock && retainLock(name, owner, locks) {
+		// Kept at the lock servers for acquiring it again, until revoked or its lease ends
+		return
+	}
 
 	// We don't need to synchronously wait until we have released all the locks (or the quorum)
 	// (a subsequent lock will retry automatically in case it would fail to get quorum)
@@ -366,10 +979,29 @@ func unlock(locks []string, name string, isReadLock bool) {
 // ForceUnlock will forcefully clear a write or read lock.
 func (dm *DRWMutex) ForceUnlock() {
 
+	forceUnlocked(dm.Name)
 	{
 		dm.m.Lock()
 		defer dm.m.Unlock()
 
+		for _, uid := range dm.writeLocks {
+			if isLocked(uid) {
+				dmetrics.released(false, 1)
+				break
+			}
+		}
+		releasedLock(dm.writeLocks)
+		if uid := ownUID(dm.writeLocks); isLocalOnly(uid) {
+			unlockLocally(dm.Name, uid, false)
+		}
+		dmetrics.released(true, len(dm.readersLocks))
+		for _, locks := range dm.readersLocks {
+			releasedLock(locks)
+			if uid := ownUID(locks); isLocalOnly(uid) {
+				unlockLocally(dm.Name, uid, true)
+			}
+		}
+
 		// Clear write locks array
 		dm.writeLocks = make([]string, dnodeCount)
 		// Clear read locks array
@@ -382,60 +1014,64 @@ func (dm *DRWMutex) ForceUnlock() {
 	}
 }
 
+// Back-off between the retries of a release that failed
+var releaseBackOffs = []time.Duration{
+	30 * time.Second, // 30secs.
+	1 * time.Minute,  // 1min.
+	3 * time.Minute,  // 3min.
+	10 * time.Minute, // 10min.
+	30 * time.Minute, // 30min.
+	1 * time.Hour,    // 1hr.
+}
+
 // sendRelease sends a release message to a node that previously granted a lock
 func sendRelease(c RPC, name, uid string, isReadLock bool) {
 
-	backOffArray := []time.Duration{
-		30 * time.Second, // 30secs.
-		1 * time.Minute,  // 1min.
-		3 * time.Minute,  // 3min.
-		10 * time.Minute, // 10min.
-		30 * time.Minute, // 30min.
-		1 * time.Hour,    // 1hr.
-	}
-
 	go func(c RPC, name string) {
 
-		for _, backOff := range backOffArray {
+		for _, backOff := range releaseBackOffs {
 
 			// All client methods issuing RPCs are thread-safe and goroutine-safe,
 			// i.e. it is safe to call them from multiple concurrently running goroutines.
 			var unlocked bool
-			args := LockArgs{Name: name, UID: uid} // Just send name & uid (and leave out node and rpcPath; unimportant for unlocks)
+			args := LockArgs{Namespace: getNamespace(), Name: name, UID: uid, Epoch: getEpoch(), Version: ProtocolVersion} // Just send name & uid (and leave out node and rpcPath; unimportant for unlocks)
 			if len(uid) == 0 {
-				if err := c.Call("Dsync.ForceUnlock", &args, &unlocked); err == nil {
+				if err := CallServer(context.Background(), c, "Dsync.ForceUnlock", &args, &unlocked); err == nil {
 					// ForceUnlock delivered, exit out
 					return
 				} else if err != nil {
-					if dsyncLog {
-						log.Println("Unable to call Dsync.ForceUnlock", err)
-					}
+					logf(LogWarn, "Unable to call", "method", "Dsync.ForceUnlock", "node", c.Node(), "err", err)
+					dmetrics.unlockFailed()
 					if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
 						// ForceUnlock possibly failed with server timestamp mismatch, server may have restarted.
 						return
 					}
 				}
 			} else if isReadLock {
-				if err := c.Call("Dsync.RUnlock", &args, &unlocked); err == nil {
+				if err := CallServer(context.Background(), c, "Dsync.RUnlock", &args, &unlocked); err == nil {
 					// RUnlock delivered, exit out
 					return
+				} else if errors.Is(err, ErrLockNotHeld) {
+					// Lock no longer held by the node (eg. purged as stale), so nothing left to release
+					return
 				} else if err != nil {
-					if dsyncLog {
-						log.Println("Unable to call Dsync.RUnlock", err)
-					}
+					logf(LogWarn, "Unable to call", "method", "Dsync.RUnlock", "node", c.Node(), "err", err)
+					dmetrics.unlockFailed()
 					if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
 						// RUnlock possibly failed with server timestamp mismatch, server may have restarted.
 						return
 					}
 				}
 			} else {
-				if err := c.Call("Dsync.Unlock", &args, &unlocked); err == nil {
+				if err := CallServer(context.Background(), c, "Dsync.Unlock", &args, &unlocked); err == nil {
 					// Unlock delivered, exit out
 					return
+				} else if errors.Is(err, ErrLockNotHeld) {
+					// Lock no longer held by the node (eg. purged as stale), so nothing left to release
+					return
 				} else if err != nil {
-					if dsyncLog {
-						log.Println("Unable to call Dsync.Unlock", err)
-					}
+					logf(LogWarn, "Unable to call", "method", "Dsync.Unlock", "node", c.Node(), "err", err)
+					dmetrics.unlockFailed()
 					if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
 						// Unlock possibly failed with server timestamp mismatch, server may have restarted.
 						return
@@ -444,7 +1080,7 @@ func sendRelease(c RPC, name, uid string, isReadLock bool) {
 			}
 
 			// Wait..
-			time.Sleep(backOff)
+			getClock().Sleep(backOff)
 		}
 	}(c, name)
 }
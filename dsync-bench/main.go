@@ -0,0 +1,263 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command dsync-bench measures the throughput of lock/unlock cycles and the latency of acquiring
+// locks for every combination of node count, contention level and payload size, eg.
+//
+//	dsync-bench -nodes 2,4,8 -names 1,64 -payload 16,1024 -duration 10s
+//
+// Every combination runs in a separate process (as dsync can only be set up once per process),
+// with its lock servers on localhost.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Prefix of the line with the result printed by a run process
+const resultPrefix = "RESULT "
+
+// Time at the start of a run during which cycles are not measured, covering connection setup
+const warmup = 500 * time.Millisecond
+
+var (
+	nodesFlag    = flag.String("nodes", "2,4,8", "Comma separated numbers of lock servers to benchmark (1 or even, at most 16)")
+	namesFlag    = flag.String("names", "1,16,1024", "Comma separated numbers of lock names the clients spread their locks over, fewer names meaning more contention")
+	payloadFlag  = flag.String("payload", "16,1024", "Comma separated sizes in bytes of the lock names, which every request carries")
+	clientsFlag  = flag.Int("clients", 16, "Number of concurrent clients")
+	durationFlag = flag.Duration("duration", 5*time.Second, "Duration of benchmarking every combination")
+	portFlag     = flag.Int("port", 13345, "First port of the lock servers, on consecutive ports")
+	seedFlag     = flag.Int64("seed", 1, "Seed of the lock names picked by the clients")
+	jsonFlag     = flag.Bool("json", false, "Print the results as JSON lines, eg. for comparing releases, instead of a table")
+	runFlag      = flag.String("run", "", "Only benchmark a single combination of nodes,names,payload and print its result (as launched by dsync-bench)")
+)
+
+// result is the outcome of benchmarking a single combination, as printed by a run process.
+type result struct {
+	Nodes   int           `json:"nodes"`
+	Names   int           `json:"names"`
+	Payload int           `json:"payload"`
+	Cycles  int           `json:"cycles"` // Lock/unlock cycles completed
+	Seconds float64       `json:"seconds"`
+	P50     time.Duration `json:"p50"` // Percentiles of the latency of acquiring a lock
+	P90     time.Duration `json:"p90"`
+	P99     time.Duration `json:"p99"`
+	Max     time.Duration `json:"max"`
+}
+
+// parseList parses a comma separated list of positive numbers.
+func parseList(name, list string) ([]int, error) {
+	var values []int
+	for _, s := range strings.Split(list, ",") {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("-%s must be a list of positive numbers, got %q", name, list)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// lockName returns lock name i, padded to payload bytes.
+func lockName(i, payload int) string {
+	name := fmt.Sprintf("bench-%d-", i)
+	if len(name) < payload {
+		name += strings.Repeat("x", payload-len(name))
+	}
+	return name
+}
+
+// percentile returns the latency at quantile q (0 to 1) of the sorted latencies.
+func percentile(sorted []time.Duration, q float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(q * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// runBenchmark starts the lock servers and runs the clients against them for duration.
+func runBenchmark(nodes, names, payload int, duration time.Duration) result {
+	var clnts []dsync.RPC
+	for i := 0; i < nodes; i++ {
+		addr := fmt.Sprintf("127.0.0.1:%d", *portFlag+i)
+		rpcPath := dsync.RpcPath + "-" + strconv.Itoa(i)
+		if err := startServer(addr, rpcPath); err != nil {
+			log.Fatalln("Unable to start lock server:", err)
+		}
+		clnts = append(clnts, newClient(addr, rpcPath))
+	}
+	if err := dsync.SetNodesWithClients(clnts, 0); err != nil {
+		log.Fatalf("set nodes failed with %v", err)
+	}
+
+	lockNames := make([]string, names)
+	for i := range lockNames {
+		lockNames[i] = lockName(i, payload)
+	}
+
+	start := time.Now()
+	measureFrom, end := start.Add(warmup), start.Add(warmup+duration)
+	latencies := make([][]time.Duration, *clientsFlag)
+	var wg sync.WaitGroup
+	for c := 0; c < *clientsFlag; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(*seedFlag + int64(c)))
+			for {
+				dm := dsync.NewDRWMutex(lockNames[random.Intn(len(lockNames))])
+				begin := time.Now()
+				if begin.After(end) {
+					return
+				}
+				dm.Lock()
+				if begin.After(measureFrom) {
+					latencies[c] = append(latencies[c], time.Since(begin))
+				}
+				dm.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	elapsed := time.Since(measureFrom)
+
+	var all []time.Duration
+	for _, l := range latencies {
+		all = append(all, l...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	r := result{Nodes: nodes, Names: names, Payload: payload, Cycles: len(all), Seconds: elapsed.Seconds(),
+		P50: percentile(all, 0.5), P90: percentile(all, 0.9), P99: percentile(all, 0.99)}
+	if len(all) > 0 {
+		r.Max = all[len(all)-1]
+	}
+	return r
+}
+
+// launchRun benchmarks a single combination in a separate process, returning its result.
+func launchRun(nodes, names, payload int) (*result, error) {
+	cmd := exec.Command(os.Args[0], "-run", fmt.Sprintf("%d,%d,%d", nodes, names, payload),
+		"-clients", fmt.Sprint(*clientsFlag), "-duration", durationFlag.String(), "-port", fmt.Sprint(*portFlag), "-seed", fmt.Sprint(*seedFlag))
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	var r *result
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, resultPrefix) {
+			r = &result{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, resultPrefix)), r); err != nil {
+				r = nil
+			}
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, err
+	} else if r == nil {
+		return nil, fmt.Errorf("Run of %d nodes, %d names and payload %d printed no result", nodes, names, payload)
+	}
+	return r, nil
+}
+
+func main() {
+	flag.Parse()
+	log.SetPrefix("[dsync-bench] ")
+	log.SetFlags(log.Lmicroseconds)
+
+	if *clientsFlag < 1 {
+		log.Fatalln("Need at least one client")
+	}
+
+	if *runFlag != "" {
+		combination, err := parseList("run", *runFlag)
+		if err != nil || len(combination) != 3 {
+			log.Fatalln("Invalid flags: -run must be nodes,names,payload")
+		}
+		r := runBenchmark(combination[0], combination[1], combination[2], *durationFlag)
+		out, _ := json.Marshal(r)
+		fmt.Println(resultPrefix + string(out))
+		os.Exit(0) // Do not wait for releases still being sent
+	}
+
+	nodes, err := parseList("nodes", *nodesFlag)
+	if err != nil {
+		log.Fatalln("Invalid flags:", err)
+	}
+	for _, n := range nodes {
+		if n > 16 || n > 1 && n%2 == 1 {
+			log.Fatalf("Invalid flags: number of nodes must be 1 or even and at most 16, got %d", n)
+		}
+	}
+	names, err := parseList("names", *namesFlag)
+	if err != nil {
+		log.Fatalln("Invalid flags:", err)
+	}
+	payloads, err := parseList("payload", *payloadFlag)
+	if err != nil {
+		log.Fatalln("Invalid flags:", err)
+	}
+
+	if !*jsonFlag {
+		fmt.Printf("%d clients, %v per combination\n", *clientsFlag, *durationFlag)
+		fmt.Printf("%5s %6s %8s %10s %10s %10s %10s %10s\n", "Nodes", "Names", "Payload", "Cycles/s", "p50", "p90", "p99", "max")
+	}
+	failed := false
+	for _, n := range nodes {
+		for _, m := range names {
+			for _, p := range payloads {
+				r, err := launchRun(n, m, p)
+				if err != nil {
+					log.Println(err)
+					failed = true
+					continue
+				}
+				if *jsonFlag {
+					out, _ := json.Marshal(r)
+					fmt.Println(string(out))
+					continue
+				}
+				fmt.Printf("%5d %6d %8d %10.1f %10v %10v %10v %10v\n", r.Nodes, r.Names, r.Payload, float64(r.Cycles)/r.Seconds,
+					r.P50.Round(time.Microsecond), r.P90.Round(time.Microsecond), r.P99.Round(time.Microsecond), r.Max.Round(time.Microsecond))
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/rpc"
+
+	"github.com/minio/dsync"
+)
+
+// lockService serves the lock handlers of an in-memory dsync.LocalLocker over net/rpc, so that
+// the benchmark measures the client and the RPC layer rather than any particular lock server.
+type lockService struct {
+	locker *dsync.LocalLocker
+}
+
+func (s *lockService) Lock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return s.locker.Call(context.Background(), "Dsync.Lock", args, reply)
+}
+
+func (s *lockService) RLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return s.locker.Call(context.Background(), "Dsync.RLock", args, reply)
+}
+
+func (s *lockService) Unlock(args *dsync.LockArgs, reply *bool) error {
+	return s.locker.Call(context.Background(), "Dsync.Unlock", args, reply)
+}
+
+func (s *lockService) RUnlock(args *dsync.LockArgs, reply *bool) error {
+	return s.locker.Call(context.Background(), "Dsync.RUnlock", args, reply)
+}
+
+func (s *lockService) ForceUnlock(args *dsync.LockArgs, reply *bool) error {
+	return s.locker.Call(context.Background(), "Dsync.ForceUnlock", args, reply)
+}
+
+func (s *lockService) Expired(args *dsync.LockArgs, reply *bool) error {
+	return s.locker.Call(context.Background(), "Dsync.Expired", args, reply)
+}
+
+// startServer serves a lock server on addr at rpcPath.
+func startServer(addr, rpcPath string) error {
+	server := rpc.NewServer()
+	server.RegisterName("Dsync", &lockService{locker: dsync.NewLocalLocker(addr, rpcPath)})
+	mux := http.NewServeMux()
+	mux.Handle(rpcPath, server)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go http.Serve(l, mux)
+	return nil
+}
@@ -0,0 +1,81 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// latencyHistogram is the histogram of the latencies of acquiring locks emitted by a workload.
+type latencyHistogram struct {
+	Bounds []time.Duration `json:"bounds"` // Upper bounds of all but the last bucket
+	Counts []int           `json:"counts"`
+	Max    time.Duration   `json:"max"`
+}
+
+// merge adds the counts of o, which must have the same bounds.
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	if h.Counts == nil {
+		h.Bounds = o.Bounds
+		h.Counts = make([]int, len(o.Counts))
+	}
+	for i, c := range o.Counts {
+		h.Counts[i] += c
+	}
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+}
+
+// quantile returns the upper bound of the bucket holding the latency at quantile q (0 to 1),
+// or the maximum for the last bucket.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	total := 0
+	for _, c := range h.Counts {
+		total += c
+	}
+	seen := 0
+	for i, c := range h.Counts {
+		seen += c
+		if c > 0 && float64(seen) >= q*float64(total) {
+			if i < len(h.Bounds) && h.Bounds[i] < h.Max {
+				return h.Bounds[i]
+			}
+			return h.Max
+		}
+	}
+	return 0
+}
+
+func (h *latencyHistogram) String() string {
+	return fmt.Sprintf("p50 %v, p90 %v, p99 %v, max %v", h.quantile(0.5), h.quantile(0.9), h.quantile(0.99), h.Max)
+}
+
+// fairness returns Jain's fairness index of the number of locks granted per client, from 1/n
+// when a single client got all locks to 1 when all clients got the same number of locks.
+func fairness(grants map[string]int) float64 {
+	sum, squares := 0.0, 0.0
+	for _, g := range grants {
+		sum += float64(g)
+		squares += float64(g) * float64(g)
+	}
+	if squares == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(grants)) * squares)
+}
@@ -0,0 +1,280 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command dsync-chaos runs a chaos scenario against lock servers and client workloads that are all
+// separate processes of the chaos program, and prints a summary of the run, eg.
+//
+//	dsync-chaos -servers 4 -clients 2 -scenario crash-loop -duration 30s -- -fault-delay '*=exp:2ms'
+//
+// Arguments after -- are passed on to all processes.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Ports and summary line as used by the chaos program
+const (
+	portStart             = 12345
+	workloadSummaryPrefix = "WORKLOAD "
+)
+
+// Address of the verifier process that checks mutual exclusion on the shared resources
+var verifierAddr = fmt.Sprintf("127.0.0.1:%d", portStart+100)
+
+// Time the workloads get to finish after the scenario (and to recover from it)
+const recoveryTimeout = 90 * time.Second
+
+var (
+	chaosFlag    = flag.String("chaos", "./chaos", "Path to the chaos program")
+	serversFlag  = flag.Int("servers", 4, "Number of lock servers (even, at most 16)")
+	clientsFlag  = flag.Int("clients", 2, "Number of client workload processes")
+	scenarioFlag = flag.String("scenario", "steady", "Scenario to run: steady, rolling, crash-loop or random")
+	durationFlag = flag.Duration("duration", 30*time.Second, "Duration of the scenario")
+	intervalFlag = flag.Duration("interval", 2*time.Second, "Interval between kills and restarts of servers")
+	seedFlag     = flag.Int64("seed", 1, "Seed of the workloads and of the random scenario")
+	historyFlag  = flag.String("history", "", "Directory to record the lock histories in (a temporary directory when empty)")
+)
+
+// workloadSummary is the summary printed by a workload process.
+type workloadSummary struct {
+	Acquired     int               `json:"acquired"`
+	FailedRounds int64             `json:"failedRounds"`
+	Latency      *latencyHistogram `json:"latency"`
+	Grants       map[string]int    `json:"grants"`
+	Violations   []string          `json:"violations,omitempty"`
+	Seconds      float64           `json:"seconds"`
+}
+
+// cluster is the set of processes of a run.
+type cluster struct {
+	args    []string // Arguments passed on to all processes
+	servers []*exec.Cmd
+}
+
+func (c *cluster) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(*chaosFlag, append(append(args, "-nodes", fmt.Sprint(*serversFlag)), c.args...)...)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func (c *cluster) startServer(index int) {
+	cmd := c.command("-serve", "-p", fmt.Sprint(portStart+index))
+	cmd.Stdout = os.Stdout
+	if err := cmd.Start(); err != nil {
+		log.Fatalln("Unable to start server:", err)
+	}
+	c.servers[index] = cmd
+}
+
+func (c *cluster) killServer(index int) {
+	c.servers[index].Process.Kill()
+	c.servers[index].Wait()
+	c.servers[index] = nil
+}
+
+// startWorkload starts a workload process, sending its summary (or nil when it has none) on the
+// returned channel once it exits.
+func (c *cluster) startWorkload(index int, history string) <-chan *workloadSummary {
+	cmd := c.command("-workload", durationFlag.String(), "-p", fmt.Sprint(portStart+index%*serversFlag),
+		"-history", history, "-verifier", verifierAddr, "-fault-seed", fmt.Sprint(*seedFlag+int64(100*index)))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Fatalln("Unable to start workload:", err)
+	}
+	if err := cmd.Start(); err != nil {
+		log.Fatalln("Unable to start workload:", err)
+	}
+	ch := make(chan *workloadSummary, 1)
+	go func() {
+		var summary *workloadSummary
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, workloadSummaryPrefix) {
+				summary = &workloadSummary{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, workloadSummaryPrefix)), summary); err != nil {
+					log.Println("Invalid workload summary:", err)
+					summary = nil
+				}
+			} else {
+				fmt.Println(line)
+			}
+		}
+		cmd.Wait()
+		ch <- summary
+	}()
+	return ch
+}
+
+// run kills and restarts servers per the scenario for duration.
+func (c *cluster) run(scenario string, duration, interval time.Duration, seed int64) {
+	random := rand.New(rand.NewSource(seed))
+	n := len(c.servers)
+	down := make(map[int]bool)
+	kill := func(index int) {
+		log.Println("Killing server", index)
+		c.killServer(index)
+		down[index] = true
+	}
+	restart := func(index int) {
+		log.Println("Restarting server", index)
+		c.startServer(index)
+		delete(down, index)
+	}
+
+	end := time.Now().Add(duration)
+	for round := 0; time.Now().Before(end); round++ {
+		switch scenario {
+		case "rolling":
+			index := round % n
+			kill(index)
+			time.Sleep(interval)
+			restart(index)
+		case "crash-loop":
+			kill(0)
+			restart(0)
+		case "random":
+			if index := random.Intn(n); down[index] {
+				restart(index)
+			} else if len(down) < n-(n/2+1) {
+				kill(index)
+			}
+		}
+		time.Sleep(interval)
+	}
+	for index := range down {
+		restart(index)
+	}
+}
+
+func main() {
+	flag.Parse()
+	log.SetPrefix("[dsync-chaos] ")
+	log.SetFlags(log.Lmicroseconds)
+
+	switch *scenarioFlag {
+	case "steady", "rolling", "crash-loop", "random":
+	default:
+		log.Fatalf("Unknown scenario %q (want steady, rolling, crash-loop or random)", *scenarioFlag)
+	}
+	if *clientsFlag < 1 {
+		log.Fatalln("Need at least one client")
+	}
+	history := *historyFlag
+	if history == "" {
+		dir, err := ioutil.TempDir("", "dsync-chaos")
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer os.RemoveAll(dir)
+		history = dir
+	} else if err := os.MkdirAll(history, 0755); err != nil {
+		log.Fatalln(err)
+	}
+
+	c := &cluster{args: flag.Args(), servers: make([]*exec.Cmd, *serversFlag)}
+	for i := range c.servers {
+		c.startServer(i)
+	}
+	verifier := c.command("-verify", "-verifier", verifierAddr)
+	verifier.Stdout = os.Stdout
+	if err := verifier.Start(); err != nil {
+		log.Fatalln("Unable to start verifier:", err)
+	}
+	time.Sleep(500 * time.Millisecond) // Give servers and verifier some time to start
+
+	start := time.Now()
+	var summaries []<-chan *workloadSummary
+	for i := 0; i < *clientsFlag; i++ {
+		summaries = append(summaries, c.startWorkload(i, history))
+	}
+	c.run(*scenarioFlag, *durationFlag, *intervalFlag, *seedFlag)
+
+	total := workloadSummary{Latency: &latencyHistogram{}, Grants: make(map[string]int)}
+	var violations []string
+	timeout := time.After(recoveryTimeout)
+	for i, ch := range summaries {
+		select {
+		case summary := <-ch:
+			if summary == nil {
+				violations = append(violations, fmt.Sprintf("workload %d exited without a summary", i))
+				continue
+			}
+			total.Acquired += summary.Acquired
+			total.FailedRounds += summary.FailedRounds
+			if summary.Latency != nil {
+				total.Latency.merge(summary.Latency)
+			}
+			for client, g := range summary.Grants {
+				total.Grants[client] += g
+			}
+			violations = append(violations, summary.Violations...)
+		case <-timeout:
+			violations = append(violations, fmt.Sprintf("workload %d did not finish", i))
+		}
+	}
+	elapsed := time.Since(start)
+	verifier.Process.Signal(syscall.SIGTERM)
+	if err := verifier.Wait(); err != nil {
+		violations = append(violations, "shared resource held by conflicting clients (see verifier)")
+	}
+	for i := range c.servers {
+		c.killServer(i)
+	}
+
+	check := c.command("-check-history", history)
+	check.Stdout = os.Stdout
+	if err := check.Run(); err != nil {
+		violations = append(violations, "lock history not linearizable")
+	}
+
+	fmt.Println()
+	fmt.Printf("Scenario:      %s (%d servers, %d clients, %v)\n", *scenarioFlag, *serversFlag, *clientsFlag, *durationFlag)
+	fmt.Printf("Locks granted: %d (%.1f/s)\n", total.Acquired, float64(total.Acquired)/elapsed.Seconds())
+	fmt.Printf("Latency:       %v\n", total.Latency)
+	fmt.Printf("Fairness:      %.2f (Jain's index of the locks granted per client)\n", fairness(total.Grants))
+	var clients []string
+	for client := range total.Grants {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	for _, client := range clients {
+		fmt.Printf("  %-12s %d locks\n", client, total.Grants[client])
+	}
+	fmt.Printf("Failed rounds: %d\n", total.FailedRounds)
+	fmt.Printf("Violations:    %d\n", len(violations))
+	for _, v := range violations {
+		fmt.Printf("  %s\n", v)
+	}
+	if len(violations) > 0 {
+		fmt.Println("Result:        FAILED")
+		os.Exit(1)
+	}
+	fmt.Println("Result:        PASSED")
+}
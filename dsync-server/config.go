@@ -0,0 +1,409 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// config is the configuration of the server, read from the configuration file and overridden by
+// the command line flags (see options).
+type config struct {
+	address         string
+	rpcPath         string
+	self            string
+	peers           []string
+	epoch           uint64
+	incarnationFile string
+	leaseTTL        time.Duration
+	maxReaders      int
+	drainTimeout    time.Duration
+	disconnectGrace time.Duration
+	rateLimit       float64
+	rateBurst       int
+
+	tlsCert       string
+	tlsKey        string
+	tlsCA         string
+	tlsClientAuth bool
+
+	tokens    []string
+	tokenFile string
+	token     string
+
+	maintenanceInterval      time.Duration
+	maintenanceSweepInterval time.Duration
+	maintenanceStaleAfter    time.Duration
+	maintenanceWorkers       int
+
+	logLevel dsync.LogLevel
+
+	metricsAddress string
+	metricsPath    string
+
+	backupEndpoint  string
+	backupName      string
+	backupInterval  time.Duration
+	backupAccessKey string
+	backupSecretKey string
+	backupRegion    string
+}
+
+func defaultConfig() config {
+	return config{
+		address:      ":9000",
+		rpcPath:      dsync.RpcPath,
+		drainTimeout: 10 * time.Second,
+		logLevel:     dsync.LogInfo,
+		metricsPath:  "/metrics",
+
+		backupInterval: 5 * time.Minute,
+	}
+}
+
+// option is a setting of the configuration, with key as its key in the configuration file and
+// the key with dots replaced by dashes as its command line flag.
+type option struct {
+	key  string
+	help string
+	list bool // Takes several values, as a YAML list or separated by commas
+	set  func(c *config, values []string) error
+}
+
+var options = []option{
+	{key: "address", help: "Address to listen on (host:port)", set: stringOption(func(c *config) *string { return &c.address })},
+	{key: "rpc-path", help: "RPC path to serve the lock handlers at", set: stringOption(func(c *config) *string { return &c.rpcPath })},
+	{key: "self", help: "Address of this server as known to its clients (host:port), announced to them when shutting down", set: stringOption(func(c *config) *string { return &c.self })},
+	{key: "peers", list: true, help: "Addresses of the other lock servers (host:port), a quorum of which must agree before a stale lock is purged", set: func(c *config, v []string) error { c.peers = v; return nil }},
+	{key: "epoch", help: "Cluster configuration epoch, requests for any other epoch are rejected", set: func(c *config, v []string) (err error) {
+		c.epoch, err = strconv.ParseUint(v[0], 10, 64)
+		return err
+	}},
+	{key: "incarnation-file", help: "File to persist the boot counter of the server in (time based incarnations when empty)", set: stringOption(func(c *config) *string { return &c.incarnationFile })},
+	{key: "lease-ttl", help: "Lease for granted locks, renewed by the lock maintenance (0 disables leases)", set: durationOption(func(c *config) *time.Duration { return &c.leaseTTL })},
+	{key: "max-readers", help: "Maximum number of read locks held simultaneously per name on this server (0 is unlimited)", set: intOption(func(c *config) *int { return &c.maxReaders })},
+	{key: "rate-limit", help: "Lock requests per second granted to every client node (0 is unlimited)", set: func(c *config, v []string) (err error) {
+		c.rateLimit, err = strconv.ParseFloat(v[0], 64)
+		return err
+	}},
+	{key: "rate-burst", help: "Lock requests a client node may make at once beyond rate-limit", set: intOption(func(c *config) *int { return &c.rateBurst })},
+	{key: "drain-timeout", help: "Time to wait for the holders of locks to release them when shutting down", set: durationOption(func(c *config) *time.Duration { return &c.drainTimeout })},
+	{key: "disconnect-grace", help: "Time after the connection of a client closes until its locks are released, unless it confirms holding them (0 leaves them to the lock maintenance)", set: durationOption(func(c *config) *time.Duration { return &c.disconnectGrace })},
+
+	{key: "tls.cert", help: "Certificate to serve TLS with (PEM), also presented to peers and clients", set: stringOption(func(c *config) *string { return &c.tlsCert })},
+	{key: "tls.key", help: "Private key of the certificate (PEM)", set: stringOption(func(c *config) *string { return &c.tlsKey })},
+	{key: "tls.ca", help: "Certificate authorities to verify peers and clients with (PEM, the system pool when empty)", set: stringOption(func(c *config) *string { return &c.tlsCA })},
+	{key: "tls.client-auth", help: "Require clients to present a certificate signed by tls.ca", set: func(c *config, v []string) (err error) {
+		c.tlsClientAuth, err = strconv.ParseBool(v[0])
+		return err
+	}},
+
+	{key: "auth.tokens", list: true, help: "Tokens that requests must carry (any request when there are none)", set: func(c *config, v []string) error { c.tokens = v; return nil }},
+	{key: "auth.token-file", help: "File with further tokens that requests may carry, one per line", set: stringOption(func(c *config) *string { return &c.tokenFile })},
+	{key: "auth.token", help: "Token to authenticate with when calling peers and clients", set: stringOption(func(c *config) *string { return &c.token })},
+
+	{key: "maintenance.interval", help: "Interval between passes of the lock maintenance", set: durationOption(func(c *config) *time.Duration { return &c.maintenanceInterval })},
+	{key: "maintenance.sweep-interval", help: "Interval between sweeps of the expired leases (0 sweeps every maintenance.interval)", set: durationOption(func(c *config) *time.Duration { return &c.maintenanceSweepInterval })},
+	{key: "maintenance.stale-after", help: "Time after which a lock is verified with its client", set: durationOption(func(c *config) *time.Duration { return &c.maintenanceStaleAfter })},
+	{key: "maintenance.workers", help: "Clients verified concurrently by the lock maintenance", set: intOption(func(c *config) *int { return &c.maintenanceWorkers })},
+
+	{key: "log.level", help: "Minimum level of the messages logged: debug, info, warn or error", set: func(c *config, v []string) (err error) {
+		c.logLevel, err = parseLogLevel(v[0])
+		return err
+	}},
+
+	{key: "metrics.address", help: "Address to serve the metrics on (host:port), on the address of the lock handlers when empty", set: stringOption(func(c *config) *string { return &c.metricsAddress })},
+	{key: "metrics.path", help: "Path to serve the metrics at in the Prometheus text format (none when empty)", set: stringOption(func(c *config) *string { return &c.metricsPath })},
+
+	{key: "backup.endpoint", help: "URL of a bucket (and prefix) of an S3-compatible endpoint to back up lock snapshots and events to, eg. https://s3.amazonaws.com/backups/dsync (disabled when empty)", set: stringOption(func(c *config) *string { return &c.backupEndpoint })},
+	{key: "backup.name", help: "Name of the server, under which its backups are stored (self, or else address, when empty)", set: stringOption(func(c *config) *string { return &c.backupName })},
+	{key: "backup.interval", help: "Interval between backups", set: durationOption(func(c *config) *time.Duration { return &c.backupInterval })},
+	{key: "backup.access-key", help: "Access key of the backup endpoint (AWS_ACCESS_KEY_ID when empty)", set: stringOption(func(c *config) *string { return &c.backupAccessKey })},
+	{key: "backup.secret-key", help: "Secret key of the backup endpoint (AWS_SECRET_ACCESS_KEY when empty)", set: stringOption(func(c *config) *string { return &c.backupSecretKey })},
+	{key: "backup.region", help: "Region of the backup endpoint (AWS_REGION, or else us-east-1, when empty)", set: stringOption(func(c *config) *string { return &c.backupRegion })},
+}
+
+func stringOption(field func(c *config) *string) func(c *config, v []string) error {
+	return func(c *config, v []string) error {
+		*field(c) = v[0]
+		return nil
+	}
+}
+
+func intOption(field func(c *config) *int) func(c *config, v []string) (err error) {
+	return func(c *config, v []string) (err error) {
+		*field(c), err = strconv.Atoi(v[0])
+		return err
+	}
+}
+
+func durationOption(field func(c *config) *time.Duration) func(c *config, v []string) error {
+	return func(c *config, v []string) (err error) {
+		*field(c), err = time.ParseDuration(v[0])
+		return err
+	}
+}
+
+func parseLogLevel(s string) (dsync.LogLevel, error) {
+	for _, level := range []dsync.LogLevel{dsync.LogDebug, dsync.LogInfo, dsync.LogWarn, dsync.LogError} {
+		if strings.EqualFold(s, level.String()) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// lookupOption returns the option for key.
+func lookupOption(key string) (option, bool) {
+	for _, o := range options {
+		if o.key == key {
+			return o, true
+		}
+	}
+	return option{}, false
+}
+
+// apply sets the option key of c to the (comma separated when a list) value.
+func (c *config) apply(key string, values []string) error {
+	o, ok := lookupOption(key)
+	if !ok {
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	if o.list && len(values) == 1 {
+		values = splitList(values[0])
+	} else if !o.list && len(values) != 1 {
+		return fmt.Errorf("%s takes a single value", key)
+	}
+	if err := o.set(c, values); err != nil {
+		return fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return nil
+}
+
+func splitList(s string) []string {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// loadFile applies the settings of the configuration file at path to c.
+func (c *config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	settings, err := parseYAML(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, s := range settings {
+		if err := c.apply(s.key, s.values); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, s.line, err)
+		}
+	}
+	return nil
+}
+
+// loadTokenFile returns the tokens in the file at path, one per line (skipping blank lines and
+// comments starting with #).
+func loadTokenFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, nil
+}
+
+// validate verifies that the configuration is consistent.
+func (c *config) validate() error {
+	if c.address == "" {
+		return fmt.Errorf("address must be set")
+	}
+	if (c.tlsCert == "") != (c.tlsKey == "") {
+		return fmt.Errorf("tls.cert and tls.key must be set together")
+	}
+	if c.tlsClientAuth && c.tlsCA == "" {
+		return fmt.Errorf("tls.client-auth requires tls.ca")
+	}
+	if c.leaseTTL < 0 || c.maxReaders < 0 || c.rateLimit < 0 || c.rateBurst < 0 || c.drainTimeout < 0 || c.disconnectGrace < 0 || c.maintenanceInterval < 0 || c.maintenanceSweepInterval < 0 || c.maintenanceStaleAfter < 0 || c.maintenanceWorkers < 0 {
+		return fmt.Errorf("durations and counts must not be negative")
+	}
+	if c.backupEndpoint != "" && c.backupInterval <= 0 {
+		return fmt.Errorf("backup.interval must be positive")
+	}
+	return nil
+}
+
+// setting is a setting of a configuration file, with the dotted path of its key.
+type setting struct {
+	key    string
+	values []string
+	line   int
+}
+
+// parseYAML parses the subset of YAML used by configuration files: nested mappings of scalars
+// (plain, single or double quoted) and lists of scalars (as block or flow sequence), eg.
+//
+//	address: ":9000"
+//	peers:
+//	  - 10.0.0.2:9000
+//	  - 10.0.0.3:9000
+//	tls:
+//	  cert: /etc/dsync/public.crt  # Comment
+//
+// returning a setting for every scalar or list, keyed by the path of keys leading to it ("tls.cert").
+func parseYAML(data []byte) ([]setting, error) {
+	type section struct {
+		indent int
+		prefix string
+	}
+	sections := []section{{indent: -1}}
+	var settings []setting
+	var pending *setting // Key without value on the same line, a section or a block sequence
+	pendingIndent := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(stripComment(scanner.Text()), " \t")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || line == 1 && content == "---" {
+			continue
+		}
+		indent := len(text) - len(content)
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", line)
+		}
+
+		if content == "-" || strings.HasPrefix(content, "- ") {
+			if pending == nil || indent < pendingIndent {
+				return nil, fmt.Errorf("line %d: list item without key", line)
+			}
+			value, err := unquote(strings.TrimSpace(content[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			pending.values = append(pending.values, value)
+			continue
+		}
+		if pending != nil {
+			if len(pending.values) > 0 {
+				settings = append(settings, *pending)
+				sections = sections[:len(sections)-1] // A list, not a section
+			} else if indent <= pendingIndent {
+				settings = append(settings, setting{key: pending.key, values: []string{""}, line: pending.line})
+			}
+			pending = nil
+		}
+
+		colon := strings.Index(content, ":")
+		if colon <= 0 || colon+1 < len(content) && content[colon+1] != ' ' {
+			return nil, fmt.Errorf("line %d: expected key: value", line)
+		}
+		for indent <= sections[len(sections)-1].indent {
+			sections = sections[:len(sections)-1]
+		}
+		key := sections[len(sections)-1].prefix + strings.TrimSpace(content[:colon])
+		value := strings.TrimSpace(content[colon+1:])
+		switch {
+		case value == "":
+			pending, pendingIndent = &setting{key: key, line: line}, indent
+			sections = append(sections, section{indent: indent, prefix: key + "."})
+		case strings.HasPrefix(value, "["):
+			if !strings.HasSuffix(value, "]") {
+				return nil, fmt.Errorf("line %d: unterminated list", line)
+			}
+			values := []string{}
+			for _, v := range strings.Split(value[1:len(value)-1], ",") {
+				if v = strings.TrimSpace(v); v == "" {
+					continue
+				}
+				v, err := unquote(v)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", line, err)
+				}
+				values = append(values, v)
+			}
+			settings = append(settings, setting{key: key, values: values, line: line})
+		default:
+			v, err := unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			settings = append(settings, setting{key: key, values: []string{v}, line: line})
+		}
+	}
+	if pending != nil {
+		if len(pending.values) == 0 {
+			pending.values = []string{""}
+		}
+		settings = append(settings, *pending)
+	}
+	return settings, scanner.Err()
+}
+
+// stripComment removes a comment (starting with a # at the start of the line or after a space,
+// outside of quotes) from a line.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// unquote returns the value of a plain, single or double quoted scalar.
+func unquote(s string) (string, error) {
+	switch {
+	case len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"':
+		return strconv.Unquote(s)
+	case len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'':
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case strings.HasPrefix(s, "\"") || strings.HasPrefix(s, "'"):
+		return "", fmt.Errorf("unterminated quote in %s", s)
+	}
+	return s, nil
+}
@@ -0,0 +1,113 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+func TestParseYAML(t *testing.T) {
+	doc := `---
+# Lock server
+address: "0.0.0.0:9000"   # All interfaces
+self: 10.0.0.1:9000
+peers:
+  - 10.0.0.2:9000
+  - '10.0.0.3:9000'
+lease-ttl: 5m
+tls:
+  cert: /etc/dsync/public.crt
+  key: "/etc/dsync/#private.key"
+auth:
+  tokens: [secret-1, "secret-2"]
+  token-file:
+maintenance:
+  interval: 30s
+log:
+  level: debug
+`
+	settings, err := parseYAML([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range settings {
+		got = append(got, s.key)
+	}
+	want := []string{"address", "self", "peers", "lease-ttl", "tls.cert", "tls.key", "auth.tokens", "auth.token-file", "maintenance.interval", "log.level"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Expected keys %v, got %v", want, got)
+	}
+
+	cfg := defaultConfig()
+	for _, s := range settings {
+		if err := cfg.apply(s.key, s.values); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cfg.address != "0.0.0.0:9000" || cfg.tlsKey != "/etc/dsync/#private.key" || cfg.leaseTTL != 5*time.Minute ||
+		cfg.maintenanceInterval != 30*time.Second || cfg.logLevel != dsync.LogDebug || cfg.rpcPath != dsync.RpcPath {
+		t.Fatalf("Unexpected configuration %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.peers, []string{"10.0.0.2:9000", "10.0.0.3:9000"}) || !reflect.DeepEqual(cfg.tokens, []string{"secret-1", "secret-2"}) {
+		t.Fatalf("Unexpected lists %v and %v", cfg.peers, cfg.tokens)
+	}
+	if err := cfg.apply("peers", []string{"a:1, b:2"}); err != nil || !reflect.DeepEqual(cfg.peers, []string{"a:1", "b:2"}) {
+		t.Fatalf("Expected peers from a flag to be split, got %v (%v)", cfg.peers, err)
+	}
+
+	for _, invalid := range []string{"address 0.0.0.0", "- item", "tls:\n\tcert: x", "key: \"unterminated"} {
+		if _, err := parseYAML([]byte(invalid)); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+	if err := cfg.apply("listen", []string{":9000"}); err == nil {
+		t.Error("Expected an unknown setting to be rejected")
+	}
+	if err := cfg.apply("lease-ttl", []string{"5"}); err == nil {
+		t.Error("Expected an invalid duration to be rejected")
+	}
+}
+
+func TestBackupConfig(t *testing.T) {
+	os.Setenv("AWS_ACCESS_KEY_ID", "access")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	cfg := defaultConfig()
+	cfg.self = "10.0.0.1:9000"
+	if err := cfg.apply("backup.endpoint", []string{"http://127.0.0.1:9001/backups"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.apply("backup.secret-key", []string{"other"}); err != nil {
+		t.Fatal(err)
+	}
+	bc := backupConfig(cfg)
+	if bc.Name != cfg.self || bc.Interval != 5*time.Minute || bc.AccessKey != "access" || bc.SecretKey != "other" {
+		t.Fatalf("Expected the name of the server, the default interval and the missing credentials from the environment, got %+v", bc)
+	}
+	cfg.backupInterval = 0
+	if err := cfg.validate(); err == nil {
+		t.Fatal("Expected backups without an interval to be rejected")
+	}
+}
@@ -0,0 +1,417 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command dsync-server runs a standalone lock server of the server package, for applications that
+// lock through dsync without serving the lock handlers themselves, eg.
+//
+//	dsync-server -config /etc/dsync/dsync-server.yaml
+//
+// The settings of the configuration file (see dsync-server.yaml) can be overridden by command
+// line flags of the same name, with dots replaced by dashes (-tls-cert for tls.cert). It shuts down
+// on SIGINT or SIGTERM, draining the locks first (see server.Server.Drain), as run by systemd with
+// dsync-server.service, and reloads its configuration on SIGHUP (or dsyncctl reload) without
+// dropping the locks held.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/minio/dsync"
+	"github.com/minio/dsync/server"
+)
+
+var configFlag = flag.String("config", "", "Configuration file (YAML)")
+
+// override is a setting of a command line flag.
+type override struct {
+	key   string
+	value string
+}
+
+func main() {
+	// Flags override the configuration file, so they are only applied once it has been read
+	var overrides []override
+	for _, o := range options {
+		key := o.key
+		flag.Func(strings.Replace(key, ".", "-", -1), o.help, func(v string) error {
+			overrides = append(overrides, override{key, v})
+			return nil
+		})
+	}
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	load := func() (config, error) {
+		return loadConfig(*configFlag, overrides)
+	}
+	cfg, err := load()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if err := run(cfg, load); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// loadConfig returns the configuration of the file at path (the defaults when empty) overridden by
+// the flags.
+func loadConfig(path string, overrides []override) (config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return cfg, fmt.Errorf("Unable to load configuration: %v", err)
+		}
+	}
+	for _, o := range overrides {
+		if err := cfg.apply(o.key, []string{o.value}); err != nil {
+			return cfg, fmt.Errorf("Invalid flag: %v", err)
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		return cfg, fmt.Errorf("Invalid configuration: %v", err)
+	}
+	return cfg, nil
+}
+
+// serverConfig returns the configuration of the lock server for the tunables of cfg (see
+// server.Server.Reconfigure), logging to logger.
+func serverConfig(cfg config, logger dsync.Logger) (server.Config, error) {
+	tokens := cfg.tokens
+	if cfg.tokenFile != "" {
+		fileTokens, err := loadTokenFile(cfg.tokenFile)
+		if err != nil {
+			return server.Config{}, fmt.Errorf("Unable to load tokens: %v", err)
+		}
+		tokens = append(append([]string(nil), tokens...), fileTokens...)
+	}
+	return server.Config{
+		LeaseTTL:   cfg.leaseTTL,
+		MaxReaders: cfg.maxReaders,
+		Tokens:     tokens,
+		RateLimit:  cfg.rateLimit,
+		RateBurst:  cfg.rateBurst,
+		Maintenance: server.MaintenanceConfig{
+			Interval:      cfg.maintenanceInterval,
+			SweepInterval: cfg.maintenanceSweepInterval,
+			StaleAfter:    cfg.maintenanceStaleAfter,
+			Workers:       cfg.maintenanceWorkers,
+		},
+		Logger: logger,
+	}, nil
+}
+
+// backupConfig returns the configuration of the backups of cfg, taking the credentials and region
+// that are not set from the environment.
+func backupConfig(cfg config) server.BackupConfig {
+	bc := server.BackupConfig{
+		Endpoint:  cfg.backupEndpoint,
+		Name:      cfg.backupName,
+		Interval:  cfg.backupInterval,
+		AccessKey: cfg.backupAccessKey,
+		SecretKey: cfg.backupSecretKey,
+		Region:    cfg.backupRegion,
+	}
+	if bc.Name == "" {
+		bc.Name = cfg.self
+	}
+	if bc.Name == "" {
+		bc.Name = cfg.address
+	}
+	if bc.AccessKey == "" {
+		bc.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if bc.SecretKey == "" {
+		bc.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if bc.Region == "" {
+		bc.Region = os.Getenv("AWS_REGION")
+	}
+	return bc
+}
+
+// run serves the lock server configured by cfg until it is signalled to shut down, reloading the
+// configuration with load when asked to.
+func run(cfg config, load func() (config, error)) error {
+	logger := &levelLogger{}
+	logger.setLevel(cfg.logLevel)
+	sc, err := serverConfig(cfg, logger)
+	if err != nil {
+		return err
+	}
+	cert := &certificate{}
+	serverTLS, clientTLS, err := loadTLS(cfg, cert)
+	if err != nil {
+		return fmt.Errorf("Unable to load TLS configuration: %v", err)
+	}
+	incarnation, err := server.NextIncarnation(cfg.incarnationFile)
+	if err != nil {
+		return fmt.Errorf("Unable to determine incarnation: %v", err)
+	}
+
+	var s *server.Server
+	var mutex sync.Mutex // Serializes reloads, guards current
+	current := cfg
+	reload := func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		cfg, err := load()
+		if err != nil {
+			return err
+		}
+		sc, err := serverConfig(cfg, logger)
+		if err != nil {
+			return err
+		}
+		if cfg.tlsCert != "" && current.tlsCert != "" {
+			if err := cert.load(cfg.tlsCert, cfg.tlsKey); err != nil {
+				return fmt.Errorf("Unable to load TLS certificate: %v", err)
+			}
+		}
+		if err := s.Reconfigure(sc); err != nil {
+			return err
+		}
+		logger.setLevel(cfg.logLevel)
+		if keys := restartRequired(current, cfg); len(keys) > 0 {
+			logger.Log(dsync.LogWarn, "Settings changed that only take effect on a restart", "settings", strings.Join(keys, ","))
+		}
+		current.leaseTTL, current.maxReaders, current.drainTimeout, current.logLevel = cfg.leaseTTL, cfg.maxReaders, cfg.drainTimeout, cfg.logLevel
+		current.tokens, current.tokenFile, current.rateLimit, current.rateBurst = cfg.tokens, cfg.tokenFile, cfg.rateLimit, cfg.rateBurst
+		current.maintenanceInterval, current.maintenanceStaleAfter, current.maintenanceWorkers = cfg.maintenanceInterval, cfg.maintenanceStaleAfter, cfg.maintenanceWorkers
+		current.maintenanceSweepInterval = cfg.maintenanceSweepInterval
+		current.tlsCert, current.tlsKey = cfg.tlsCert, cfg.tlsKey
+		return nil
+	}
+
+	peers := make([]dsync.RPC, len(cfg.peers))
+	for i, peer := range cfg.peers {
+		peers[i] = server.NewTLSClient(peer, cfg.rpcPath, cfg.token, clientTLS)
+	}
+	sc.Self = dsync.Identity{Node: cfg.self, Path: cfg.rpcPath}
+	sc.Incarnation = incarnation
+	sc.Epoch = cfg.epoch
+	sc.Resolver = &server.ClientPool{Token: cfg.token, TLSConfig: clientTLS}
+	sc.Peers = peers
+	sc.Reloader = reload
+	sc.DisconnectGrace = cfg.disconnectGrace
+	if cfg.incarnationFile != "" {
+		sc.Assume = func(incarnation uint64) error { return server.StoreIncarnation(cfg.incarnationFile, incarnation) }
+	}
+	s = server.New(sc)
+	if cfg.backupEndpoint != "" {
+		if err := s.StartBackups(backupConfig(cfg)); err != nil {
+			return fmt.Errorf("Unable to start backups: %v", err)
+		}
+	}
+
+	mux := http.NewServeMux()
+	if err := s.HandleHTTP(mux, cfg.rpcPath); err != nil {
+		return err
+	}
+	handleProbes := func(mux *http.ServeMux) {
+		mux.Handle("/health", s.HealthHandler())
+		mux.Handle("/ready", s.ReadyHandler())
+	}
+	handleProbes(mux)
+	var servers []*http.Server
+	serve := func(address string, handler http.Handler, tlsConfig *tls.Config) error {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+		}
+		srv := &http.Server{Handler: handler}
+		servers = append(servers, srv)
+		go func() {
+			if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				logger.Log(dsync.LogError, "Unable to serve", "address", address, "err", err)
+			}
+		}()
+		return nil
+	}
+	if cfg.metricsPath != "" {
+		if cfg.metricsAddress != "" {
+			metrics := http.NewServeMux()
+			metrics.Handle(cfg.metricsPath, s.MetricsHandler())
+			handleProbes(metrics)
+			if err := serve(cfg.metricsAddress, metrics, nil); err != nil {
+				return err
+			}
+		} else {
+			mux.Handle(cfg.metricsPath, s.MetricsHandler())
+		}
+	}
+	if err := serve(cfg.address, mux, serverTLS); err != nil {
+		return err
+	}
+	s.Start()
+	logger.Log(dsync.LogInfo, "Serving locks", "address", cfg.address, "incarnation", incarnation, "epoch", cfg.epoch, "tls", serverTLS != nil)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			if err := reload(); err != nil {
+				logger.Log(dsync.LogError, "Unable to reload configuration, keeping the current one", "err", err)
+			}
+			continue
+		}
+		logger.Log(dsync.LogInfo, "Shutting down", "signal", sig)
+		mutex.Lock()
+		drainTimeout := current.drainTimeout
+		mutex.Unlock()
+		s.Drain(drainTimeout)
+		break
+	}
+	s.Close()
+	for _, srv := range servers {
+		srv.Close()
+	}
+	return nil
+}
+
+// restartRequired returns the keys of the settings that differ between old and new and are not
+// changed by a reload.
+func restartRequired(old, new config) []string {
+	var keys []string
+	changed := func(key string, differs bool) {
+		if differs {
+			keys = append(keys, key)
+		}
+	}
+	changed("address", old.address != new.address)
+	changed("rpc-path", old.rpcPath != new.rpcPath)
+	changed("self", old.self != new.self)
+	changed("peers", strings.Join(old.peers, ",") != strings.Join(new.peers, ","))
+	changed("epoch", old.epoch != new.epoch)
+	changed("incarnation-file", old.incarnationFile != new.incarnationFile)
+	changed("disconnect-grace", old.disconnectGrace != new.disconnectGrace)
+	changed("tls.cert", (old.tlsCert == "") != (new.tlsCert == ""))
+	changed("tls.ca", old.tlsCA != new.tlsCA)
+	changed("tls.client-auth", old.tlsClientAuth != new.tlsClientAuth)
+	changed("auth.token", old.token != new.token)
+	changed("metrics.address", old.metricsAddress != new.metricsAddress)
+	changed("metrics.path", old.metricsPath != new.metricsPath)
+	changed("backup.endpoint", old.backupEndpoint != new.backupEndpoint)
+	changed("backup.name", old.backupName != new.backupName)
+	changed("backup.interval", old.backupInterval != new.backupInterval)
+	changed("backup.access-key", old.backupAccessKey != new.backupAccessKey)
+	changed("backup.secret-key", old.backupSecretKey != new.backupSecretKey)
+	changed("backup.region", old.backupRegion != new.backupRegion)
+	return keys
+}
+
+// certificate holds the certificate of the server, which is replaced when reloaded.
+type certificate struct {
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+func (c *certificate) load(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+func (c *certificate) get() *tls.Certificate {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert
+}
+
+// loadTLS returns the configuration to serve TLS with and to dial peers and clients with, both nil
+// unless a certificate is configured, which is loaded into cert (and served from it, so that
+// reloading cert takes effect for new connections).
+func loadTLS(cfg config, cert *certificate) (serverTLS, clientTLS *tls.Config, err error) {
+	if cfg.tlsCert == "" {
+		return nil, nil, nil
+	}
+	if err = cert.load(cfg.tlsCert, cfg.tlsKey); err != nil {
+		return nil, nil, err
+	}
+	pool, err := loadCertPool(cfg.tlsCA)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverTLS = &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return cert.get(), nil },
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cfg.tlsClientAuth {
+		serverTLS.ClientCAs, serverTLS.ClientAuth = pool, tls.RequireAndVerifyClientCert
+	}
+	clientTLS = &tls.Config{
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert.get(), nil },
+		RootCAs:              pool,
+		MinVersion:           tls.VersionTLS12,
+	}
+	return serverTLS, clientTLS, nil
+}
+
+// loadCertPool returns the certificate authorities of the PEM file at path, nil (the system pool)
+// when path is empty.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	if path == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+	return pool, nil
+}
+
+// levelLogger logs the messages of at least its level with the standard logger, the level
+// changing when the configuration is reloaded.
+type levelLogger struct {
+	level int32 // dsync.LogLevel
+}
+
+func (l *levelLogger) setLevel(level dsync.LogLevel) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+func (l *levelLogger) Log(level dsync.LogLevel, msg string, keysAndValues ...interface{}) {
+	min := dsync.LogLevel(atomic.LoadInt32(&l.level))
+	dsync.NewStdLogger(nil, min).Log(level, msg, keysAndValues...)
+}
@@ -17,41 +17,100 @@
 package dsync_test
 
 import (
-	"errors"
 	"fmt"
 	. "github.com/minio/dsync"
+	"strings"
 	"sync"
 	"time"
 )
 
-// used when cached timestamp do not match with what client remembers.
-var errInvalidTimestamp = errors.New("Timestamps don't match, server may have restarted.")
-
 const WriteLock = -1
 
 type lockServer struct {
 	mutex sync.Mutex
 	// Map of locks, with negative value indicating (exclusive) write lock
 	// and positive values indicating number of read locks
-	lockMap   map[string]int64
-	timestamp time.Time // Timestamp set at the time of initialization. Resets naturally on minio server restart.
+	lockMap      map[string]int64
+	reservations map[string]reservation // Locks reserved by PrepareLock or PrepareRLock until committed, keyed by uid
+	persistent   map[string]LockArgs    // Request of the persistent lock on a name, keyed by name
+	incarnation  uint64                 // Incarnation set at the time of initialization. Changes naturally on minio server restart.
+	epoch        uint64                 // Cluster configuration epoch, requests for any other epoch are rejected.
+}
+
+type reservation struct {
+	name   string
+	writer bool
+	until  time.Time
 }
 
 func (l *lockServer) verifyArgs(args *LockArgs) error {
-	if !l.timestamp.Equal(args.Timestamp) {
-		return errInvalidTimestamp
+	if err := CheckVersion(args.Version); err != nil {
+		return err
+	}
+	if err := CheckIncarnation(l.incarnation, args.Incarnation); err != nil {
+		return err
+	}
+	if l.epoch != args.Epoch {
+		return EpochMismatchError{ServerEpoch: l.epoch, ClientEpoch: args.Epoch}
 	}
 	return nil
 }
 
-func (l *lockServer) Lock(args *LockArgs, reply *bool) error {
+// stamped replies to a request acquiring a lock with handler, stamping the reply with the epoch of the server
+func (l *lockServer) stamped(handler func(*LockArgs, *bool) error, args *LockArgs, reply *LockReply) error {
+	reply.Epoch = l.epoch
+	return handler(args, &reply.Granted)
+}
+
+func (l *lockServer) Lock(args *LockArgs, reply *LockReply) error {
+	return l.stamped(l.lock, args, reply)
+}
+
+func (l *lockServer) RLock(args *LockArgs, reply *LockReply) error {
+	return l.stamped(l.rlock, args, reply)
+}
+
+func (l *lockServer) LockWait(args *LockArgs, reply *LockReply) error {
+	return l.stamped(l.lockWait, args, reply)
+}
+
+func (l *lockServer) RLockWait(args *LockArgs, reply *LockReply) error {
+	return l.stamped(l.rlockWait, args, reply)
+}
+
+func (l *lockServer) PrepareLock(args *LockArgs, reply *LockReply) error {
+	return l.stamped(l.prepareLock, args, reply)
+}
+
+func (l *lockServer) PrepareRLock(args *LockArgs, reply *LockReply) error {
+	return l.stamped(l.prepareRLock, args, reply)
+}
+
+func (l *lockServer) LockBatch(args *LockArgs, reply *LockReply) error {
+	return l.stamped(l.lockBatch, args, reply)
+}
+
+func (l *lockServer) LockPersistent(args *LockArgs, reply *LockReply) error {
+	return l.stamped(l.lockPersistent, args, reply)
+}
+
+func (l *lockServer) TakeOver(args *LockArgs, reply *LockReply) error {
+	return l.stamped(l.takeOver, args, reply)
+}
+
+func (l *lockServer) lock(args *LockArgs, reply *bool) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 	if err := l.verifyArgs(args); err != nil {
 		return err
 	}
+	l.expireReservations()
 	if _, *reply = l.lockMap[args.Name]; !*reply {
 		l.lockMap[args.Name] = WriteLock // No locks held on the given name, so claim write lock
+	} else {
+		// Denied, so have the holder hand back the lock if it retains it (as all clients
+		// of the tests run in this process, the callback to its node is a direct call)
+		RevokeRetained(args.Namespace, args.Name)
 	}
 	*reply = !*reply // Negate *reply to return true when lock is granted or false otherwise
 	return nil
@@ -65,23 +124,25 @@ func (l *lockServer) Unlock(args *LockArgs, reply *bool) error {
 	}
 	var locksHeld int64
 	if locksHeld, *reply = l.lockMap[args.Name]; !*reply { // No lock is held on the given name
-		return fmt.Errorf("Unlock attempted on an unlocked entity: %s", args.Name)
+		return LockServerError(ErrLockNotHeld, "Unlock attempted on an unlocked entity: "+args.Name)
 	}
 	if *reply = locksHeld == WriteLock; !*reply { // Unless it is a write lock
-		return fmt.Errorf("Unlock attempted on a read locked entity: %s (%d read locks active)", args.Name, locksHeld)
+		return LockServerError(ErrReadLockHeld, fmt.Sprintf("Unlock attempted on a read locked entity: %s (%d read locks active)", args.Name, locksHeld))
 	}
 	delete(l.lockMap, args.Name) // Remove the write lock
+	delete(l.reservations, args.UID)
 	return nil
 }
 
 const ReadLock = 1
 
-func (l *lockServer) RLock(args *LockArgs, reply *bool) error {
+func (l *lockServer) rlock(args *LockArgs, reply *bool) error {
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 	if err := l.verifyArgs(args); err != nil {
 		return err
 	}
+	l.expireReservations()
 	var locksHeld int64
 	if locksHeld, *reply = l.lockMap[args.Name]; !*reply {
 		l.lockMap[args.Name] = ReadLock // No locks held on the given name, so claim (first) read lock
@@ -102,17 +163,23 @@ func (l *lockServer) RUnlock(args *LockArgs, reply *bool) error {
 	}
 	var locksHeld int64
 	if locksHeld, *reply = l.lockMap[args.Name]; !*reply { // No lock is held on the given name
-		return fmt.Errorf("RUnlock attempted on an unlocked entity: %s", args.Name)
+		return LockServerError(ErrLockNotHeld, "RUnlock attempted on an unlocked entity: "+args.Name)
 	}
 	if *reply = locksHeld != WriteLock; !*reply { // A write-lock is held, cannot release a read lock
-		return fmt.Errorf("RUnlock attempted on a write locked entity: %s", args.Name)
+		return LockServerError(ErrWriteLockHeld, "RUnlock attempted on a write locked entity: "+args.Name)
 	}
-	if locksHeld > ReadLock {
-		l.lockMap[args.Name] = locksHeld - ReadLock // Remove one of the read locks held
+	l.release(args.Name, false)
+	delete(l.reservations, args.UID)
+	return nil
+}
+
+// release removes a single write or read lock held on name, should be called with the mutex held
+func (l *lockServer) release(name string, writer bool) {
+	if locksHeld := l.lockMap[name]; !writer && locksHeld > ReadLock {
+		l.lockMap[name] = locksHeld - ReadLock // Remove one of the read locks held
 	} else {
-		delete(l.lockMap, args.Name) // Remove the (last) read lock
+		delete(l.lockMap, name) // Remove the write lock or (last) read lock
 	}
-	return nil
 }
 
 func (l *lockServer) ForceUnlock(args *LockArgs, reply *bool) error {
@@ -127,6 +194,181 @@ func (l *lockServer) ForceUnlock(args *LockArgs, reply *bool) error {
 	if _, ok := l.lockMap[args.Name]; ok { // Only clear lock when set
 		delete(l.lockMap, args.Name) // Remove the lock (irrespective of write or read lock)
 	}
+	for uid, r := range l.reservations {
+		if r.name == args.Name {
+			delete(l.reservations, uid)
+		}
+	}
 	*reply = true
 	return nil
 }
+
+// Interval at which parked requests check whether the lock has freed up
+const lockWaitPoll = 5 * time.Millisecond
+
+func (l *lockServer) lockWait(args *LockArgs, reply *bool) error {
+	deadline := time.Now().Add(args.WaitTimeout)
+	for {
+		if err := l.lock(args, reply); err != nil || *reply || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(lockWaitPoll)
+	}
+}
+
+func (l *lockServer) Watch(args *LockArgs, reply *bool) error {
+	deadline := time.Now().Add(args.WaitTimeout)
+	for waited := false; ; waited = true {
+		l.mutex.Lock()
+		if err := l.verifyArgs(args); err != nil {
+			l.mutex.Unlock()
+			return err
+		}
+		_, locked := l.lockMap[args.Name]
+		l.mutex.Unlock()
+		if *reply = !locked && waited; !locked || time.Now().After(deadline) {
+			return nil // Released while waiting, or not locked at all (so no release to notify of)
+		}
+		time.Sleep(lockWaitPoll)
+	}
+}
+
+func (l *lockServer) rlockWait(args *LockArgs, reply *bool) error {
+	deadline := time.Now().Add(args.WaitTimeout)
+	for {
+		if err := l.rlock(args, reply); err != nil || *reply || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(lockWaitPoll)
+	}
+}
+
+func (l *lockServer) prepareLock(args *LockArgs, reply *bool) error {
+	if err := l.lock(args, reply); err != nil || !*reply {
+		return err
+	}
+	l.reserve(args, true)
+	return nil
+}
+
+func (l *lockServer) prepareRLock(args *LockArgs, reply *bool) error {
+	if err := l.rlock(args, reply); err != nil || !*reply {
+		return err
+	}
+	l.reserve(args, false)
+	return nil
+}
+
+func (l *lockServer) reserve(args *LockArgs, writer bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.reservations == nil {
+		l.reservations = make(map[string]reservation)
+	}
+	l.reservations[args.UID] = reservation{name: args.Name, writer: writer, until: time.Now().Add(args.Reservation)}
+}
+
+func (l *lockServer) Commit(args *LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.verifyArgs(args); err != nil {
+		return err
+	}
+	l.expireReservations()
+	if _, *reply = l.reservations[args.UID]; *reply {
+		delete(l.reservations, args.UID) // Reservation is a regular lock from now on
+	}
+	return nil
+}
+
+// expireReservations releases all reservations that have lapsed, should be called with the mutex held
+func (l *lockServer) expireReservations() {
+	for uid, r := range l.reservations {
+		if time.Now().After(r.until) {
+			l.release(r.name, r.writer)
+			delete(l.reservations, uid)
+		}
+	}
+}
+
+func (l *lockServer) lockBatch(args *LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.verifyArgs(args); err != nil {
+		return err
+	}
+	l.expireReservations()
+	for _, name := range args.Names {
+		if _, locked := l.lockMap[name]; locked { // Grant all names or none
+			*reply = false
+			return nil
+		}
+	}
+	for _, name := range args.Names {
+		l.lockMap[name] = WriteLock
+	}
+	*reply = true
+	return nil
+}
+
+func (l *lockServer) lockPersistent(args *LockArgs, reply *bool) error {
+	if err := l.lock(args, reply); err != nil || !*reply {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.persistent == nil {
+		l.persistent = make(map[string]LockArgs)
+	}
+	l.persistent[args.Name] = *args
+	return nil
+}
+
+func (l *lockServer) takeOver(args *LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.verifyArgs(args); err != nil {
+		return err
+	}
+	p, ok := l.persistent[args.Name]
+	if !ok || p.UID != args.UID || l.lockMap[args.Name] != WriteLock {
+		return LockServerError(ErrLockNotHeld, "TakeOver attempted on an unlocked entity: "+args.Name)
+	}
+	if p.RecoveryToken != args.RecoveryToken {
+		return AccessDeniedError{Identity: args.Source.Node, Operation: "takeover", Namespace: args.Namespace}
+	}
+	*reply = true
+	return nil
+}
+
+// Expired reports a lock as expired when its name is not locked, as locks are not kept by uid
+func (l *lockServer) Expired(args *LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.verifyArgs(args); err != nil {
+		return err
+	}
+	_, locked := l.lockMap[args.Name]
+	*reply = !locked
+	return nil
+}
+
+func (l *lockServer) UnlockBatch(args *LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.verifyArgs(args); err != nil {
+		return err
+	}
+	*reply = true
+	for _, name := range args.Names {
+		if l.lockMap[name] != WriteLock {
+			*reply = false
+			continue
+		}
+		delete(l.lockMap, name)
+	}
+	if !*reply {
+		return LockServerError(ErrLockNotHeld, "UnlockBatch attempted on unlocked entities: "+strings.Join(args.Names, ", "))
+	}
+	return nil
+}
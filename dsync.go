@@ -16,7 +16,12 @@
 
 package dsync
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
 
 const RpcPath = "/dsync"
 const DebugPath = "/debug"
@@ -32,24 +37,74 @@ var clnts []RPC
 // Index into rpc client array for server running on localhost
 var ownNode int
 
-// Simple majority based quorum, set to dNodeCount/2+1
+// In-memory locker when it is the only node, so that locks bypass the RPC layer (nil otherwise).
+var dlocal *LocalLocker
+
+// Weight of each node in the quorum calculation, set to 1 for every node by default.
+var dnodeWeights []int
+
+// Sum of the weights of all nodes, equal to dNodeCount by default.
+var dtotalWeight int
+
+// Simple majority based quorum, set to dtotalWeight/2+1 unless configured otherwise
 var dquorum int
-// Simple quorum for read operations, set to dNodeCount/2
+
+// Simple quorum for read operations, set to dtotalWeight-dtotalWeight/2 unless configured otherwise
 var dquorumReads int
 
+// Weight of the nodes that may answer incorrectly (eg. grant any lock) which the quorums tolerate, 0 by default.
+var dbyzantine int
+
+// Cluster configuration epoch, stamped on every request so that lock servers can reject
+// clients that operate on a different (stale) configuration of the cluster.
+var depoch uint64
+
+// Namespace of all locks of this client, so that several applications can share a cluster (a string).
+var dnamespace atomic.Value
+
+// Time that lock servers may park a lock request until the lock frees up (0 disables parking).
+var dserverWait int64
+
+// Time that a client waits on the lock servers for a lock to be released before retrying (0 disables watching).
+var dwatchTimeout int64
+
+// Time that lock servers hold a reservation for a lock until it is committed (0 disables two-phase locking).
+var dreservation int64
+
+// Number of lock requests of an attempt in flight at once (0 sends them to all nodes at once).
+var dfanOut int64
+
+// Time that GetLock and GetRLock try to acquire a lock before giving up (0 tries until granted).
+var dacquireTimeout int64
+
+// Number of attempts that GetLock and GetRLock make to acquire a lock before giving up (0 tries until granted).
+var dmaxRounds int64
+
+// Time that an attempt to acquire a lock waits for the answers of the nodes (0 for DRWMutexAcquireTimeout).
+var dattemptTimeout int64
+
 // SetNodesWithPath - initializes package-level global state variables such as clnts.
+// When passed just the own node, locks are kept in memory by a LocalLocker (presenting itself
+// as that node) instead, which DRWMutexes call directly, so that a single node deployment does
+// not need any network nor pay for the distributed protocol.
 // N B - This function should be called only once inside any program that uses
 // dsync.
 func SetNodesWithClients(rpcClnts []RPC, rpcOwnNode int) (err error) {
 
+	if len(rpcClnts) == 1 && rpcOwnNode == 0 {
+		if _, ok := rpcClnts[0].(*LocalLocker); !ok {
+			rpcClnts = []RPC{NewLocalLocker(rpcClnts[0].Node(), rpcClnts[0].RPCPath())}
+		}
+	}
+
 	// Validate if number of nodes is within allowable range.
 	if dnodeCount != 0 {
 		return errors.New("Cannot reinitialize dsync package")
-	} else if len(rpcClnts) < 2 {
-		return errors.New("Dsync not designed for less than 2 nodes")
+	} else if len(rpcClnts) < 1 {
+		return errors.New("Dsync not designed for less than 1 node")
 	} else if len(rpcClnts) > 16 {
 		return errors.New("Dsync not designed for more than 16 nodes")
-	} else if len(rpcClnts)&1 == 1 {
+	} else if len(rpcClnts)&1 == 1 && len(rpcClnts) > 1 {
 		return errors.New("Dsync not designed for an uneven number of nodes")
 	}
 
@@ -58,12 +113,305 @@ func SetNodesWithClients(rpcClnts []RPC, rpcOwnNode int) (err error) {
 	}
 
 	dnodeCount = len(rpcClnts)
-	dquorum = dnodeCount/2 + 1
-	dquorumReads = dnodeCount/2
+	weights := make([]int, dnodeCount)
+	for i := range weights {
+		weights[i] = 1
+	}
+	setWeights(weights)
 	// Initialize node name and rpc path for each RPCClient object.
 	clnts = make([]RPC, dnodeCount)
 	copy(clnts, rpcClnts)
 
 	ownNode = rpcOwnNode
+	if dnodeCount == 1 {
+		dlocal, _ = clnts[0].(*LocalLocker)
+	}
+	return nil
+}
+
+// SetNodeWeights - assigns a weight to every node (in the same order as passed into
+// SetNodesWithClients) so that read and write quorums are computed over the total weight
+// instead of the number of nodes, eg. a node backed by replicated storage may count double.
+// N B - This function should be called right after SetNodesWithClients and before any locking.
+func SetNodeWeights(weights []int) error {
+
+	if dnodeCount == 0 {
+		return errors.New("Dsync not initialized, call SetNodesWithClients first")
+	} else if len(weights) != dnodeCount {
+		return errors.New("Number of weights does not match number of nodes")
+	}
+	for _, w := range weights {
+		if w < 1 {
+			return errors.New("Weight of a node must be at least 1")
+		}
+	}
+
+	setWeights(weights)
 	return nil
 }
+
+// SetQuorums - overrides the (weighted) number of nodes needed to grant a read and a write lock, which
+// default to total-total/2 and total/2+1 of the total weight, so that deployments can trade availability
+// for safety per their topology, eg. raising the write quorum to lower the read quorum. The write
+// quorum must be a majority (no two writers) and together with the read quorum exceed the total
+// weight (no reader alongside a writer), both by more than the weight set with SetByzantineTolerance.
+// N B - This function should be called after SetNodeWeights (which resets the quorums) and before any locking.
+func SetQuorums(readQuorum, writeQuorum int) error {
+
+	if dnodeCount == 0 {
+		return errors.New("Dsync not initialized, call SetNodesWithClients first")
+	} else if readQuorum < 1 || readQuorum > dtotalWeight {
+		return fmt.Errorf("Read quorum must be between 1 and %d", dtotalWeight)
+	} else if writeQuorum < 1 || writeQuorum > dtotalWeight {
+		return fmt.Errorf("Write quorum must be between 1 and %d", dtotalWeight)
+	} else if 2*writeQuorum <= dtotalWeight+dbyzantine {
+		return fmt.Errorf("Write quorum must be more than half of %d", dtotalWeight+dbyzantine)
+	} else if readQuorum+writeQuorum <= dtotalWeight+dbyzantine {
+		return fmt.Errorf("Read and write quorum together must be more than %d", dtotalWeight+dbyzantine)
+	}
+
+	dquorum = writeQuorum
+	dquorumReads = readQuorum
+	return nil
+}
+
+// SetByzantineTolerance - raises the read and write quorums so that nodes of up to the given (total)
+// weight answering incorrectly, eg. granting every lock or a read lock for a write lock, cannot cause
+// conflicting locks to be granted: any two quorums that conflict then overlap in more than that weight,
+// so in at least one node answering correctly. As the lying nodes may as well deny every lock, the
+// write quorum must still be reachable without them. Passing 0 restores the default quorums.
+// N B - This function should be called after SetNodeWeights (which resets the quorums) and before any locking.
+func SetByzantineTolerance(weight int) error {
+
+	if dnodeCount == 0 {
+		return errors.New("Dsync not initialized, call SetNodesWithClients first")
+	} else if weight < 0 {
+		return errors.New("Byzantine tolerance must not be negative")
+	}
+
+	writeQuorum := (dtotalWeight+weight)/2 + 1
+	readQuorum := dtotalWeight + weight + 1 - writeQuorum
+	if writeQuorum > dtotalWeight-weight {
+		return fmt.Errorf("Cannot tolerate a weight of %d lying nodes out of %d", weight, dtotalWeight)
+	}
+
+	dbyzantine = weight
+	dquorum = writeQuorum
+	dquorumReads = readQuorum
+	return nil
+}
+
+// setWeights updates the node weights and recomputes the quorums based on the total weight.
+func setWeights(weights []int) {
+	dnodeWeights = make([]int, len(weights))
+	copy(dnodeWeights, weights)
+	dtotalWeight = 0
+	for _, w := range dnodeWeights {
+		dtotalWeight += w
+	}
+	dbyzantine = 0
+	dquorum = dtotalWeight/2 + 1
+	dquorumReads = dtotalWeight - dquorum + 1 // Overlaps every write quorum, also for an uneven total weight
+}
+
+// SetEpoch - sets the cluster configuration epoch that is sent along with every request.
+// Lock servers reject requests for a different epoch than their own, preventing two
+// differently-configured halves of a cluster from both reaching quorum. The epoch should
+// be increased whenever the list of nodes (or their weights) changes.
+func SetEpoch(epoch uint64) {
+	atomic.StoreUint64(&depoch, epoch)
+}
+
+func getEpoch() uint64 {
+	return atomic.LoadUint64(&depoch)
+}
+
+// SetNamespace - sets the namespace that all locks of this client belong to. Lock names only need
+// to be unique within a namespace, which lets a single cluster of lock servers serve several
+// applications without their locks interfering. The default is the empty namespace.
+func SetNamespace(namespace string) {
+	dnamespace.Store(namespace)
+}
+
+func getNamespace() string {
+	namespace, _ := dnamespace.Load().(string)
+	return namespace
+}
+
+// SetServerWait - lets lock servers park a lock request for up to wait until the lock frees up
+// (using the LockWait and RLockWait handlers) instead of denying it immediately, so that
+// clients don't burn network round-trips on retries under contention. Zero disables parking.
+// N B - The RPC clients must allow concurrent calls, otherwise releases queue up behind parked requests.
+func SetServerWait(wait time.Duration) {
+	atomic.StoreInt64(&dserverWait, int64(wait))
+}
+
+func getServerWait() time.Duration {
+	return time.Duration(atomic.LoadInt64(&dserverWait))
+}
+
+// SetWatchTimeout - after failing to acquire a lock, lets clients watch the lock servers for up to
+// timeout (using the Watch handler) and retry the moment the lock is released, instead of retrying
+// after a randomized back-off. Servers on which the lock is not held do not count as a release, so
+// when no server notifies a release in time the client still backs off. Zero disables watching.
+// N B - The RPC clients must allow concurrent calls, otherwise releases queue up behind watches.
+func SetWatchTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&dwatchTimeout, int64(timeout))
+}
+
+func getWatchTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&dwatchTimeout))
+}
+
+// SetTwoPhase - lets clients acquire locks in two phases: the lock servers first reserve the lock
+// for up to reservation (using the PrepareLock and PrepareRLock handlers), and only once quorum is
+// reached the client commits the reservations (using the Commit handler). Reservations of a client
+// that fails to reach quorum lapse by themselves, so they do not block other clients for longer
+// than reservation even when their release gets lost. Zero disables two-phase locking.
+// N B - Lock servers do not park reservations, so SetServerWait has no effect while enabled.
+func SetTwoPhase(reservation time.Duration) {
+	atomic.StoreInt64(&dreservation, int64(reservation))
+}
+
+func getReservation() time.Duration {
+	return time.Duration(atomic.LoadInt64(&dreservation))
+}
+
+// SetFanOut - limits the lock requests of an attempt that are in flight at once to fanOut, sending
+// the request to the next node as soon as one answers (starting with the own node). The attempt
+// ends as soon as quorum is reached or can no longer be reached, without contacting the remaining
+// nodes, which spares requests on large clusters at the cost of the lock being held by fewer
+// nodes. Zero (the default) sends the requests to all nodes at once.
+func SetFanOut(fanOut int) {
+	atomic.StoreInt64(&dfanOut, int64(fanOut))
+}
+
+func getFanOut() int {
+	return int(atomic.LoadInt64(&dfanOut))
+}
+
+// SetAcquireTimeout - sets the time that GetLock and GetRLock try to acquire a lock before giving up
+// with ErrAcquireTimeout, unless overridden by their LockOptions. Zero (the default) tries until the
+// lock is granted. Lock and RLock never give up.
+func SetAcquireTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&dacquireTimeout, int64(timeout))
+}
+
+func getAcquireTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&dacquireTimeout))
+}
+
+// SetMaxRounds - sets the number of attempts (rounds of lock requests to the nodes) that GetLock and
+// GetRLock make to acquire a lock before giving up with ErrMaxRounds, unless overridden by their
+// LockOptions. Zero (the default) tries until the lock is granted. Lock and RLock never give up.
+func SetMaxRounds(rounds int) {
+	atomic.StoreInt64(&dmaxRounds, int64(rounds))
+}
+
+func getMaxRounds() int {
+	return int(atomic.LoadInt64(&dmaxRounds))
+}
+
+// SetAttemptTimeout - sets the time that a single attempt to acquire a lock waits for the answers of
+// the nodes (on top of the time that servers may park it, see SetServerWait), after which nodes that
+// did not answer count as failed and the attempt is decided without them. It bounds the share of the
+// timeout of GetLock and GetRLock (see SetAcquireTimeout) that one slow node can take up, which is
+// never exceeded by an attempt. Zero (the default) restores DRWMutexAcquireTimeout.
+func SetAttemptTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&dattemptTimeout, int64(timeout))
+}
+
+func getAttemptTimeout() time.Duration {
+	if timeout := time.Duration(atomic.LoadInt64(&dattemptTimeout)); timeout > 0 {
+		return timeout
+	}
+	return DRWMutexAcquireTimeout
+}
+
+// EpochMismatchError - returned by a lock server for a request that is stamped with
+// a different cluster configuration epoch than the epoch of the server itself.
+type EpochMismatchError struct {
+	ServerEpoch uint64
+	ClientEpoch uint64
+}
+
+const epochMismatchFormat = "Cluster epoch mismatch: server at epoch %d, client at epoch %d"
+
+func (e EpochMismatchError) Error() string {
+	return fmt.Sprintf(epochMismatchFormat, e.ServerEpoch, e.ClientEpoch)
+}
+
+// toEpochMismatchError returns the epoch mismatch carried by err (also when transported
+// as a plain error string by net/rpc), or nil if err is not an epoch mismatch.
+func toEpochMismatchError(err error) *EpochMismatchError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(EpochMismatchError); ok {
+		return &e
+	}
+	var e EpochMismatchError
+	if n, _ := fmt.Sscanf(err.Error(), epochMismatchFormat, &e.ServerEpoch, &e.ClientEpoch); n != 2 {
+		return nil
+	}
+	return &e
+}
+
+// QuotaExceededError - returned by a lock server that refuses a lock because the client
+// already holds the maximum number of locks the server allows per client.
+type QuotaExceededError struct {
+	Node  string
+	Quota int
+}
+
+const quotaExceededFormat = "Lock quota exceeded: client %s already holds %d locks"
+
+func (e QuotaExceededError) Error() string {
+	return fmt.Sprintf(quotaExceededFormat, e.Node, e.Quota)
+}
+
+// toQuotaExceededError returns the quota error carried by err (also when transported
+// as a plain error string by net/rpc), or nil if err is not a quota error.
+func toQuotaExceededError(err error) *QuotaExceededError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(QuotaExceededError); ok {
+		return &e
+	}
+	var e QuotaExceededError
+	if n, _ := fmt.Sscanf(err.Error(), quotaExceededFormat, &e.Node, &e.Quota); n != 2 {
+		return nil
+	}
+	return &e
+}
+
+// AccessDeniedError - returned by a lock server that does not allow the client (as identified
+// by the token of the request) to perform an operation within a namespace.
+type AccessDeniedError struct {
+	Identity  string
+	Operation string
+	Namespace string
+}
+
+const accessDeniedFormat = "Access denied: client %q may not %s in namespace %q"
+
+func (e AccessDeniedError) Error() string {
+	return fmt.Sprintf(accessDeniedFormat, e.Identity, e.Operation, e.Namespace)
+}
+
+// toAccessDeniedError returns the access denied error carried by err (also when transported
+// as a plain error string by net/rpc), or nil if err is not an access denied error.
+func toAccessDeniedError(err error) *AccessDeniedError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(AccessDeniedError); ok {
+		return &e
+	}
+	var e AccessDeniedError
+	if n, _ := fmt.Sscanf(err.Error(), accessDeniedFormat, &e.Identity, &e.Operation, &e.Namespace); n != 3 {
+		return nil
+	}
+	return &e
+}
@@ -19,14 +19,19 @@
 package dsync_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/rpc"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -36,15 +41,18 @@ import (
 const N = 4           // number of lock servers for tests.
 var nodes []string    // list of node IP addrs or hostname with ports.
 var rpcPaths []string // list of rpc paths where lock server is serving.
+var servers []*lockServer // lock servers for tests.
 
 func startRPCServers(nodes []string) {
 
 	for i := range nodes {
 		server := rpc.NewServer()
-		server.RegisterName("Dsync", &lockServer{
-			mutex:   sync.Mutex{},
-			lockMap: make(map[string]int64),
+		servers = append(servers, &lockServer{
+			mutex:       sync.Mutex{},
+			lockMap:     make(map[string]int64),
+			incarnation: uint64(i + 1),
 		})
+		server.RegisterName("Dsync", servers[i])
 		// For some reason the registration paths need to be different (even for different server objs)
 		server.HandleHTTP(rpcPaths[i], fmt.Sprintf("%s-debug", rpcPaths[i]))
 		l, e := net.Listen("tcp", ":"+strconv.Itoa(i+12345))
@@ -356,3 +364,1561 @@ func BenchmarkMutexSpin(b *testing.B) {
 		}
 	})
 }
+
+// Test that node weights are validated and taken into account for quorum
+func TestSetNodeWeights(t *testing.T) {
+
+	if err := SetNodeWeights([]int{1, 1, 1}); err == nil {
+		t.Fatal("Expected error for number of weights not matching number of nodes")
+	}
+	if err := SetNodeWeights([]int{1, 0, 1, 1}); err == nil {
+		t.Fatal("Expected error for zero weight")
+	}
+
+	// Own node counts triple, so (total weight 6) quorum is reached with own node plus any other node
+	if err := SetNodeWeights([]int{3, 1, 1, 1}); err != nil {
+		t.Fatalf("Unexpected error setting weights: %v", err)
+	}
+	defer SetNodeWeights([]int{1, 1, 1, 1})
+
+	dm := NewDRWMutex("weighted")
+	dm.Lock()
+	dm.Unlock()
+}
+
+// Test that quorums are validated and taken into account for locking
+func TestSetQuorums(t *testing.T) {
+
+	if err := SetQuorums(2, 2); err == nil {
+		t.Fatal("Expected error for write quorum that is no majority")
+	}
+	if err := SetQuorums(1, 3); err == nil {
+		t.Fatal("Expected error for read and write quorum that do not overlap")
+	}
+	if err := SetQuorums(0, 5); err == nil {
+		t.Fatal("Expected error for quorums out of range")
+	}
+
+	// All nodes needed for a write lock, so a single node suffices for a read lock
+	if err := SetQuorums(1, 4); err != nil {
+		t.Fatalf("Unexpected error setting quorums: %v", err)
+	}
+	defer SetQuorums(2, 3)
+
+	dm := NewDRWMutex("quorums")
+	dm.Lock()
+	dm.Unlock()
+	dm.RLock()
+	dm.RUnlock()
+}
+
+// Test that tolerating lying nodes raises the quorums and is validated
+func TestSetByzantineTolerance(t *testing.T) {
+
+	if err := SetByzantineTolerance(2); err == nil {
+		t.Fatal("Expected error for tolerance that leaves no write quorum without the lying nodes")
+	}
+
+	// A single lying node out of 4 takes 3 nodes for a read lock as well as for a write lock
+	if err := SetByzantineTolerance(1); err != nil {
+		t.Fatalf("Unexpected error setting tolerance: %v", err)
+	}
+	defer SetByzantineTolerance(0)
+	if err := SetQuorums(2, 3); err == nil {
+		t.Fatal("Expected error for quorums that overlap in the lying node only")
+	}
+
+	dm := NewDRWMutex("byzantine")
+	dm.Lock()
+	dm.Unlock()
+	dm.RLock()
+	dm.RUnlock()
+}
+
+// Test that a client at a different cluster epoch than the servers is not granted a lock
+func TestEpochMismatch(t *testing.T) {
+
+	SetEpoch(1)
+
+	dm := NewDRWMutex("epoch")
+	ch := make(chan struct{})
+	go func() {
+		dm.Lock()
+		close(ch)
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for {
+		if _, ok := dm.LastError().(EpochMismatchError); ok {
+			break
+		}
+		select {
+		case <-ch:
+			t.Fatal("Lock granted to client at stale epoch")
+		case <-timeout:
+			t.Fatal("Timed out waiting for epoch mismatch error")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// Back at the epoch of the servers the lock is granted
+	SetEpoch(0)
+	<-ch
+	if err := dm.LastError(); err != nil {
+		t.Fatalf("Expected no error after lock granted, got %v", err)
+	}
+	dm.Unlock()
+}
+
+// Test that a client resynchronizes with lock servers that have restarted
+func TestIncarnationResync(t *testing.T) {
+
+	dm := NewDRWMutex("incarnation")
+	dm.Lock()
+	dm.Unlock()
+
+	// Simulate a restart of all servers, after which the lock can only be granted once resynchronized
+	for _, s := range servers {
+		s.mutex.Lock()
+		s.incarnation += N
+		s.mutex.Unlock()
+	}
+
+	ch := make(chan struct{})
+	go func() {
+		dm.Lock()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for lock after restart of servers")
+	}
+	if err := dm.LastError(); err != nil {
+		t.Fatalf("Expected no error after lock granted, got %v", err)
+	}
+	dm.Unlock()
+}
+
+// Test that locks are granted in two phases, and that reservations that are not committed lapse
+func TestTwoPhase(t *testing.T) {
+
+	SetTwoPhase(time.Second)
+	defer SetTwoPhase(0)
+
+	dm := NewDRWMutex("two-phase")
+	dm.Lock()
+	dm.Unlock()
+	dm.RLock()
+	dm.RLock()
+	dm.RUnlock()
+	dm.RUnlock()
+
+	// Reservations on half of the servers of a client that went away block the lock until they lapse
+	for _, s := range servers[:N/2] {
+		var reserved LockReply
+		args := LockArgs{Name: "reserved", UID: "abandoned", Reservation: 100 * time.Millisecond, Incarnation: s.incarnation, Version: ProtocolVersion}
+		if err := s.PrepareLock(&args, &reserved); err != nil || !reserved.Granted {
+			t.Fatalf("Expected reservation to be granted, got %v (%v)", reserved.Granted, err)
+		}
+	}
+
+	ch := make(chan struct{})
+	go func() {
+		dm := NewDRWMutex("reserved")
+		dm.Lock()
+		dm.Unlock()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for reservations to lapse")
+	}
+}
+
+// Test that a failed attempt reports which nodes denied the lock
+func TestLastAttempt(t *testing.T) {
+
+	holder := NewDRWMutex("attempt")
+	holder.Lock()
+
+	dm := NewDRWMutex("attempt")
+	ch := make(chan struct{})
+	go func() {
+		dm.Lock()
+		close(ch)
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for dm.LastAttempt() == nil {
+		select {
+		case <-timeout:
+			t.Fatal("Timed out waiting for failed attempt")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	attempt := dm.LastAttempt()
+	if len(attempt.Granted) != 0 || len(attempt.Denied)+len(attempt.Errored) != N {
+		t.Fatalf("Expected lock to be denied by all nodes, got %v", attempt)
+	}
+	if attempt.Name != "attempt" || len(attempt.Denied) == 0 {
+		t.Fatalf("Expected lock to be denied by held lock, got %v", attempt)
+	}
+
+	holder.Unlock()
+	<-ch
+	if attempt := dm.LastAttempt(); attempt != nil {
+		t.Fatalf("Expected no failed attempt after lock granted, got %v", attempt)
+	}
+	dm.Unlock()
+}
+
+type gossipServer struct {
+	members []Member
+}
+
+func (g *gossipServer) Members(args *MembershipArgs, reply *[]Member) error {
+	*reply = g.members
+	return nil
+}
+
+// Test that clients can bootstrap the (live) membership from a single seed server
+func TestGetMembers(t *testing.T) {
+
+	server := rpc.NewServer()
+	server.RegisterName("Gossip", &gossipServer{members: []Member{
+		{Node: "127.0.0.1:12345", RPCPath: "/dsync-0", State: MemberAlive},
+		{Node: "127.0.0.1:12346", RPCPath: "/dsync-1", State: MemberSuspect},
+		{Node: "127.0.0.1:12347", RPCPath: "/dsync-2", State: MemberDead},
+	}})
+	server.HandleHTTP("/dsync-gossip", "/dsync-gossip-debug")
+
+	seed := newClient(nodes[0], "/dsync-gossip")
+	defer seed.Close()
+
+	members, err := GetMembers(context.Background(), seed)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("Expected 2 live members, got %d", len(members))
+	}
+	for _, m := range members {
+		if m.State == MemberDead {
+			t.Fatalf("Dead member returned: %v", m)
+		}
+	}
+}
+
+// Test the compatibility rules for protocol versions
+func TestCheckVersion(t *testing.T) {
+
+	if err := CheckVersion(ProtocolVersion); err != nil {
+		t.Fatalf("Expected current version to be supported, got %v", err)
+	}
+	for _, v := range []uint32{0, MinProtocolVersion - 1, ProtocolVersion + 1} {
+		err := CheckVersion(v)
+		if e, ok := err.(VersionMismatchError); !ok || e.ClientVersion != v {
+			t.Fatalf("Expected version mismatch for version %d, got %v", v, err)
+		}
+	}
+}
+
+// legacyServer - a lock server speaking protocol versions up to version, which records the lock
+// requests it accepts.
+type legacyServer struct {
+	version     uint32
+	incarnation uint64
+	accepted    []LockArgs
+}
+
+func (s *legacyServer) Call(ctx context.Context, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	lockArgs := args.(*LockArgs)
+	// Errors as transported by net/rpc
+	if lockArgs.Version < MinProtocolVersion || lockArgs.Version > s.version {
+		return errors.New(VersionMismatchError{ServerMinVersion: MinProtocolVersion, ServerVersion: s.version, ClientVersion: lockArgs.Version}.Error())
+	}
+	if err := CheckIncarnation(s.incarnation, lockArgs.Incarnation); err != nil {
+		return errors.New(err.Error())
+	}
+	s.accepted = append(s.accepted, *lockArgs)
+	granted, _ := GrantedReply(reply, lockArgs)
+	*granted = true
+	return nil
+}
+
+func (s *legacyServer) Node() string    { return "legacy:9000" }
+func (s *legacyServer) RPCPath() string { return RpcPath }
+func (s *legacyServer) Close() error    { return nil }
+
+// Test that clients speak the older protocol version to servers that have not been upgraded yet
+func TestVersionNegotiation(t *testing.T) {
+
+	s := &legacyServer{version: 2, incarnation: 1}
+	source := Identity{Node: "client:9000", Path: RpcPath}
+	lock := func() LockArgs {
+		t.Helper()
+		var locked bool
+		args := LockArgs{Name: "negotiated", UID: "uid", Source: source, Version: ProtocolVersion}
+		if err := CallServer(context.Background(), s, "Dsync.Lock", &args, &locked); err != nil || !locked {
+			t.Fatalf("Expected lock to be granted, got %v (error %v)", locked, err)
+		}
+		return s.accepted[len(s.accepted)-1]
+	}
+
+	args := lock()
+	if args.Version != 2 || args.Node != source.Node || args.RPCPath != source.Path {
+		t.Fatalf("Expected request of version 2 with legacy source, got %+v", args)
+	}
+	args.Source = Identity{}
+	if args.Upgrade(); args.Source != source {
+		t.Fatalf("Expected source %v after upgrade, got %v", source, args.Source)
+	}
+
+	// The negotiated version is remembered
+	s.accepted = nil
+	if args = lock(); args.Version != 2 {
+		t.Fatalf("Expected negotiated version 2, got %d", args.Version)
+	}
+
+	// Once upgraded (and so restarted) the server is spoken to at the current version again
+	s.version, s.incarnation = ProtocolVersion, 2
+	if args = lock(); args.Version != ProtocolVersion || args.Node != "" || args.Source != source {
+		t.Fatalf("Expected request of version %d without legacy source, got %+v", ProtocolVersion, args)
+	}
+}
+
+// Test that a lock request parked on the servers is granted once the lock frees up
+func TestServerWait(t *testing.T) {
+
+	SetServerWait(2 * time.Second)
+	defer SetServerWait(0)
+
+	dm1st := NewDRWMutex("server-wait")
+	dm2nd := NewDRWMutex("server-wait")
+
+	dm1st.Lock()
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		dm1st.Unlock()
+	}()
+
+	start := time.Now()
+	dm2nd.Lock()
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("Lock granted before it was released (after %v)", elapsed)
+	}
+	dm2nd.Unlock()
+}
+
+type recordingLogger struct {
+	messages chan string
+}
+
+func (r *recordingLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	select {
+	case r.messages <- fmt.Sprint(level, " ", msg, " ", keysAndValues):
+	default:
+	}
+}
+
+// Test that failed RPC operations are reported to the logger set by the application
+func TestSetLogger(t *testing.T) {
+
+	logger := &recordingLogger{messages: make(chan string, 1)}
+	SetLogger(logger)
+	defer SetLogger(nil)
+
+	// Have the servers reject the lock request
+	SetEpoch(1)
+	dm := NewDRWMutex("logger")
+	ch := make(chan struct{})
+	go func() {
+		dm.Lock()
+		close(ch)
+	}()
+
+	select {
+	case msg := <-logger.messages:
+		if want := "WARN Unable to call [method Dsync."; len(msg) < len(want) || msg[:len(want)] != want {
+			t.Fatalf("Unexpected log message: %s", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for log message")
+	}
+
+	SetEpoch(0)
+	<-ch
+	dm.Unlock()
+}
+
+func TestStdLogger(t *testing.T) {
+
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", 0), LogInfo)
+
+	logger.Log(LogDebug, "suppressed")
+	logger.Log(LogWarn, "Unable to call", "method", "Dsync.Lock", "err", "timeout")
+	if got, want := buf.String(), "WARN Unable to call method=Dsync.Lock err=timeout\n"; got != want {
+		t.Fatalf("Expected %q, got %q", want, got)
+	}
+}
+
+// Test that a client watching the servers acquires the lock once it is released
+func TestWatch(t *testing.T) {
+
+	SetWatchTimeout(2 * time.Second)
+	defer SetWatchTimeout(0)
+
+	dm1st := NewDRWMutex("watch")
+	dm2nd := NewDRWMutex("watch")
+
+	dm1st.Lock()
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		dm1st.Unlock()
+	}()
+
+	start := time.Now()
+	dm2nd.Lock()
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("Lock granted before it was released (after %v)", elapsed)
+	}
+	dm2nd.Unlock()
+}
+
+// Test that a node on which the lock is not held does not wake up a watching client
+func TestWatchBacksOff(t *testing.T) {
+
+	SetWatchTimeout(2 * time.Second)
+	defer SetWatchTimeout(0)
+
+	// Write lock held by all nodes but the last one
+	for _, s := range servers[:3] {
+		s.mutex.Lock()
+		s.lockMap["watch-minority"] = WriteLock
+		s.mutex.Unlock()
+	}
+	defer func() {
+		for _, s := range servers[:3] {
+			s.mutex.Lock()
+			delete(s.lockMap, "watch-minority")
+			s.mutex.Unlock()
+		}
+	}()
+
+	dm := NewDRWMutex("watch-minority")
+	if err := dm.GetLock(context.Background(), LockOptions{Timeout: 500 * time.Millisecond}); err != ErrAcquireTimeout {
+		t.Fatalf("Expected ErrAcquireTimeout, got %v", err)
+	}
+	if attempts := dm.Stats().Attempts; attempts > 3 {
+		t.Fatalf("Expected the client to wait for a release rather than to retry right away, made %d attempts", attempts)
+	}
+}
+
+func TestFindDeadlocks(t *testing.T) {
+
+	now := time.Now()
+	holds := []WaitForEdge{
+		{Owner: "A", Name: "x", Since: now.Add(-3 * time.Second)},
+		{Owner: "B", Name: "y", Since: now.Add(-3 * time.Second)},
+	}
+
+	// A waits for y (held by B), no deadlock as long as B is not waiting
+	graphs := []WaitForGraph{
+		{Holds: holds, Waits: []WaitForEdge{{Owner: "A", Name: "y", Since: now.Add(-2 * time.Second)}}},
+	}
+	if victims := FindDeadlocks(graphs); len(victims) != 0 {
+		t.Fatalf("Expected no deadlocks, got %v", victims)
+	}
+
+	// B (reported by another server) waits for x (held by A), B is waiting for the shortest time
+	graphs = append(graphs, WaitForGraph{Holds: holds, Waits: []WaitForEdge{{Owner: "B", Name: "x", Since: now.Add(-1 * time.Second)}}})
+	victims := FindDeadlocks(graphs)
+	if len(victims) != 1 || victims[0].Owner != "B" || victims[0].Name != "x" {
+		t.Fatalf("Expected wait of B for x to be aborted, got %v", victims)
+	}
+
+	// Same name in another namespace does not close the cycle
+	graphs[1].Waits[0].Namespace = "other"
+	if victims := FindDeadlocks(graphs); len(victims) != 0 {
+		t.Fatalf("Expected no deadlocks across namespaces, got %v", victims)
+	}
+}
+
+// Test that acquiring and releasing locks is reflected in the metrics of the client
+func TestMetrics(t *testing.T) {
+
+	before := MetricsCollector().Snapshot()
+	dm := NewDRWMutex("metrics")
+	dm.Lock()
+	held := MetricsCollector().Snapshot()
+	dm.Unlock()
+	dm.RLock()
+	dm.RUnlock()
+	after := MetricsCollector().Snapshot()
+
+	if held.Held.Write != before.Held.Write+1 {
+		t.Fatalf("Expected %d write locks held while locked, got %d", before.Held.Write+1, held.Held.Write)
+	}
+	if after.Held != before.Held {
+		t.Fatalf("Expected %v locks held after unlocking, got %v", before.Held, after.Held)
+	}
+	if after.Acquired.Write < before.Acquired.Write+1 || after.Acquired.Read < before.Acquired.Read+1 {
+		t.Fatalf("Expected the locks to be counted as acquired, got %v (before %v)", after.Acquired, before.Acquired)
+	}
+	if after.Attempts.Write < after.Acquired.Write || after.Rounds.Count != after.Acquired.Write+after.Acquired.Read ||
+		after.AcquireSeconds.Count != after.Rounds.Count {
+		t.Fatalf("Expected an attempt and an observation per lock acquired, got %+v", after)
+	}
+
+	var buf bytes.Buffer
+	if _, err := MetricsCollector().WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE dsync_lock_attempts_total counter\n",
+		fmt.Sprintf("dsync_locks_acquired_total{namespace=\"\",type=\"write\"} %d\n", after.Namespaces[""].Acquired.Write),
+		fmt.Sprintf("dsync_lock_rounds_bucket{le=\"+Inf\"} %d\n", after.Rounds.Count),
+		"# TYPE dsync_lock_acquire_seconds histogram\n",
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte(line)) {
+			t.Fatalf("Expected %q in metrics, got:\n%s", line, buf.String())
+		}
+	}
+}
+
+// Test that the metrics of the client count the locks acquired and released per namespace
+func TestMetricsPerNamespace(t *testing.T) {
+	defer SetNamespace("")
+
+	SetNamespace("metrics-a")
+	dm := NewDRWMutex("metrics")
+	dm.Lock()
+	dm.Unlock()
+	SetNamespace("metrics-b")
+	dm.RLock()
+	dm.RUnlock()
+	dm.RLock()
+	dm.RUnlock()
+
+	var buf bytes.Buffer
+	if _, err := MetricsCollector().WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	series := make(map[string]string)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if i := strings.LastIndex(line, " "); i > 0 && !strings.HasPrefix(line, "#") {
+			series[line[:i]] = line[i+1:]
+		}
+	}
+	for name, value := range map[string]string{
+		`dsync_locks_acquired_total{namespace="metrics-a",type="write"}`: "1",
+		`dsync_locks_acquired_total{namespace="metrics-a",type="read"}`:  "0",
+		`dsync_locks_released_total{namespace="metrics-a",type="write"}`: "1",
+		`dsync_locks_acquired_total{namespace="metrics-b",type="write"}`: "0",
+		`dsync_locks_acquired_total{namespace="metrics-b",type="read"}`:  "2",
+		`dsync_locks_released_total{namespace="metrics-b",type="read"}`:  "2",
+	} {
+		if series[name] != value {
+			t.Fatalf("Expected %s %s in metrics, got:\n%s", name, value, buf.String())
+		}
+	}
+}
+
+// recordingTracer records the spans started, with contexts numbered in order of starting.
+type recordingTracer struct {
+	mutex sync.Mutex
+	spans []*recordedSpan
+}
+
+type recordedSpan struct {
+	tracer     *recordingTracer
+	parent     string
+	name       string
+	context    string
+	attributes []interface{}
+	ended      bool
+	err        error
+}
+
+func (r *recordingTracer) Start(parent, name string, keysAndValues ...interface{}) Span {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	s := &recordedSpan{tracer: r, parent: parent, name: name, attributes: keysAndValues,
+		context: fmt.Sprintf("00-%032x-%016x-01", 1, len(r.spans)+1)}
+	r.spans = append(r.spans, s)
+	return s
+}
+
+func (s *recordedSpan) Context() string { return s.context }
+
+func (s *recordedSpan) SetAttributes(keysAndValues ...interface{}) {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.attributes = append(s.attributes, keysAndValues...)
+}
+
+func (s *recordedSpan) End(err error) {
+	s.tracer.mutex.Lock()
+	defer s.tracer.mutex.Unlock()
+	s.ended, s.err = true, err
+}
+
+// Test that a lock acquisition is traced with a child span per request to a node, and that the
+// spans of the handlers of a lock server link to them
+func TestTracing(t *testing.T) {
+
+	tracer := &recordingTracer{}
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	dm := NewDRWMutex("traced")
+	dm.Lock()
+	dm.Unlock()
+
+	tracer.mutex.Lock()
+	spans := tracer.spans
+	tracer.mutex.Unlock()
+	if len(spans) == 0 || spans[0].name != "dsync.Lock" || spans[0].parent != "" || !spans[0].ended || spans[0].err != nil {
+		t.Fatalf("Expected an ended root span for the lock acquisition first, got %+v", spans)
+	}
+	requests := 0
+	for _, s := range spans[1:] {
+		if s.name == "Dsync.Lock" && s.parent == spans[0].context {
+			requests++
+		}
+	}
+	if requests < N {
+		t.Fatalf("Expected a child span per node of the acquisition, got %d", requests)
+	}
+
+	l := NewLocalLocker("localhost", DefaultPath)
+	var locked bool
+	if err := l.Call(context.Background(), "Dsync.Lock", &LockArgs{Name: "traced", UID: "uid", TraceContext: spans[1].context}, &locked); err != nil || !locked {
+		t.Fatalf("Expected lock to be granted, got %v (%v)", locked, err)
+	}
+	tracer.mutex.Lock()
+	server := tracer.spans[len(tracer.spans)-1]
+	tracer.mutex.Unlock()
+	if server.name != "LocalLocker.Lock" || server.parent != spans[1].context || !server.ended {
+		t.Fatalf("Expected an ended span of the handler linked to the request, got %+v", server)
+	}
+}
+
+// Test that an acquisition waiting for a lock held by someone else is listed as in flight
+func TestInFlight(t *testing.T) {
+
+	holder := NewDRWMutex("in-flight")
+	holder.Lock()
+
+	ch := make(chan struct{})
+	go func() {
+		dm := NewDRWMutex("in-flight")
+		dm.RLock()
+		dm.RUnlock()
+		close(ch)
+	}()
+
+	var waiting *Acquisition
+	for deadline := time.Now().Add(5 * time.Second); waiting == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the acquisition to be listed with a failed attempt")
+		}
+		for _, a := range InFlight() {
+			if a.Name == "in-flight" && a.Attempts > 0 {
+				waiting = &a
+			}
+		}
+	}
+	if !waiting.ReadLock || waiting.LastAttempt == nil || len(waiting.LastAttempt.Denied) == 0 {
+		t.Fatalf("Expected a read lock denied by the nodes, got %+v", waiting)
+	}
+
+	rec := httptest.NewRecorder()
+	DebugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/dsync", nil))
+	if body := rec.Body.String(); !strings.Contains(body, `read lock on "in-flight"`) || !strings.Contains(body, "denied by") {
+		t.Fatalf("Expected the acquisition in the debug view, got:\n%s", body)
+	}
+
+	holder.Unlock()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for read lock")
+	}
+	for _, a := range InFlight() {
+		if a.Name == "in-flight" {
+			t.Fatalf("Expected no acquisition in flight once granted, got %+v", a)
+		}
+	}
+}
+
+func TestHoldWatchdog(t *testing.T) {
+
+	reported := make(chan HeldLock, 10)
+	SetHoldWatchdog(50*time.Millisecond, func(l HeldLock) { reported <- l })
+	defer SetHoldWatchdog(0, nil)
+
+	// Released before the threshold, so never reported
+	quick := NewDRWMutex("hold-quick")
+	quick.RLock()
+	quick.RUnlock()
+
+	dm := NewDRWMutex("hold-forgotten")
+	dm.Lock()
+	select {
+	case l := <-reported:
+		if l.Name != "hold-forgotten" || l.ReadLock || l.Held < 50*time.Millisecond {
+			t.Fatalf("Expected the write lock to be reported once held past the threshold, got %+v", l)
+		}
+		if !strings.Contains(l.Source, "TestHoldWatchdog") || !strings.Contains(l.Source, "dsync_test.go") {
+			t.Fatalf("Expected the acquisition source to point at the test, got %q", l.Source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the lock to be reported")
+	}
+
+	// Reported only once, and no longer watched once released
+	dm.Unlock()
+	select {
+	case l := <-reported:
+		t.Fatalf("Expected no further reports, got %+v", l)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// recordingEvents records the lock events of the names it is interested in.
+type recordingEvents struct {
+	mutex  sync.Mutex
+	names  map[string]bool
+	events []string
+}
+
+func (r *recordingEvents) record(kind string, ev LockEvent) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.names[ev.Name] {
+		r.events = append(r.events, kind+" "+ev.Name)
+	}
+}
+
+func (r *recordingEvents) OnAcquired(ev LockEvent)   { r.record("acquired", ev) }
+func (r *recordingEvents) OnReleased(ev LockEvent)   { r.record("released", ev) }
+func (r *recordingEvents) OnQuorumLost(ev LockEvent) { r.record("lost", ev) }
+func (r *recordingEvents) OnStalePurge(ev LockEvent) { r.record("purged", ev) }
+
+func (r *recordingEvents) recorded() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return strings.Join(r.events, ", ")
+}
+
+// Test that the lifecycle of locks is reported, including locks no longer held by a quorum as
+// lock servers that granted them restarted
+func TestEvents(t *testing.T) {
+
+	events := &recordingEvents{names: map[string]bool{"events": true, "events-probe": true}}
+	SetEvents(events)
+	defer SetEvents(nil)
+
+	dm := NewDRWMutex("events")
+	dm.Lock()
+
+	// Simulate a restart of half the servers, noticed by the client on its next requests to them
+	for _, s := range servers[N/2:] {
+		s.mutex.Lock()
+		s.incarnation += N
+		s.mutex.Unlock()
+	}
+	probe := NewDRWMutex("events-probe")
+	probe.RLock()
+	probe.RUnlock()
+	dm.Unlock()
+
+	expected := "acquired events, lost events, acquired events-probe, released events-probe, released events"
+	if got := events.recorded(); got != expected {
+		t.Fatalf("Expected events %q, got %q", expected, got)
+	}
+}
+
+// Test that the loss of a lock is signalled to its holder
+func TestLost(t *testing.T) {
+
+	isClosed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	dm := NewDRWMutex("lost")
+	if dm.Lost() != nil {
+		t.Fatal("Expected no lost channel before locking")
+	}
+	dm.Lock()
+	lost := dm.Lost()
+	if isClosed(lost) {
+		t.Fatal("Expected a held lock not to be lost")
+	}
+
+	// Simulate a restart of half the servers, noticed by the client on its next requests to them
+	for _, s := range servers[N/2:] {
+		s.mutex.Lock()
+		s.incarnation += N
+		s.mutex.Unlock()
+	}
+	probe := NewDRWMutex("lost-probe")
+	probe.RLock()
+	probe.RUnlock()
+	if !isClosed(lost) {
+		t.Fatal("Expected the lock to be lost once lock servers restarted")
+	}
+	dm.Unlock()
+
+	dm.RLock()
+	if lost = dm.Lost(); isClosed(lost) {
+		t.Fatal("Expected a lock acquired again not to be lost")
+	}
+	NewDRWMutex("lost").ForceUnlock()
+	if !isClosed(lost) {
+		t.Fatal("Expected the lock to be lost once force unlocked")
+	}
+}
+
+// Test that the locks still held by a quorum are re-registered with a lock server that restarted
+func TestRestartRecovery(t *testing.T) {
+
+	dm := NewDRWMutex("recovered")
+	dm.Lock()
+
+	// Simulate a restart of a server (without its locks), noticed by the client on its next request to it
+	restarted := servers[N-1]
+	restarted.mutex.Lock()
+	restarted.incarnation += N
+	delete(restarted.lockMap, "recovered")
+	restarted.mutex.Unlock()
+	probe := NewDRWMutex("recovered-probe")
+	probe.RLock()
+	probe.RUnlock()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		restarted.mutex.Lock()
+		registered := restarted.lockMap["recovered"] == WriteLock
+		restarted.mutex.Unlock()
+		if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the lock to be re-registered")
+		}
+	}
+	select {
+	case <-dm.Lost():
+		t.Fatal("Expected a lock still held by a quorum not to be lost")
+	default:
+	}
+
+	// Released at the restarted server as well
+	dm.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		restarted.mutex.Lock()
+		_, locked := restarted.lockMap["recovered"]
+		restarted.mutex.Unlock()
+		if !locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the re-registered lock to be released")
+		}
+	}
+}
+
+// Test that the lock validator re-asserts a lock at a node that lost it, and signals its loss
+// once a quorum of the nodes lost it
+func TestLockValidator(t *testing.T) {
+
+	dm := NewDRWMutex("validated")
+	dm.Lock()
+	SetLockValidator(10 * time.Millisecond)
+	defer SetLockValidator(0)
+
+	// Purge the lock at a node, as lock maintenance might
+	purge := func(servers ...*lockServer) {
+		for _, s := range servers {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+		}
+		for _, s := range servers {
+			delete(s.lockMap, "validated")
+		}
+	}
+	purge(servers[1])
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		servers[1].mutex.Lock()
+		reasserted := servers[1].lockMap["validated"] == WriteLock
+		servers[1].mutex.Unlock()
+		if reasserted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the lock to be re-asserted")
+		}
+	}
+
+	purge(servers[1:]...)
+	select {
+	case <-dm.Lost():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the lock to be lost")
+	}
+	dm.Unlock()
+}
+
+// Test the policies applying while a quorum of the nodes is unreachable
+func TestDegradedMode(t *testing.T) {
+
+	// Every node fails the requests for another epoch, so no quorum is reachable
+	SetEpoch(1)
+	defer SetEpoch(0)
+	defer SetDegradedMode(DegradedBlock, 0, nil)
+
+	SetDegradedMode(DegradedFailFast, 0, nil)
+	dm := NewDRWMutex("degraded")
+	if err := dm.GetLock(context.Background(), LockOptions{}); !errors.Is(err, ErrQuorumUnreachable) {
+		t.Fatalf("Expected the lock to fail fast, got %v", err)
+	}
+
+	var mutex sync.Mutex
+	var reported []LockEvent
+	SetDegradedMode(DegradedLocal, 0, func(ev LockEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		reported = append(reported, ev)
+	})
+	if err := dm.GetLock(context.Background(), LockOptions{}); err != nil {
+		t.Fatalf("Expected the lock to be granted locally, got %v", err)
+	}
+	mutex.Lock()
+	if len(reported) != 1 || reported[0].Name != "degraded" {
+		t.Fatalf("Expected the lock granted locally to be reported, got %v", reported)
+	}
+	mutex.Unlock()
+	other := NewDRWMutex("degraded")
+	if err := other.GetLock(context.Background(), LockOptions{Timeout: 100 * time.Millisecond}); !errors.Is(err, ErrAcquireTimeout) {
+		t.Fatalf("Expected a lock granted locally to exclude other holders of the process, got %v", err)
+	}
+	dm.Unlock()
+	if err := other.GetLock(context.Background(), LockOptions{Timeout: time.Second}); err != nil {
+		t.Fatalf("Expected the lock to be granted locally once unlocked, got %v", err)
+	}
+
+	// Once quorum is reachable again, the lock granted locally still excludes the other holders of the process
+	SetEpoch(0)
+	if err := dm.GetLock(context.Background(), LockOptions{Timeout: 200 * time.Millisecond}); !errors.Is(err, ErrAcquireTimeout) {
+		t.Fatalf("Expected a lock granted locally to exclude holders by quorum of the process, got %v", err)
+	}
+	other.Unlock()
+	if err := dm.GetLock(context.Background(), LockOptions{Timeout: time.Second}); err != nil {
+		t.Fatalf("Expected the lock to be granted by quorum once unlocked, got %v", err)
+	}
+
+	// And a lock held by quorum excludes the locks granted locally once quorum is lost again
+	SetEpoch(1)
+	if err := other.GetLock(context.Background(), LockOptions{Timeout: 200 * time.Millisecond}); !errors.Is(err, ErrAcquireTimeout) {
+		t.Fatalf("Expected a lock held by quorum to exclude holders granted locally, got %v", err)
+	}
+	SetEpoch(0)
+	dm.Unlock()
+}
+
+// acquiredEvents passes on the lock events of the locks acquired.
+type acquiredEvents struct {
+	NopEvents
+	acquired chan LockEvent
+}
+
+func (a acquiredEvents) OnAcquired(ev LockEvent) { a.acquired <- ev }
+
+// Test that a holder is asked to release its lock by a revocation request
+func TestRequestRevocation(t *testing.T) {
+
+	events := acquiredEvents{acquired: make(chan LockEvent, 1)}
+	SetEvents(events)
+	dm := NewDRWMutex("revoked")
+	dm.Lock()
+	SetEvents(nil)
+	uid := (<-events.acquired).UID // Uid at the own node, which is the first one
+	source := Identity{Node: nodes[0], Path: rpcPaths[0]}
+
+	if !dm.RevokeDeadline().IsZero() {
+		t.Fatal("Expected a held lock not to be revoked")
+	}
+	if RequestRevocation(source, "", "not-held", uid, time.Second) {
+		t.Fatal("Expected a revocation of a lock not held to be refused")
+	}
+	if RequestRevocation(Identity{}, "", "revoked", uid, time.Second) || RequestRevocation(Identity{Node: "unknown:9000", Path: rpcPaths[0]}, "", "revoked", uid, time.Second) {
+		t.Fatal("Expected a revocation by a lock server that is not a node to be refused")
+	}
+	if RequestRevocation(source, "", "revoked", "other-uid", time.Second) {
+		t.Fatal("Expected a revocation of another lock on the name to be refused")
+	}
+	select {
+	case <-dm.Revoked():
+		t.Fatal("Expected the holder not to be asked to release the lock by refused revocations")
+	default:
+	}
+	before := time.Now()
+	if !RequestRevocation(source, "", "revoked", uid, time.Minute) {
+		t.Fatal("Expected a revocation of a held lock to be accepted")
+	}
+	select {
+	case <-dm.Revoked():
+	default:
+		t.Fatal("Expected the holder to be asked to release the lock")
+	}
+	if deadline := dm.RevokeDeadline(); deadline.Before(before.Add(time.Minute)) || deadline.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("Expected the lock to be released within the grace, got %v", deadline)
+	}
+	dm.Unlock()
+}
+
+// Test that the causes of failures can be matched with errors.Is, also for errors of lock servers
+// transported as plain strings by net/rpc
+func TestErrors(t *testing.T) {
+
+	c := newClient(nodes[0], rpcPaths[0])
+	var reply bool
+	args := LockArgs{Name: "errors", UID: "never-granted", Version: ProtocolVersion}
+	if err := CallServer(context.Background(), c, "Dsync.Unlock", &args, &reply); !errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("Expected unlock of a lock not held to fail with ErrLockNotHeld, got %v", err)
+	}
+
+	dm := NewDRWMutex("errors")
+	dm.RLock()
+	err := CallServer(context.Background(), c, "Dsync.Unlock", &args, &reply)
+	dm.RUnlock()
+	if !errors.Is(err, ErrReadLockHeld) || errors.Is(err, ErrLockNotHeld) {
+		t.Fatalf("Expected unlock of a read locked name to fail with ErrReadLockHeld only, got %v", err)
+	}
+
+	var restarted IncarnationMismatchError
+	if err := error(IncarnationMismatchError{ServerIncarnation: 2, ClientIncarnation: 1}); !errors.Is(err, ErrTimestampMismatch) || !errors.As(err, &restarted) {
+		t.Fatalf("Expected an incarnation mismatch to match ErrTimestampMismatch, got %v", err)
+	}
+	if err := error(&QuorumError{Name: "errors"}); !errors.Is(err, ErrQuorumNotReached) {
+		t.Fatalf("Expected a quorum error to match ErrQuorumNotReached, got %v", err)
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Test that a failed attempt exposes the outcome at every node that did not grant the lock
+func TestQuorumErrorNodes(t *testing.T) {
+
+	var err error = &QuorumError{Name: "quorum", Granted: []string{"node0"}, Denied: []string{"node1"},
+		Errored: []NodeError{{Node: "node2", Err: IncarnationMismatchError{ServerIncarnation: 2, ClientIncarnation: 1}}, {Node: "node3", Err: timeoutError{}}}}
+
+	for _, cause := range []error{ErrQuorumNotReached, ErrLockDenied, ErrTimestampMismatch} {
+		if !errors.Is(err, cause) {
+			t.Errorf("Expected %v to match %v", err, cause)
+		}
+	}
+	if errors.Is(err, ErrNoResponse) {
+		t.Errorf("Expected %v not to match %v", err, ErrNoResponse)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected %v to carry a net.Error that timed out", err)
+	}
+	var nodeErr NodeError
+	if !errors.As(err, &nodeErr) || nodeErr.Node != "node1" || nodeErr.Err != ErrLockDenied {
+		t.Errorf("Expected the first node error to be the denial of node1, got %v", nodeErr)
+	}
+}
+
+// Test that the statistics of a DRWMutex and of the client count acquisitions, attempts and the
+// answers of every node
+func TestStats(t *testing.T) {
+
+	holder := NewDRWMutex("stats")
+	holder.Lock()
+
+	dm := NewDRWMutex("stats")
+	ch := make(chan struct{})
+	go func() {
+		dm.Lock()
+		close(ch)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); dm.Stats().Attempts < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for failed attempts")
+		}
+	}
+	holder.Unlock()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for lock")
+	}
+	dm.Unlock()
+
+	stats := dm.Stats()
+	if stats.Acquired.Write != 1 || stats.Acquired.Read != 0 || stats.AvgRounds != float64(stats.Attempts) || stats.AvgRounds < 2 {
+		t.Fatalf("Expected a single write lock acquired after all attempts, got %+v", stats)
+	}
+	var denied uint64
+	for _, ns := range stats.Nodes {
+		denied += ns.Denied
+	}
+	if len(stats.Nodes) != N || denied == 0 {
+		t.Fatalf("Expected denials recorded per node, got %+v", stats.Nodes)
+	}
+	if global := Stats(); global.Attempts < stats.Attempts || global.Acquired.Write < 2 {
+		t.Fatalf("Expected the statistics of the client to include those of the mutexes, got %+v", global)
+	}
+}
+
+// Test that the locks whose attempts fail most often are reported as most contended
+func TestMostContended(t *testing.T) {
+
+	holder := NewDRWMutex("hot-spot")
+	holder.Lock()
+	dm := NewDRWMutex("hot-spot")
+	ch := make(chan struct{})
+	go func() {
+		dm.RLock()
+		close(ch)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); dm.Stats().Attempts < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for failed attempts")
+		}
+	}
+	holder.Unlock()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for read lock")
+	}
+	dm.RUnlock()
+
+	contended := MostContended(1 << 20)
+	var hot *Contention
+	for i, c := range contended {
+		if i > 0 && c.Failed > contended[i-1].Failed {
+			t.Fatalf("Expected the most contended locks first, got %+v", contended)
+		}
+		if c.Name == "hot-spot" {
+			hot = &contended[i]
+		}
+	}
+	if hot == nil || hot.Failed < 2 || hot.Attempts <= hot.Failed || hot.Denials == 0 || hot.DenialRate <= 0 || hot.DenialRate >= 1 || hot.Waited == 0 {
+		t.Fatalf("Expected the failed attempts of the read lock to be reported, got %+v", hot)
+	}
+	if len(MostContended(1)) != 1 {
+		t.Fatalf("Expected a single lock to be reported")
+	}
+}
+
+// Test that with a limited fan-out an attempt is decided without contacting all nodes
+func TestFanOut(t *testing.T) {
+
+	SetFanOut(1)
+	defer SetFanOut(0)
+
+	holder := NewDRWMutex("fan-out")
+	holder.Lock()
+	if stats := holder.Stats(); len(stats.Nodes) != N/2+1 {
+		t.Fatalf("Expected just a quorum of the nodes to be contacted, got %+v", stats.Nodes)
+	}
+
+	dm := NewDRWMutex("fan-out")
+	ch := make(chan struct{})
+	go func() {
+		dm.Lock()
+		close(ch)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); dm.Stats().Attempts < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for failed attempts")
+		}
+	}
+	attempt := dm.LastAttempt()
+	if attempt == nil || len(attempt.Denied) != 1 || attempt.Denied[0] != nodes[0] || len(attempt.Errored) != N-1 || !errors.Is(attempt.Errored[0].Err, ErrNotContacted) {
+		t.Fatalf("Expected the attempt to end with the denial of the own node, got %+v", attempt)
+	}
+	holder.Unlock()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for lock")
+	}
+	dm.Unlock()
+}
+
+// Test that a persistent lock is taken over with its recovery token only
+func TestPersistentLock(t *testing.T) {
+
+	pl := NewPersistentLock("persistent", time.Hour)
+	pl.Lock()
+	handle := pl.Handle()
+	if handle.UID == "" || handle.RecoveryToken == "" || handle.TTL != time.Hour {
+		t.Fatalf("Expected the handle of a held lock, got %+v", handle)
+	}
+
+	guessed := handle
+	guessed.RecoveryToken = "guess"
+	if _, err := TakeOverPersistentLock(context.Background(), guessed); !errors.As(err, new(AccessDeniedError)) {
+		t.Fatalf("Expected a take over with the wrong token to be denied, got %v", err)
+	}
+	other := handle
+	other.Namespace = "other"
+	if _, err := TakeOverPersistentLock(context.Background(), other); err == nil {
+		t.Fatal("Expected a take over of a lock of another namespace to fail")
+	}
+
+	taken, err := TakeOverPersistentLock(context.Background(), handle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if taken.Handle() != handle {
+		t.Fatalf("Expected the lock taken over to have the same handle, got %+v", taken.Handle())
+	}
+	taken.Unlock()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, err := TakeOverPersistentLock(context.Background(), handle)
+		if errors.Is(err, ErrQuorumNotReached) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a take over of a released lock to fail, got %v", err)
+		}
+	}
+}
+
+// Test that a batch of names is locked all or nothing
+func TestLockBatch(t *testing.T) {
+
+	batch := NewDRWMutexBatch("batch-part.1", "batch-part.2", "batch-part.3")
+	batch.Lock()
+
+	lockedAt := func(name string) (count int) {
+		for _, server := range servers {
+			server.mutex.Lock()
+			if server.lockMap[name] == WriteLock {
+				count++
+			}
+			server.mutex.Unlock()
+		}
+		return count
+	}
+	for _, name := range batch.Names {
+		if lockedAt(name) != N {
+			t.Fatalf("Expected %s to be write locked at all nodes", name)
+		}
+	}
+
+	overlapping := NewDRWMutexBatch("batch-part.3", "batch-part.4")
+	ch := make(chan struct{})
+	go func() {
+		overlapping.Lock()
+		close(ch)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); overlapping.LastAttempt() == nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for a failed attempt")
+		}
+	}
+	if attempt := overlapping.LastAttempt(); len(attempt.Denied) != N || !errors.Is(attempt, ErrQuorumNotReached) {
+		t.Fatalf("Expected all nodes to deny an overlapping batch, got %+v", attempt)
+	}
+	if lockedAt("batch-part.4") != 0 {
+		t.Fatal("Expected no names of a denied batch to be locked")
+	}
+
+	batch.Unlock()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for overlapping batch")
+	}
+	overlapping.Unlock()
+}
+
+// Test that concurrent calls on a client are pipelined on its connection rather than serialized
+func TestPipelining(t *testing.T) {
+
+	dm := NewDRWMutex("pipelined")
+	dm.Lock()
+	defer dm.Unlock()
+
+	c := newClient(nodes[0], rpcPaths[0])
+	defer c.Close()
+	const calls, wait = 4, 500 * time.Millisecond
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Parked by the server until the wait elapses, as the lock is held
+			var released bool
+			args := LockArgs{Name: "pipelined", WaitTimeout: wait, Version: ProtocolVersion}
+			if err := CallServer(context.Background(), c, "Dsync.Watch", &args, &released); err != nil || released {
+				t.Errorf("Expected the watch to time out, got %v and error %v", released, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed >= calls*wait/2 {
+		t.Fatalf("Expected the calls to be pipelined, took %v for %d calls", elapsed, calls)
+	}
+}
+
+// Test that a retained write lock is acquired again locally, and handed back once someone else asks for it
+func TestRetainLease(t *testing.T) {
+
+	SetRetainLease(time.Minute)
+	defer SetRetainLease(0)
+
+	dm := NewDRWMutex("retained")
+	dm.Owner = "retainer"
+	dm.Lock()
+	dm.Unlock()
+	attempts := dm.Stats().Attempts
+	dm.Lock()
+	if dm.Stats().Attempts != attempts {
+		t.Fatal("Expected a retained lock to be acquired again without requests")
+	}
+	dm.Unlock()
+	for _, server := range servers {
+		server.mutex.Lock()
+		locked := server.lockMap["retained"] == WriteLock
+		server.mutex.Unlock()
+		if !locked {
+			t.Fatal("Expected a retained lock to be held at all nodes")
+		}
+	}
+
+	other := NewDRWMutex("retained")
+	ch := make(chan struct{})
+	go func() {
+		other.Lock()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the retained lock to be revoked")
+	}
+	other.Unlock()
+
+	// Not retained again while contended
+	dm.Lock()
+	dm.Unlock()
+	attempts = dm.Stats().Attempts
+	dm.Lock()
+	if dm.Stats().Attempts == attempts {
+		t.Fatal("Expected a revoked lock not to be retained again")
+	}
+	dm.Unlock()
+}
+
+// Test that the back-off policy is consulted with the contention of the name, and that the
+// default policy backs off longer on hot names than on cold ones
+func TestBackOffPolicy(t *testing.T) {
+
+	var mutex sync.Mutex
+	var states []BackOffState
+	SetBackOffPolicy(BackOffFunc(func(state BackOffState) time.Duration {
+		mutex.Lock()
+		defer mutex.Unlock()
+		states = append(states, state)
+		return time.Millisecond
+	}))
+	defer SetBackOffPolicy(nil)
+
+	holder := NewDRWMutex("backed-off")
+	holder.Lock()
+	dm := NewDRWMutex("backed-off")
+	ch := make(chan struct{})
+	go func() {
+		dm.Lock()
+		close(ch)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); dm.Stats().Attempts < 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for failed attempts")
+		}
+	}
+	holder.Unlock()
+	<-ch
+	dm.Unlock()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, state := range states {
+		if state.Name != "backed-off" || state.Attempt != i+1 || state.RecentFailures <= float64(i) || state.RecentFailures > float64(i+1) {
+			t.Fatalf("Expected attempt %d with as many recent failures, got %+v", i+1, state)
+		}
+	}
+
+	var cold, hot time.Duration
+	for i := 0; i < 1000; i++ {
+		cold += AdaptiveBackOff.BackOff(BackOffState{Name: "cold", Attempt: 1, RecentFailures: 1})
+		hot += AdaptiveBackOff.BackOff(BackOffState{Name: "hot", Attempt: 1, RecentFailures: 100})
+	}
+	if hot < 3*cold {
+		t.Fatalf("Expected a hot name to be backed off much longer than a cold one, got %v and %v", hot/1000, cold/1000)
+	}
+}
+
+func TestLockStriper(t *testing.T) {
+
+	striper := NewLockStriper("striped", 16)
+	perStripe := make(map[*DRWMutex]int)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("bucket/object-%d", i)
+		dm := striper.Get(key)
+		if striper.Get(key) != dm {
+			t.Fatalf("Expected %s to map onto the same stripe every time", key)
+		}
+		perStripe[dm]++
+	}
+	if len(perStripe) != striper.Stripes() {
+		t.Fatalf("Expected keys on all %d stripes, got %d", striper.Stripes(), len(perStripe))
+	}
+	for dm, keys := range perStripe {
+		if keys < 10000/16/2 || keys > 10000/16*2 {
+			t.Errorf("Expected stripe %s to get about %d keys, got %d", dm.Name, 10000/16, keys)
+		}
+	}
+
+	// Adding a stripe should move few keys onto another stripe (about one in 17)
+	grown := NewLockStriper("striped", 17)
+	moved := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("bucket/object-%d", i)
+		if striper.Get(key).Name != grown.Get(key).Name {
+			moved++
+		}
+	}
+	if moved > 10000/17*2 {
+		t.Errorf("Expected about %d keys to move onto another stripe, got %d", 10000/17, moved)
+	}
+
+	dm := striper.Get("bucket/object-0")
+	dm.Lock()
+	for _, server := range servers {
+		server.mutex.Lock()
+		locked := server.lockMap[dm.Name] == WriteLock
+		server.mutex.Unlock()
+		if !locked {
+			t.Fatalf("Expected stripe %s to be write locked at all nodes", dm.Name)
+		}
+	}
+	dm.Unlock()
+}
+
+func TestGetLock(t *testing.T) {
+
+	holder := NewDRWMutex("get-lock")
+	holder.Lock()
+
+	dm := NewDRWMutex("get-lock")
+	if err := dm.GetLock(context.Background(), LockOptions{MaxRounds: 3}); err != ErrMaxRounds {
+		t.Fatalf("Expected ErrMaxRounds, got %v", err)
+	}
+	if attempts := dm.Stats().Attempts; attempts != 3 {
+		t.Fatalf("Expected 3 attempts, got %d", attempts)
+	}
+
+	start := time.Now()
+	if err := dm.GetRLock(context.Background(), LockOptions{Timeout: 200 * time.Millisecond}); err != ErrAcquireTimeout {
+		t.Fatalf("Expected ErrAcquireTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("Expected to give up after the timeout of 200ms, gave up after %v", elapsed)
+	}
+
+	// Limits of the client apply unless overridden per call
+	SetMaxRounds(2)
+	defer SetMaxRounds(0)
+	if err := dm.GetLock(context.Background(), LockOptions{}); err != ErrMaxRounds {
+		t.Fatalf("Expected ErrMaxRounds, got %v", err)
+	}
+	if attempts := dm.Stats().Attempts; attempts < 5 {
+		t.Fatalf("Expected at least 5 attempts, got %d", attempts)
+	}
+
+	holder.Unlock()
+	if err := dm.GetLock(context.Background(), LockOptions{Timeout: 5 * time.Second}); err != nil {
+		t.Fatalf("Expected the lock to be granted, got %v", err)
+	}
+	dm.Unlock()
+}
+
+// Test that an attempt parked on the servers does not outlast the timeout of GetLock
+func TestAttemptTimeout(t *testing.T) {
+
+	holder := NewDRWMutex("attempt-timeout")
+	holder.Lock()
+	defer holder.Unlock()
+
+	SetServerWait(5 * time.Second)
+	defer SetServerWait(0)
+
+	dm := NewDRWMutex("attempt-timeout")
+	start := time.Now()
+	if err := dm.GetLock(context.Background(), LockOptions{Timeout: 300 * time.Millisecond, AttemptTimeout: 50 * time.Millisecond}); err != ErrAcquireTimeout {
+		t.Fatalf("Expected ErrAcquireTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected to give up after the timeout of 300ms, gave up after %v", elapsed)
+	}
+	if attempts := dm.Stats().Attempts; attempts != 1 {
+		t.Fatalf("Expected the attempt to be parked until the timeout, got %d attempts", attempts)
+	}
+}
+
+// Test that an acquisition is abandoned once its context is cancelled, also while parked on the servers
+func TestGetLockContext(t *testing.T) {
+
+	holder := NewDRWMutex("get-lock-context")
+	holder.Lock()
+
+	SetServerWait(5 * time.Second)
+	defer SetServerWait(0)
+
+	dm := NewDRWMutex("get-lock-context")
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if err := dm.GetLock(ctx, LockOptions{}); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected to give up once cancelled after 100ms, gave up after %v", elapsed)
+	}
+
+	// The requests that were parked are granted once the holder unlocks, and released again
+	holder.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := dm.GetLock(ctx, LockOptions{}); err != nil {
+		t.Fatalf("Expected the lock to be granted, got %v", err)
+	}
+	dm.Unlock()
+}
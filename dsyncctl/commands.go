@@ -0,0 +1,406 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/minio/dsync"
+	"github.com/minio/dsync/server"
+)
+
+var errUsage = errors.New("Invalid arguments")
+
+// controller runs the commands of dsyncctl against all lock servers.
+type controller struct {
+	clients   []dsync.RPC
+	namespace string
+	epoch     uint64
+	timeout   time.Duration // Per call
+	json      bool
+	out       io.Writer
+}
+
+// run runs command with its arguments.
+func (c *controller) run(ctx context.Context, command string, args []string) error {
+	switch command {
+	case "ls":
+		if len(args) > 1 {
+			return fmt.Errorf("%w: ls takes at most a prefix", errUsage)
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		return c.list(ctx, prefix)
+	case "holders":
+		if len(args) != 1 {
+			return fmt.Errorf("%w: holders takes a name", errUsage)
+		}
+		return c.holders(ctx, args[0])
+	case "force-unlock":
+		fs := flag.NewFlagSet("force-unlock", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		prefix := fs.String("prefix", "", "")
+		pattern := fs.String("pattern", "", "")
+		if err := fs.Parse(args); err != nil {
+			return fmt.Errorf("%w: %v", errUsage, err)
+		}
+		switch {
+		case *prefix == "" && *pattern == "" && fs.NArg() == 1:
+			return c.forceUnlock(ctx, fs.Arg(0))
+		case (*prefix == "") != (*pattern == "") && fs.NArg() == 0:
+			return c.forceUnlockMatching(ctx, *prefix, *pattern)
+		}
+		return fmt.Errorf("%w: force-unlock takes either a name, a -prefix or a -pattern", errUsage)
+	case "ping":
+		return c.ping(ctx)
+	case "stats":
+		return c.stats(ctx)
+	case "reload":
+		return c.reload(ctx)
+	case "read-only":
+		if len(args) != 1 || args[0] != "on" && args[0] != "off" {
+			return fmt.Errorf("%w: read-only takes on or off", errUsage)
+		}
+		return c.readOnly(ctx, args[0] == "on")
+	case "migrate":
+		if len(args) != 1 || len(c.clients) != 1 {
+			return fmt.Errorf("%w: migrate takes the address of the replacement, and a single server in -nodes", errUsage)
+		}
+		return c.migrate(ctx, args[0])
+	}
+	return fmt.Errorf("%w: unknown command %q", errUsage, command)
+}
+
+// forEach calls f for every server concurrently, each with the timeout of a call, returning the
+// errors per server (nil for the servers that succeeded).
+func (c *controller) forEach(ctx context.Context, f func(ctx context.Context, i int, clnt dsync.RPC) error) []error {
+	errs := make([]error, len(c.clients))
+	var wg sync.WaitGroup
+	for i, clnt := range c.clients {
+		wg.Add(1)
+		go func(i int, clnt dsync.RPC) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+			errs[i] = f(ctx, i, clnt)
+		}(i, clnt)
+	}
+	wg.Wait()
+	return errs
+}
+
+// report prints the errors of the servers that failed to stderr, returning an error when any did.
+func (c *controller) report(errs []error) error {
+	failed := 0
+	for i, err := range errs {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", c.clients[i].Node(), err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d servers failed", failed, len(c.clients))
+	}
+	return nil
+}
+
+// listLocks returns all locks held by a server whose name starts with prefix, across all pages.
+func (c *controller) listLocks(ctx context.Context, clnt dsync.RPC, prefix string) ([]dsync.LockInfo, error) {
+	var locks []dsync.LockInfo
+	marker := ""
+	for {
+		args := dsync.ListLocksArgs{Namespace: c.namespace, Prefix: prefix, Marker: marker, Version: dsync.ProtocolVersion}
+		var reply dsync.ListLocksReply
+		if err := dsync.CallServer(ctx, clnt, "Dsync.ListLocks", &args, &reply); err != nil {
+			return nil, err
+		}
+		locks = append(locks, reply.Locks...)
+		if !reply.Truncated {
+			return locks, nil
+		}
+		marker = reply.NextMarker
+	}
+}
+
+// mergedLock is a lock as held by all servers together.
+type mergedLock struct {
+	Name    string        `json:"name"`
+	Writer  bool          `json:"writer"`
+	Servers int           `json:"servers"` // Servers holding the lock
+	Clients []string      `json:"clients"` // Nodes of the clients holding the lock
+	Age     time.Duration `json:"age"`     // Longest time the lock has been held by a server
+}
+
+// list prints the locks whose name starts with prefix, merged over all servers.
+func (c *controller) list(ctx context.Context, prefix string) error {
+	perServer := make([][]dsync.LockInfo, len(c.clients))
+	errs := c.forEach(ctx, func(ctx context.Context, i int, clnt dsync.RPC) (err error) {
+		perServer[i], err = c.listLocks(ctx, clnt, prefix)
+		return err
+	})
+
+	merged := make(map[string]*mergedLock)
+	for _, locks := range perServer {
+		for _, info := range locks {
+			m, ok := merged[info.Name]
+			if !ok {
+				m = &mergedLock{Name: info.Name}
+				merged[info.Name] = m
+			}
+			m.Servers++
+			for _, h := range info.Holders {
+				m.Writer = m.Writer || h.Writer
+				if h.Age > m.Age {
+					m.Age = h.Age
+				}
+				m.Clients = appendUnique(m.Clients, h.Node)
+			}
+		}
+	}
+	locks := make([]*mergedLock, 0, len(merged))
+	for _, m := range merged {
+		sort.Strings(m.Clients)
+		locks = append(locks, m)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Name < locks[j].Name })
+
+	if c.json {
+		if err := json.NewEncoder(c.out).Encode(locks); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tTYPE\tSERVERS\tCLIENTS\tAGE")
+		for _, m := range locks {
+			fmt.Fprintf(w, "%s\t%s\t%d/%d\t%s\t%v\n", m.Name, lockType(m.Writer), m.Servers, len(c.clients), strings.Join(m.Clients, ","), m.Age.Round(time.Millisecond))
+		}
+		w.Flush()
+	}
+	return c.report(errs)
+}
+
+// serverHolder is a holder of a lock at a server.
+type serverHolder struct {
+	Server string `json:"server"`
+	dsync.LockHolder
+}
+
+// holders prints the holders of the lock on name per server.
+func (c *controller) holders(ctx context.Context, name string) error {
+	perServer := make([][]dsync.LockHolder, len(c.clients))
+	errs := c.forEach(ctx, func(ctx context.Context, i int, clnt dsync.RPC) error {
+		// The name itself sorts first among the names it is a prefix of
+		args := dsync.ListLocksArgs{Namespace: c.namespace, Prefix: name, MaxEntries: 1, Version: dsync.ProtocolVersion}
+		var reply dsync.ListLocksReply
+		if err := dsync.CallServer(ctx, clnt, "Dsync.ListLocks", &args, &reply); err != nil {
+			return err
+		}
+		if len(reply.Locks) == 1 && reply.Locks[0].Name == name {
+			perServer[i] = reply.Locks[0].Holders
+		}
+		return nil
+	})
+
+	var holders []serverHolder
+	for i, lh := range perServer {
+		for _, h := range lh {
+			holders = append(holders, serverHolder{Server: c.clients[i].Node(), LockHolder: h})
+		}
+	}
+	if c.json {
+		if err := json.NewEncoder(c.out).Encode(holders); err != nil {
+			return err
+		}
+	} else if len(holders) == 0 {
+		fmt.Fprintf(c.out, "%s is not locked on any server\n", name)
+	} else {
+		w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVER\tTYPE\tCLIENT\tUID\tAGE\tLAST-CHECK")
+		for _, h := range holders {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%s\n", h.Server, lockType(h.Writer), h.Node+h.RPCPath, h.UID, h.Age.Round(time.Millisecond), h.LastCheck.Format(time.RFC3339))
+		}
+		w.Flush()
+	}
+	return c.report(errs)
+}
+
+// forceUnlock releases the lock on name on all servers.
+func (c *controller) forceUnlock(ctx context.Context, name string) error {
+	errs := c.forEach(ctx, func(ctx context.Context, i int, clnt dsync.RPC) error {
+		args := dsync.LockArgs{Namespace: c.namespace, Name: name, Epoch: c.epoch, Version: dsync.ProtocolVersion}
+		var reply bool
+		return dsync.CallServer(ctx, clnt, "Dsync.ForceUnlock", &args, &reply)
+	})
+	for i, err := range errs {
+		if err == nil {
+			fmt.Fprintf(c.out, "%s: released %s\n", c.clients[i].Node(), name)
+		}
+	}
+	return c.report(errs)
+}
+
+// forceUnlockMatching releases all locks whose name starts with prefix or matches pattern on all servers.
+func (c *controller) forceUnlockMatching(ctx context.Context, prefix, pattern string) error {
+	released := make([]int, len(c.clients))
+	errs := c.forEach(ctx, func(ctx context.Context, i int, clnt dsync.RPC) error {
+		args := dsync.ForceUnlockArgs{Namespace: c.namespace, Prefix: prefix, Pattern: pattern, Version: dsync.ProtocolVersion}
+		return dsync.CallServer(ctx, clnt, "Dsync.ForceUnlockMatching", &args, &released[i])
+	})
+	for i, err := range errs {
+		if err == nil {
+			fmt.Fprintf(c.out, "%s: released %d names\n", c.clients[i].Node(), released[i])
+		}
+	}
+	return c.report(errs)
+}
+
+// ping checks that every server answers (with a listing of a single lock, which all lock
+// servers implement), printing the latency of the answer.
+func (c *controller) ping(ctx context.Context) error {
+	latencies := make([]time.Duration, len(c.clients))
+	errs := c.forEach(ctx, func(ctx context.Context, i int, clnt dsync.RPC) error {
+		start := time.Now()
+		args := dsync.ListLocksArgs{Namespace: c.namespace, MaxEntries: 1, Version: dsync.ProtocolVersion}
+		var reply dsync.ListLocksReply
+		err := dsync.CallServer(ctx, clnt, "Dsync.ListLocks", &args, &reply)
+		latencies[i] = time.Since(start)
+		return err
+	})
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tSTATUS\tLATENCY")
+	for i, err := range errs {
+		status := "up"
+		if err != nil {
+			status = "down"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\n", c.clients[i].Node(), status, latencies[i].Round(time.Microsecond))
+	}
+	w.Flush()
+	return c.report(errs)
+}
+
+// stats prints the statistics of every server.
+func (c *controller) stats(ctx context.Context) error {
+	stats := make([]server.Stats, len(c.clients))
+	errs := c.forEach(ctx, func(ctx context.Context, i int, clnt dsync.RPC) error {
+		args := server.StatsArgs{Version: dsync.ProtocolVersion}
+		return dsync.CallServer(ctx, clnt, "Dsync.Stats", &args, &stats[i])
+	})
+	if c.json {
+		var answered []server.Stats
+		for i, err := range errs {
+			if err == nil {
+				stats[i].Node = c.clients[i].Node()
+				answered = append(answered, stats[i])
+			}
+		}
+		if err := json.NewEncoder(c.out).Encode(answered); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVER\tINCARNATION\tUPTIME\tNAMES\tWRITE\tREAD\tPARKED\tCLIENTS\tDRAINING\tCHECKED\tPURGED\tEXPIRED")
+		for i, err := range errs {
+			if err != nil {
+				continue
+			}
+			s := stats[i]
+			fmt.Fprintf(w, "%s\t%d\t%v\t%d\t%d\t%d\t%d\t%d\t%v\t%d\t%d\t%d\n", c.clients[i].Node(), s.Incarnation, s.Uptime.Round(time.Second),
+				s.Names, s.WriteLocks, s.ReadLocks, s.Parked, s.Clients, s.Draining, s.Maintenance.Checked, s.Maintenance.Purged, s.Maintenance.Expired)
+		}
+		w.Flush()
+	}
+	return c.report(errs)
+}
+
+// reload has every server reload its configuration.
+func (c *controller) reload(ctx context.Context) error {
+	errs := c.forEach(ctx, func(ctx context.Context, i int, clnt dsync.RPC) error {
+		args := server.StatsArgs{Version: dsync.ProtocolVersion}
+		var reply bool
+		return dsync.CallServer(ctx, clnt, "Dsync.Reload", &args, &reply)
+	})
+	for i, err := range errs {
+		if err == nil {
+			fmt.Fprintf(c.out, "%s: reloaded\n", c.clients[i].Node())
+		}
+	}
+	return c.report(errs)
+}
+
+// readOnly puts every server into read-only mode, or back out of it.
+func (c *controller) readOnly(ctx context.Context, readOnly bool) error {
+	errs := c.forEach(ctx, func(ctx context.Context, i int, clnt dsync.RPC) error {
+		args := server.ReadOnlyArgs{Version: dsync.ProtocolVersion, ReadOnly: readOnly}
+		var was bool
+		return dsync.CallServer(ctx, clnt, "Dsync.ReadOnly", &args, &was)
+	})
+	mode := "granting new locks"
+	if readOnly {
+		mode = "read-only"
+	}
+	for i, err := range errs {
+		if err == nil {
+			fmt.Fprintf(c.out, "%s: %s\n", c.clients[i].Node(), mode)
+		}
+	}
+	return c.report(errs)
+}
+
+// migrate has the (single) server hand its locks over to the replacement at node.
+func (c *controller) migrate(ctx context.Context, node string) error {
+	errs := c.forEach(ctx, func(ctx context.Context, i int, clnt dsync.RPC) error {
+		args := server.MigrateToArgs{Version: dsync.ProtocolVersion, Target: dsync.Identity{Node: node, Path: clnt.RPCPath()}}
+		var migrated int
+		err := dsync.CallServer(ctx, clnt, "Dsync.MigrateTo", &args, &migrated)
+		if err == nil {
+			fmt.Fprintf(c.out, "%s: handed %d locks over to %s\n", clnt.Node(), migrated, node)
+		}
+		return err
+	})
+	return c.report(errs)
+}
+
+func lockType(writer bool) string {
+	if writer {
+		return "write"
+	}
+	return "read"
+}
+
+func appendUnique(list []string, s string) []string {
+	for _, e := range list {
+		if e == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -0,0 +1,135 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command dsyncctl inspects and administers the lock servers of a dsync cluster, talking to all of
+// them at once, eg.
+//
+//	dsyncctl -nodes 10.0.0.1:9000,10.0.0.2:9000,10.0.0.3:9000,10.0.0.4:9000 ls bucket/
+//
+// Commands:
+//
+//	ls [prefix]                       list the locks held (merged over all servers)
+//	holders <name>                    show the holders of a lock per server
+//	force-unlock <name>               release a lock on all servers, whoever holds it
+//	force-unlock -prefix|-pattern <p> release all locks whose name matches on all servers
+//	ping                              check that every server answers, with its latency
+//	stats                             dump the statistics of every server
+//	reload                            have every server reload its configuration
+//	read-only on|off                  have every server deny (or grant again) new locks
+//	migrate <host:port>               have the server hand its locks over to a replacement
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/dsync"
+	"github.com/minio/dsync/server"
+)
+
+var (
+	nodesFlag     = flag.String("nodes", "", "Comma separated addresses of the lock servers (host:port)")
+	rpcPathFlag   = flag.String("rpc-path", dsync.RpcPath, "RPC path the lock servers serve the lock handlers at")
+	tokenFlag     = flag.String("token", "", "Token to authenticate with, for servers that enforce access control")
+	namespaceFlag = flag.String("namespace", "", "Namespace of the locks (see dsync.SetNamespace)")
+	epochFlag     = flag.Uint64("epoch", 0, "Cluster configuration epoch of the servers")
+	timeoutFlag   = flag.Duration("timeout", 5*time.Second, "Time to wait for the answer of every server")
+	jsonFlag      = flag.Bool("json", false, "Print the results as JSON instead of a table")
+	tlsFlag       = flag.Bool("tls", false, "Connect to the lock servers over TLS")
+	tlsCAFlag     = flag.String("tls-ca", "", "Certificate authorities to verify the lock servers with (PEM, the system pool when empty)")
+	tlsCertFlag   = flag.String("tls-cert", "", "Certificate to present to lock servers that require one (PEM)")
+	tlsKeyFlag    = flag.String("tls-key", "", "Private key of -tls-cert (PEM)")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: dsyncctl -nodes <host:port,...> [flags] <command> [arguments]
+
+Commands:
+  ls [prefix]                        list the locks held (merged over all servers)
+  holders <name>                     show the holders of a lock per server
+  force-unlock <name>                release a lock on all servers, whoever holds it
+  force-unlock -prefix|-pattern <p>  release all locks whose name matches on all servers
+  ping                               check that every server answers, with its latency
+  stats                              dump the statistics of every server
+  reload                             have every server reload its configuration
+  read-only on|off                   have every server deny (or grant again) new locks
+  migrate <host:port>                have the server hand its locks over to a replacement
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *nodesFlag == "" || flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	tlsConfig, err := loadTLS()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dsyncctl: unable to load TLS configuration:", err)
+		os.Exit(2)
+	}
+	var clients []dsync.RPC
+	for _, node := range strings.Split(*nodesFlag, ",") {
+		clients = append(clients, server.NewTLSClient(strings.TrimSpace(node), *rpcPathFlag, *tokenFlag, tlsConfig))
+	}
+	ctl := &controller{clients: clients, namespace: *namespaceFlag, epoch: *epochFlag, timeout: *timeoutFlag, json: *jsonFlag, out: os.Stdout}
+	if err := ctl.run(context.Background(), flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "dsyncctl:", err)
+		if errors.Is(err, errUsage) {
+			usage()
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+// loadTLS returns the configuration to connect to the lock servers with, nil unless -tls is set.
+func loadTLS() (*tls.Config, error) {
+	if !*tlsFlag {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if *tlsCAFlag != "" {
+		pem, err := ioutil.ReadFile(*tlsCAFlag)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + *tlsCAFlag)
+		}
+	}
+	if *tlsCertFlag != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCertFlag, *tlsKeyFlag)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,316 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package dsynctest runs a cluster of dsync lock servers inside a Go test and wires dsync up to
+// it, so that code taking DRWMutexes can be integration tested without starting lock servers:
+//
+//	func TestTransfer(t *testing.T) {
+//		cluster := dsynctest.Start(t, 4)
+//		cluster.Stop(3) // Locks are still granted by a quorum of the other servers
+//		...
+//	}
+//
+// Every lock server is a dsync.LocalLocker, called in memory or (with Options.Network) served over
+// net/rpc on an ephemeral port of localhost. A cluster is torn down once its test has finished.
+//
+// As dsync is configured once per process, it is wired to the nodes of the first cluster started,
+// and every later cluster takes these nodes over with servers of its own (without any locks). All
+// clusters in a process must therefore have the same number of nodes, and only one can run at a
+// time, so tests using them cannot run in parallel. Lock attempts that a test leaves blocked keep
+// retrying on the clusters of later tests, so tests had better use lock names of their own.
+//
+// To unit test how an application behaves when quorum is denied or nodes fail, StartFake starts a
+// cluster of FakeLockers instead, answering every request as scripted by the test.
+package dsynctest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+var (
+	errNoCluster  = errors.New("Connection refused: no dsynctest cluster is running")
+	errServerDown = errors.New("Connection refused: lock server is down")
+)
+
+var (
+	mutex   sync.Mutex
+	nodes   []*node  // Nodes dsync is wired to, once the first cluster has started
+	running *Cluster // Cluster the nodes send their requests to
+)
+
+// Options - options of a cluster.
+type Options struct {
+	Network bool // Serve the lock servers over net/rpc on ephemeral ports rather than calling them in memory
+}
+
+// Cluster - lock servers inside the test process that dsync is wired up to.
+type Cluster struct {
+	servers []*server
+}
+
+// server is a lock server of a cluster, its locker being replaced on every restart.
+type server struct {
+	locker   *dsync.LocalLocker
+	down     bool
+	listener net.Listener // When served over the network
+	client   *rpc.Client
+	fake     *FakeLocker // Answering all requests instead, when started with StartFake
+}
+
+// Start starts a cluster of nodes lock servers called in memory, with dsync wired up to it (the
+// first node being the own node), failing tb when that is not possible.
+func Start(tb testing.TB, nodes int) *Cluster {
+	tb.Helper()
+	return StartWithOptions(tb, nodes, Options{})
+}
+
+// StartWithOptions starts a cluster of nodes lock servers like Start, with the given options.
+func StartWithOptions(tb testing.TB, n int, opts Options) *Cluster {
+	tb.Helper()
+	c, err := start(n, opts)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(c.Close)
+	return c
+}
+
+func start(n int, opts Options) (*Cluster, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if running != nil {
+		return nil, errors.New("Another dsynctest cluster is still running (tests using clusters cannot run in parallel)")
+	}
+	if n < 2 {
+		return nil, fmt.Errorf("Cluster needs at least 2 nodes, got %d", n)
+	}
+	if nodes == nil {
+		var clnts []dsync.RPC
+		for i := 0; i < n; i++ {
+			clnts = append(clnts, &node{index: i})
+		}
+		if err := dsync.SetNodesWithClients(clnts, 0); err != nil {
+			return nil, err
+		}
+		for _, c := range clnts {
+			nodes = append(nodes, c.(*node))
+		}
+	} else if len(nodes) != n {
+		return nil, fmt.Errorf("Cluster needs %d nodes, as dsync is wired up to the nodes of the first cluster started", len(nodes))
+	}
+
+	c := &Cluster{}
+	for i := 0; i < n; i++ {
+		s := &server{locker: dsync.NewLocalLocker(nodeName(i), dsync.DefaultPath)}
+		c.servers = append(c.servers, s)
+		if opts.Network {
+			if err := s.serve(); err != nil {
+				c.close()
+				return nil, err
+			}
+		}
+	}
+	running = c
+	return c, nil
+}
+
+// serve serves the server over net/rpc on an ephemeral port and connects to it.
+func (s *server) serve() (err error) {
+	if s.listener, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		return err
+	}
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("Dsync", &service{server: s})
+	mux := http.NewServeMux()
+	mux.Handle(dsync.DefaultPath, rpcServer)
+	go http.Serve(s.listener, mux)
+	s.client, err = rpc.DialHTTPPath("tcp", s.listener.Addr().String(), dsync.DefaultPath)
+	return err
+}
+
+// Stop takes a lock server down, losing its locks: requests to it fail until it is restarted.
+func (c *Cluster) Stop(index int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.servers[index].down = true
+	c.servers[index].locker = dsync.NewLocalLocker(nodeName(index), dsync.DefaultPath)
+}
+
+// Restart brings a lock server back up without any locks.
+func (c *Cluster) Restart(index int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.servers[index].down = false
+	c.servers[index].locker = dsync.NewLocalLocker(nodeName(index), dsync.DefaultPath)
+}
+
+// Close tears the cluster down, after which requests of dsync fail until another cluster is started.
+// It is called once the test that started the cluster has finished.
+func (c *Cluster) Close() {
+	mutex.Lock()
+	defer mutex.Unlock()
+	c.close()
+}
+
+// close tears the cluster down, should be called with the mutex held.
+func (c *Cluster) close() {
+	if running == c {
+		running = nil
+	}
+	for _, s := range c.servers {
+		if s.client != nil {
+			s.client.Close()
+		}
+		if s.listener != nil {
+			s.listener.Close()
+		}
+		s.locker.Close()
+	}
+}
+
+// lookup returns the server of the running cluster at index.
+func lookup(index int) (*server, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if running == nil {
+		return nil, errNoCluster
+	}
+	return running.servers[index], nil
+}
+
+func nodeName(index int) string {
+	return fmt.Sprintf("dsynctest-%d:9000", index)
+}
+
+// node - a dsync.RPC that sends requests to a lock server of the running cluster.
+type node struct {
+	index int
+}
+
+func (n *node) Node() string {
+	return nodeName(n.index)
+}
+
+func (n *node) RPCPath() string {
+	return dsync.DefaultPath
+}
+
+func (n *node) Close() error {
+	return nil
+}
+
+// Call sends a request to the lock server, over net/rpc when it is served over the network.
+func (n *node) Call(ctx context.Context, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	s, err := lookup(n.index)
+	if err != nil {
+		return err
+	}
+	args.SetTimestamp(time.Now())
+	mutex.Lock()
+	fake := s.fake
+	mutex.Unlock()
+	if fake != nil {
+		return fake.Call(ctx, serviceMethod, args, reply)
+	} else if s.client != nil {
+		select {
+		case call := <-s.client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1)).Done:
+			return call.Error
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return handle(ctx, s, serviceMethod, args, reply)
+}
+
+// handle handles a request in memory, failing it when the server is down.
+func handle(ctx context.Context, s *server, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	mutex.Lock()
+	locker, down := s.locker, s.down
+	mutex.Unlock()
+	if down {
+		return errServerDown
+	}
+	return locker.Call(ctx, serviceMethod, args, reply)
+}
+
+// service - the lock handlers of a server, as served over net/rpc.
+type service struct {
+	server *server
+}
+
+func (s *service) Lock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return handle(context.Background(), s.server, "Dsync.Lock", args, reply)
+}
+
+func (s *service) RLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return handle(context.Background(), s.server, "Dsync.RLock", args, reply)
+}
+
+func (s *service) LockWait(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return handle(context.Background(), s.server, "Dsync.LockWait", args, reply)
+}
+
+func (s *service) RLockWait(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return handle(context.Background(), s.server, "Dsync.RLockWait", args, reply)
+}
+
+func (s *service) PrepareLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return handle(context.Background(), s.server, "Dsync.PrepareLock", args, reply)
+}
+
+func (s *service) PrepareRLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return handle(context.Background(), s.server, "Dsync.PrepareRLock", args, reply)
+}
+
+func (s *service) Commit(args *dsync.LockArgs, reply *bool) error {
+	return handle(context.Background(), s.server, "Dsync.Commit", args, reply)
+}
+
+func (s *service) Unlock(args *dsync.LockArgs, reply *bool) error {
+	return handle(context.Background(), s.server, "Dsync.Unlock", args, reply)
+}
+
+func (s *service) RUnlock(args *dsync.LockArgs, reply *bool) error {
+	return handle(context.Background(), s.server, "Dsync.RUnlock", args, reply)
+}
+
+func (s *service) ForceUnlock(args *dsync.LockArgs, reply *bool) error {
+	return handle(context.Background(), s.server, "Dsync.ForceUnlock", args, reply)
+}
+
+func (s *service) Watch(args *dsync.LockArgs, reply *bool) error {
+	return handle(context.Background(), s.server, "Dsync.Watch", args, reply)
+}
+
+func (s *service) Expired(args *dsync.LockArgs, reply *bool) error {
+	return handle(context.Background(), s.server, "Dsync.Expired", args, reply)
+}
@@ -0,0 +1,167 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsynctest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// lockedWithin returns whether a lock on name is granted within timeout (leaving it locked).
+func lockedWithin(name string, readLock bool, timeout time.Duration) bool {
+	ch := make(chan struct{})
+	go func() {
+		if dm := dsync.NewDRWMutex(name); readLock {
+			dm.RLock()
+		} else {
+			dm.Lock()
+		}
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// testCluster checks that locks of the cluster exclude each other, also with a server down. Names
+// are per test, as lock attempts of earlier tests that are left blocked carry over to later clusters.
+func testCluster(t *testing.T, c *Cluster) {
+	resource, other := t.Name()+"/resource", t.Name()+"/other"
+	dm := dsync.NewDRWMutex(resource)
+	dm.Lock()
+	if lockedWithin(resource, false, time.Second) {
+		t.Fatal("Write lock granted while another write lock is held")
+	}
+	dm.Unlock()
+
+	c.Stop(3)
+	if !lockedWithin(other, false, 5*time.Second) {
+		t.Fatal("Write lock not granted by a quorum with a single server down")
+	}
+	if lockedWithin(other, true, time.Second) {
+		t.Fatal("Read lock granted while a write lock is held")
+	}
+}
+
+func TestCluster(t *testing.T) {
+	c := Start(t, 4)
+	testCluster(t, c)
+}
+
+func TestClusterNetwork(t *testing.T) {
+	// Takes over the nodes of the cluster of the test above
+	c := StartWithOptions(t, 4, Options{Network: true})
+	testCluster(t, c)
+}
+
+func TestFakeLocker(t *testing.T) {
+	fakes := StartFake(t, 4)
+	resource, other := t.Name()+"/resource", t.Name()+"/other"
+
+	// Denied quorum on the first attempt, granted on the retry
+	fakes[1].Script("Dsync.Lock", Fail(errors.New("Connection reset")))
+	fakes[2].Script("Dsync.Lock", Deny)
+	fakes[3].Script("*", Deny)
+	if !lockedWithin(resource, false, 5*time.Second) {
+		t.Fatal("Write lock not granted once the fakes grant it")
+	}
+	for i, f := range fakes {
+		if locks := countCalls(f, "Dsync.Lock", resource); locks != 2 {
+			t.Errorf("Fake %d: expected 2 lock requests, got %d", i, locks)
+		}
+	}
+
+	// Quorum denied for good
+	for _, f := range fakes[1:] {
+		f.Always("Dsync.RLock", Deny)
+	}
+	if lockedWithin(other, true, time.Second) {
+		t.Fatal("Read lock granted while denied by a quorum of the fakes")
+	}
+
+	delay := 100 * time.Millisecond
+	fakes[0].Script("Dsync.Unlock", Response{Delay: delay, Deny: true})
+	var unlocked bool
+	start := time.Now()
+	if err := fakes[0].Call(context.Background(), "Dsync.Unlock", &dsync.LockArgs{Name: resource}, &unlocked); err != nil || unlocked {
+		t.Fatalf("Expected a denied unlock without error, got %v, %v", unlocked, err)
+	} else if time.Since(start) < delay {
+		t.Fatalf("Expected the answer to be delayed by %v, got it after %v", delay, time.Since(start))
+	}
+}
+
+// Test that grants stamped with another epoch than the client, older or newer, are not counted
+// towards quorum but released again
+func TestFakeEpoch(t *testing.T) {
+	fakes := StartFake(t, 4)
+	dsync.SetEpoch(1)
+	defer dsync.SetEpoch(0)
+
+	for _, epoch := range []uint64{0, 2} {
+		epoch := epoch
+		name := fmt.Sprintf("%s/%d", t.Name(), epoch)
+		for _, f := range fakes {
+			f.Always("Dsync.Lock", Response{Epoch: &epoch})
+		}
+		dm := dsync.NewDRWMutex(name)
+		if err := dm.GetLock(context.Background(), dsync.LockOptions{MaxRounds: 1}); err == nil {
+			t.Fatalf("Lock granted by fakes at epoch %d to client at epoch 1", epoch)
+		}
+		if err := dm.LastError(); err != (dsync.EpochMismatchError{ServerEpoch: epoch, ClientEpoch: 1}) {
+			t.Fatalf("Expected epoch mismatch with fakes at epoch %d, got %v", epoch, err)
+		}
+		for i, f := range fakes {
+			deadline := time.Now().Add(5 * time.Second)
+			for countCalls(f, "Dsync.Unlock", name) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("Fake %d: expected the lock granted at epoch %d to be released", i, epoch)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
+
+// countCalls returns the number of requests for serviceMethod on name that f received.
+func countCalls(f *FakeLocker, serviceMethod, name string) (count int) {
+	for _, c := range f.Calls() {
+		if c.Method == serviceMethod && c.Name == name {
+			count++
+		}
+	}
+	return count
+}
+
+func TestClusterNodes(t *testing.T) {
+	Start(t, 4).Close()
+	if _, err := start(2, Options{}); err == nil {
+		t.Fatal("Expected error for a cluster with another number of nodes than the first")
+	}
+	c := Start(t, 4)
+	if _, err := start(4, Options{}); err == nil {
+		t.Fatal("Expected error for a cluster while another one is running")
+	}
+	c.Close()
+}
@@ -0,0 +1,179 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsynctest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Response - the scripted answer of a FakeLocker to a single request.
+type Response struct {
+	Deny  bool          // Reply false, eg. as the lock is held by someone else
+	Err   error         // Fail the request with this error (taking precedence over Deny)
+	Delay time.Duration // Time to wait before answering
+	Epoch *uint64       // Cluster configuration epoch to stamp the reply to a lock request with (the epoch of the request when nil)
+}
+
+// Answers for scripting a FakeLocker
+var (
+	Grant = Response{}
+	Deny  = Response{Deny: true}
+)
+
+// Fail returns the answer failing a request with err.
+func Fail(err error) Response {
+	return Response{Err: err}
+}
+
+// Call - a request received by a FakeLocker.
+type Call struct {
+	Method string // Service method, eg. Dsync.Lock
+	Name   string // Name of the lock (for lock requests)
+	UID    string
+}
+
+// FakeLocker - a dsync.RPC that answers every request as scripted, without holding any locks, so
+// that the behaviour of an application can be unit tested when quorum is denied or nodes fail:
+//
+//	fakes := dsynctest.StartFake(t, 4)
+//	fakes[1].Script("Dsync.Lock", dsynctest.Deny, dsynctest.Fail(errors.New("Connection reset")))
+//	fakes[2].Always("Dsync.Lock", dsynctest.Response{Delay: time.Second})
+//
+// Requests without any answer scripted are granted (replying true).
+type FakeLocker struct {
+	mutex  sync.Mutex
+	node   string
+	script map[string][]Response // Answers per service method (or "*" for any), used once each in order
+	always map[string]Response   // Answer per service method (or "*") once the script has run out
+	calls  []Call
+}
+
+// NewFakeLocker returns a FakeLocker presenting itself as node, granting every request. It can be
+// passed to dsync.SetNodesWithClients directly, or be started as part of a cluster with StartFake.
+func NewFakeLocker(node string) *FakeLocker {
+	return &FakeLocker{node: node, script: make(map[string][]Response), always: make(map[string]Response)}
+}
+
+// Script appends answers to the next requests for serviceMethod (eg. Dsync.Lock, or * for any method),
+// each answer being used for a single request.
+func (f *FakeLocker) Script(serviceMethod string, responses ...Response) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.script[serviceMethod] = append(f.script[serviceMethod], responses...)
+}
+
+// Always sets the answer to all requests for serviceMethod (or * for any method) once the answers
+// scripted for it have been used up.
+func (f *FakeLocker) Always(serviceMethod string, response Response) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.always[serviceMethod] = response
+}
+
+// Calls returns the requests received so far, in order of arrival.
+func (f *FakeLocker) Calls() []Call {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// next records a request and returns the answer to it, preferring answers for the method over
+// answers for any method, and scripted answers over the ones set with Always.
+func (f *FakeLocker) next(serviceMethod string, args interface{}) Response {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	call := Call{Method: serviceMethod}
+	if lockArgs, ok := args.(*dsync.LockArgs); ok {
+		call.Name, call.UID = lockArgs.Name, lockArgs.UID
+	}
+	f.calls = append(f.calls, call)
+	for _, method := range []string{serviceMethod, "*"} {
+		if script := f.script[method]; len(script) > 0 {
+			f.script[method] = script[1:]
+			return script[0]
+		}
+	}
+	for _, method := range []string{serviceMethod, "*"} {
+		if response, ok := f.always[method]; ok {
+			return response
+		}
+	}
+	return Grant
+}
+
+func (f *FakeLocker) Node() string {
+	return f.node
+}
+
+func (f *FakeLocker) RPCPath() string {
+	return dsync.DefaultPath
+}
+
+func (f *FakeLocker) Close() error {
+	return nil
+}
+
+// Call answers a request as scripted, or fails it with the error of ctx once ctx is done
+// before the delay of the response has elapsed.
+func (f *FakeLocker) Call(ctx context.Context, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	response := f.next(serviceMethod, args)
+	select {
+	case <-time.After(response.Delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if response.Err != nil {
+		return response.Err
+	}
+	lockArgs, _ := args.(*dsync.LockArgs)
+	if result, ok := reply.(*bool); ok {
+		*result = !response.Deny
+	} else if result, ok := reply.(*dsync.LockReply); ok && lockArgs != nil {
+		result.Granted, result.Epoch = !response.Deny, lockArgs.Epoch
+		if response.Epoch != nil {
+			result.Epoch = *response.Epoch
+		}
+	}
+	return nil
+}
+
+// StartFake starts a cluster of nodes FakeLockers with dsync wired up to it (the first node being
+// the own node), like Start.
+func StartFake(tb testing.TB, nodes int) []*FakeLocker {
+	tb.Helper()
+	c, err := start(nodes, Options{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(c.Close)
+	var fakes []*FakeLocker
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, s := range c.servers {
+		s.fake = NewFakeLocker(nodeName(i))
+		fakes = append(fakes, s.fake)
+	}
+	return fakes
+}
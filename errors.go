@@ -0,0 +1,81 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"errors"
+	"strings"
+)
+
+// Causes of failures to branch on with errors.Is, also for errors of lock servers received by
+// CallServer (which restores them from the plain error strings transported by net/rpc).
+var (
+	// ErrLockNotHeld - a release of a lock that the lock server does not hold (under the uid of the request).
+	ErrLockNotHeld = errors.New("Lock not held")
+	// ErrWriteLockHeld - a release of a read lock on a name that is write locked at the lock server.
+	ErrWriteLockHeld = errors.New("Write lock held")
+	// ErrReadLockHeld - a release of a write lock on a name that is read locked at the lock server.
+	ErrReadLockHeld = errors.New("Read lock held")
+	// ErrTimestampMismatch - a request addressed to an earlier start of a lock server, matched by IncarnationMismatchError.
+	ErrTimestampMismatch = errors.New("Lock server restarted")
+	// ErrQuorumNotReached - an attempt to acquire a lock that did not reach quorum, matched by QuorumError.
+	ErrQuorumNotReached = errors.New("Quorum not reached")
+	// ErrAcquireTimeout - a lock that GetLock or GetRLock did not acquire within the timeout.
+	ErrAcquireTimeout = errors.New("Lock not acquired within timeout")
+	// ErrMaxRounds - a lock that GetLock or GetRLock did not acquire within the maximum number of attempts.
+	ErrMaxRounds = errors.New("Lock not acquired within maximum number of attempts")
+	// ErrQuorumUnreachable - a lock not acquired as a quorum of the nodes has been unreachable, see DegradedFailFast.
+	ErrQuorumUnreachable = errors.New("Quorum unreachable")
+)
+
+// Errors that lock servers return wrapped, as prefix of the message (see LockServerError)
+var lockServerErrors = []error{ErrLockNotHeld, ErrWriteLockHeld, ErrReadLockHeld}
+
+// LockServerError - returns an error of a lock server for cause (ErrLockNotHeld, ErrWriteLockHeld or
+// ErrReadLockHeld) with details, for use by lock servers so that clients can match the cause with errors.Is.
+func LockServerError(cause error, details string) error {
+	return wrappedError{msg: cause.Error() + ": " + details, cause: cause}
+}
+
+// wrappedError - an error with details that matches its cause with errors.Is.
+type wrappedError struct {
+	msg   string
+	cause error
+}
+
+func (e wrappedError) Error() string { return e.msg }
+func (e wrappedError) Unwrap() error { return e.cause }
+
+// restoreError returns the typed error carried by err when transported as a plain error string
+// by net/rpc, or err otherwise.
+func restoreError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if roundErr := toRoundError(err); roundErr != nil {
+		return roundErr
+	}
+	for _, cause := range lockServerErrors {
+		if errors.Is(err, cause) {
+			return err
+		}
+		if strings.HasPrefix(err.Error(), cause.Error()+": ") {
+			return wrappedError{msg: err.Error(), cause: cause}
+		}
+	}
+	return err
+}
@@ -0,0 +1,331 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package etcd provides a dsync.RPC that keeps locks in etcd rather than in dsync lock servers,
+// so that the DRWMutex API can be used unchanged in environments that already run etcd.
+//
+// Locks are stored as keys attached to a lease of the Locker that is kept alive for as long as
+// the process runs, so that the locks of a crashed process are released by etcd itself once the
+// lease expires (no lock maintenance is needed). The etcd v3 JSON gateway is used, so no client
+// library is required.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// DefaultTTL is the time to live of the lease to which the locks of a Locker are attached.
+const DefaultTTL = 10 * time.Second
+
+// Locker - a dsync.RPC that implements the lock handlers on top of etcd leases and transactions.
+// Every Locker counts as a single node, eg. one per etcd cluster (or several Lockers with different
+// prefixes on the same cluster, at the expense of the robustness of the quorum).
+type Locker struct {
+	endpoint string // Base URL of the etcd gateway, eg. http://127.0.0.1:2379
+	prefix   string // Prefix of all keys of this locker
+	ttl      time.Duration
+	client   *http.Client
+
+	mutex sync.Mutex
+	lease int64     // Lease all locks are attached to (0 when not granted yet)
+	stop  chan bool // Stops the keep-alive of the lease (nil when not running)
+}
+
+// New returns a Locker that keeps its locks under prefix in the etcd cluster at endpoint.
+func New(endpoint, prefix string) *Locker {
+	return &Locker{
+		endpoint: endpoint,
+		prefix:   prefix,
+		ttl:      DefaultTTL,
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// SetTTL sets the time to live of the lease of the locks (DefaultTTL unless set), after which
+// the locks of a process that stopped keeping its lease alive are released.
+func (l *Locker) SetTTL(ttl time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ttl = ttl
+}
+
+// Node returns the endpoint of the etcd cluster.
+func (l *Locker) Node() string {
+	return l.endpoint
+}
+
+// RPCPath returns the prefix of the keys of the locks.
+func (l *Locker) RPCPath() string {
+	return l.prefix
+}
+
+// Close stops keeping the lease alive and revokes it, releasing all locks held through l.
+func (l *Locker) Close() error {
+	l.mutex.Lock()
+	lease := l.lease
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	l.lease = 0
+	l.mutex.Unlock()
+	if lease == 0 {
+		return nil
+	}
+	return l.post(context.Background(), "/v3/lease/revoke", map[string]string{"ID": strconv.FormatInt(lease, 10)}, nil)
+}
+
+// Call performs the lock handler serviceMethod (eg. "Dsync.Lock") against etcd.
+func (l *Locker) Call(ctx context.Context, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	lockArgs, ok := args.(*dsync.LockArgs)
+	if !ok {
+		return fmt.Errorf("Unsupported arguments for %s: %T", serviceMethod, args)
+	}
+	result, ok := dsync.GrantedReply(reply, lockArgs)
+	if !ok {
+		return fmt.Errorf("Unsupported reply for %s: %T", serviceMethod, reply)
+	}
+
+	switch serviceMethod {
+	case "Dsync.Lock":
+		return l.lock(ctx, lockArgs, result)
+	case "Dsync.RLock":
+		return l.rlock(ctx, lockArgs, result)
+	case "Dsync.Unlock":
+		return l.unlock(ctx, lockArgs, result)
+	case "Dsync.RUnlock":
+		return l.runlock(ctx, lockArgs, result)
+	case "Dsync.ForceUnlock":
+		return l.forceUnlock(ctx, lockArgs, result)
+	case "Dsync.Expired":
+		return l.expired(ctx, lockArgs, result)
+	}
+	return fmt.Errorf("Unsupported method for etcd: %s", serviceMethod)
+}
+
+// Keys of a lock: <prefix>/<namespace>/<name>/w for a write lock and <prefix>/<namespace>/<name>/r/<uid>
+// for every read lock, with namespace and name escaped so that they cannot contain a slash.
+func (l *Locker) lockPrefix(args *dsync.LockArgs) string {
+	return l.prefix + "/" + url.QueryEscape(args.Namespace) + "/" + url.QueryEscape(args.Name) + "/"
+}
+
+func (l *Locker) writerKey(args *dsync.LockArgs) string {
+	return l.lockPrefix(args) + "w"
+}
+
+func (l *Locker) readerKey(args *dsync.LockArgs) string {
+	return l.lockPrefix(args) + "r/" + args.UID
+}
+
+// lock puts the write lock key unless any key of the lock exists.
+func (l *Locker) lock(ctx context.Context, args *dsync.LockArgs, reply *bool) error {
+	lease, err := l.getLease()
+	if err != nil {
+		return err
+	}
+	prefix := l.lockPrefix(args)
+	*reply, err = l.txn(ctx,
+		[]compare{{Key: encode(prefix), RangeEnd: encode(prefixEnd(prefix)), Target: "CREATE", Result: "EQUAL", CreateRevision: "0"}},
+		[]requestOp{{RequestPut: &putRequest{Key: encode(l.writerKey(args)), Value: encode(args.UID), Lease: strconv.FormatInt(lease, 10)}}},
+	)
+	return err
+}
+
+// rlock puts a read lock key unless the write lock key exists.
+func (l *Locker) rlock(ctx context.Context, args *dsync.LockArgs, reply *bool) error {
+	lease, err := l.getLease()
+	if err != nil {
+		return err
+	}
+	*reply, err = l.txn(ctx,
+		[]compare{{Key: encode(l.writerKey(args)), Target: "CREATE", Result: "EQUAL", CreateRevision: "0"}},
+		[]requestOp{{RequestPut: &putRequest{Key: encode(l.readerKey(args)), Value: encode(args.UID), Lease: strconv.FormatInt(lease, 10)}}},
+	)
+	return err
+}
+
+// unlock deletes the write lock key when it holds the uid of the lock.
+func (l *Locker) unlock(ctx context.Context, args *dsync.LockArgs, reply *bool) error {
+	ok, err := l.txn(ctx,
+		[]compare{{Key: encode(l.writerKey(args)), Target: "VALUE", Result: "EQUAL", Value: encode(args.UID)}},
+		[]requestOp{{RequestDeleteRange: &deleteRangeRequest{Key: encode(l.writerKey(args))}}},
+	)
+	if err != nil {
+		return err
+	}
+	if *reply = ok; !ok {
+		return dsync.LockServerError(dsync.ErrLockNotHeld, "Unlock unable to find corresponding lock for uid: "+args.UID)
+	}
+	return nil
+}
+
+// runlock deletes the read lock key of the uid.
+func (l *Locker) runlock(ctx context.Context, args *dsync.LockArgs, reply *bool) error {
+	var resp deleteRangeResponse
+	if err := l.post(ctx, "/v3/kv/deleterange", deleteRangeRequest{Key: encode(l.readerKey(args))}, &resp); err != nil {
+		return err
+	}
+	if *reply = resp.Deleted > 0; !*reply {
+		return dsync.LockServerError(dsync.ErrLockNotHeld, "RUnlock unable to find corresponding read lock for uid: "+args.UID)
+	}
+	return nil
+}
+
+// forceUnlock deletes all keys of the lock.
+func (l *Locker) forceUnlock(ctx context.Context, args *dsync.LockArgs, reply *bool) error {
+	if len(args.UID) != 0 {
+		return fmt.Errorf("ForceUnlock called with non-empty UID: %s", args.UID)
+	}
+	prefix := l.lockPrefix(args)
+	if err := l.post(ctx, "/v3/kv/deleterange", deleteRangeRequest{Key: encode(prefix), RangeEnd: encode(prefixEnd(prefix))}, nil); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// expired replies whether neither the write lock key nor the read lock key holds the uid.
+func (l *Locker) expired(ctx context.Context, args *dsync.LockArgs, reply *bool) error {
+	writer, err := l.txn(ctx,
+		[]compare{{Key: encode(l.writerKey(args)), Target: "VALUE", Result: "EQUAL", Value: encode(args.UID)}}, nil)
+	if err != nil {
+		return err
+	}
+	reader, err := l.txn(ctx,
+		[]compare{{Key: encode(l.readerKey(args)), Target: "CREATE", Result: "GREATER", CreateRevision: "0"}}, nil)
+	if err != nil {
+		return err
+	}
+	*reply = !writer && !reader
+	return nil
+}
+
+// getLease returns the lease to attach locks to, granting it (and starting to keep it alive) on first use.
+func (l *Locker) getLease() (int64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.lease != 0 {
+		return l.lease, nil
+	}
+	var resp leaseGrantResponse
+	ttl := int64(l.ttl / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+	if err := l.post(context.Background(), "/v3/lease/grant", map[string]string{"TTL": strconv.FormatInt(ttl, 10)}, &resp); err != nil {
+		return 0, err
+	}
+	if resp.ID == 0 {
+		return 0, errors.New("Lease not granted by etcd")
+	}
+	l.lease = int64(resp.ID)
+	l.stop = make(chan bool)
+	go l.keepAlive(int64(resp.ID), l.ttl/3, l.stop)
+	return l.lease, nil
+}
+
+// keepAlive renews lease every interval until stopped, or until the lease turns out to be lost
+// (eg. after a partition from etcd that lasted longer than its time to live) in which case a new
+// lease is granted for subsequent locks.
+func (l *Locker) keepAlive(lease int64, interval time.Duration, stop chan bool) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		var resp leaseKeepAliveResponse
+		err := l.post(context.Background(), "/v3/lease/keepalive", map[string]string{"ID": strconv.FormatInt(lease, 10)}, &resp)
+		if err != nil || resp.Result.TTL > 0 {
+			continue // Renewed, or try again on the next interval as the lease may still be alive
+		}
+		l.mutex.Lock()
+		if l.lease == lease {
+			l.lease = 0
+			l.stop = nil
+		}
+		l.mutex.Unlock()
+		return
+	}
+}
+
+// txn runs a transaction that executes success when all comparisons hold, returning whether they held.
+func (l *Locker) txn(ctx context.Context, compares []compare, success []requestOp) (bool, error) {
+	var resp txnResponse
+	if err := l.post(ctx, "/v3/kv/txn", txnRequest{Compare: compares, Success: success}, &resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// post sends req as JSON to path of the gateway and decodes the response into resp (unless nil),
+// abandoning the request once ctx is done.
+func (l *Locker) post(ctx context.Context, path string, req interface{}, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", l.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	r, err := l.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		var e gatewayError
+		json.NewDecoder(r.Body).Decode(&e)
+		return fmt.Errorf("etcd request %s failed with status %d: %s", path, r.StatusCode, e.Message)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+func encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// prefixEnd returns the end of the range of all keys that start with prefix.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00" // All keys
+}
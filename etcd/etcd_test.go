@@ -0,0 +1,212 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package etcd_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/dsync"
+	"github.com/minio/dsync/etcd"
+)
+
+// fakeEtcd implements the part of the etcd v3 JSON gateway used by the Locker.
+type fakeEtcd struct {
+	mutex     sync.Mutex
+	kvs       map[string]fakeKV
+	leases    map[int64]bool
+	revision  int64
+	nextLease int64
+}
+
+type fakeKV struct {
+	value          string
+	lease          int64
+	createRevision int64
+}
+
+func decode(s string) string {
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return string(b)
+}
+
+// keys returns all keys in [key, rangeEnd), or just key when rangeEnd is empty.
+func (f *fakeEtcd) keys(key, rangeEnd string) []string {
+	if rangeEnd == "" {
+		if _, ok := f.kvs[key]; ok {
+			return []string{key}
+		}
+		return nil
+	}
+	keys := []string{}
+	for k := range f.kvs {
+		if k >= key && k < rangeEnd {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req map[string]json.RawMessage
+	json.NewDecoder(r.Body).Decode(&req)
+	str := func(field string) string {
+		var s string
+		json.Unmarshal(req[field], &s)
+		return s
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	resp := map[string]interface{}{}
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		f.nextLease++
+		f.leases[f.nextLease] = true
+		resp["ID"] = strconv.FormatInt(f.nextLease, 10)
+		resp["TTL"] = str("TTL")
+	case "/v3/lease/keepalive":
+		id, _ := strconv.ParseInt(str("ID"), 10, 64)
+		result := map[string]string{"ID": str("ID")}
+		if f.leases[id] {
+			result["TTL"] = "10"
+		}
+		resp["result"] = result
+	case "/v3/lease/revoke":
+		id, _ := strconv.ParseInt(str("ID"), 10, 64)
+		delete(f.leases, id)
+		for k, kv := range f.kvs {
+			if kv.lease == id {
+				delete(f.kvs, k)
+			}
+		}
+	case "/v3/kv/deleterange":
+		keys := f.keys(decode(str("key")), decode(str("range_end")))
+		for _, k := range keys {
+			delete(f.kvs, k)
+		}
+		if len(keys) > 0 {
+			resp["deleted"] = strconv.Itoa(len(keys))
+		}
+	case "/v3/kv/txn":
+		var txn struct {
+			Success []struct {
+				RequestPut *struct {
+					Key, Value, Lease string
+				} `json:"request_put"`
+				RequestDeleteRange *struct {
+					Key string
+				} `json:"request_delete_range"`
+			}
+		}
+		data, _ := json.Marshal(req)
+		json.Unmarshal(data, &txn)
+		succeeded := true
+		var compares []map[string]string
+		json.Unmarshal(req["compare"], &compares)
+		for _, c := range compares {
+			keys := f.keys(decode(c["key"]), decode(c["range_end"]))
+			switch c["target"] {
+			case "CREATE":
+				if c["result"] == "EQUAL" && len(keys) > 0 || c["result"] == "GREATER" && len(keys) == 0 {
+					succeeded = false
+				}
+			case "VALUE":
+				if len(keys) == 0 || f.kvs[keys[0]].value != decode(c["value"]) {
+					succeeded = false
+				}
+			}
+		}
+		if succeeded {
+			f.revision++
+			for _, op := range txn.Success {
+				if op.RequestPut != nil {
+					lease, _ := strconv.ParseInt(op.RequestPut.Lease, 10, 64)
+					f.kvs[decode(op.RequestPut.Key)] = fakeKV{value: decode(op.RequestPut.Value), lease: lease, createRevision: f.revision}
+				}
+				if op.RequestDeleteRange != nil {
+					delete(f.kvs, decode(op.RequestDeleteRange.Key))
+				}
+			}
+			resp["succeeded"] = true
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestLocker(t *testing.T) {
+	server := httptest.NewServer(&fakeEtcd{kvs: make(map[string]fakeKV), leases: make(map[int64]bool)})
+	defer server.Close()
+
+	// Two lockers on the same (fake) cluster, so that dsync has the minimum of two nodes
+	lockers := []*etcd.Locker{etcd.New(server.URL, "/dsync-0"), etcd.New(server.URL, "/dsync-1")}
+	if err := dsync.SetNodesWithClients([]dsync.RPC{lockers[0], lockers[1]}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dm := dsync.NewDRWMutex("test")
+	dm.Lock()
+
+	ch := make(chan struct{})
+	go func() {
+		dm := dsync.NewDRWMutex("test")
+		dm.RLock()
+		dm.RLock()
+		dm.RUnlock()
+		dm.RUnlock()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		t.Fatal("Read lock granted while write lock held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	dm.Unlock()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for read locks")
+	}
+
+	// Revoking the leases releases the locks of a process that goes away
+	dm.Lock()
+	for _, l := range lockers {
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ch = make(chan struct{})
+	go func() {
+		dm := dsync.NewDRWMutex("test")
+		dm.Lock()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for lock after leases were revoked")
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package etcd
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Messages of the etcd v3 JSON gateway (as far as used), keys and values are base64 encoded and
+// 64-bit integers are sent as strings.
+
+type compare struct {
+	Key            string `json:"key"`
+	RangeEnd       string `json:"range_end,omitempty"`
+	Target         string `json:"target"` // VERSION, CREATE, MOD or VALUE
+	Result         string `json:"result"` // EQUAL, GREATER, LESS or NOT_EQUAL
+	CreateRevision string `json:"create_revision,omitempty"`
+	Value          string `json:"value,omitempty"`
+}
+
+type putRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Lease string `json:"lease,omitempty"`
+}
+
+type deleteRangeRequest struct {
+	Key      string `json:"key"`
+	RangeEnd string `json:"range_end,omitempty"`
+}
+
+type requestOp struct {
+	RequestPut         *putRequest         `json:"request_put,omitempty"`
+	RequestDeleteRange *deleteRangeRequest `json:"request_delete_range,omitempty"`
+}
+
+type txnRequest struct {
+	Compare []compare   `json:"compare"`
+	Success []requestOp `json:"success,omitempty"`
+}
+
+type txnResponse struct {
+	Succeeded bool `json:"succeeded"`
+}
+
+type deleteRangeResponse struct {
+	Deleted int64String `json:"deleted"`
+}
+
+type leaseGrantResponse struct {
+	ID  int64String `json:"ID"`
+	TTL int64String `json:"TTL"`
+}
+
+type leaseKeepAliveResponse struct {
+	Result struct {
+		ID  int64String `json:"ID"`
+		TTL int64String `json:"TTL"`
+	} `json:"result"`
+}
+
+type gatewayError struct {
+	Message string `json:"message"`
+}
+
+// int64String decodes a 64-bit integer sent either as a string or as a number.
+type int64String int64
+
+func (i *int64String) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		var n int64
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*i = int64String(n)
+		return nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = int64String(n)
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LockEvent - a change in the lifecycle of a lock, as reported to Events.
+type LockEvent struct {
+	Namespace string
+	Name      string
+	Owner     string
+	UID       string // Uid of the lock (at the own node for the client)
+	ReadLock  bool
+	Node      string        // For lock servers the node of the client holding the lock, for OnQuorumLost of the client the lock server that lost it
+	Since     time.Time     // Time at which the lock was granted
+	Held      time.Duration // Time the lock had been held for (zero for OnAcquired)
+}
+
+// Events - interface through which the lifecycle of locks is reported, to be implemented by the
+// embedding application to wire up metrics, logging or corrective actions. The client reports the
+// locks it acquires, releases and no longer holds a quorum of (as lock servers that granted them
+// restarted, or they were force unlocked), lock servers report the locks they grant, release and purge as stale.
+//
+// The methods are called synchronously (by lock servers while holding their mutex) so must not block.
+type Events interface {
+	OnAcquired(ev LockEvent)
+	OnReleased(ev LockEvent)
+	OnQuorumLost(ev LockEvent)
+	OnStalePurge(ev LockEvent)
+}
+
+// NopEvents - Events ignoring all events, to embed in implementations interested in some events only.
+type NopEvents struct{}
+
+func (NopEvents) OnAcquired(ev LockEvent)   {}
+func (NopEvents) OnReleased(ev LockEvent)   {}
+func (NopEvents) OnQuorumLost(ev LockEvent) {}
+func (NopEvents) OnStalePurge(ev LockEvent) {}
+
+type eventsHolder struct {
+	events Events
+}
+
+// Events of the client, set via SetEvents.
+var devents atomic.Value
+
+func init() {
+	devents.Store(eventsHolder{events: NopEvents{}})
+}
+
+// SetEvents - installs the events through which the client reports the lifecycle of its locks, nil
+// stops reporting.
+func SetEvents(events Events) {
+	if events == nil {
+		events = NopEvents{}
+	}
+	devents.Store(eventsHolder{events: events})
+}
+
+func getEvents() Events {
+	return devents.Load().(eventsHolder).events
+}
@@ -0,0 +1,157 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import "time"
+
+// Maximum number of entries a lock server should send in a single ExpiredBatch call.
+const MaxExpiredBatchEntries = 1000
+
+// ExpiredEntry - identifies a single lock (by name and uid) to check in an ExpiredBatch call.
+type ExpiredEntry struct {
+	Namespace string
+	Name      string
+	UID       string
+}
+
+// ExpiredBatchArgs - arguments for the ExpiredBatch rpc call, which checks many locks in a single
+// call rather than one Expired call per lock.
+type ExpiredBatchArgs struct {
+	Token       string
+	Timestamp   time.Time
+	Incarnation uint64
+	Epoch       uint64
+	Version     uint32
+	Entries     []ExpiredEntry
+}
+
+func (e *ExpiredBatchArgs) SetToken(token string) {
+	e.Token = token
+}
+
+func (e *ExpiredBatchArgs) SetTimestamp(tstamp time.Time) {
+	e.Timestamp = tstamp
+}
+
+func (e *ExpiredBatchArgs) SetIncarnation(incarnation uint64) {
+	e.Incarnation = incarnation
+}
+
+func (e *ExpiredBatchArgs) SetVersion(version uint32) {
+	e.Version = version
+}
+
+// ExpiredBatchReply - reply of the ExpiredBatch rpc call, a bitmap with bit i set when Entries[i] has expired.
+type ExpiredBatchReply struct {
+	Expired []byte
+}
+
+// SetExpired marks entry i as expired.
+func (r *ExpiredBatchReply) SetExpired(i int) {
+	r.Expired = setBit(r.Expired, i)
+}
+
+// IsExpired returns whether entry i has expired.
+func (r *ExpiredBatchReply) IsExpired(i int) bool {
+	return isBitSet(r.Expired, i)
+}
+
+// ConfirmExpiredReply - reply of the ConfirmExpired rpc call, bitmaps with bit i set when the peer
+// agrees that Entries[i] is stale (Expired) or when it holds no lock for it and abstains (NotHeld).
+type ConfirmExpiredReply struct {
+	Expired []byte
+	NotHeld []byte
+}
+
+// SetExpired marks entry i as agreed to be stale.
+func (r *ConfirmExpiredReply) SetExpired(i int) {
+	r.Expired = setBit(r.Expired, i)
+}
+
+// IsExpired returns whether entry i is agreed to be stale.
+func (r *ConfirmExpiredReply) IsExpired(i int) bool {
+	return isBitSet(r.Expired, i)
+}
+
+// SetNotHeld marks entry i as not held by the peer.
+func (r *ConfirmExpiredReply) SetNotHeld(i int) {
+	r.NotHeld = setBit(r.NotHeld, i)
+}
+
+// IsNotHeld returns whether entry i is not held by the peer.
+func (r *ConfirmExpiredReply) IsNotHeld(i int) bool {
+	return isBitSet(r.NotHeld, i)
+}
+
+func setBit(bitmap []byte, i int) []byte {
+	for len(bitmap) <= i/8 {
+		bitmap = append(bitmap, 0)
+	}
+	bitmap[i/8] |= 1 << uint(i%8)
+	return bitmap
+}
+
+func isBitSet(bitmap []byte, i int) bool {
+	return i/8 < len(bitmap) && bitmap[i/8]&(1<<uint(i%8)) != 0
+}
+
+// ConfirmExpiredArgs - arguments for the ConfirmExpired rpc call, by which a lock server asks a peer
+// whether it agrees that locks of an originating server are stale before purging them. Peers hold
+// the same locks under uids of their own, so the UID of the entries is ignored.
+type ConfirmExpiredArgs struct {
+	Token       string
+	Timestamp   time.Time
+	Incarnation uint64
+	Epoch       uint64
+	Version     uint32
+	Source      Identity // Server the locks originated from
+	Entries     []ExpiredEntry
+
+	// Source of requests of protocol version 2, see SetVersion and Upgrade
+	Node    string
+	RPCPath string
+}
+
+func (c *ConfirmExpiredArgs) SetToken(token string) {
+	c.Token = token
+}
+
+func (c *ConfirmExpiredArgs) SetTimestamp(tstamp time.Time) {
+	c.Timestamp = tstamp
+}
+
+func (c *ConfirmExpiredArgs) SetIncarnation(incarnation uint64) {
+	c.Incarnation = incarnation
+}
+
+// SetVersion - sets the protocol version of the request, filling in the fields that lock servers of
+// that version expect (Node and RPCPath for version 2).
+func (c *ConfirmExpiredArgs) SetVersion(version uint32) {
+	c.Version = version
+	c.Node, c.RPCPath = "", ""
+	if version < 3 {
+		c.Node, c.RPCPath = c.Source.Node, c.Source.Path
+	}
+}
+
+// Upgrade - fills in the fields of a request of an older protocol version as carried by the current
+// version (Source from Node and RPCPath of version 2), for use by lock servers accepting older versions.
+func (c *ConfirmExpiredArgs) Upgrade() {
+	if c.Version < 3 && c.Source == (Identity{}) {
+		c.Source = Identity{Node: c.Node, Path: c.RPCPath}
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// heldLock is a lock held by this client.
+type heldLock struct {
+	HeldLock               // As reported by the hold watchdog (Source is only captured while it is enabled)
+	owner    string        // Actor on whose behalf the lock is held
+	uid      string        // Uid of the lock at the own node when acquired, which identifies it
+	locks    []string      // Uids of the lock per node, empty for the nodes that did not grant it (or lost it)
+	dropped  []bool        // Nodes that granted the lock but lost it, to re-assert it at (see SetLockValidator)
+	reported bool          // Reported by the hold watchdog
+	lost     bool          // No longer held by a quorum of the nodes
+	lostCh   chan struct{} // Closed once lost, see DRWMutex.Lost
+
+	revokeBy  time.Time     // Time by which a lock server asked the lock to be released, zero unless asked
+	revokedCh chan struct{} // Closed once asked to release the lock, see DRWMutex.Revoked
+}
+
+// event returns the lock event of the lock, reported by node (empty when the client itself).
+func (h *heldLock) event(node string) LockEvent {
+	return LockEvent{Namespace: h.Namespace, Name: h.Name, Owner: h.owner, UID: h.uid, ReadLock: h.ReadLock,
+		Node: node, Since: h.Since, Held: getClock().Now().Sub(h.Since)}
+}
+
+// Locks held by this client, keyed by the uid of the lock at the own node
+var held = struct {
+	sync.Mutex
+	locks map[string]*heldLock
+}{locks: make(map[string]*heldLock)}
+
+// ownUID returns the uid of a lock at the own node, which identifies the lock.
+func ownUID(locks []string) string {
+	if dlocal != nil {
+		return locks[0]
+	}
+	return locks[ownNode]
+}
+
+// acquiredLock registers a lock just acquired by dm, returning it.
+func acquiredLock(dm *DRWMutex, locks []string, isReadLock bool) *heldLock {
+	h := newHeldLock(dm, locks, isReadLock)
+	held.Lock()
+	held.locks[h.uid] = h
+	held.Unlock()
+	h.acquired()
+	return h
+}
+
+// acquiredUnlessConflicting registers a lock just acquired by dm like acquiredLock, unless this
+// client holds a conflicting lock on the name that was granted within this process only while the
+// lock was granted by quorum, or the other way round (see DegradedLocal), returning nil then. As
+// the lock servers do not know of the locks granted within this process only, this is the only
+// place that keeps the two apart.
+func acquiredUnlessConflicting(dm *DRWMutex, locks []string, isReadLock bool) *heldLock {
+	h := newHeldLock(dm, locks, isReadLock)
+	held.Lock()
+	for _, other := range held.locks {
+		if other.Namespace == h.Namespace && other.Name == h.Name && isLocalOnly(other.uid) != isLocalOnly(h.uid) && (!other.ReadLock || !h.ReadLock) {
+			held.Unlock()
+			return nil
+		}
+	}
+	held.locks[h.uid] = h
+	held.Unlock()
+	h.acquired()
+	return h
+}
+
+// newHeldLock returns a lock just acquired by dm, yet to be registered.
+func newHeldLock(dm *DRWMutex, locks []string, isReadLock bool) *heldLock {
+	h := &heldLock{HeldLock: HeldLock{Namespace: getNamespace(), Name: dm.Name, ReadLock: isReadLock, Since: getClock().Now()},
+		owner: dm.Owner, uid: ownUID(locks), locks: append([]string(nil), locks...), dropped: make([]bool, len(locks)),
+		lostCh: make(chan struct{}), revokedCh: make(chan struct{})}
+	if holdWatchdogEnabled() {
+		h.Source = acquisitionSource()
+	}
+	return h
+}
+
+// acquired reports a lock just registered.
+func (h *heldLock) acquired() {
+	ev := h.event("")
+	ev.Held = 0
+	getEvents().OnAcquired(ev)
+}
+
+// releasedLock unregisters a lock that is being released, returning the uids of the lock per node
+// to release (which differ from locks for the nodes that lost it, or at which it was re-asserted).
+func releasedLock(locks []string) []string {
+	uid := ownUID(locks)
+	held.Lock()
+	h, ok := held.locks[uid]
+	delete(held.locks, uid)
+	held.Unlock()
+	if !ok {
+		return locks
+	}
+	getEvents().OnReleased(h.event(""))
+	return h.locks
+}
+
+// serverRestarted forgets the locks granted by a lock server that has restarted (and so lost
+// them), reporting the locks that are thereby no longer held by a quorum of the nodes and
+// re-registering the others with the server in the background.
+func serverRestarted(c RPC) {
+	index := -1
+	for i, clnt := range clnts {
+		if clnt.Node() == c.Node() && clnt.RPCPath() == c.RPCPath() {
+			index = i
+		}
+	}
+	if index < 0 {
+		return // Not one of the nodes of the client, eg. a peer of a lock server
+	}
+	forgetRetained(index)
+
+	var lost []LockEvent
+	var reassert []*heldLock
+	held.Lock()
+	for _, h := range held.locks {
+		if !isLocked(h.locks[index]) || isLocalOnly(h.uid) {
+			continue
+		}
+		h.drop(index)
+		if !quorumMet(&h.locks, h.ReadLock) {
+			if h.markLost() {
+				lost = append(lost, h.event(c.Node()))
+			}
+		} else if !h.lost {
+			reassert = append(reassert, h)
+		}
+	}
+	held.Unlock()
+
+	if len(reassert) > 0 {
+		go func() {
+			for _, h := range reassert {
+				reassertLock(context.Background(), h, index)
+			}
+		}()
+	}
+
+	for _, ev := range lost {
+		logf(LogWarn, "Lock no longer held by a quorum, lock server restarted", "name", ev.Name, "node", ev.Node)
+		getEvents().OnQuorumLost(ev)
+	}
+}
+
+// forceUnlocked reports the locks on name held by this client as lost, as they are being force
+// unlocked (by any DRWMutex of this client).
+func forceUnlocked(name string) {
+	var lost []LockEvent
+	held.Lock()
+	for _, h := range held.locks {
+		if h.Namespace == getNamespace() && h.Name == name && h.markLost() {
+			lost = append(lost, h.event(""))
+		}
+	}
+	held.Unlock()
+
+	for _, ev := range lost {
+		logf(LogWarn, "Lock no longer held, force unlocked", "name", ev.Name)
+		getEvents().OnQuorumLost(ev)
+	}
+}
+
+// markLost marks the lock as no longer held by a quorum of the nodes, returning false when it
+// was lost already. Must be called with the mutex of held locks held.
+func (h *heldLock) markLost() bool {
+	if h.lost {
+		return false
+	}
+	h.lost = true
+	close(h.lostCh)
+	return true
+}
+
+// drop forgets the lock at the node at index, which lost it. Must be called with the mutex of
+// held locks held.
+func (h *heldLock) drop(index int) {
+	h.locks[index] = ""
+	h.dropped[index] = true
+}
@@ -0,0 +1,144 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Maximum number of names whose contention is tracked, the least contended name is forgotten
+// to make room for another
+const maxContentionNames = 1024
+
+// Half-life of the count of recent failures of a name, see BackOffState
+const recentFailuresHalfLife = 10 * time.Second
+
+// Contention - how contended a lock is, as seen by this client.
+type Contention struct {
+	Namespace  string
+	Name       string
+	Attempts   uint64        // Attempts to acquire the lock
+	Failed     uint64        // Attempts that failed to reach quorum
+	Denials    uint64        // Denials by nodes, as the lock was held by someone else
+	DenialRate float64       // Fraction of the attempts that failed
+	Waited     time.Duration // Total time waited for the lock
+}
+
+type contentionKey struct {
+	namespace string
+	name      string
+}
+
+type contentionEntry struct {
+	Contention
+	recent  float64   // Failed attempts, decaying since updated
+	updated time.Time // Time at which recent was last updated
+}
+
+// recentFailures returns the failed attempts, decayed until now.
+func (c *contentionEntry) recentFailures(now time.Time) float64 {
+	return c.recent * math.Exp2(-float64(now.Sub(c.updated))/float64(recentFailuresHalfLife))
+}
+
+// Contention per name
+var contention = struct {
+	sync.Mutex
+	names map[contentionKey]*contentionEntry
+}{names: make(map[contentionKey]*contentionEntry)}
+
+// contended records an attempt to acquire the lock on name, and whether it failed (with the
+// number of nodes that denied it).
+func contended(name string, failed bool, denials int) {
+	key := contentionKey{namespace: getNamespace(), name: name}
+	contention.Lock()
+	defer contention.Unlock()
+	c, ok := contention.names[key]
+	if !ok {
+		if len(contention.names) >= maxContentionNames {
+			evictLeastContended()
+		}
+		c = &contentionEntry{Contention: Contention{Namespace: key.namespace, Name: key.name}}
+		contention.names[key] = c
+	}
+	c.Attempts++
+	if failed {
+		c.Failed++
+		c.Denials += uint64(denials)
+		now := getClock().Now()
+		c.recent, c.updated = c.recentFailures(now)+1, now
+	}
+}
+
+// recentFailures returns the failed attempts on name recently (see BackOffState).
+func recentFailures(name string) float64 {
+	contention.Lock()
+	defer contention.Unlock()
+	if c, ok := contention.names[contentionKey{namespace: getNamespace(), name: name}]; ok {
+		return c.recentFailures(getClock().Now())
+	}
+	return 0
+}
+
+// waited records the time waited for a lock that has been acquired.
+func waited(name string, d time.Duration) {
+	contention.Lock()
+	defer contention.Unlock()
+	if c, ok := contention.names[contentionKey{namespace: getNamespace(), name: name}]; ok {
+		c.Waited += d
+	}
+}
+
+// evictLeastContended forgets the name with the fewest failed attempts, must be called with the
+// mutex held.
+func evictLeastContended() {
+	var least *contentionEntry
+	for _, c := range contention.names {
+		if least == nil || c.Failed < least.Failed || c.Failed == least.Failed && c.Attempts < least.Attempts {
+			least = c
+		}
+	}
+	delete(contention.names, contentionKey{namespace: least.Namespace, name: least.Name})
+}
+
+// MostContended returns the (at most) n locks of this client with the most failed attempts, to find
+// out which resources need finer-grained locking. Only the 1024 most contended names are tracked.
+func MostContended(n int) []Contention {
+	contention.Lock()
+	locks := make([]Contention, 0, len(contention.names))
+	for _, c := range contention.names {
+		if c.Failed > 0 {
+			lock := c.Contention
+			lock.DenialRate = float64(c.Failed) / float64(c.Attempts)
+			locks = append(locks, lock)
+		}
+	}
+	contention.Unlock()
+
+	sort.Slice(locks, func(i, j int) bool {
+		if locks[i].Failed != locks[j].Failed {
+			return locks[i].Failed > locks[j].Failed
+		}
+		return locks[i].Waited > locks[j].Waited
+	})
+	if len(locks) > n {
+		locks = locks[:n]
+	}
+	return locks
+}
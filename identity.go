@@ -0,0 +1,59 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import "errors"
+
+// Identity - who a request comes from, as carried by LockArgs (see Source) and ConfirmExpiredArgs.
+// Lock servers attribute locks to it (eg. for quotas and rate limits) and, through a Resolver, call
+// it back to check that its locks are still held or to revoke a retained lock. Its fields are opaque
+// to lock servers other than for comparison: for net/rpc the address and RPC path of the client, for
+// other transports anything their Resolver understands.
+type Identity struct {
+	Node string // Address (or other name) of the client
+	Path string // Where the client serves callbacks (the RPC path for net/rpc), empty when it serves none
+}
+
+// Callable returns whether the client serves callbacks. Lock servers cannot check back with plain
+// clients that serve none, so that only lease expiry (or a force unlock) frees their abandoned locks.
+func (id Identity) Callable() bool {
+	return id.Path != ""
+}
+
+func (id Identity) String() string {
+	return id.Node + id.Path
+}
+
+// ErrNotCallable - resolving an Identity of a client that serves no callbacks.
+var ErrNotCallable = errors.New("Client serves no callbacks")
+
+// Resolver - resolves the Identity of a client into an RPC to call it back, for use by lock servers.
+type Resolver interface {
+	Resolve(id Identity) (RPC, error)
+}
+
+// ResolverFunc - adapts a function to a Resolver.
+type ResolverFunc func(id Identity) (RPC, error)
+
+func (f ResolverFunc) Resolve(id Identity) (RPC, error) {
+	return f(id)
+}
+
+// ownIdentity returns the Identity of this client, as one of the nodes.
+func ownIdentity() Identity {
+	return Identity{Node: clnts[ownNode].Node(), Path: clnts[ownNode].RPCPath()}
+}
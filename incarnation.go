@@ -0,0 +1,189 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IncarnationMismatchError - returned by a lock server for a request addressed to another incarnation
+// of the server, ie. when the server has restarted (and lost its locks) since the client learned its
+// incarnation, or when the client has yet to learn it.
+type IncarnationMismatchError struct {
+	ServerIncarnation uint64
+	ClientIncarnation uint64
+}
+
+const incarnationMismatchFormat = "Incarnation mismatch: server at incarnation %d, client at incarnation %d, server may have restarted"
+
+func (e IncarnationMismatchError) Error() string {
+	return fmt.Sprintf(incarnationMismatchFormat, e.ServerIncarnation, e.ClientIncarnation)
+}
+
+// Is matches ErrTimestampMismatch.
+func (e IncarnationMismatchError) Is(target error) bool {
+	return target == ErrTimestampMismatch
+}
+
+// CheckIncarnation - verifies that a request is addressed to the current incarnation of a lock server, for use by lock servers.
+func CheckIncarnation(serverIncarnation, clientIncarnation uint64) error {
+	if clientIncarnation != serverIncarnation {
+		return IncarnationMismatchError{ServerIncarnation: serverIncarnation, ClientIncarnation: clientIncarnation}
+	}
+	return nil
+}
+
+// toIncarnationMismatchError returns the incarnation mismatch carried by err (also when transported
+// as a plain error string by net/rpc), or nil if err is not an incarnation mismatch.
+func toIncarnationMismatchError(err error) *IncarnationMismatchError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(IncarnationMismatchError); ok {
+		return &e
+	}
+	var e IncarnationMismatchError
+	if n, _ := fmt.Sscanf(err.Error(), incarnationMismatchFormat, &e.ServerIncarnation, &e.ClientIncarnation); n != 2 {
+		return nil
+	}
+	return &e
+}
+
+// Incarnations of the lock servers as last learned, keyed by node and rpc path
+var incarnations = struct {
+	sync.Mutex
+	m map[string]uint64
+}{m: make(map[string]uint64)}
+
+func getIncarnation(c RPC) uint64 {
+	incarnations.Lock()
+	defer incarnations.Unlock()
+	return incarnations.m[c.Node()+c.RPCPath()]
+}
+
+func setIncarnation(c RPC, incarnation uint64) {
+	incarnations.Lock()
+	defer incarnations.Unlock()
+	incarnations.m[c.Node()+c.RPCPath()] = incarnation
+}
+
+// IncarnatedArgs - arguments of rpc calls that are checked against the incarnation of the lock server.
+type IncarnatedArgs interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+	SetIncarnation(incarnation uint64)
+}
+
+// CallServer - makes an rpc call addressed to the incarnation of the lock server as known to the client
+// (also for lock servers calling other lock servers), restoring the errors of the lock server so that
+// they can be matched with errors.Is and errors.As. When the server turns out to be at another
+// incarnation the client resynchronizes and makes the call once more, as a restarted server holds
+// no state the call could conflict with, and re-registers the locks of the client that are still
+// held by a quorum of the nodes with the server in the background (reporting those that are not
+// as lost, see DRWMutex.Lost). Likewise, when args are VersionedArgs and the server does
+// not accept the protocol version of the call, the client switches to the newest version the server
+// accepts (if it speaks it too) and makes the call once more, speaking that version to the server
+// until it restarts. Requests acquiring a lock whose reply is stamped with another cluster
+// configuration epoch than the request fail with an EpochMismatchError (see LockReply), a lock
+// granted all the same being released again.
+func CallServer(ctx context.Context, c RPC, serviceMethod string, args IncarnatedArgs, reply interface{}) error {
+	versioned, _ := args.(VersionedArgs)
+	if versioned != nil {
+		versioned.SetVersion(getServerVersion(c))
+	}
+	args.SetIncarnation(getIncarnation(c))
+	var err error
+	for resynchronized, negotiated := false, false; ; {
+		err = callStamped(ctx, c, serviceMethod, args, reply)
+		if e := toIncarnationMismatchError(err); e != nil && !resynchronized {
+			setIncarnation(c, e.ServerIncarnation)
+			if e.ClientIncarnation != 0 {
+				logf(LogInfo, "Lock server restarted, resynchronizing", "node", c.Node(), "incarnation", e.ServerIncarnation)
+				// The server may have been upgraded, so speak the newest version to it again
+				setServerVersion(c, ProtocolVersion)
+				if versioned != nil {
+					versioned.SetVersion(ProtocolVersion)
+				}
+				serverRestarted(c)
+			}
+			args.SetIncarnation(e.ServerIncarnation)
+			resynchronized = true
+			continue
+		}
+		if e := toVersionMismatchError(err); e != nil && versioned != nil && !negotiated {
+			if version, ok := negotiateVersion(*e); ok {
+				logf(LogInfo, "Lock server speaks another protocol version, switching", "node", c.Node(), "version", version)
+				setServerVersion(c, version)
+				versioned.SetVersion(version)
+				negotiated = true
+				continue
+			}
+		}
+		break
+	}
+	if err != nil {
+		dmetrics.rpcFailed(c.Node(), serviceMethod)
+	}
+	return restoreError(err)
+}
+
+// Requests acquiring a lock, whose replies are stamped with the epoch of the server as of protocol
+// version 4 (see LockReply), along with whether they acquire a read lock
+var acquiringMethods = map[string]bool{
+	"Dsync.Lock":           false,
+	"Dsync.RLock":          true,
+	"Dsync.LockWait":       false,
+	"Dsync.RLockWait":      true,
+	"Dsync.PrepareLock":    false,
+	"Dsync.PrepareRLock":   true,
+	"Dsync.LockBatch":      false,
+	"Dsync.LockPersistent": false,
+	"Dsync.TakeOver":       false,
+}
+
+// callStamped makes an rpc call, receiving the reply to a request acquiring a lock of protocol
+// version 4 onwards as a LockReply whose epoch must match the epoch of the request.
+func callStamped(ctx context.Context, c RPC, serviceMethod string, args IncarnatedArgs, reply interface{}) error {
+	lockArgs, _ := args.(*LockArgs)
+	granted, _ := reply.(*bool)
+	isReadLock, acquiring := acquiringMethods[serviceMethod]
+	if lockArgs == nil || granted == nil || !acquiring || lockArgs.Version < 4 {
+		return c.Call(ctx, serviceMethod, args, reply)
+	}
+	var stamped LockReply
+	err := c.Call(ctx, serviceMethod, args, &stamped)
+	if err == nil && stamped.Epoch != lockArgs.Epoch {
+		if stamped.Granted {
+			// Granted by a server of another configuration, so not to be counted but released
+			switch serviceMethod {
+			case "Dsync.LockBatch":
+				sendReleaseBatch(c, lockArgs.Names, lockArgs.UID)
+			case "Dsync.TakeOver":
+				// Held before, so left to the persistent lock to release
+			default:
+				sendRelease(c, lockArgs.Name, lockArgs.UID, isReadLock)
+			}
+		}
+		stamped.Granted = false
+		err = EpochMismatchError{ServerEpoch: stamped.Epoch, ClientEpoch: lockArgs.Epoch}
+	}
+	*granted = stamped.Granted
+	return err
+}
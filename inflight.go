@@ -0,0 +1,132 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Acquisition - a lock acquisition of this client that has not been granted (yet).
+type Acquisition struct {
+	Namespace   string
+	Name        string
+	Owner       string
+	ReadLock    bool
+	Since       time.Time     // Time at which the acquisition started
+	Waiting     time.Duration // Time waited so far
+	Attempts    int           // Attempts that failed to reach quorum so far
+	LastAttempt *QuorumError  // Outcome at every node of the most recent attempt (nil until an attempt has failed)
+}
+
+// Acquisitions in flight, keyed by a sequence number
+var inflight = struct {
+	sync.Mutex
+	next         uint64
+	acquisitions map[uint64]*Acquisition
+}{acquisitions: make(map[uint64]*Acquisition)}
+
+// startAcquisition registers an acquisition as in flight, returning its key.
+func startAcquisition(dm *DRWMutex, isReadLock bool, since time.Time) uint64 {
+	inflight.Lock()
+	defer inflight.Unlock()
+	inflight.next++
+	inflight.acquisitions[inflight.next] = &Acquisition{Namespace: getNamespace(), Name: dm.Name, Owner: dm.Owner, ReadLock: isReadLock, Since: since}
+	return inflight.next
+}
+
+// failedAcquisition records an attempt of an acquisition in flight that failed to reach quorum.
+func failedAcquisition(key uint64, attempt *QuorumError) {
+	inflight.Lock()
+	defer inflight.Unlock()
+	if a, ok := inflight.acquisitions[key]; ok {
+		a.Attempts++
+		a.LastAttempt = attempt
+	}
+}
+
+// endAcquisition removes an acquisition that has been granted (or aborted).
+func endAcquisition(key uint64) {
+	inflight.Lock()
+	defer inflight.Unlock()
+	delete(inflight.acquisitions, key)
+}
+
+// InFlight returns the lock acquisitions of this client that have not been granted yet, longest
+// waiting first, eg. to find out on which locks a hanging service is waiting and which nodes deny them.
+func InFlight() []Acquisition {
+	now := getClock().Now()
+	inflight.Lock()
+	defer inflight.Unlock()
+	acquisitions := make([]Acquisition, 0, len(inflight.acquisitions))
+	for _, a := range inflight.acquisitions {
+		acquisition := *a
+		acquisition.Waiting = now.Sub(a.Since)
+		acquisitions = append(acquisitions, acquisition)
+	}
+	sort.Slice(acquisitions, func(i, j int) bool { return acquisitions[i].Since.Before(acquisitions[j].Since) })
+	return acquisitions
+}
+
+// Number of most contended locks listed by the debug handler
+const debugContendedLocks = 10
+
+// DebugHandler returns an http.Handler listing the acquisitions in flight (see InFlight) and the most
+// contended locks (see MostContended) as plain text, for the embedding application to serve,
+// eg. http.Handle("/debug/dsync", dsync.DebugHandler()).
+func DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acquisitions := InFlight()
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "%d lock acquisitions in flight\n", len(acquisitions))
+		for _, a := range acquisitions {
+			kind := "write"
+			if a.ReadLock {
+				kind = "read"
+			}
+			name := a.Name
+			if a.Namespace != "" {
+				name = a.Namespace + "/" + a.Name
+			}
+			fmt.Fprintf(&buf, "\n%s lock on %q", kind, name)
+			if a.Owner != "" {
+				fmt.Fprintf(&buf, " for %q", a.Owner)
+			}
+			fmt.Fprintf(&buf, ": waiting %v, %d failed attempts\n", a.Waiting.Round(time.Millisecond), a.Attempts)
+			if a.LastAttempt != nil {
+				fmt.Fprintf(&buf, "  last attempt: %v\n", a.LastAttempt)
+			}
+		}
+		if contended := MostContended(debugContendedLocks); len(contended) > 0 {
+			fmt.Fprintf(&buf, "\nmost contended locks\n")
+			for _, c := range contended {
+				name := c.Name
+				if c.Namespace != "" {
+					name = c.Namespace + "/" + c.Name
+				}
+				fmt.Fprintf(&buf, "  %q: %d of %d attempts failed (%.0f%%), %d denials, waited %v\n",
+					name, c.Failed, c.Attempts, 100*c.DenialRate, c.Denials, c.Waited.Round(time.Millisecond))
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		buf.WriteTo(w)
+	})
+}
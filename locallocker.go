@@ -0,0 +1,388 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LocalLocker - an RPC that implements all lock handlers in memory, without any network. It is
+// used automatically when SetNodesWithClients is passed just the own node, and lets unit tests
+// of code that takes DRWMutexes run without lock servers, eg.
+//
+//	dsync.SetNodesWithClients([]dsync.RPC{dsync.NewLocalLocker("localhost", dsync.DefaultPath)}, 0)
+type LocalLocker struct {
+	node    string
+	rpcPath string
+	uids    uint64 // Counter for the uids of the locks acquired on the fast path
+
+	mutex    sync.Mutex
+	locks    map[string]*localLock // Keyed by namespace and name
+	released chan struct{}         // Closed (and replaced) whenever a lock is released while waited on
+	waiters  int                   // Number of requests waiting for a lock to be released
+}
+
+// localLock - the write lock or read locks held on a single name, by uid.
+type localLock struct {
+	writer   string
+	readers  map[string]bool      // Allocated on the first read lock
+	reserved map[string]time.Time // Uids that are only reserved (by PrepareLock or PrepareRLock) until then
+}
+
+// NewLocalLocker returns an in-memory LocalLocker that presents itself as node and rpcPath.
+func NewLocalLocker(node, rpcPath string) *LocalLocker {
+	return &LocalLocker{
+		node:     node,
+		rpcPath:  rpcPath,
+		locks:    make(map[string]*localLock),
+		released: make(chan struct{}),
+	}
+}
+
+// Node returns the address the locker presents itself as.
+func (l *LocalLocker) Node() string {
+	return l.node
+}
+
+// RPCPath returns the rpc path the locker presents itself as.
+func (l *LocalLocker) RPCPath() string {
+	return l.rpcPath
+}
+
+// Close releases all locks.
+func (l *LocalLocker) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.locks = make(map[string]*localLock)
+	l.notify()
+	return nil
+}
+
+// Call performs the lock handler serviceMethod (eg. "Dsync.Lock") in memory.
+func (l *LocalLocker) Call(ctx context.Context, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	lockArgs, ok := args.(*LockArgs)
+	if !ok {
+		return fmt.Errorf("Unsupported arguments for %s: %T", serviceMethod, args)
+	}
+	result, ok := GrantedReply(reply, lockArgs)
+	if !ok {
+		return fmt.Errorf("Unsupported reply for %s: %T", serviceMethod, reply)
+	}
+
+	span := StartSpan(lockArgs.TraceContext, "LocalLocker."+strings.TrimPrefix(serviceMethod, "Dsync."), "name", lockArgs.Name, "uid", lockArgs.UID)
+	err := l.call(ctx, serviceMethod, lockArgs, result)
+	span.SetAttributes("reply", *result)
+	span.End(err)
+	return err
+}
+
+// call dispatches a request to its handler, which stops waiting for a lock once ctx is done.
+func (l *LocalLocker) call(ctx context.Context, serviceMethod string, lockArgs *LockArgs, result *bool) error {
+	now := getClock().Now()
+	switch serviceMethod {
+	case "Dsync.Lock":
+		return l.lock(ctx, lockArgs, true, now, 0, result)
+	case "Dsync.RLock":
+		return l.lock(ctx, lockArgs, false, now, 0, result)
+	case "Dsync.LockWait":
+		return l.lock(ctx, lockArgs, true, now.Add(lockArgs.WaitTimeout), 0, result)
+	case "Dsync.RLockWait":
+		return l.lock(ctx, lockArgs, false, now.Add(lockArgs.WaitTimeout), 0, result)
+	case "Dsync.PrepareLock":
+		return l.lock(ctx, lockArgs, true, now, lockArgs.Reservation, result)
+	case "Dsync.PrepareRLock":
+		return l.lock(ctx, lockArgs, false, now, lockArgs.Reservation, result)
+	case "Dsync.LockBatch":
+		return l.lockBatch(lockArgs, result)
+	case "Dsync.UnlockBatch":
+		return l.unlockBatch(lockArgs, result)
+	case "Dsync.Commit":
+		return l.commit(lockArgs, result)
+	case "Dsync.Unlock":
+		return l.unlock(lockArgs, true, result)
+	case "Dsync.RUnlock":
+		return l.unlock(lockArgs, false, result)
+	case "Dsync.ForceUnlock":
+		return l.forceUnlock(lockArgs, result)
+	case "Dsync.Watch":
+		return l.watch(ctx, lockArgs, result)
+	case "Dsync.Expired":
+		return l.expired(lockArgs, result)
+	}
+	return fmt.Errorf("Unsupported method for local locker: %s", serviceMethod)
+}
+
+func localKey(args *LockArgs) string {
+	return localNameKey(args.Namespace, args.Name)
+}
+
+func localNameKey(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return strconv.Itoa(len(namespace)) + ":" + namespace + name
+}
+
+// acquire blocks until a write or read lock on name is granted and returns its uid (empty when not
+// granted before deadline, unless zero, or before ctx is done). It is called
+// directly by DRWMutex on the single node fast path, bypassing Call and the RPC machinery.
+func (l *LocalLocker) acquire(ctx context.Context, namespace, name string, isReadLock bool, deadline time.Time) string {
+	args := LockArgs{Namespace: namespace, Name: name, UID: strconv.FormatUint(atomic.AddUint64(&l.uids, 1), 16)}
+	var locked bool
+	l.lock(ctx, &args, !isReadLock, deadline, 0, &locked)
+	if !locked {
+		return "" // Not granted before the deadline
+	}
+	return args.UID
+}
+
+// unlockDirect releases a lock granted by acquire, on the single node fast path.
+func (l *LocalLocker) unlockDirect(namespace, name, uid string, isReadLock bool) error {
+	args := LockArgs{Namespace: namespace, Name: name, UID: uid}
+	var unlocked bool
+	return l.unlock(&args, !isReadLock, &unlocked)
+}
+
+// lock grants a write or read lock, waiting until deadline (forever when zero) for the lock to free
+// up. With a reservation the lock is released again unless committed within that time.
+func (l *LocalLocker) lock(ctx context.Context, args *LockArgs, writer bool, deadline time.Time, reservation time.Duration, reply *bool) error {
+	key := localKey(args)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for {
+		l.dropExpiredReservations(key)
+		lk := l.locks[key]
+		if lk == nil {
+			lk = &localLock{}
+			l.locks[key] = lk
+		}
+		if *reply = lk.writer == "" && (!writer || len(lk.readers) == 0); *reply {
+			if writer {
+				lk.writer = args.UID
+			} else {
+				if lk.readers == nil {
+					lk.readers = make(map[string]bool)
+				}
+				lk.readers[args.UID] = true
+			}
+			if reservation > 0 {
+				if lk.reserved == nil {
+					lk.reserved = make(map[string]time.Time)
+				}
+				lk.reserved[args.UID] = getClock().Now().Add(reservation)
+			}
+			return nil
+		}
+		if !l.waitRelease(ctx, deadline) {
+			return nil
+		}
+	}
+}
+
+// lockBatch grants write locks on all of args.Names, or on none of them when any is locked already.
+func (l *LocalLocker) lockBatch(args *LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	keys := make([]string, len(args.Names))
+	for i, name := range args.Names {
+		keys[i] = localNameKey(args.Namespace, name)
+		l.dropExpiredReservations(keys[i])
+		if lk := l.locks[keys[i]]; lk != nil && lk.writer != args.UID { // Granted before when the reply got lost
+			*reply = false
+			return nil
+		}
+	}
+	for _, key := range keys {
+		l.locks[key] = &localLock{writer: args.UID}
+	}
+	*reply = true
+	return nil
+}
+
+// unlockBatch releases the write locks of args.UID on all of args.Names.
+func (l *LocalLocker) unlockBatch(args *LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	*reply = true
+	var notHeld []string
+	for _, name := range args.Names {
+		key := localNameKey(args.Namespace, name)
+		if lk := l.locks[key]; lk == nil || lk.writer != args.UID {
+			notHeld = append(notHeld, name)
+			continue
+		}
+		l.release(key, args.UID)
+	}
+	if len(notHeld) > 0 {
+		*reply = false
+		return LockServerError(ErrLockNotHeld, "UnlockBatch unable to find corresponding locks for uid: "+args.UID+" on: "+strings.Join(notHeld, ", "))
+	}
+	return nil
+}
+
+func (l *LocalLocker) commit(args *LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	key := localKey(args)
+	l.dropExpiredReservations(key)
+	if lk := l.locks[key]; lk != nil {
+		if _, *reply = lk.reserved[args.UID]; *reply {
+			delete(lk.reserved, args.UID) // Reservation is a regular lock from now on
+		}
+	}
+	return nil
+}
+
+func (l *LocalLocker) unlock(args *LockArgs, writer bool, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lk := l.locks[localKey(args)]
+	if writer {
+		if *reply = lk != nil && lk.writer == args.UID; !*reply {
+			return LockServerError(ErrLockNotHeld, "Unlock unable to find corresponding lock for uid: "+args.UID)
+		}
+	} else if *reply = lk != nil && lk.readers[args.UID]; !*reply {
+		return LockServerError(ErrLockNotHeld, "RUnlock unable to find corresponding read lock for uid: "+args.UID)
+	}
+	l.release(localKey(args), args.UID)
+	return nil
+}
+
+func (l *LocalLocker) forceUnlock(args *LockArgs, reply *bool) error {
+	if len(args.UID) != 0 {
+		return fmt.Errorf("ForceUnlock called with non-empty UID: %s", args.UID)
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.locks, localKey(args))
+	l.notify()
+	*reply = true
+	return nil
+}
+
+// watch waits up to the wait timeout of the request for the lock to be released.
+func (l *LocalLocker) watch(ctx context.Context, args *LockArgs, reply *bool) error {
+	deadline := getClock().Now().Add(args.WaitTimeout)
+	key := localKey(args)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.dropExpiredReservations(key)
+	*reply = false
+	if l.locks[key] == nil {
+		return nil // Not locked, so no release to notify of
+	}
+	for !*reply && l.waitRelease(ctx, deadline) {
+		l.dropExpiredReservations(key)
+		*reply = l.locks[key] == nil
+	}
+	return nil
+}
+
+func (l *LocalLocker) expired(args *LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	lk := l.locks[localKey(args)]
+	*reply = lk == nil || lk.writer != args.UID && !lk.readers[args.UID]
+	return nil
+}
+
+// release removes the lock of uid, should be called with the mutex held.
+func (l *LocalLocker) release(key, uid string) {
+	lk := l.locks[key]
+	if lk == nil {
+		return
+	}
+	if lk.writer == uid {
+		lk.writer = ""
+	}
+	delete(lk.readers, uid)
+	delete(lk.reserved, uid)
+	if lk.writer == "" && len(lk.readers) == 0 {
+		delete(l.locks, key)
+	}
+	l.notify()
+}
+
+// dropExpiredReservations releases the reservations on key that were not committed in time,
+// should be called with the mutex held.
+func (l *LocalLocker) dropExpiredReservations(key string) {
+	lk := l.locks[key]
+	if lk == nil {
+		return
+	}
+	var expired []string
+	now := getClock().Now()
+	for uid, until := range lk.reserved {
+		if now.After(until) {
+			expired = append(expired, uid)
+		}
+	}
+	for _, uid := range expired {
+		l.release(key, uid)
+	}
+}
+
+// notify wakes up all waiters, should be called with the mutex held.
+func (l *LocalLocker) notify() {
+	if l.waiters == 0 {
+		return
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// waitRelease waits (with the mutex released in the mean time) until a lock is released, or the
+// deadline (unless zero) or the earliest reservation lapses, returning false once the deadline
+// has passed or ctx is done. Should be called with the mutex held.
+func (l *LocalLocker) waitRelease(ctx context.Context, deadline time.Time) bool {
+	wake := deadline
+	now := getClock().Now()
+	if !deadline.IsZero() && !now.Before(deadline) || ctx.Err() != nil {
+		return false
+	}
+	for _, lk := range l.locks {
+		for _, until := range lk.reserved {
+			if wake.IsZero() || until.Before(wake) {
+				wake = until
+			}
+		}
+	}
+	var timeout <-chan time.Time
+	if !wake.IsZero() {
+		timeout = getClock().After(wake.Sub(now))
+	}
+	released := l.released
+	l.waiters++
+	l.mutex.Unlock()
+	select {
+	case <-released:
+	case <-timeout:
+	case <-ctx.Done():
+	}
+	l.mutex.Lock()
+	l.waiters--
+	return true
+}
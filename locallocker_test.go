@@ -0,0 +1,97 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/minio/dsync"
+)
+
+func TestLocalLocker(t *testing.T) {
+	l := NewLocalLocker("localhost", DefaultPath)
+	call := func(method, uid string) bool {
+		var reply bool
+		args := LockArgs{Name: "test", UID: uid, WaitTimeout: 100 * time.Millisecond, Reservation: 50 * time.Millisecond}
+		l.Call(context.Background(), "Dsync."+method, &args, &reply)
+		return reply
+	}
+
+	if !call("Lock", "w1") {
+		t.Fatal("Expected write lock to be granted")
+	}
+	if call("RLock", "r1") || call("Lock", "w2") {
+		t.Fatal("Expected lock to be denied while write lock held")
+	}
+	if call("Expired", "w1") || !call("Expired", "w2") {
+		t.Fatal("Expected only lock of w1 to be held")
+	}
+
+	// A parked read lock is granted once the write lock is released
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		call("Unlock", "w1")
+	}()
+	if !call("RLockWait", "r1") || !call("RLock", "r2") {
+		t.Fatal("Expected read locks to be granted")
+	}
+	if call("LockWait", "w2") {
+		t.Fatal("Expected write lock to be denied while read locks held")
+	}
+	call("RUnlock", "r1")
+	call("RUnlock", "r2")
+
+	// A reservation lapses unless committed
+	if !call("PrepareLock", "w3") {
+		t.Fatal("Expected write lock to be reserved")
+	}
+	if !call("LockWait", "w4") {
+		t.Fatal("Expected write lock to be granted after reservation lapsed")
+	}
+	if call("Commit", "w3") {
+		t.Fatal("Expected commit of lapsed reservation to fail")
+	}
+	if !call("ForceUnlock", "") || call("Watch", "") {
+		t.Fatal("Expected lock to be released by force unlock (so there is no release to watch for)")
+	}
+
+	// A batch is locked all or nothing
+	batch := func(method, uid string, names ...string) bool {
+		var reply bool
+		args := LockArgs{Names: names, UID: uid}
+		l.Call(context.Background(), "Dsync."+method, &args, &reply)
+		return reply
+	}
+	if !call("Lock", "w5") || batch("LockBatch", "b1", "other", "test") || !batch("LockBatch", "b2", "other") {
+		t.Fatal("Expected only a batch of unlocked names to be granted")
+	}
+	if batch("UnlockBatch", "b2", "other", "test") || !call("Unlock", "w5") || !batch("LockBatch", "b1", "other", "test") {
+		t.Fatal("Expected the names of a released batch to be unlocked")
+	}
+
+	// A parked request stops waiting once its context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	var reply bool
+	start := time.Now()
+	l.Call(ctx, "Dsync.LockWait", &LockArgs{Name: "test", UID: "w6", WaitTimeout: time.Minute}, &reply)
+	if reply || time.Since(start) > time.Second {
+		t.Fatalf("Expected parked write lock to be denied once cancelled, granted %v after %v", reply, time.Since(start))
+	}
+}
@@ -0,0 +1,122 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+)
+
+// LogLevel - severity of a log message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogInfo:
+		return "INFO"
+	case LogWarn:
+		return "WARN"
+	case LogError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Logger - interface through which dsync reports what it is doing, to be implemented by the
+// embedding application so that dsync messages flow into its own logging pipeline.
+//
+// keysAndValues holds alternating keys (strings) and values giving structured context to msg,
+// eg. Log(LogWarn, "Unable to call", "method", "Dsync.Lock", "node", node, "err", err).
+type Logger interface {
+	Log(level LogLevel, msg string, keysAndValues ...interface{})
+}
+
+// NewStdLogger returns a Logger that writes messages of at least level min to l
+// (or to the standard logger of package log when l is nil) as "LEVEL msg key=value ...".
+func NewStdLogger(l *log.Logger, min LogLevel) Logger {
+	return stdLogger{l: l, min: min}
+}
+
+type stdLogger struct {
+	l   *log.Logger
+	min LogLevel
+}
+
+func (s stdLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {
+	if level < s.min {
+		return
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s", level, msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 < len(keysAndValues) {
+			fmt.Fprintf(&buf, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+		} else {
+			fmt.Fprintf(&buf, " %v", keysAndValues[i])
+		}
+	}
+	if s.l != nil {
+		s.l.Output(3, buf.String())
+	} else {
+		log.Output(3, buf.String())
+	}
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Log(level LogLevel, msg string, keysAndValues ...interface{}) {}
+
+type loggerHolder struct {
+	logger Logger
+}
+
+// Logger used by the client, set via SetLogger.
+var dlogger atomic.Value
+
+func init() {
+	// Unless a logger is set, failed RPC operations are logged only when the DSYNC_LOG env variable is set.
+	if os.Getenv("DSYNC_LOG") == "1" {
+		SetLogger(NewStdLogger(nil, LogDebug))
+	} else {
+		SetLogger(nil)
+	}
+}
+
+// SetLogger - sets the logger to which dsync reports, nil discards all messages.
+func SetLogger(logger Logger) {
+	if logger == nil {
+		logger = discardLogger{}
+	}
+	dlogger.Store(loggerHolder{logger: logger})
+}
+
+// logf reports a message to the logger set via SetLogger.
+func logf(level LogLevel, msg string, keysAndValues ...interface{}) {
+	dlogger.Load().(loggerHolder).logger.Log(level, msg, keysAndValues...)
+}
@@ -0,0 +1,92 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// MemberState - state of a lock server as seen by the gossip based membership protocol.
+type MemberState int
+
+const (
+	MemberAlive MemberState = iota
+	MemberSuspect
+	MemberDead
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberAlive:
+		return "alive"
+	case MemberSuspect:
+		return "suspect"
+	case MemberDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member - describes a single lock server participating in the gossip based membership.
+type Member struct {
+	Node        string      // Network address of the lock server
+	RPCPath     string      // RPC path of the lock server
+	Incarnation uint64      // Incarnation number, only increased by the member itself to refute suspicion
+	State       MemberState // Alive, suspect or dead
+}
+
+// MembershipArgs - arguments for the gossip rpc calls, the members known to
+// the sender are piggybacked on every message.
+type MembershipArgs struct {
+	Token     string
+	Timestamp time.Time
+	From      Member   // Member sending the message
+	Target    Member   // Member to probe on behalf of the sender (for indirect probes only)
+	Members   []Member // Members known to the sender
+}
+
+func (m *MembershipArgs) SetToken(token string) {
+	m.Token = token
+}
+
+func (m *MembershipArgs) SetTimestamp(tstamp time.Time) {
+	m.Timestamp = tstamp
+}
+
+// GetMembers - bootstraps the list of lock servers from any single lock server that
+// runs the gossip protocol, returning all members that are currently believed to be
+// alive (or merely suspect). The result can be used to set up the clients that are
+// passed into SetNodesWithClients instead of configuring a static list of nodes.
+func GetMembers(ctx context.Context, seed RPC) ([]Member, error) {
+	var members []Member
+	if err := seed.Call(ctx, "Gossip.Members", &MembershipArgs{}, &members); err != nil {
+		return nil, err
+	}
+
+	alive := []Member{}
+	for _, m := range members {
+		if m.State != MemberDead {
+			alive = append(alive, m)
+		}
+	}
+	if len(alive) == 0 {
+		return nil, errors.New("No live members known to seed node")
+	}
+	return alive, nil
+}
@@ -0,0 +1,240 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the buckets of the histograms of the client
+var (
+	roundsBuckets  = []float64{1, 2, 3, 5, 10, 20, 50, 100}
+	secondsBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+)
+
+// LockCounts - a metric counted separately for write and read locks.
+type LockCounts struct {
+	Write uint64
+	Read  uint64
+}
+
+// Histogram - the distribution of observed values, as cumulative counts per bucket.
+type Histogram struct {
+	Bounds []float64 // Upper bounds of the buckets
+	Counts []uint64  // Number of values up to the bound of every bucket
+	Count  uint64    // Number of values observed
+	Sum    float64   // Sum of the values observed
+}
+
+// RPCErrorKey identifies the RPC errors of a method at a node.
+type RPCErrorKey struct {
+	Node   string
+	Method string
+}
+
+// NamespaceCounts - the locks acquired and released within a namespace.
+type NamespaceCounts struct {
+	Acquired LockCounts
+	Released LockCounts
+}
+
+// Metrics - a snapshot of the metrics of the dsync client.
+type Metrics struct {
+	Attempts       LockCounts                 // Attempts to acquire a lock (every round of requests to the nodes)
+	Acquired       LockCounts                 // Locks acquired
+	Held           LockCounts                 // Locks currently held
+	Namespaces     map[string]NamespaceCounts // Locks acquired and released per namespace (see SetNamespace)
+	UnlockFailures uint64                     // Releases that failed at a node (every retry counting)
+	RPCErrors      map[RPCErrorKey]uint64     // Failed requests per node and method
+	Rounds         Histogram                  // Attempts taken to acquire a lock
+	AcquireSeconds Histogram                  // Time taken to acquire a lock
+}
+
+// Collector - the metrics of the dsync client of this process, for the embedding application to
+// register with its monitoring. It serves them in the Prometheus text format, eg.
+//
+//	http.Handle("/metrics/dsync", dsync.MetricsCollector())
+//
+// and Snapshot returns them for bridging to a metrics library.
+type Collector struct {
+	mutex   sync.Mutex
+	metrics Metrics
+}
+
+var dmetrics = &Collector{metrics: Metrics{
+	Namespaces:     make(map[string]NamespaceCounts),
+	RPCErrors:      make(map[RPCErrorKey]uint64),
+	Rounds:         Histogram{Bounds: roundsBuckets, Counts: make([]uint64, len(roundsBuckets))},
+	AcquireSeconds: Histogram{Bounds: secondsBuckets, Counts: make([]uint64, len(secondsBuckets))},
+}}
+
+// MetricsCollector returns the collector of the metrics of the dsync client.
+func MetricsCollector() *Collector {
+	return dmetrics
+}
+
+// lockCount returns the count of c for the type of lock.
+func lockCount(c *LockCounts, isReadLock bool) *uint64 {
+	if isReadLock {
+		return &c.Read
+	}
+	return &c.Write
+}
+
+func (h *Histogram) observe(v float64) {
+	for i, bound := range h.Bounds {
+		if v <= bound {
+			h.Counts[i]++
+		}
+	}
+	h.Count++
+	h.Sum += v
+}
+
+// attempted counts an attempt to acquire a lock.
+func (c *Collector) attempted(isReadLock bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	*lockCount(&c.metrics.Attempts, isReadLock)++
+}
+
+// acquired counts a lock acquired after the given number of attempts, since start.
+func (c *Collector) acquired(isReadLock bool, attempts int, start time.Time) {
+	elapsed := getClock().Now().Sub(start)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	*lockCount(&c.metrics.Acquired, isReadLock)++
+	*lockCount(&c.metrics.Held, isReadLock)++
+	namespace := getNamespace()
+	counts := c.metrics.Namespaces[namespace]
+	*lockCount(&counts.Acquired, isReadLock)++
+	c.metrics.Namespaces[namespace] = counts
+	c.metrics.Rounds.observe(float64(attempts))
+	c.metrics.AcquireSeconds.observe(elapsed.Seconds())
+}
+
+// released uncounts locks that are no longer held.
+func (c *Collector) released(isReadLock bool, count int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if count > 0 {
+		namespace := getNamespace()
+		counts := c.metrics.Namespaces[namespace]
+		*lockCount(&counts.Released, isReadLock) += uint64(count)
+		c.metrics.Namespaces[namespace] = counts
+	}
+	if held := lockCount(&c.metrics.Held, isReadLock); *held >= uint64(count) {
+		*held -= uint64(count)
+	} else {
+		*held = 0
+	}
+}
+
+// rpcFailed counts a failed request.
+func (c *Collector) rpcFailed(node, method string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.metrics.RPCErrors[RPCErrorKey{node, method}]++
+}
+
+// unlockFailed counts a failed release.
+func (c *Collector) unlockFailed() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.metrics.UnlockFailures++
+}
+
+// Snapshot returns the current metrics.
+func (c *Collector) Snapshot() Metrics {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	m := c.metrics
+	m.RPCErrors = make(map[RPCErrorKey]uint64, len(c.metrics.RPCErrors))
+	for k, v := range c.metrics.RPCErrors {
+		m.RPCErrors[k] = v
+	}
+	m.Namespaces = make(map[string]NamespaceCounts, len(c.metrics.Namespaces))
+	for namespace, counts := range c.metrics.Namespaces {
+		m.Namespaces[namespace] = counts
+	}
+	m.Rounds.Counts = append([]uint64(nil), c.metrics.Rounds.Counts...)
+	m.AcquireSeconds.Counts = append([]uint64(nil), c.metrics.AcquireSeconds.Counts...)
+	return m
+}
+
+// WriteTo writes the current metrics in the Prometheus text format.
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	m := c.Snapshot()
+	var buf bytes.Buffer
+	lockCounts := func(name, kind, help string, counts LockCounts) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		fmt.Fprintf(&buf, "%s{type=\"write\"} %d\n%s{type=\"read\"} %d\n", name, counts.Write, name, counts.Read)
+	}
+	namespaces := make([]string, 0, len(m.Namespaces))
+	for namespace := range m.Namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	perNamespace := func(name, help string, counts func(NamespaceCounts) LockCounts) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, namespace := range namespaces {
+			c := counts(m.Namespaces[namespace])
+			fmt.Fprintf(&buf, "%s{namespace=%q,type=\"write\"} %d\n%s{namespace=%q,type=\"read\"} %d\n", name, namespace, c.Write, name, namespace, c.Read)
+		}
+	}
+	histogram := func(name, help string, h Histogram) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for i, bound := range h.Bounds {
+			fmt.Fprintf(&buf, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.Counts[i])
+		}
+		fmt.Fprintf(&buf, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, h.Count, name, strconv.FormatFloat(h.Sum, 'g', -1, 64), name, h.Count)
+	}
+
+	lockCounts("dsync_lock_attempts_total", "counter", "Attempts to acquire a lock.", m.Attempts)
+	perNamespace("dsync_locks_acquired_total", "Locks acquired.", func(c NamespaceCounts) LockCounts { return c.Acquired })
+	perNamespace("dsync_locks_released_total", "Locks released.", func(c NamespaceCounts) LockCounts { return c.Released })
+	lockCounts("dsync_locks_held", "gauge", "Locks currently held.", m.Held)
+	histogram("dsync_lock_rounds", "Attempts taken to acquire a lock.", m.Rounds)
+	histogram("dsync_lock_acquire_seconds", "Time taken to acquire a lock.", m.AcquireSeconds)
+	fmt.Fprintf(&buf, "# HELP dsync_unlock_failures_total Releases that failed at a node.\n# TYPE dsync_unlock_failures_total counter\ndsync_unlock_failures_total %d\n", m.UnlockFailures)
+
+	keys := make([]RPCErrorKey, 0, len(m.RPCErrors))
+	for k := range m.RPCErrors {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Node < keys[j].Node || keys[i].Node == keys[j].Node && keys[i].Method < keys[j].Method
+	})
+	fmt.Fprintf(&buf, "# HELP dsync_rpc_errors_total Failed requests to a node.\n# TYPE dsync_rpc_errors_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "dsync_rpc_errors_total{node=%q,method=%q} %d\n", k.Node, k.Method, m.RPCErrors[k])
+	}
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves the current metrics in the Prometheus text format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.WriteTo(w)
+}
@@ -17,43 +17,39 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"github.com/minio/dsync"
 	"sync"
-	"time"
 )
 
-// used when cached timestamp do not match with what client remembers.
-var errInvalidTimestamp = errors.New("Timestamps don't match, server may have restarted.")
-
 const WriteLock = -1
 
 type lockServer struct {
 	mutex sync.Mutex
 						// Map of locks, with negative value indicating (exclusive) write lock
 						// and positive values indicating number of read locks
-	lockMap   map[string]int64
-	timestamp time.Time // Timestamp set at the time of initialization. Resets naturally on minio server restart.
+	lockMap     map[string]int64
+	incarnation uint64 // Incarnation set at the time of initialization. Changes naturally on server restart.
 }
 
 func (l *lockServer) verifyArgs(args *dsync.LockArgs) error {
-	if !l.timestamp.Equal(args.Timestamp) {
-		return errInvalidTimestamp
+	if err := dsync.CheckVersion(args.Version); err != nil {
+		return err
 	}
-	return nil
+	return dsync.CheckIncarnation(l.incarnation, args.Incarnation)
 }
 
-func (l *lockServer) Lock(args *dsync.LockArgs, reply *bool) error {
+func (l *lockServer) Lock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	granted, _ := dsync.GrantedReply(reply, args) // Stamped with the epoch of the request, as the server has none
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 	if err := l.verifyArgs(args); err != nil {
 		return err
 	}
-	if _, *reply = l.lockMap[args.Name]; !*reply {
+	if _, *granted = l.lockMap[args.Name]; !*granted {
 		l.lockMap[args.Name] = WriteLock // No locks held on the given name, so claim write lock
 	}
-	*reply = !*reply // Negate *reply to return true when lock is granted or false otherwise
+	*granted = !*granted // Negate *granted to return true when lock is granted or false otherwise
 	return nil
 }
 
@@ -76,18 +72,19 @@ func (l *lockServer) Unlock(args *dsync.LockArgs, reply *bool) error {
 
 const ReadLock = 1
 
-func (l *lockServer) RLock(args *dsync.LockArgs, reply *bool) error {
+func (l *lockServer) RLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	granted, _ := dsync.GrantedReply(reply, args) // Stamped with the epoch of the request, as the server has none
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 	if err := l.verifyArgs(args); err != nil {
 		return err
 	}
 	var locksHeld int64
-	if locksHeld, *reply = l.lockMap[args.Name]; !*reply {
+	if locksHeld, *granted = l.lockMap[args.Name]; !*granted {
 		l.lockMap[args.Name] = ReadLock // No locks held on the given name, so claim (first) read lock
-		*reply = true
+		*granted = true
 	} else {
-		if *reply = locksHeld != WriteLock; *reply { // Unless there is a write lock
+		if *granted = locksHeld != WriteLock; *granted { // Unless there is a write lock
 			l.lockMap[args.Name] = locksHeld + ReadLock // Grant another read lock
 		}
 	}
@@ -81,8 +81,9 @@ func lockLoop(w *sync.WaitGroup, timeStart *time.Time, runs int, done *bool, nr
 func startRPCServer(port int) {
 	server := rpc.NewServer()
 	server.RegisterName("Dsync", &lockServer{
-		mutex:   sync.Mutex{},
-		lockMap: make(map[string]int64),
+		mutex:       sync.Mutex{},
+		lockMap:     make(map[string]int64),
+		incarnation: uint64(time.Now().UnixNano()),
 	})
 	// For some reason the registration paths need to be different (even for different server objs)
 	server.HandleHTTP(rpcPaths[port-12345], fmt.Sprintf("%s-debug", rpcPaths[port-12345]))
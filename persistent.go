@@ -0,0 +1,225 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// PersistentLock - a write lock that intentionally survives the crash of the process holding it,
+// until its TTL runs out, for workflows that must resume rather than release after a crash. The
+// lock servers do not check with the client whether it still holds a persistent lock (so lock
+// maintenance does not purge it), but drop it once the TTL has passed. The process persists the
+// Handle of the lock, with which a new process takes over the lock (see TakeOverPersistentLock).
+// It is granted by lock servers implementing the LockPersistent and TakeOver handlers, like the
+// lock server of the server package.
+type PersistentLock struct {
+	Name        string
+	Owner       string        // Actor on whose behalf the lock is held (the node when empty)
+	TTL         time.Duration // Time the lock is held for at most, also after a crash
+	writeLocks  []string      // Uid of the lock per node, empty for the nodes that did not grant it
+	handle      PersistentHandle
+	lastAttempt *QuorumError // Outcome at every node of the most recent attempt, when it failed
+	m           sync.Mutex
+}
+
+// PersistentHandle - identifies a persistent lock held by a process, to be stored durably by the
+// process so that a new process can take the lock over after a crash.
+type PersistentHandle struct {
+	Namespace     string        `json:"namespace"`
+	Name          string        `json:"name"`
+	UID           string        `json:"uid"`           // Uid of the lock on all nodes
+	RecoveryToken string        `json:"recoveryToken"` // Secret proving the right to take the lock over
+	TTL           time.Duration `json:"ttl"`           // TTL of the lock from the time it is taken over
+}
+
+// NewPersistentLock returns a persistent write lock on name, held for at most ttl.
+func NewPersistentLock(name string, ttl time.Duration) *PersistentLock {
+	return &PersistentLock{
+		Name:       name,
+		TTL:        ttl,
+		writeLocks: make([]string, dnodeCount),
+	}
+}
+
+// Lock holds the persistent write lock on pl.
+//
+// If the lock is already in use, the calling go routine
+// blocks until the mutex is available.
+func (pl *PersistentLock) Lock() {
+
+	start := getClock().Now()
+	for attempts := 1; ; attempts++ {
+		dmetrics.attempted(false)
+		dstats.attempted()
+		handle := PersistentHandle{Namespace: getNamespace(), Name: pl.Name, UID: newUID(), RecoveryToken: newUID(), TTL: pl.TTL}
+		locks, attempt := persistentRound("Dsync.LockPersistent", handle, pl.Owner)
+		if attempt == nil {
+			dmetrics.acquired(false, attempts, start)
+			dstats.acquired(false, attempts)
+			pl.m.Lock()
+			defer pl.m.Unlock()
+			pl.lastAttempt = nil
+			pl.writeLocks, pl.handle = locks, handle
+			return
+		}
+
+		logf(LogDebug, "Unable to acquire persistent lock", "name", pl.Name, "err", attempt)
+		pl.m.Lock()
+		pl.lastAttempt = attempt
+		pl.m.Unlock()
+
+		backOff(context.Background(), pl.Name, attempts, time.Time{})
+	}
+}
+
+// TakeOverPersistentLock has this process take over the persistent lock of handle (as held by a
+// process that crashed), so that it is checked with and released by this process from now on, and
+// held for the TTL of handle from now. Returns a QuorumError when not enough nodes hold the lock
+// anymore (eg. as its TTL passed), and an AccessDeniedError when the recovery token does not match.
+func TakeOverPersistentLock(ctx context.Context, handle PersistentHandle) (*PersistentLock, error) {
+	if handle.Namespace != getNamespace() {
+		return nil, errors.New("Persistent lock of another namespace: " + handle.Namespace)
+	}
+	locks, attempt := persistentRound("Dsync.TakeOver", handle, "")
+	if attempt != nil {
+		for _, nodeErr := range attempt.Errored {
+			if denied := toAccessDeniedError(nodeErr.Err); denied != nil {
+				return nil, *denied
+			}
+		}
+		return nil, attempt
+	}
+	logf(LogInfo, "Took over persistent lock", "name", handle.Name, "uid", handle.UID)
+	return &PersistentLock{Name: handle.Name, TTL: handle.TTL, writeLocks: locks, handle: handle}, nil
+}
+
+// Handle returns the handle of the lock to take it over with, the zero handle when not locked.
+func (pl *PersistentLock) Handle() PersistentHandle {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	return pl.handle
+}
+
+// LastAttempt returns which nodes granted, denied or failed the most recent attempt to acquire
+// the lock, or nil if it was granted (or not requested yet).
+func (pl *PersistentLock) LastAttempt() *QuorumError {
+	pl.m.Lock()
+	defer pl.m.Unlock()
+	return pl.lastAttempt
+}
+
+// Unlock releases the persistent write lock on pl.
+//
+// It is a run-time error if pl is not locked on entry to Unlock.
+func (pl *PersistentLock) Unlock() {
+
+	locks := make([]string, dnodeCount)
+	{
+		pl.m.Lock()
+		defer pl.m.Unlock()
+
+		lockFound := false
+		for _, uid := range pl.writeLocks {
+			lockFound = lockFound || isLocked(uid)
+		}
+		if !lockFound {
+			panic("Trying to Unlock() while no Lock() is active")
+		}
+		copy(locks, pl.writeLocks)
+		pl.writeLocks, pl.handle = make([]string, dnodeCount), PersistentHandle{}
+	}
+
+	dmetrics.released(false, 1)
+	for index, c := range clnts {
+		if isLocked(locks[index]) {
+			sendRelease(c, pl.Name, locks[index], false)
+		}
+	}
+}
+
+// persistentRound makes a request for the persistent lock of handle to every node with method
+// (LockPersistent or TakeOver), returning the uid per node once a quorum of the nodes (including
+// the own node) granted it, or the outcome at every node otherwise (releasing the grants when locking).
+func persistentRound(method string, handle PersistentHandle, owner string) ([]string, *QuorumError) {
+
+	ch := make(chan Granted, dnodeCount)
+	for index, c := range clnts {
+		go func(index int, c RPC) {
+			var locked bool
+			args := LockArgs{Namespace: handle.Namespace, Name: handle.Name, Source: ownIdentity(), Owner: owner, UID: handle.UID, Epoch: getEpoch(), Version: ProtocolVersion,
+				Persist: handle.TTL, RecoveryToken: handle.RecoveryToken}
+			err := CallServer(context.Background(), c, method, &args, &locked)
+			if err != nil {
+				logf(LogWarn, "Unable to call", "method", method, "node", c.Node(), "err", err)
+			}
+			dstats.answered(c.Node(), locked, err)
+
+			g := Granted{index: index, err: err}
+			if locked {
+				g.lockUid = args.UID
+			}
+			ch <- g
+		}(index, c)
+	}
+
+	locks := make([]string, dnodeCount)
+	answers := make([]*Granted, dnodeCount) // Answers received before the attempt was decided
+	var order []int                         // Index of the nodes in order of answering
+	timeout := getClock().After(getAttemptTimeout())
+	received := 0
+wait:
+	for ; received < dnodeCount; received++ {
+		select {
+		case grant := <-ch:
+			answers[grant.index] = &grant
+			order = append(order, grant.index)
+			if grant.isLocked() {
+				locks[grant.index] = grant.lockUid
+			}
+		case <-timeout:
+			break wait
+		}
+	}
+
+	locking := method == "Dsync.LockPersistent"
+	if received < dnodeCount && locking {
+		// Release the locks granted by the nodes that answer after the timeout
+		go func(late int) {
+			for ; late > 0; late-- {
+				if grant := <-ch; grant.isLocked() {
+					sendRelease(clnts[grant.index], handle.Name, grant.lockUid, false)
+				}
+			}
+		}(dnodeCount - received)
+	}
+
+	if quorumMet(&locks, false) && isLocked(locks[ownNode]) {
+		return locks, nil
+	}
+	if locking {
+		for index, uid := range locks {
+			if isLocked(uid) {
+				sendRelease(clnts[index], handle.Name, uid, false)
+			}
+		}
+	}
+	return nil, newQuorumError(clnts, handle.Name, answers, order)
+}
@@ -0,0 +1,119 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNoResponse - recorded for a node that did not answer a lock request before the attempt was decided.
+var ErrNoResponse = errors.New("No response before the attempt was decided")
+
+// ErrNotContacted - recorded for a node that was not sent a lock request, as the attempt was decided
+// before its turn came (see SetFanOut).
+var ErrNotContacted = errors.New("Not contacted before the attempt was decided")
+
+// ErrLockDenied - the cause of a node denying a lock, as it is held by someone else.
+var ErrLockDenied = errors.New("Lock held by someone else")
+
+// NodeError - the error of a lock request at a single node.
+type NodeError struct {
+	Node string
+	Err  error
+}
+
+func (e NodeError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Node, e.Err)
+}
+
+// Unwrap returns the error of the request at the node.
+func (e NodeError) Unwrap() error {
+	return e.Err
+}
+
+// QuorumError - describes an attempt to acquire a lock that did not reach quorum, with the outcome
+// of the request at every node.
+type QuorumError struct {
+	Name    string
+	Granted []string    // Nodes that granted the lock (released again as quorum was not reached)
+	Denied  []string    // Nodes that denied the lock as it is held by someone else
+	Errored []NodeError // Nodes whose request failed (or that did not answer in time), in order of answering
+}
+
+func (e QuorumError) Error() string {
+	errored := make([]string, 0, len(e.Errored))
+	for _, ne := range e.Errored {
+		errored = append(errored, fmt.Sprintf("%s (%v)", ne.Node, ne.Err))
+	}
+	return fmt.Sprintf("Quorum not reached for lock %s: granted by [%s], denied by [%s], failed at [%s]",
+		e.Name, strings.Join(e.Granted, " "), strings.Join(e.Denied, " "), strings.Join(errored, " "))
+}
+
+// Is matches ErrQuorumNotReached.
+func (e QuorumError) Is(target error) bool {
+	return target == ErrQuorumNotReached
+}
+
+// Unwrap returns the outcome at every node that did not grant the lock as a NodeError, with
+// ErrLockDenied for the nodes that denied it, so that errors.Is and errors.As tell whether an
+// attempt failed on contention, restarts of lock servers (ErrTimestampMismatch) or the network
+// (eg. a net.Error that timed out).
+func (e QuorumError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Denied)+len(e.Errored))
+	for _, node := range e.Denied {
+		errs = append(errs, NodeError{Node: node, Err: ErrLockDenied})
+	}
+	for _, ne := range e.Errored {
+		errs = append(errs, ne)
+	}
+	return errs
+}
+
+// newQuorumError builds the description of a failed attempt from the answers of the nodes
+// (nil for nodes that did not answer), listing the errors in order of answering.
+func newQuorumError(clnts []RPC, lockName string, answers []*Granted, order []int) *QuorumError {
+	e := &QuorumError{Name: lockName}
+	for _, index := range order {
+		if g := answers[index]; g.isLocked() {
+			e.Granted = append(e.Granted, clnts[index].Node())
+		} else if g.err == nil {
+			e.Denied = append(e.Denied, clnts[index].Node())
+		} else {
+			e.Errored = append(e.Errored, NodeError{Node: clnts[index].Node(), Err: g.err})
+		}
+	}
+	for index, g := range answers {
+		if g == nil {
+			e.Errored = append(e.Errored, NodeError{Node: clnts[index].Node(), Err: ErrNoResponse})
+		}
+	}
+	return e
+}
+
+// cause returns the typed error that explains why the attempt failed (see toRoundError),
+// the one of the node that answered last when there are several, or nil otherwise.
+func (e *QuorumError) cause() error {
+	var err error
+	for _, ne := range e.Errored {
+		if roundErr := toRoundError(ne.Err); roundErr != nil {
+			err = roundErr
+		}
+	}
+	return err
+}
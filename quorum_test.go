@@ -0,0 +1,56 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import "testing"
+
+// Test that a read and a write quorum always overlap, so that no node split
+// can grant a write lock and a read lock at the same time.
+func TestQuorumsOverlap(t *testing.T) {
+	defer setWeights(dnodeWeights)
+
+	for _, weights := range [][]int{
+		{1},
+		{1, 1},
+		{1, 1, 1},
+		{1, 1, 1, 1},
+		{2, 1, 1, 1},
+		{1, 1, 1, 1, 1},
+		{3, 1, 1, 1},
+	} {
+		setWeights(weights)
+		if dquorum+dquorumReads <= dtotalWeight {
+			t.Errorf("Weights %v: write quorum %d and read quorum %d do not overlap for total weight %d", weights, dquorum, dquorumReads, dtotalWeight)
+		}
+
+		// Every node either votes for the writer or for the reader
+		for mask := 0; mask < 1<<uint(len(weights)); mask++ {
+			writer := make([]string, len(weights))
+			reader := make([]string, len(weights))
+			for i := range weights {
+				if mask&(1<<uint(i)) != 0 {
+					writer[i] = "writer"
+				} else {
+					reader[i] = "reader"
+				}
+			}
+			if quorumMet(&writer, false) && quorumMet(&reader, true) {
+				t.Errorf("Weights %v: write lock on %v and read lock on %v both granted", weights, writer, reader)
+			}
+		}
+	}
+}
@@ -0,0 +1,380 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package redis provides a dsync.RPC that keeps locks in Redis rather than in dsync lock servers,
+// following the RedLock algorithm: with a Locker per independent Redis master passed to
+// dsync.SetNodesWithClients, a lock is held once a quorum of the masters granted it.
+//
+// A write lock is a key set with SET NX PX, read locks are members of a sorted set scored by
+// their expiry. Locks expire unless refreshed, which the Locker does for the locks it granted
+// for as long as they are held, so that the locks of a crashed process are released by Redis
+// itself. Every write lock granted draws a fencing token from a counter per lock, from which
+// FencingToken derives the token of the lock held through a quorum of the masters, for storage
+// that guards against writes by holders whose lock expired while they were paused.
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// DefaultTTL is the time after which a lock expires unless refreshed.
+const DefaultTTL = 10 * time.Second
+
+// All scripts take the keys of the write lock, of the read locks and of the fencing counter,
+// and read the time from Redis so that expiry does not depend on the clocks of the clients.
+const scriptNow = `redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+`
+
+// Grant a write lock (ARGV uid, ttl) unless any lock is held, returning the fencing token or 0.
+const scriptLock = scriptNow + `if redis.call('EXISTS', KEYS[1]) == 1 or redis.call('ZCARD', KEYS[2]) > 0 then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2])
+return redis.call('INCR', KEYS[3])
+`
+
+// Grant a read lock (ARGV uid, ttl) unless a write lock is held, returning 1 or 0.
+const scriptRLock = scriptNow + `if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('ZADD', KEYS[2], now + tonumber(ARGV[2]), ARGV[1])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return 1
+`
+
+// Release the write lock (ARGV uid), returning 1 when it was held by uid.
+const scriptUnlock = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// Extend the write or read lock of uid (ARGV uid, ttl), returning 1 when it is still held.
+const scriptRefresh = scriptNow + `if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+if redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	redis.call('ZADD', KEYS[2], now + tonumber(ARGV[2]), ARGV[1])
+	return redis.call('PEXPIRE', KEYS[2], ARGV[2])
+end
+return 0
+`
+
+// Raise the fencing counter to at least ARGV token while the write lock is held by ARGV uid,
+// returning 1 when it is still held.
+const scriptFence = `if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(redis.call('GET', KEYS[3]) or '0') < tonumber(ARGV[2]) then
+	redis.call('SET', KEYS[3], ARGV[2])
+end
+return 1
+`
+
+// Return 1 when the write or a read lock (ARGV uid) is still held.
+const scriptHeld = scriptNow + `if redis.call('GET', KEYS[1]) == ARGV[1] or redis.call('ZSCORE', KEYS[2], ARGV[1]) then
+	return 1
+end
+return 0
+`
+
+// Locker - a dsync.RPC that implements the lock handlers on a single Redis master.
+type Locker struct {
+	addr   string // Address of the Redis master
+	prefix string // Prefix of all keys of this locker
+	conn   *conn
+
+	mutex  sync.Mutex
+	ttl    time.Duration
+	held   map[string]*dsync.LockArgs // Locks granted by this locker that are refreshed, keyed by uid
+	tokens map[string]int64           // Fencing token drawn by the write locks granted that are refreshed, keyed by uid
+	stop   chan bool                  // Stops refreshing the locks (nil when not running)
+}
+
+// New returns a Locker that keeps its locks under prefix in the Redis master at addr.
+func New(addr, prefix string) *Locker {
+	return &Locker{
+		addr:   addr,
+		prefix: prefix,
+		conn:   &conn{addr: addr},
+		ttl:    DefaultTTL,
+		held:   make(map[string]*dsync.LockArgs),
+		tokens: make(map[string]int64),
+	}
+}
+
+// SetTTL sets the time after which a lock expires unless refreshed (DefaultTTL unless set).
+func (l *Locker) SetTTL(ttl time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.ttl = ttl
+}
+
+// ErrNotFenced is returned by FencingToken when the write lock is not (or no longer) held
+// through a quorum of the masters.
+var ErrNotFenced = errors.New("Write lock not held through a quorum of the masters")
+
+// FencingToken returns the fencing token of the write lock on name (within namespace) held
+// through lockers, the Lockers of all masters as passed to dsync.SetNodesWithClients. Storage can
+// reject writes carrying a lower token than it has seen, as the token of every later write lock on
+// name is higher.
+//
+// The counters of the masters are independent, so the token is the highest one drawn by the
+// masters that granted the lock, which is then raised to at the masters that still hold it: as
+// every later write lock is granted by a quorum overlapping a quorum of those, it draws a higher
+// token. ErrNotFenced is returned unless the lock is held through a quorum of the masters
+// (eg. once it expired), in which case the lock must not be relied upon.
+func FencingToken(lockers []*Locker, namespace, name string) (int64, error) {
+	quorum := len(lockers)/2 + 1
+	var token int64
+	uids := make([]string, len(lockers))
+	granted := 0
+	for i, l := range lockers {
+		var t int64
+		if uids[i], t = l.writeLock(namespace, name); t > 0 {
+			granted++
+			if t > token {
+				token = t
+			}
+		}
+	}
+	if granted < quorum {
+		return 0, ErrNotFenced
+	}
+
+	fenced := 0
+	args := &dsync.LockArgs{Namespace: namespace, Name: name}
+	for i, l := range lockers {
+		if uids[i] == "" {
+			continue
+		}
+		if n, err := l.eval(scriptFence, args, uids[i], strconv.FormatInt(token, 10)); err == nil && n > 0 {
+			fenced++
+		}
+	}
+	if fenced < quorum {
+		return 0, ErrNotFenced
+	}
+	return token, nil
+}
+
+// writeLock returns the uid and fencing token of the write lock on name (within namespace)
+// granted through l, or an empty uid when none is held.
+func (l *Locker) writeLock(namespace, name string) (string, int64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for uid, args := range l.held {
+		if token := l.tokens[uid]; token > 0 && args.Namespace == namespace && args.Name == name {
+			return uid, token
+		}
+	}
+	return "", 0
+}
+
+// Node returns the address of the Redis master.
+func (l *Locker) Node() string {
+	return l.addr
+}
+
+// RPCPath returns the prefix of the keys of the locks.
+func (l *Locker) RPCPath() string {
+	return l.prefix
+}
+
+// Close stops refreshing the locks (which expire subsequently) and closes the connection.
+func (l *Locker) Close() error {
+	l.mutex.Lock()
+	if l.stop != nil {
+		close(l.stop)
+		l.stop = nil
+	}
+	l.held = make(map[string]*dsync.LockArgs)
+	l.tokens = make(map[string]int64)
+	l.mutex.Unlock()
+
+	l.conn.mutex.Lock()
+	defer l.conn.mutex.Unlock()
+	return l.conn.close()
+}
+
+// Call performs the lock handler serviceMethod (eg. "Dsync.Lock") against Redis, unless ctx is done
+// already. Once sent, a command is not interrupted, as it shares the connection with all other calls.
+func (l *Locker) Call(ctx context.Context, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lockArgs, ok := args.(*dsync.LockArgs)
+	if !ok {
+		return fmt.Errorf("Unsupported arguments for %s: %T", serviceMethod, args)
+	}
+	result, ok := dsync.GrantedReply(reply, lockArgs)
+	if !ok {
+		return fmt.Errorf("Unsupported reply for %s: %T", serviceMethod, reply)
+	}
+
+	switch serviceMethod {
+	case "Dsync.Lock":
+		return l.lock(scriptLock, lockArgs, result)
+	case "Dsync.RLock":
+		return l.lock(scriptRLock, lockArgs, result)
+	case "Dsync.Unlock":
+		return l.unlock(lockArgs, result)
+	case "Dsync.RUnlock":
+		return l.runlock(lockArgs, result)
+	case "Dsync.ForceUnlock":
+		return l.forceUnlock(lockArgs, result)
+	case "Dsync.Expired":
+		return l.expired(lockArgs, result)
+	}
+	return fmt.Errorf("Unsupported method for Redis: %s", serviceMethod)
+}
+
+// Keys of a lock: <prefix>:<namespace>:<name>: followed by w for the write lock, r for the
+// read locks and fence for the fencing counter of the write locks. The names are length prefixed so that they
+// cannot collide whatever characters they contain.
+func (l *Locker) key(namespace, name string) string {
+	return l.prefix + ":" + strconv.Itoa(len(namespace)) + ":" + namespace + ":" + name + ":"
+}
+
+func (l *Locker) eval(script string, args *dsync.LockArgs, argv ...string) (int64, error) {
+	key := l.key(args.Namespace, args.Name)
+	cmd := append([]string{"EVAL", script, "3", key + "w", key + "r", key + "fence"}, argv...)
+	return integer(l.conn.do(cmd...))
+}
+
+func (l *Locker) getTTL() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return strconv.FormatInt(int64(l.ttl/time.Millisecond), 10)
+}
+
+// lock runs the script granting a write or read lock and starts refreshing the lock once granted.
+func (l *Locker) lock(script string, args *dsync.LockArgs, reply *bool) error {
+	token, err := l.eval(script, args, args.UID, l.getTTL())
+	if err != nil {
+		return err
+	}
+	if *reply = token > 0; *reply {
+		l.mutex.Lock()
+		if script == scriptLock {
+			l.tokens[args.UID] = token
+		}
+		held := *args
+		l.held[args.UID] = &held
+		if l.stop == nil {
+			l.stop = make(chan bool)
+			go l.refresh(l.stop)
+		}
+		l.mutex.Unlock()
+	}
+	return nil
+}
+
+func (l *Locker) unlock(args *dsync.LockArgs, reply *bool) error {
+	l.release(args.UID)
+	n, err := l.eval(scriptUnlock, args, args.UID)
+	if err != nil {
+		return err
+	}
+	if *reply = n > 0; !*reply {
+		return dsync.LockServerError(dsync.ErrLockNotHeld, "Unlock unable to find corresponding lock for uid: "+args.UID)
+	}
+	return nil
+}
+
+func (l *Locker) runlock(args *dsync.LockArgs, reply *bool) error {
+	l.release(args.UID)
+	n, err := integer(l.conn.do("ZREM", l.key(args.Namespace, args.Name)+"r", args.UID))
+	if err != nil {
+		return err
+	}
+	if *reply = n > 0; !*reply {
+		return dsync.LockServerError(dsync.ErrLockNotHeld, "RUnlock unable to find corresponding read lock for uid: "+args.UID)
+	}
+	return nil
+}
+
+func (l *Locker) forceUnlock(args *dsync.LockArgs, reply *bool) error {
+	if len(args.UID) != 0 {
+		return fmt.Errorf("ForceUnlock called with non-empty UID: %s", args.UID)
+	}
+	key := l.key(args.Namespace, args.Name)
+	if _, err := l.conn.do("DEL", key+"w", key+"r"); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+func (l *Locker) expired(args *dsync.LockArgs, reply *bool) error {
+	n, err := l.eval(scriptHeld, args, args.UID)
+	if err != nil {
+		return err
+	}
+	*reply = n == 0
+	return nil
+}
+
+// release stops refreshing the lock of uid.
+func (l *Locker) release(uid string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.held, uid)
+	delete(l.tokens, uid)
+}
+
+// refresh extends all locks held through l every third of their time to live until stopped.
+// Locks that turn out to have expired (eg. after a partition from Redis that lasted longer
+// than their time to live) are no longer refreshed.
+func (l *Locker) refresh(stop chan bool) {
+	for {
+		l.mutex.Lock()
+		interval := l.ttl / 3
+		l.mutex.Unlock()
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		l.mutex.Lock()
+		held := make([]*dsync.LockArgs, 0, len(l.held))
+		for _, args := range l.held {
+			held = append(held, args)
+		}
+		l.mutex.Unlock()
+		ttl := l.getTTL()
+		for _, args := range held {
+			n, err := l.eval(scriptRefresh, args, args.UID, ttl)
+			if err == nil && n == 0 {
+				l.release(args.UID)
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// fakeRedis serves the commands sent by the Locker, running the scripts as Go code (without expiry).
+type fakeRedis struct {
+	mutex   sync.Mutex
+	writers map[string]string          // Write lock key to uid
+	readers map[string]map[string]bool // Read locks key to uids
+	fences  map[string]int64
+	down    string // Prefix of the keys of a master that is down, whose commands fail
+}
+
+func (f *fakeRedis) exec(args []string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	integer := func(n int) string { return fmt.Sprintf(":%d\r\n", n) }
+	if f.down != "" && len(args) > 3 && strings.HasPrefix(args[3], f.down+":") {
+		return "-ERR down\r\n"
+	}
+	switch args[0] {
+	case "DEL":
+		delete(f.writers, args[1])
+		delete(f.readers, args[2])
+		return integer(1)
+	case "ZREM":
+		if !f.readers[args[1]][args[2]] {
+			return integer(0)
+		}
+		delete(f.readers[args[1]], args[2])
+		return integer(1)
+	case "EVAL":
+		w, r, fence, uid := args[3], args[4], args[5], args[6]
+		switch args[1] {
+		case scriptLock, scriptRLock:
+			if _, ok := f.writers[w]; ok || args[1] == scriptLock && len(f.readers[r]) > 0 {
+				return integer(0)
+			}
+			if args[1] == scriptLock {
+				f.writers[w] = uid
+			} else {
+				if f.readers[r] == nil {
+					f.readers[r] = make(map[string]bool)
+				}
+				f.readers[r][uid] = true
+				return integer(1)
+			}
+			f.fences[fence]++
+			return integer(int(f.fences[fence]))
+		case scriptFence:
+			if f.writers[w] != uid {
+				return integer(0)
+			}
+			if token, _ := strconv.ParseInt(args[7], 10, 64); f.fences[fence] < token {
+				f.fences[fence] = token
+			}
+			return integer(1)
+		case scriptUnlock:
+			if f.writers[w] != uid {
+				return integer(0)
+			}
+			delete(f.writers, w)
+			return integer(1)
+		case scriptRefresh, scriptHeld:
+			if f.writers[w] == uid || f.readers[r][uid] {
+				return integer(1)
+			}
+			return integer(0)
+		}
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		reply, err := readReply(r) // Commands are sent as arrays of bulk strings
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range reply.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		if _, err := c.Write([]byte(f.exec(args))); err != nil {
+			return
+		}
+	}
+}
+
+// startFake starts a fake Redis master, returning it along with the listener to close once done.
+func startFake(t *testing.T) (*fakeRedis, net.Listener) {
+	fake := &fakeRedis{writers: make(map[string]string), readers: make(map[string]map[string]bool), fences: make(map[string]int64)}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(c)
+		}
+	}()
+	return fake, ln
+}
+
+func TestLocker(t *testing.T) {
+	_, ln := startFake(t)
+	defer ln.Close()
+
+	// Two lockers on the same (fake) master, so that dsync has the minimum of two nodes
+	lockers := []*Locker{New(ln.Addr().String(), "dsync-0"), New(ln.Addr().String(), "dsync-1")}
+	if err := dsync.SetNodesWithClients([]dsync.RPC{lockers[0], lockers[1]}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dm := dsync.NewDRWMutex("test")
+	dm.Lock()
+	token, err := FencingToken(lockers, "", "test")
+	if err != nil || token == 0 {
+		t.Fatalf("Expected fencing token for granted lock, got %d (%v)", token, err)
+	}
+
+	ch := make(chan struct{})
+	go func() {
+		dm := dsync.NewDRWMutex("test")
+		dm.RLock()
+		dm.RLock()
+		dm.RUnlock()
+		dm.RUnlock()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		t.Fatal("Read lock granted while write lock held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	dm.Unlock()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for read locks")
+	}
+
+	dm.Lock()
+	if next, err := FencingToken(lockers, "", "test"); err != nil || next <= token {
+		t.Fatalf("Expected fencing token to increase, got %d (%v) after %d", next, err, token)
+	}
+	dm.Unlock()
+	if _, err := FencingToken(lockers, "", "test"); err != ErrNotFenced {
+		t.Fatalf("Expected no fencing token once unlocked, got %v", err)
+	}
+}
+
+// Test that the fencing token increases between write locks granted by different quorums of the
+// masters, whose counters are independent.
+func TestFencingToken(t *testing.T) {
+	fake, ln := startFake(t)
+	defer ln.Close()
+
+	lockers := make([]*Locker, 4) // Quorum of three
+	for i := range lockers {
+		lockers[i] = New(ln.Addr().String(), fmt.Sprintf("fence-%d", i))
+		defer lockers[i].Close()
+	}
+	call := func(l *Locker, method, uid string) bool {
+		var reply bool
+		err := l.Call(context.Background(), method, &dsync.LockArgs{Name: "test", UID: uid}, &reply)
+		return err == nil && reply
+	}
+
+	fake.fences[lockers[0].key("", "test")+"fence"] = 100 // Counter of a master that granted many locks
+	for _, l := range lockers[:3] {
+		if !call(l, "Dsync.Lock", "first") {
+			t.Fatal("Expected write lock to be granted")
+		}
+	}
+	token, err := FencingToken(lockers, "", "test")
+	if err != nil || token != 101 {
+		t.Fatalf("Expected the highest token of the quorum, got %d (%v)", token, err)
+	}
+	for _, l := range lockers[:3] {
+		call(l, "Dsync.Unlock", "first")
+	}
+
+	// Granted by a quorum without the master that drew the highest token
+	fake.mutex.Lock()
+	fake.down = "fence-0"
+	fake.mutex.Unlock()
+	for _, l := range lockers[1:] {
+		if !call(l, "Dsync.Lock", "second") {
+			t.Fatal("Expected write lock to be granted")
+		}
+	}
+	if next, err := FencingToken(lockers, "", "test"); err != nil || next <= token {
+		t.Fatalf("Expected fencing token to increase, got %d (%v) after %d", next, err, token)
+	}
+
+	// Expired at the masters, so the lock must not be relied upon
+	fake.mutex.Lock()
+	for _, l := range lockers {
+		delete(fake.writers, l.key("", "test")+"w")
+	}
+	fake.mutex.Unlock()
+	if _, err := FencingToken(lockers, "", "test"); err != ErrNotFenced {
+		t.Fatalf("Expected no fencing token for an expired lock, got %v", err)
+	}
+}
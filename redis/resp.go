@@ -0,0 +1,146 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Timeout for dialing as well as for every command sent to Redis.
+const commandTimeout = 5 * time.Second
+
+// Error - error reply of Redis to a command.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// conn is a single connection to Redis speaking the RESP protocol, on which commands are sent
+// one at a time. It redials after a failure.
+type conn struct {
+	mutex sync.Mutex
+	addr  string
+	c     net.Conn
+	r     *bufio.Reader
+}
+
+// do sends a command and returns its reply: a string, an int64, nil or a []interface{} of these.
+func (c *conn) do(args ...string) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.c == nil {
+		nc, err := net.DialTimeout("tcp", c.addr, commandTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c.c, c.r = nc, bufio.NewReader(nc)
+	}
+	c.c.SetDeadline(time.Now().Add(commandTimeout))
+
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"+arg+"\r\n"...)
+	}
+	_, err := c.c.Write(buf)
+	var reply interface{}
+	if err == nil {
+		reply, err = readReply(c.r)
+	}
+	if _, ok := err.(Error); err != nil && !ok {
+		// The connection is in an unknown state, so start over with a new one
+		c.close()
+	}
+	return reply, err
+}
+
+// close closes the connection, should be called with the mutex held.
+func (c *conn) close() error {
+	if c.c == nil {
+		return nil
+	}
+	err := c.c.Close()
+	c.c, c.r = nil, nil
+	return err
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("Malformed reply from Redis: %q", line)
+	}
+	line = line[:len(line)-2]
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err // Nil bulk string
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err // Nil array
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			if array[i], err = readReply(r); err != nil {
+				if _, ok := err.(Error); !ok {
+					return nil, err
+				}
+				array[i] = err
+			}
+		}
+		return array, nil
+	}
+	return nil, errors.New("Unknown reply type from Redis: " + line)
+}
+
+// integer returns the integer reply of a command (0 for a nil reply).
+func integer(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case nil:
+		return 0, nil
+	}
+	return 0, fmt.Errorf("Unexpected reply from Redis: %v", reply)
+}
@@ -0,0 +1,178 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time that a client retains a released write lock at the lock servers (0 disables retaining).
+var dretainLease int64
+
+// SetRetainLease - lets Unlock retain a write lock at the lock servers for up to lease rather than
+// releasing it, so that acquiring it again (by the same Owner) within that time is granted locally
+// without any requests. Lock requests are marked Retainable meanwhile, so that a lock server that
+// denies the lock to someone else calls back the own node of the client, whose lock server then
+// hands the lock back with RevokeRetained. Zero (the default) disables retaining.
+func SetRetainLease(lease time.Duration) {
+	atomic.StoreInt64(&dretainLease, int64(lease))
+}
+
+func getRetainLease() time.Duration {
+	return time.Duration(atomic.LoadInt64(&dretainLease))
+}
+
+type retainKey struct {
+	namespace string
+	name      string
+	owner     string
+}
+
+type nameKey struct {
+	namespace string
+	name      string
+}
+
+// retainedLock is a write lock that has been unlocked but is still held at the lock servers.
+type retainedLock struct {
+	locks []string      // Uids of the lock per node
+	taken chan struct{} // Closed once acquired again or released, ending the lease
+}
+
+// Write locks retained by this client, and the names that others asked for recently (which are not retained)
+var retained = struct {
+	sync.Mutex
+	locks  map[retainKey]*retainedLock
+	wanted map[nameKey]time.Time
+}{locks: make(map[retainKey]*retainedLock), wanted: make(map[nameKey]time.Time)}
+
+// retainLock retains the write lock locks on name at the lock servers instead of releasing it,
+// returning false when it is not retained.
+func retainLock(name, owner string, locks []string) bool {
+	lease := getRetainLease()
+	if lease <= 0 || dlocal != nil {
+		return false
+	}
+	key := retainKey{namespace: getNamespace(), name: name, owner: owner}
+	r := &retainedLock{locks: locks, taken: make(chan struct{})}
+
+	retained.Lock()
+	if since, ok := retained.wanted[nameKey{key.namespace, name}]; ok && getClock().Now().Sub(since) < lease {
+		retained.Unlock()
+		return false // Contended, so hand it back right away
+	}
+	if _, ok := retained.locks[key]; ok {
+		retained.Unlock()
+		return false // Another lock of the owner on the name is retained already
+	}
+	retained.locks[key] = r
+	retained.Unlock()
+
+	go func() {
+		select {
+		case <-getClock().After(lease):
+			releaseRetained(key, r)
+		case <-r.taken:
+		}
+	}()
+	return true
+}
+
+// takeRetained returns the retained write lock of owner on name for acquiring it again, or nil
+// when there is none (or it is no longer held by a quorum of the nodes).
+func takeRetained(name, owner string) []string {
+	key := retainKey{namespace: getNamespace(), name: name, owner: owner}
+	retained.Lock()
+	r, ok := retained.locks[key]
+	delete(retained.locks, key)
+	retained.Unlock()
+	if !ok {
+		return nil
+	}
+	close(r.taken)
+	if !quorumMet(&r.locks, false) || !isLocked(r.locks[ownNode]) {
+		releaseAll(clnts, &r.locks, name, false)
+		return nil
+	}
+	return r.locks
+}
+
+// releaseRetained releases the retained lock r at the lock servers once its lease has ended,
+// unless it has been taken in the mean time.
+func releaseRetained(key retainKey, r *retainedLock) {
+	retained.Lock()
+	if retained.locks[key] != r {
+		retained.Unlock()
+		return
+	}
+	delete(retained.locks, key)
+	retained.Unlock()
+	unlockRetained(key.name, r.locks)
+}
+
+// unlockRetained sends a release of a retained lock to all nodes that granted it.
+func unlockRetained(name string, locks []string) {
+	for index, c := range clnts {
+		if isLocked(locks[index]) {
+			sendRelease(c, name, locks[index], false)
+		}
+	}
+}
+
+// RevokeRetained - releases the write locks on name that this client retains (see SetRetainLease),
+// and keeps it from retaining the lock on name for a lease, returning whether any lock was
+// released. Lock servers call it from their Revoke handler, which lock servers of other nodes
+// call when denying the lock to someone else while it is held by a client of this node.
+func RevokeRetained(namespace, name string) bool {
+	lease := getRetainLease()
+	if lease <= 0 {
+		return false
+	}
+	now := getClock().Now()
+	var revoked []*retainedLock
+	retained.Lock()
+	for key, since := range retained.wanted {
+		if now.Sub(since) >= lease {
+			delete(retained.wanted, key)
+		}
+	}
+	retained.wanted[nameKey{namespace, name}] = now
+	for key, r := range retained.locks {
+		if key.namespace == namespace && key.name == name {
+			delete(retained.locks, key)
+			revoked = append(revoked, r)
+		}
+	}
+	retained.Unlock()
+
+	for _, r := range revoked {
+		close(r.taken)
+		unlockRetained(name, r.locks)
+	}
+	return len(revoked) > 0
+}
+
+// forgetRetained forgets the locks granted by the node at index, which has restarted (and so lost them).
+func forgetRetained(index int) {
+	retained.Lock()
+	defer retained.Unlock()
+	for _, r := range retained.locks {
+		r.locks[index] = ""
+	}
+}
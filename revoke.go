@@ -0,0 +1,66 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import "time"
+
+// RequestRevocation - asks the holder of the lock of this client with uid on name, as granted by the
+// lock server source, to release it within grace: DRWMutex.Revoked of the lock is closed, and
+// RevokeDeadline tells by when to release it before the lock server releases it forcibly. A lock
+// that the client merely retains (see SetRetainLease) is released right away. Returns whether such
+// a lock is held (or retained). Requests of a source that is not one of the nodes of the client are
+// refused, as it cannot have granted any lock.
+//
+// Lock servers call it from their RequestRevocation handler, which lock servers of other nodes call
+// to revoke locks cooperatively, eg. when draining.
+func RequestRevocation(source Identity, namespace, name, uid string, grace time.Duration) bool {
+	index := -1
+	for i, c := range clnts {
+		if c.Node() == source.Node && c.RPCPath() == source.Path {
+			index = i
+		}
+	}
+	if index < 0 {
+		logf(LogWarn, "Refusing to release lock for unknown lock server", "name", name, "node", source.Node)
+		return false
+	}
+
+	deadline := getClock().Now().Add(grace)
+	var revoked []LockEvent
+	held.Lock()
+	for _, h := range held.locks {
+		if h.Namespace != namespace || h.Name != name || h.locks[index] != uid {
+			continue
+		}
+		if h.revokeBy.IsZero() {
+			h.revokeBy = deadline
+			close(h.revokedCh)
+		} else if deadline.Before(h.revokeBy) {
+			h.revokeBy = deadline
+		}
+		revoked = append(revoked, h.event(source.Node))
+	}
+	held.Unlock()
+
+	for _, ev := range revoked {
+		logf(LogInfo, "Lock server asks to release lock", "name", ev.Name, "node", ev.Node, "grace", grace)
+	}
+	if len(revoked) > 0 {
+		return true
+	}
+	return RevokeRetained(namespace, name)
+}
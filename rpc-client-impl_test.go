@@ -17,6 +17,7 @@
 package dsync_test
 
 import (
+	"context"
 	"net/rpc"
 	"sync"
 	"time"
@@ -57,26 +58,40 @@ func (rpcClient *RPCClient) Close() error {
 }
 
 // Call makes a RPC call to the remote endpoint using the default codec, namely encoding/gob.
-func (rpcClient *RPCClient) Call(serviceMethod string, args interface {
+// Concurrent calls are pipelined on the connection (net/rpc matches the replies to their
+// calls by sequence number), so the mutex is only held while (re)connecting.
+func (rpcClient *RPCClient) Call(ctx context.Context, serviceMethod string, args interface {
 	SetToken(token string)
 	SetTimestamp(tstamp time.Time)
 }, reply interface{}) error {
 	rpcClient.Lock()
-	defer rpcClient.Unlock()
 	// If the rpc.Client is nil, we attempt to (re)connect with the remote endpoint.
 	if rpcClient.rpc == nil {
 		clnt, err := rpc.DialHTTPPath("tcp", rpcClient.node, rpcClient.rpcPath)
 		if err != nil {
+			rpcClient.Unlock()
 			return err
 		}
 		rpcClient.rpc = clnt
 	}
+	clnt := rpcClient.rpc
+	rpcClient.Unlock()
 
 	// If the RPC fails due to a network-related error, then we reset
 	// rpc.Client for a subsequent reconnect.
-	err := rpcClient.rpc.Call(serviceMethod, args, reply)
+	var err error
+	select {
+	case call := <-clnt.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1)).Done:
+		err = call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 	if IsRPCError(err) {
-		rpcClient.rpc = nil
+		rpcClient.Lock()
+		if rpcClient.rpc == clnt {
+			rpcClient.rpc = nil
+		}
+		rpcClient.Unlock()
 	}
 	return err
 
@@ -16,11 +16,22 @@
 
 package dsync
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // RPC - is dsync compatible client interface.
+//
+// Call is called concurrently, for every lock round and release, and should pipeline the calls on
+// its connection rather than serialize them (as an rpc.Client of net/rpc does by itself, matching
+// replies to calls by sequence number), so that a round is never held up behind another one (or
+// behind a request parked by the lock server) on the same node.
+//
+// The context of Call carries the cancellation of the lock operation that the call is part of (see
+// DRWMutex.GetLock): once it is done, Call should return its error without waiting for the reply.
 type RPC interface {
-	Call(serviceMethod string, args interface {
+	Call(ctx context.Context, serviceMethod string, args interface {
 		SetToken(token string)
 		SetTimestamp(tstamp time.Time)
 	}, reply interface{}) error
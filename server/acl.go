@@ -0,0 +1,100 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/minio/dsync"
+)
+
+// Operations subject to access control
+const (
+	ACLLock        = "lock"         // Lock and RLock (including their Wait and Prepare variants), Commit, LockBatch and TakeOver, as well as ListLocks, Watch and the namespace statistics of Stats
+	ACLUnlock      = "unlock"       // Unlock and RUnlock and UnlockBatch
+	ACLForceUnlock = "force-unlock" // ForceUnlock and ForceUnlockMatching
+)
+
+// Identity that matches any client, including unauthenticated ones
+const ACLAnyone = "*"
+
+// ACL - access control of a Server (see Config.ACL), configuring which clients may perform which
+// operations per namespace, eg.
+//
+//	{
+//	  "identities": { "secret-token-1": "app1", "secret-token-2": "ops" },
+//	  "namespaces": {
+//	    "app1": { "lock": ["app1"], "unlock": ["app1"], "force-unlock": ["ops"] }
+//	  }
+//	}
+//
+// Clients are authenticated by the token sent along with every request. Namespaces
+// without an entry are open to all clients.
+type ACL struct {
+	Identities map[string]string       `json:"identities"` // Identity of a client keyed by its token
+	Namespaces map[string]NamespaceACL `json:"namespaces"`
+}
+
+// NamespaceACL - the identities allowed to perform each operation within a namespace.
+type NamespaceACL struct {
+	Lock        []string `json:"lock"`
+	Unlock      []string `json:"unlock"`
+	ForceUnlock []string `json:"force-unlock"`
+}
+
+// LoadACL reads an ACL from the JSON file at path.
+func LoadACL(path string) (*ACL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	acl := &ACL{}
+	if err = json.Unmarshal(data, acl); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// checkACL returns an AccessDeniedError unless the client authenticated by token may perform
+// operation within namespace.
+func (l *Server) checkACL(token, namespace, operation string) error {
+	acl := l.tuned().acl
+	if acl == nil {
+		return nil
+	}
+	nsACL, ok := acl.Namespaces[namespace]
+	if !ok {
+		return nil
+	}
+	var allowed []string
+	switch operation {
+	case ACLLock:
+		allowed = nsACL.Lock
+	case ACLUnlock:
+		allowed = nsACL.Unlock
+	case ACLForceUnlock:
+		allowed = nsACL.ForceUnlock
+	}
+	identity := acl.Identities[token]
+	for _, id := range allowed {
+		if id == ACLAnyone || identity != "" && id == identity {
+			return nil
+		}
+	}
+	return dsync.AccessDeniedError{Identity: identity, Operation: operation, Namespace: namespace}
+}
@@ -0,0 +1,155 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// StatsArgs - arguments for the Stats, Health and Ready rpc calls of a Server.
+type StatsArgs struct {
+	Token       string
+	Timestamp   time.Time
+	Incarnation uint64
+	Version     uint32
+}
+
+func (s *StatsArgs) SetToken(token string) {
+	s.Token = token
+}
+
+func (s *StatsArgs) SetTimestamp(tstamp time.Time) {
+	s.Timestamp = tstamp
+}
+
+func (s *StatsArgs) SetIncarnation(incarnation uint64) {
+	s.Incarnation = incarnation
+}
+
+// Stats - statistics of a Server, as replied by its Stats handler.
+type Stats struct {
+	Node        string            `json:"node"`
+	Incarnation uint64            `json:"incarnation"`
+	Epoch       uint64            `json:"epoch"`
+	StartTime   time.Time         `json:"startTime"`
+	Uptime      time.Duration     `json:"uptime"`
+	Names       int               `json:"names"`                // Names on which locks are held
+	WriteLocks  int               `json:"writeLocks"`           // Write locks held (including reservations)
+	ReadLocks   int               `json:"readLocks"`            // Read locks held (including reservations)
+	Reserved    int               `json:"reserved"`             // Locks reserved by PrepareLock or PrepareRLock, not committed yet
+	Parked      int               `json:"parked"`               // Requests parked by LockWait, RLockWait or Watch
+	Clients     int               `json:"clients"`              // Clients that have been granted locks
+	Namespaces  map[string]int    `json:"namespaces,omitempty"` // Locks held per namespace
+	Waiters     map[string]int    `json:"waiters,omitempty"`    // Requests parked per namespace
+	Granted     map[string]uint64 `json:"granted,omitempty"`    // Locks granted per namespace since the server started
+	Denied      map[string]uint64 `json:"denied,omitempty"`     // Lock requests denied per namespace since the server started
+	Purged      map[string]uint64 `json:"purged,omitempty"`     // Locks purged, expired or revoked per namespace since the server started
+	Unlocks     int               `json:"unlocks,omitempty"`    // Unlocks remembered to succeed again when retried
+	Draining    bool              `json:"draining"`
+	ReadOnly    bool              `json:"readOnly"`
+	Maintenance MaintenanceStats  `json:"maintenance"`
+}
+
+// Stats - rpc handler for the statistics of the server, as shown by dsyncctl. The statistics per
+// namespace only cover the namespaces in which the ACL allows the client to lock.
+func (l *Server) Stats(args *StatsArgs, reply *Stats) error {
+	l.mutex.RLock()
+	err := l.authenticate(args.Token, "")
+	if err == nil {
+		err = dsync.CheckVersion(args.Version)
+	}
+	if err == nil {
+		err = dsync.CheckIncarnation(l.Incarnation(), args.Incarnation)
+	}
+	l.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	*reply = l.stats()
+	for _, counts := range []map[string]int{reply.Namespaces, reply.Waiters} {
+		for namespace := range counts {
+			if l.checkACL(args.Token, namespace, ACLLock) != nil {
+				delete(counts, namespace)
+			}
+		}
+	}
+	for _, counts := range []map[string]uint64{reply.Granted, reply.Denied, reply.Purged} {
+		for namespace := range counts {
+			if l.checkACL(args.Token, namespace, ACLLock) != nil {
+				delete(counts, namespace)
+			}
+		}
+	}
+	return nil
+}
+
+// stats returns the statistics of the server. Takes the mutexes of the shards and of the server.
+func (l *Server) stats() Stats {
+	stats := Stats{
+		Node:        l.config.Self.Node,
+		Incarnation: l.Incarnation(),
+		Epoch:       l.config.Epoch,
+		StartTime:   l.startTime.UTC(),
+		Uptime:      l.elapsedSince(l.startTime),
+		Maintenance: l.maintenance.Stats(),
+		Namespaces:  make(map[string]int),
+		Waiters:     make(map[string]int),
+	}
+	for _, s := range l.shards {
+		s.mutex.RLock()
+		stats.Names += len(s.lockMap)
+		stats.Unlocks += len(s.unlocked)
+		for key, lri := range s.lockMap {
+			stats.Namespaces[key.namespace] += len(lri)
+			for _, entry := range lri {
+				if entry.writer {
+					stats.WriteLocks++
+				} else {
+					stats.ReadLocks++
+				}
+				if !entry.reservedUntil.IsZero() {
+					stats.Reserved++
+				}
+			}
+		}
+		for key, n := range s.parked {
+			stats.Parked += n
+			stats.Waiters[key.namespace] += n
+		}
+		s.mutex.RUnlock()
+	}
+	l.mutex.RLock()
+	stats.Clients = len(l.clients)
+	stats.Draining = l.draining
+	stats.ReadOnly = l.readOnly
+	stats.Granted = copyCounts(l.granted)
+	stats.Denied = copyCounts(l.denied)
+	stats.Purged = copyCounts(l.purged)
+	l.mutex.RUnlock()
+	return stats
+}
+
+// copyCounts returns a copy of counts per namespace.
+func copyCounts(counts map[string]uint64) map[string]uint64 {
+	c := make(map[string]uint64, len(counts))
+	for namespace, n := range counts {
+		c[namespace] = n
+	}
+	return c
+}
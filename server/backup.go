@@ -0,0 +1,279 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+const (
+	backupTimeout     = 30 * time.Second // Time to wait for the endpoint to accept an object
+	backupQueueEvents = 100000           // Number of events buffered until the next backup, older ones are dropped
+)
+
+// Format of the time in the names of backup objects, sorting in time order
+const backupTimeFormat = "20060102T150405.000Z"
+
+// BackupConfig - configuration of the backups of a Server to an S3-compatible endpoint (see StartBackups).
+type BackupConfig struct {
+	Endpoint  string        // URL of the bucket (and prefix) to back up to, eg. http://127.0.0.1:9000/backups/dsync
+	Name      string        // Name of the server, under which its objects are stored
+	Interval  time.Duration // Time between backups
+	AccessKey string
+	SecretKey string
+	Region    string // Region of the endpoint, us-east-1 when empty
+}
+
+// backup uploads the snapshots of a server, and the lock lifecycle events it receives as an
+// EventSink, to a bucket of an S3-compatible endpoint.
+type backup struct {
+	store  *s3Client
+	prefix string // Prefix of the objects of the server
+
+	mutex   sync.Mutex
+	events  []Event // Events since the last backup
+	dropped int     // Events dropped since the last backup, as the queue was full
+}
+
+// newBackup returns a backup as configured by config.
+func newBackup(config BackupConfig) (*backup, error) {
+	u, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("Backup endpoint must be an http or https URL: %s", config.Endpoint)
+	}
+	path := strings.Trim(u.Path, "/")
+	if path == "" {
+		return nil, fmt.Errorf("Backup endpoint lacks a bucket: %s", config.Endpoint)
+	}
+	if config.Name == "" {
+		return nil, errors.New("Backup requires the name of the server")
+	}
+	if config.Interval <= 0 {
+		return nil, errors.New("Backup interval must be positive")
+	}
+	if config.AccessKey == "" || config.SecretKey == "" {
+		return nil, errors.New("Backup requires an access key and a secret key")
+	}
+	bucket, prefix := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		bucket, prefix = path[:i], path[i+1:]+"/"
+	}
+	store := &s3Client{
+		endpoint:  u.Scheme + "://" + u.Host,
+		bucket:    bucket,
+		accessKey: config.AccessKey,
+		secretKey: config.SecretKey,
+		region:    config.Region,
+		client:    &http.Client{Timeout: backupTimeout},
+	}
+	if store.region == "" {
+		store.region = "us-east-1"
+	}
+	return &backup{store: store, prefix: prefix + config.Name + "/"}, nil
+}
+
+// Send queues ev for the next backup, dropping the oldest event when the queue is full.
+func (b *backup) Send(ev Event) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(b.events) >= backupQueueEvents {
+		b.events = b.events[1:]
+		b.dropped++
+	}
+	b.events = append(b.events, ev)
+	return nil
+}
+
+// StartBackups uploads a snapshot of the lock map (see Snapshot), and the lock lifecycle events
+// since the previous upload (as in an AuditLog), to a bucket of an S3-compatible endpoint every
+// config.Interval in the background until Close is called, as a recovery point (see Restore) and
+// an offline view of the lock history. The objects are named <prefix>/<name>/<time>.snapshot.json
+// and <prefix>/<name>/<time>.audit.jsonl. Events that fail to upload are kept for the next backup.
+func (l *Server) StartBackups(config BackupConfig) error {
+	b, err := newBackup(config)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return errors.New("Lock server is closed")
+	}
+	l.sinks = append(l.sinks, b)
+	l.stopped.Add(1)
+	go func() {
+		defer l.stopped.Done()
+		for {
+			select {
+			case <-l.ctx.Done():
+				return
+			case <-l.config.Clock.After(config.Interval):
+				if err := l.backUp(l.ctx, b); err != nil {
+					l.log(dsync.LogError, "Unable to back up lock state", "err", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// backUp uploads a snapshot of the lock map and the events since the last backup. Events that
+// fail to upload are kept for the next backup.
+func (l *Server) backUp(ctx context.Context, b *backup) error {
+	name := b.prefix + l.now().UTC().Format(backupTimeFormat)
+	snapshot, err := l.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := b.store.put(ctx, name+".snapshot.json", snapshot); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	events, dropped := b.events, b.dropped
+	b.events, b.dropped = nil, 0
+	b.mutex.Unlock()
+	if dropped > 0 {
+		l.log(dsync.LogWarn, "Dropped lock events from backup, backups are failing or too far apart", "dropped", dropped)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	var audit bytes.Buffer
+	enc := json.NewEncoder(&audit)
+	for i := range events {
+		if err := enc.Encode(&events[i]); err != nil {
+			return err
+		}
+	}
+	if err := b.store.put(ctx, name+".audit.jsonl", audit.Bytes()); err != nil {
+		b.mutex.Lock()
+		b.events = append(events, b.events...)
+		if excess := len(b.events) - backupQueueEvents; excess > 0 {
+			b.events, b.dropped = b.events[excess:], b.dropped+excess
+		}
+		b.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// s3Client uploads objects to a bucket of an S3-compatible endpoint (path-style, signed with
+// AWS Signature Version 4), as dsync has no dependencies.
+type s3Client struct {
+	endpoint  string // Scheme and host
+	bucket    string
+	accessKey string
+	secretKey string
+	region    string
+	client    *http.Client
+}
+
+// put uploads data as the object key.
+func (s *s3Client) put(ctx context.Context, key string, data []byte) error {
+	req, err := http.NewRequest(http.MethodPut, s.endpoint+"/"+s.bucket+"/"+key, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req, data, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("Upload of %s responded with status %s: %s", key, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// sign signs req with payload as body at t (AWS Signature Version 4), covering the host and all
+// headers set on req.
+func (s *s3Client) sign(req *http.Request, payload []byte, t time.Time) {
+	t = t.UTC()
+	amzDate, date := t.Format("20060102T150405Z"), t.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
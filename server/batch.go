@@ -0,0 +1,134 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/minio/dsync"
+)
+
+// LockBatch - rpc handler for write locking all of args.Names at once (under args.UID), granting
+// either all of them or none when any of them is locked already.
+func (l *Server) LockBatch(args *dsync.LockArgs, reply *dsync.LockReply) (err error) {
+	granted := l.stamp(reply)
+	span := dsync.StartSpan(args.TraceContext, "server.LockBatch", "names", len(args.Names), "uid", args.UID)
+	defer func() {
+		span.SetAttributes("granted", *granted)
+		span.End(err)
+	}()
+	keys := batchKeys(args)
+	shards := l.batchShards(keys)
+	for _, s := range shards {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	if ok, err := l.admit(args, keys...); !ok {
+		*granted = false
+		return err
+	}
+	lrInfo := l.newRequesterInfo(args, true, 0)
+
+	*granted = true
+	for _, key := range keys {
+		l.dropExpiredReservations(key)
+		s := l.shard(key)
+		if _, locked := s.lockMap[key]; locked && !s.holds(key, args.UID, true) {
+			*granted = false // Grant all names or none
+		}
+	}
+	for _, key := range keys {
+		s := l.shard(key)
+		switch {
+		case !*granted:
+			l.recordRequest(args, key, lrInfo, false)
+		case s.holds(key, args.UID, true): // Granted before when the reply got lost
+			l.recordRegrant(args, key, lrInfo)
+		default:
+			s.lockMap[key] = []lockRequesterInfo{lrInfo}
+			if l.wal != nil {
+				l.wal.logGrant(key, lrInfo)
+			}
+			l.recordRequest(args, key, lrInfo, true)
+		}
+	}
+	return nil
+}
+
+// UnlockBatch - rpc handler for releasing the write locks of args.UID on all of args.Names, which
+// fails with ErrLockNotHeld for those it does not hold (after releasing the others).
+func (l *Server) UnlockBatch(args *dsync.LockArgs, reply *bool) error {
+	if err := l.authorizeTo(args, ACLUnlock); err != nil {
+		return err
+	}
+	keys := batchKeys(args)
+	shards := l.batchShards(keys)
+	for _, s := range shards {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+	}
+	var notHeld []string
+	for _, key := range keys {
+		s := l.shard(key)
+		if s.unlockProcessed(key, args.UID, true) {
+			continue // Retry of an unlock whose reply got lost, so it is released already
+		}
+		lri, ok := s.lockMap[key]
+		if !ok || !isWriteLock(lri) || !l.removeEntry(key, args.UID, &lri, EventRelease) {
+			notHeld = append(notHeld, key.name)
+			continue
+		}
+		s.recordUnlock(key, args.UID, true)
+	}
+	if *reply = len(notHeld) == 0; !*reply {
+		return dsync.LockServerError(dsync.ErrLockNotHeld, "UnlockBatch unable to find corresponding locks for uid: "+args.UID+" on: "+strings.Join(notHeld, ", "))
+	}
+	return nil
+}
+
+// batchKeys returns the (distinct) keys of the names of a batch request.
+func batchKeys(args *dsync.LockArgs) []lockKey {
+	keys := make([]lockKey, 0, len(args.Names))
+	seen := make(map[lockKey]bool, len(args.Names))
+	for _, name := range args.Names {
+		if key := (lockKey{args.Namespace, name}); !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// batchShards returns the shards holding the locks for keys in the order of lockAll, so that
+// taking their mutexes in that order cannot deadlock with other batches nor with lockAll.
+func (l *Server) batchShards(keys []lockKey) []*lockShard {
+	var indices []int
+	seen := make(map[int]bool)
+	for _, key := range keys {
+		if index := l.shardIndex(key); !seen[index] {
+			seen[index] = true
+			indices = append(indices, index)
+		}
+	}
+	sort.Ints(indices)
+	shards := make([]*lockShard, len(indices))
+	for i, index := range indices {
+		shards[i] = l.shards[index]
+	}
+	return shards
+}
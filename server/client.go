@@ -0,0 +1,302 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Interval after which the host name of a node is resolved again, so that lock servers
+// behind DNS (containers, autoscaling groups) can be replaced without restarting clients.
+const resolveInterval = 30 * time.Second
+
+// Client - a dsync.RPC calling a lock server (or a client serving callbacks) over net/rpc on
+// HTTP, which dials on the first call and redials after the connection has been shut down. The
+// host name of the node is resolved again every resolveInterval, dropping the connection when
+// the address it is dialed to is no longer among the resolved addresses.
+type Client struct {
+	mutex       sync.Mutex
+	client      *rpc.Client
+	addr        string    // Resolved address the connection is dialed to
+	lastResolve time.Time // Time at which the host name of node was last resolved
+	node        string
+	rpcPath     string
+	token       string
+	tls         *tls.Config // Dial over TLS when set
+	clock       dsync.Clock // Timestamps the requests, the wall clock when nil
+
+	lookup func(node string) ([]string, error) // Resolves node, lookupNode unless replaced by tests
+}
+
+// NewClient returns a client for the lock server at node serving rpcPath, which authenticates
+// with token (when not empty). It does not connect until the first call.
+func NewClient(node, rpcPath, token string) *Client {
+	return &Client{node: node, rpcPath: rpcPath, token: token}
+}
+
+// NewTLSClient returns a client like NewClient, which connects to the lock server over TLS with
+// config (over plain TCP when config is nil).
+func NewTLSClient(node, rpcPath, token string, config *tls.Config) *Client {
+	return &Client{node: node, rpcPath: rpcPath, token: token, tls: config}
+}
+
+// SetClock replaces the clock that timestamps the requests of the client (the wall clock by
+// default), to be called before the first call.
+func (c *Client) SetClock(clock dsync.Clock) {
+	c.clock = clock
+}
+
+// dial returns the connection of the client, dialing it when there is none. The host name of the
+// node is resolved and dialed without holding the mutex, so that a slow DNS server or an
+// unreachable node does not block concurrent calls; when calls race to dial, the first connection
+// is kept and the others are closed.
+func (c *Client) dial() (*rpc.Client, error) {
+	c.mutex.Lock()
+	client := c.client
+	c.mutex.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	addrs, err := c.resolve()
+	if err != nil {
+		return nil, err
+	}
+	addr := addrs[0]
+	if c.tls != nil {
+		client, err = dialTLS(addr, c.rpcPath, c.tlsConfig())
+	} else {
+		client, err = rpc.DialHTTPPath("tcp", addr, c.rpcPath)
+	}
+	if err != nil {
+		return nil, err
+	} else if client == nil {
+		return nil, errors.New("No valid RPC Client created after dial")
+	}
+
+	c.mutex.Lock()
+	if existing := c.client; existing != nil {
+		// Dialed concurrently, keep the connection that was there first
+		c.mutex.Unlock()
+		client.Close()
+		return existing, nil
+	}
+	c.client = client
+	c.addr = addr
+	c.lastResolve = time.Now()
+	c.mutex.Unlock()
+	return client, nil
+}
+
+// resolve returns the addresses that the host name of the node currently resolves to.
+func (c *Client) resolve() ([]string, error) {
+	if c.lookup != nil {
+		return c.lookup(c.node)
+	}
+	return lookupNode(c.node)
+}
+
+// lookupNode returns all addresses that the host name of node currently resolves to (IP
+// addresses are returned as is).
+func lookupNode(node string) ([]string, error) {
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{node}, nil
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	} else if len(ips) == 0 {
+		return nil, errors.New("No addresses found for host " + host)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip, port))
+	}
+	return addrs, nil
+}
+
+// tlsConfig returns the TLS configuration to dial with, verifying the certificate of the server
+// against the host name of the node rather than the address it resolved to.
+func (c *Client) tlsConfig() *tls.Config {
+	if c.tls.ServerName != "" {
+		return c.tls
+	}
+	host, _, err := net.SplitHostPort(c.node)
+	if err != nil {
+		return c.tls
+	}
+	config := c.tls.Clone()
+	config.ServerName = host
+	return config
+}
+
+// reresolve resolves the host name of the node again once resolveInterval has passed, and drops
+// the connection when the address it is dialed to is no longer among the resolved addresses, so
+// that the next call dials the new address.
+func (c *Client) reresolve() {
+	c.mutex.Lock()
+	if c.client == nil || time.Since(c.lastResolve) < resolveInterval {
+		c.mutex.Unlock()
+		return
+	}
+	c.lastResolve = time.Now()
+	addr := c.addr
+	c.mutex.Unlock()
+
+	// Resolve without holding the mutex so as to not block concurrent calls on a slow DNS server
+	addrs, err := c.resolve()
+	if err != nil {
+		return // Keep using the connection, resolution is retried later
+	}
+	for _, a := range addrs {
+		if a == addr {
+			return
+		}
+	}
+
+	c.mutex.Lock()
+	client := c.client
+	if client != nil && c.addr == addr {
+		c.client = nil
+	} else {
+		client = nil // Already redialed concurrently
+	}
+	c.mutex.Unlock()
+	if client != nil {
+		client.Close()
+	}
+}
+
+// dialTLS connects to a net/rpc server on HTTP over TLS, like rpc.DialHTTPPath does over plain TCP.
+func dialTLS(addr, rpcPath string, config *tls.Config) (*rpc.Client, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	io.WriteString(conn, "CONNECT "+rpcPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Call makes a RPC call to the remote endpoint, returning the error of ctx without waiting for the
+// reply once ctx is done. Concurrent calls are pipelined on the connection (net/rpc matches the
+// replies to their calls by sequence number), the mutex is only held to get the connection.
+func (c *Client) Call(ctx context.Context, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	c.reresolve()
+	if c.clock != nil {
+		args.SetTimestamp(c.clock.Now())
+	} else {
+		args.SetTimestamp(time.Now())
+	}
+	if c.token != "" {
+		args.SetToken(c.token)
+	}
+	client, err := c.dial()
+	if err != nil {
+		return err
+	}
+	select {
+	case call := <-client.Go(serviceMethod, args, reply, make(chan *rpc.Call, 1)).Done:
+		err = call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if err != nil && err.Error() == rpc.ErrShutdown.Error() {
+		// Drop the connection so that the next call redials
+		c.mutex.Lock()
+		if c.client == client {
+			c.client = nil
+		}
+		c.mutex.Unlock()
+		client.Close()
+		err = rpc.ErrShutdown
+	}
+	return err
+}
+
+// Close closes the connection of the client (if any), a later call dials again.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	client := c.client
+	c.client = nil
+	c.mutex.Unlock()
+	if client == nil {
+		return nil
+	}
+	return client.Close()
+}
+
+func (c *Client) Node() string {
+	return c.node
+}
+
+func (c *Client) RPCPath() string {
+	return c.rpcPath
+}
+
+// ClientPool - a dsync.Resolver keeping a single Client per callable client of a lock server,
+// shared by all callers and kept across calls rather than dialing a connection for every call.
+type ClientPool struct {
+	Token     string      // Token the clients authenticate with
+	TLSConfig *tls.Config // Dial the clients over TLS with this configuration when set
+
+	mutex   sync.Mutex
+	clients map[dsync.Identity]*Client
+}
+
+// Resolve returns the Client for id, creating it on first use.
+func (p *ClientPool) Resolve(id dsync.Identity) (dsync.RPC, error) {
+	if !id.Callable() {
+		return nil, dsync.ErrNotCallable
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.clients == nil {
+		p.clients = make(map[dsync.Identity]*Client)
+	}
+	c, ok := p.clients[id]
+	if !ok {
+		c = NewTLSClient(id.Node, id.Path, p.Token, p.TLSConfig)
+		p.clients[id] = c
+	}
+	return c, nil
+}
@@ -0,0 +1,166 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Time after which an owner that has stopped retrying a denied lock request is no longer
+// considered to be waiting for the lock (and after which an unclaimed abort is dropped)
+const deadlockWaitTTL = 2 * time.Second
+
+// waiter identifies an owner waiting for a lock.
+type waiter struct {
+	owner string
+	key   lockKey
+}
+
+type waitInfo struct {
+	since    time.Time // Time of the first denied request
+	lastSeen time.Time // Time of the most recent denied request
+}
+
+// ownerOf returns the owner on whose behalf a lock is requested.
+func ownerOf(args *dsync.LockArgs) string {
+	if args.Owner != "" {
+		return args.Owner
+	}
+	return args.Source.Node
+}
+
+// checkAborted returns ErrDeadlock (once) when the request of the owner for key has been
+// aborted to break a deadlock. Must be called with the server mutex held.
+func (l *Server) checkAborted(owner string, key lockKey) error {
+	w := waiter{owner: owner, key: key}
+	if _, ok := l.aborted[w]; ok {
+		delete(l.aborted, w)
+		delete(l.waiting, w)
+		return dsync.ErrDeadlock
+	}
+	return nil
+}
+
+// trackWait records that the owner is waiting for key when its request was denied, and
+// forgets about it once granted. Must be called with the server mutex held.
+func (l *Server) trackWait(owner string, key lockKey, granted bool) {
+	w := waiter{owner: owner, key: key}
+	if granted {
+		delete(l.waiting, w)
+		return
+	}
+	if l.waiting == nil {
+		l.waiting = make(map[waiter]*waitInfo)
+	}
+	now := l.now()
+	if wi, ok := l.waiting[w]; ok {
+		wi.lastSeen = now
+	} else {
+		l.waiting[w] = &waitInfo{since: now, lastSeen: now}
+	}
+}
+
+// WaitForGraph - rpc handler returning which owners hold and wait for which locks on this server.
+func (l *Server) WaitForGraph(args *dsync.LockArgs, reply *dsync.WaitForGraph) error {
+	if err := l.authorize(args); err != nil {
+		return err
+	}
+	for _, s := range l.shards {
+		s.mutex.RLock()
+		for key, lri := range s.lockMap {
+			for _, entry := range lri {
+				owner := entry.owner
+				if owner == "" {
+					owner = entry.source.Node
+				}
+				reply.Holds = append(reply.Holds, dsync.WaitForEdge{Owner: owner, Namespace: key.namespace, Name: key.name, Since: entry.timestamp.UTC()})
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	for w, wi := range l.waiting {
+		if now.Sub(wi.lastSeen) > deadlockWaitTTL {
+			delete(l.waiting, w) // Owner gave up (or is down)
+			continue
+		}
+		reply.Waits = append(reply.Waits, dsync.WaitForEdge{Owner: w.owner, Namespace: w.key.namespace, Name: w.key.name, Since: wi.since.UTC()})
+	}
+	for w, t := range l.aborted {
+		if now.Sub(t) > deadlockWaitTTL {
+			delete(l.aborted, w)
+		}
+	}
+	return nil
+}
+
+// AbortWait - rpc handler marking the next request of args.Owner for args.Name to be aborted
+// with ErrDeadlock, in order to break a deadlock.
+func (l *Server) AbortWait(args *dsync.LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	if err := l.validateLockArgs(args); err != nil {
+		l.mutex.Unlock()
+		return err
+	}
+	key := lockKey{args.Namespace, args.Name}
+	if l.aborted == nil {
+		l.aborted = make(map[waiter]time.Time)
+	}
+	l.aborted[waiter{owner: args.Owner, key: key}] = l.now()
+	l.mutex.Unlock()
+
+	s := l.shard(key)
+	s.mutex.Lock()
+	s.notifyWaiters(key) // Wake up a parked request so it is aborted right away
+	s.mutex.Unlock()
+	*reply = true
+	return nil
+}
+
+// DetectDeadlocks collects the wait-for graphs of all lock servers (through their WaitForGraph
+// handler) and aborts the youngest wait of every cycle found on all of them (through their
+// AbortWait handler), returning the waits aborted. Run it periodically from a single node, eg.
+// every second.
+func DetectDeadlocks(ctx context.Context, servers []dsync.RPC, epoch uint64, logger dsync.Logger) []dsync.WaitForEdge {
+	if logger == nil {
+		logger = discardLogger{}
+	}
+	graphs := []dsync.WaitForGraph{}
+	for _, c := range servers {
+		var graph dsync.WaitForGraph
+		// Servers that are down cannot contribute, but a cycle needs each of its waits to be
+		// reported by just a single server
+		if err := dsync.CallServer(ctx, c, "Dsync.WaitForGraph", &dsync.LockArgs{Epoch: epoch, Version: dsync.ProtocolVersion}, &graph); err == nil {
+			graphs = append(graphs, graph)
+		}
+	}
+
+	victims := dsync.FindDeadlocks(graphs)
+	for _, victim := range victims {
+		logger.Log(dsync.LogWarn, "Breaking deadlock", "owner", victim.Owner, "namespace", victim.Namespace, "name", victim.Name, "waitingSince", victim.Since)
+		for _, c := range servers {
+			var ok bool
+			dsync.CallServer(ctx, c, "Dsync.AbortWait", &dsync.LockArgs{Namespace: victim.Namespace, Name: victim.Name, Owner: victim.Owner, Epoch: epoch, Version: dsync.ProtocolVersion}, &ok)
+		}
+	}
+	return victims
+}
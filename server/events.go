@@ -0,0 +1,215 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Lock lifecycle events, as reported to the EventSinks of a Server
+const (
+	EventGrant       = "grant"        // Lock granted
+	EventRelease     = "release"      // Lock released by the client holding it
+	EventForceUnlock = "force-unlock" // Lock released by a force unlock
+	EventPurge       = "purge"        // Stale lock purged by lock maintenance, or released as its connection closed
+	EventExpire      = "expire"       // Lock whose lease (or reservation) expired swept
+	EventRevoke      = "revoke"       // Lock released as its client did not release it within the grace of a revocation
+)
+
+// Delivery of events by a WebhookSink
+const (
+	webhookTimeout   = 5 * time.Second // Time to wait for the endpoint to accept an event
+	webhookQueueSize = 1024            // Number of events buffered while the endpoint is slow or down
+)
+
+// Event - a single change to the locks held by a Server.
+type Event struct {
+	Time      time.Time     `json:"time"`
+	Event     string        `json:"event"`
+	Namespace string        `json:"namespace,omitempty"`
+	Name      string        `json:"name"`
+	Writer    bool          `json:"writer"`
+	Node      string        `json:"node"`            // Node of the client holding the lock
+	RPCPath   string        `json:"rpcPath"`         // RPC path of the client holding the lock
+	Owner     string        `json:"owner,omitempty"` // Actor on whose behalf the lock is held
+	UID       string        `json:"uid"`
+	Since     time.Time     `json:"since"`          // Time at which the lock was granted
+	Held      time.Duration `json:"held,omitempty"` // Time the lock was held for (for all but grants)
+}
+
+// EventSink - receiver of all lock lifecycle events of a Server (see Config.Sinks), eg. a
+// ChannelSink, an EventsSink, a WebhookSink or an AuditLog. Send is called with the server mutex
+// held so must not block, the server logs the errors it returns.
+type EventSink interface {
+	Send(ev Event) error
+}
+
+// recordEvent reports a change to the lock map to all event sinks, must be called with the server
+// mutex held.
+func (l *Server) recordEvent(event string, key lockKey, lri lockRequesterInfo) {
+	switch event {
+	case EventGrant:
+		l.granted = countNamespace(l.granted, key.namespace)
+	case EventPurge, EventExpire, EventRevoke:
+		l.purged = countNamespace(l.purged, key.namespace)
+	}
+	if len(l.sinks) == 0 {
+		return
+	}
+	ev := Event{
+		Time:      l.now().UTC(),
+		Event:     event,
+		Namespace: key.namespace,
+		Name:      key.name,
+		Writer:    lri.writer,
+		Node:      lri.source.Node,
+		RPCPath:   lri.source.Path,
+		Owner:     lri.owner,
+		UID:       lri.uid,
+		Since:     lri.timestamp.UTC(),
+	}
+	if event != EventGrant {
+		ev.Held = l.elapsedSince(lri.timestamp)
+	}
+	for _, sink := range l.sinks {
+		if err := sink.Send(ev); err != nil {
+			l.log(dsync.LogWarn, "Unable to report lock event", "event", ev.Event, "namespace", ev.Namespace, "name", ev.Name, "err", err)
+		}
+	}
+}
+
+// countNamespace increments the count of namespace in counts, allocating counts when nil.
+func countNamespace(counts map[string]uint64, namespace string) map[string]uint64 {
+	if counts == nil {
+		counts = make(map[string]uint64)
+	}
+	counts[namespace]++
+	return counts
+}
+
+// AddEventSink registers a sink for all subsequent lock lifecycle events, next to Config.Sinks.
+func (l *Server) AddEventSink(sink EventSink) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.sinks = append(l.sinks, sink)
+}
+
+// SetEvents reports all subsequent lock lifecycle events to events as well (see EventsSink).
+func (l *Server) SetEvents(events dsync.Events) {
+	l.AddEventSink(EventsSink{Events: events})
+}
+
+// EventsSink - EventSink reporting to the dsync.Events of an embedder: grants to OnAcquired,
+// releases and force unlocks to OnReleased, and locks purged by lock maintenance, swept with an
+// expired lease or revoked to OnStalePurge.
+type EventsSink struct {
+	Events dsync.Events
+}
+
+func (e EventsSink) Send(ev Event) error {
+	dev := dsync.LockEvent{Namespace: ev.Namespace, Name: ev.Name, Owner: ev.Owner, UID: ev.UID, ReadLock: !ev.Writer,
+		Node: ev.Node, Since: ev.Since, Held: ev.Held}
+	switch ev.Event {
+	case EventGrant:
+		e.Events.OnAcquired(dev)
+	case EventRelease, EventForceUnlock:
+		e.Events.OnReleased(dev)
+	case EventPurge, EventExpire, EventRevoke:
+		e.Events.OnStalePurge(dev)
+	}
+	return nil
+}
+
+// ChannelSink - EventSink pushing every event to a channel, for an embedder consuming the events
+// itself. Events are dropped while the channel is full, so the server is never held up by a slow
+// receiver.
+type ChannelSink chan<- Event
+
+func (c ChannelSink) Send(ev Event) error {
+	select {
+	case c <- ev:
+		return nil
+	default:
+		return errors.New("Event channel is full, dropping lock event")
+	}
+}
+
+// WebhookSink - EventSink POSTing every event as JSON to an HTTP endpoint, in order and from a
+// single goroutine so that the server is never held up by a slow or unavailable endpoint. Events
+// are dropped while webhookQueueSize events are waiting to be delivered.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	queue  chan Event
+	logger dsync.Logger
+}
+
+// NewWebhookSink returns a sink delivering the events to url, logging failed deliveries to logger
+// (discarded when nil).
+func NewWebhookSink(url string, logger dsync.Logger) *WebhookSink {
+	if logger == nil {
+		logger = discardLogger{}
+	}
+	w := &WebhookSink{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan Event, webhookQueueSize),
+		logger: logger,
+	}
+	go w.run()
+	return w
+}
+
+func (w *WebhookSink) Send(ev Event) error {
+	select {
+	case w.queue <- ev:
+		return nil
+	default:
+		return errors.New("Webhook queue is full, dropping lock event")
+	}
+}
+
+func (w *WebhookSink) run() {
+	for ev := range w.queue {
+		if err := w.post(ev); err != nil {
+			w.logger.Log(dsync.LogWarn, "Unable to deliver lock event to webhook", "url", w.url, "event", ev.Event, "namespace", ev.Namespace, "name", ev.Name, "err", err)
+		}
+	}
+}
+
+func (w *WebhookSink) post(ev Event) error {
+	data, err := json.Marshal(&ev)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Webhook responded with status %s", resp.Status)
+	}
+	return nil
+}
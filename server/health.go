@@ -0,0 +1,115 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Health - the state of a Server as reported to load balancers and orchestration probes, by the
+// Health and Ready handlers and by HealthHandler and ReadyHandler.
+type Health struct {
+	Node        string        `json:"node"`
+	Incarnation uint64        `json:"incarnation"`
+	Uptime      time.Duration `json:"uptime"`
+	Names       int           `json:"names"`      // Names on which locks are held
+	WriteLocks  int           `json:"writeLocks"` // Write locks held (including reservations)
+	ReadLocks   int           `json:"readLocks"`  // Read locks held (including reservations)
+	Draining    bool          `json:"draining"`
+	ReadOnly    bool          `json:"readOnly"`
+	Ready       bool          `json:"ready"` // Whether the server grants locks, that is neither draining, read-only nor closed
+}
+
+// Health - rpc handler for the health of the server. Unlike other requests it is answered
+// whatever the incarnation the request is addressed to.
+func (l *Server) Health(args *StatsArgs, reply *Health) error {
+	if err := l.validateAdminArgs(args); err != nil {
+		return err
+	}
+	*reply = l.health()
+	return nil
+}
+
+// Ready - rpc handler for whether the server grants locks.
+func (l *Server) Ready(args *StatsArgs, reply *bool) error {
+	if err := l.validateAdminArgs(args); err != nil {
+		return err
+	}
+	*reply = l.isGranting()
+	return nil
+}
+
+// validateAdminArgs checks the token and protocol version of a request that is answered whatever
+// the incarnation it is addressed to. Takes the server mutex.
+func (l *Server) validateAdminArgs(args *StatsArgs) error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if err := l.authenticate(args.Token, ""); err != nil {
+		return err
+	}
+	return dsync.CheckVersion(args.Version)
+}
+
+// health returns the health of the server. Takes the mutexes of the shards and of the server.
+func (l *Server) health() Health {
+	s := l.stats()
+	return Health{
+		Node:        s.Node,
+		Incarnation: s.Incarnation,
+		Uptime:      s.Uptime,
+		Names:       s.Names,
+		WriteLocks:  s.WriteLocks,
+		ReadLocks:   s.ReadLocks,
+		Draining:    s.Draining,
+		ReadOnly:    s.ReadOnly,
+		Ready:       l.isGranting(),
+	}
+}
+
+// HealthHandler returns a handler for liveness probes, answering with the health of the server as
+// JSON and status 200 for as long as the server runs, eg.
+//
+//	http.Handle("/health", s.HealthHandler())
+func (l *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.writeHealth(w, http.StatusOK)
+	})
+}
+
+// ReadyHandler returns a handler for readiness probes, answering with the health of the server as
+// JSON, with status 200 while it grants locks and 503 (Service Unavailable) while it is read-only
+// or once it is draining or closed, so that load balancers stop sending requests to it.
+func (l *Server) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		if !l.isGranting() {
+			status = http.StatusServiceUnavailable
+		}
+		l.writeHealth(w, status)
+	})
+}
+
+func (l *Server) writeHealth(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(l.health())
+}
@@ -0,0 +1,70 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NextIncarnation raises the boot counter persisted at path and returns it as the incarnation of the
+// starting server, or a time based incarnation when path is empty.
+func NextIncarnation(path string) (uint64, error) {
+	if path == "" {
+		return uint64(time.Now().UnixNano()), nil
+	}
+	var incarnation uint64
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if incarnation, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return 0, err
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	incarnation++
+	if err = StoreIncarnation(path, incarnation); err != nil {
+		return 0, err
+	}
+	return incarnation, nil
+}
+
+// StoreIncarnation persists incarnation as the boot counter at path, so that the next start of the
+// server gets a later one (see NextIncarnation), eg. after assuming the incarnation of a departing
+// server (see Config.Assume).
+func StoreIncarnation(path string, incarnation uint64) error {
+	// Write to a new file that replaces the old one, so a crash cannot leave the counter corrupt
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strconv.FormatUint(incarnation, 10) + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	return err
+}
@@ -0,0 +1,188 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Maximum time to wait for a client to acknowledge the shutdown notification
+const drainNotifyTimeout = 2 * time.Second
+
+// ServerDraining - rpc handler for the notification that another lock server is shutting down.
+func (l *Server) ServerDraining(args *dsync.LockArgs, reply *bool) error {
+	if err := l.authorize(args); err != nil {
+		return err
+	}
+	l.log(dsync.LogInfo, "Lock server is shutting down", "node", args.Source.Node)
+	*reply = true
+	return nil
+}
+
+// Drain stops granting new locks, asks the current holders to release their locks within timeout
+// (see RequestRelease) and waits (at most timeout) for them to do so, after which all clients that have been granted locks are notified of the shutdown,
+// so that they do not have to discover it through an incarnation mismatch. Call Close afterwards.
+// Returns right away once the locks have been handed over to a replacement (see Migrate), whose
+// clients are served by the replacement.
+func (l *Server) Drain(timeout time.Duration) {
+	l.mutex.Lock()
+	l.draining = true
+	handedOver := l.handedOver
+	l.mutex.Unlock()
+	if handedOver {
+		return
+	}
+	l.log(dsync.LogInfo, "Draining, no longer granting new locks")
+	if timeout > 0 {
+		l.requestReleaseAll(timeout)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		held := l.countLockedNames()
+		if held == 0 {
+			l.log(dsync.LogInfo, "All locks released")
+			break
+		} else if time.Now().After(deadline) {
+			l.log(dsync.LogWarn, "Drain timed out with locks still held", "held", held)
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	l.mutex.RLock()
+	clients := make([]dsync.Identity, 0, len(l.clients))
+	for node, rpcPath := range l.clients {
+		clients = append(clients, dsync.Identity{Node: node, Path: rpcPath})
+	}
+	l.mutex.RUnlock()
+
+	// Notify all clients in parallel, not waiting longer than drainNotifyTimeout for clients that are down
+	ctx, cancel := context.WithTimeout(context.Background(), drainNotifyTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, client := range clients {
+		c, err := l.config.Resolver.Resolve(client)
+		if err != nil {
+			continue // Serves no callbacks
+		}
+		wg.Add(1)
+		go func(c dsync.RPC) {
+			defer wg.Done()
+			var ok bool
+			dsync.CallServer(ctx, c, "Dsync.ServerDraining", &dsync.LockArgs{Source: l.config.Self, Epoch: l.config.Epoch, Version: dsync.ProtocolVersion}, &ok)
+		}(c)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		l.log(dsync.LogWarn, "Timed out notifying clients of shutdown")
+	}
+}
+
+// ReadOnlyArgs - arguments for the ReadOnly rpc call of a Server.
+type ReadOnlyArgs struct {
+	Token       string
+	Timestamp   time.Time
+	Incarnation uint64
+	Version     uint32
+	ReadOnly    bool // Whether to enter or leave read-only mode
+}
+
+func (r *ReadOnlyArgs) SetToken(token string) {
+	r.Token = token
+}
+
+func (r *ReadOnlyArgs) SetTimestamp(tstamp time.Time) {
+	r.Timestamp = tstamp
+}
+
+func (r *ReadOnlyArgs) SetIncarnation(incarnation uint64) {
+	r.Incarnation = incarnation
+}
+
+// SetReadOnly puts the server into (or back out of) read-only mode, in which it denies new locks
+// (and reports not to be ready, see ReadyHandler) but keeps serving the releases and checks of the
+// locks held, so that it can be taken out of rotation cleanly before maintenance. Unlike Drain it
+// can be undone, and it does not notify the clients. Returns whether the server was read-only before.
+func (l *Server) SetReadOnly(readOnly bool) bool {
+	l.mutex.Lock()
+	was := l.readOnly
+	changed := was != readOnly
+	l.readOnly = readOnly
+	l.mutex.Unlock()
+	if changed && readOnly {
+		l.log(dsync.LogInfo, "Read-only, no longer granting new locks")
+	} else if changed {
+		l.log(dsync.LogInfo, "Granting new locks again")
+	}
+	return was
+}
+
+// ReadOnly - rpc handler for entering or leaving read-only mode (see SetReadOnly), replies with
+// whether the server was read-only before.
+func (l *Server) ReadOnly(args *ReadOnlyArgs, reply *bool) error {
+	l.mutex.RLock()
+	err := l.authenticate(args.Token, "")
+	if err == nil {
+		err = dsync.CheckVersion(args.Version)
+	}
+	if err == nil {
+		err = dsync.CheckIncarnation(l.Incarnation(), args.Incarnation)
+	}
+	l.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	*reply = l.SetReadOnly(args.ReadOnly)
+	return nil
+}
+
+// Revoke - rpc handler for a lock server of another node that denied a lock which a client of this
+// node may retain, having the client hand back the lock (see dsync.SetRetainLease).
+func (l *Server) Revoke(args *dsync.LockArgs, reply *bool) error {
+	if err := l.authorize(args); err != nil {
+		return err
+	}
+	*reply = dsync.RevokeRetained(args.Namespace, args.Name)
+	return nil
+}
+
+// revokeRetained calls back the clients that may retain their locks lri on key, as the lock on
+// key has been denied to someone else. The callbacks are made asynchronously, so it may be called
+// with the mutex of the shard of key held.
+func (l *Server) revokeRetained(key lockKey, lri []lockRequesterInfo) {
+	for _, entry := range lri {
+		if !entry.retainable {
+			continue
+		}
+		go func(client dsync.Identity) {
+			args := dsync.LockArgs{Namespace: key.namespace, Name: key.name, Epoch: l.config.Epoch, Version: dsync.ProtocolVersion}
+			var revoked bool
+			c, err := l.config.Resolver.Resolve(client)
+			if err == nil {
+				err = dsync.CallServer(context.Background(), c, "Dsync.Revoke", &args, &revoked)
+			}
+			if err != nil {
+				l.log(dsync.LogWarn, "Unable to revoke retained lock", "namespace", key.namespace, "name", key.name, "node", client.Node, "err", err)
+			}
+		}(entry.source)
+	}
+}
@@ -0,0 +1,455 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+type lockRequesterInfo struct {
+	writer        bool           // Bool whether write or read lock
+	source        dsync.Identity // Client claiming lock
+	owner         string         // Actor on whose behalf the lock is claimed (empty when the node itself)
+	uid           string         // Uid to uniquely identify request of client
+	timestamp     time.Time      // Timestamp set at the time of initialization
+	timeLastCheck time.Time      // Timestamp for last check of validity of lock
+	leaseExpiry   time.Time      // Time at which the lock expires unless renewed, zero when leases are disabled
+	suspect       bool           // Set when lock maintenance found the lock expired, purged if it is still expired on the next pass
+	reservedUntil time.Time      // Time at which a reservation by PrepareLock or PrepareRLock lapses unless committed, zero once committed
+	retainable    bool           // Set when the client may retain the lock after unlocking it, until revoked (see revokeRetained)
+	persistent    bool           // Set for a LockPersistent lock, held until its leaseExpiry without being checked with its client
+	recovery      []byte         // Hash of the recovery token that a TakeOver of a persistent lock must present
+}
+
+// lockKey identifies a lock, names of locks are only unique within their namespace.
+type lockKey struct {
+	namespace string
+	name      string
+}
+
+func (k lockKey) String() string {
+	if k.namespace == "" {
+		return k.name
+	}
+	return k.namespace + "/" + k.name
+}
+
+func isWriteLock(lri []lockRequesterInfo) bool {
+	return len(lri) == 1 && lri[0].writer
+}
+
+// maxReadersReached returns whether no more read locks may be granted in addition to the read locks lri.
+func (l *Server) maxReadersReached(lri []lockRequesterInfo) bool {
+	maxReaders := l.tuned().maxReaders
+	return maxReaders > 0 && len(lri) >= maxReaders
+}
+
+// newRequesterInfo returns the entry of a lock granted for args now, only reserved until committed
+// when reservation is non-zero.
+func (l *Server) newRequesterInfo(args *dsync.LockArgs, writer bool, reservation time.Duration) lockRequesterInfo {
+	now := l.now()
+	lri := lockRequesterInfo{
+		writer:        writer,
+		source:        args.Source,
+		owner:         args.Owner,
+		uid:           args.UID,
+		timestamp:     now,
+		timeLastCheck: now,
+		leaseExpiry:   l.newLeaseExpiry(),
+		retainable:    writer && args.Retainable,
+	}
+	if reservation > 0 {
+		lri.reservedUntil = now.Add(reservation)
+	}
+	if args.Persist > 0 {
+		lri.persistent, lri.recovery = true, recoveryHash(args.RecoveryToken)
+		lri.leaseExpiry = now.Add(args.Persist)
+	}
+	return lri
+}
+
+// Lock - rpc handler for (single) write lock operation.
+func (l *Server) Lock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return l.lock(args, l.stamp(reply), 0)
+}
+
+// lock grants a write lock, or only reserves it until committed when reservation is non-zero.
+func (l *Server) lock(args *dsync.LockArgs, reply *bool, reservation time.Duration) (err error) {
+	span := dsync.StartSpan(args.TraceContext, "server.lock", "name", args.Name, "uid", args.UID)
+	defer func() {
+		span.SetAttributes("granted", *reply)
+		span.End(err)
+	}()
+	key := lockKey{args.Namespace, args.Name}
+	s := l.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ok, err := l.admit(args, key); !ok {
+		*reply = false
+		return err
+	}
+	lrInfo := l.newRequesterInfo(args, true, reservation)
+	l.dropExpiredReservations(key)
+	if s.holds(key, args.UID, true) {
+		l.recordRegrant(args, key, lrInfo)
+		*reply = true // Retry of a lock request whose reply got lost
+		return nil
+	}
+	var held []lockRequesterInfo
+	held, *reply = s.lockMap[key]
+	if !*reply { // No locks held on the given name, so claim write lock
+		s.lockMap[key] = []lockRequesterInfo{lrInfo}
+		if l.wal != nil && reservation == 0 { // Reservations are logged once committed
+			l.wal.logGrant(key, lrInfo)
+		}
+	} else {
+		l.revokeRetained(key, held)
+	}
+	*reply = !*reply // Negate *reply to return true when lock is granted or false otherwise
+	l.recordRequest(args, key, lrInfo, *reply)
+	return nil
+}
+
+// Unlock - rpc handler for (single) write unlock operation.
+func (l *Server) Unlock(args *dsync.LockArgs, reply *bool) error {
+	if err := l.authorizeTo(args, ACLUnlock); err != nil {
+		return err
+	}
+	key := lockKey{args.Namespace, args.Name}
+	s := l.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.unlockProcessed(key, args.UID, true) {
+		*reply = true // Retry of an unlock whose reply got lost, so it is released already
+		return nil
+	}
+	var lri []lockRequesterInfo
+	if lri, *reply = s.lockMap[key]; !*reply { // No lock is held on the given name
+		return dsync.LockServerError(dsync.ErrLockNotHeld, "Unlock attempted on an unlocked entity: "+args.Name)
+	}
+	if *reply = isWriteLock(lri); !*reply { // Unless it is a write lock
+		return dsync.LockServerError(dsync.ErrReadLockHeld, fmt.Sprintf("Unlock attempted on a read locked entity: %s (%d read locks active)", args.Name, len(lri)))
+	}
+	if !l.removeEntry(key, args.UID, &lri, EventRelease) {
+		return dsync.LockServerError(dsync.ErrLockNotHeld, "Unlock unable to find corresponding lock for uid: "+args.UID)
+	}
+	s.recordUnlock(key, args.UID, true)
+	return nil
+}
+
+// RLock - rpc handler for read lock operation.
+func (l *Server) RLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return l.rlock(args, l.stamp(reply), 0)
+}
+
+// rlock grants a read lock, or only reserves it until committed when reservation is non-zero.
+func (l *Server) rlock(args *dsync.LockArgs, reply *bool, reservation time.Duration) (err error) {
+	span := dsync.StartSpan(args.TraceContext, "server.rlock", "name", args.Name, "uid", args.UID)
+	defer func() {
+		span.SetAttributes("granted", *reply)
+		span.End(err)
+	}()
+	key := lockKey{args.Namespace, args.Name}
+	s := l.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if ok, err := l.admit(args, key); !ok {
+		*reply = false
+		return err
+	}
+	lrInfo := l.newRequesterInfo(args, false, reservation)
+	l.dropExpiredReservations(key)
+	if s.holds(key, args.UID, false) {
+		l.recordRegrant(args, key, lrInfo)
+		*reply = true // Retry of a lock request whose reply got lost
+		return nil
+	}
+	if lri, ok := s.lockMap[key]; ok {
+		if *reply = !isWriteLock(lri) && !l.maxReadersReached(lri); *reply { // Unless there is a write lock (or too many read locks)
+			s.lockMap[key] = append(s.lockMap[key], lrInfo)
+		} else {
+			l.revokeRetained(key, lri)
+		}
+	} else { // No locks held on the given name, so claim (first) read lock
+		s.lockMap[key] = []lockRequesterInfo{lrInfo}
+		*reply = true
+	}
+	if *reply && l.wal != nil && reservation == 0 { // Reservations are logged once committed
+		l.wal.logGrant(key, lrInfo)
+	}
+	l.recordRequest(args, key, lrInfo, *reply)
+	return nil
+}
+
+// RUnlock - rpc handler for read unlock operation.
+func (l *Server) RUnlock(args *dsync.LockArgs, reply *bool) error {
+	if err := l.authorizeTo(args, ACLUnlock); err != nil {
+		return err
+	}
+	key := lockKey{args.Namespace, args.Name}
+	s := l.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.unlockProcessed(key, args.UID, false) {
+		*reply = true // Retry of an unlock whose reply got lost, so it is released already
+		return nil
+	}
+	var lri []lockRequesterInfo
+	if lri, *reply = s.lockMap[key]; !*reply { // No lock is held on the given name
+		return dsync.LockServerError(dsync.ErrLockNotHeld, "RUnlock attempted on an unlocked entity: "+args.Name)
+	}
+	if *reply = !isWriteLock(lri); !*reply { // A write-lock is held, cannot release a read lock
+		return dsync.LockServerError(dsync.ErrWriteLockHeld, "RUnlock attempted on a write locked entity: "+args.Name)
+	}
+	if !l.removeEntry(key, args.UID, &lri, EventRelease) {
+		return dsync.LockServerError(dsync.ErrLockNotHeld, "RUnlock unable to find corresponding read lock for uid: "+args.UID)
+	}
+	s.recordUnlock(key, args.UID, false)
+	return nil
+}
+
+// ForceUnlock - rpc handler for force unlock operation.
+func (l *Server) ForceUnlock(args *dsync.LockArgs, reply *bool) error {
+	if err := l.authorizeTo(args, ACLForceUnlock); err != nil {
+		return err
+	}
+	if len(args.UID) != 0 {
+		return fmt.Errorf("ForceUnlock called with non-empty UID: %s", args.UID)
+	}
+	key := lockKey{args.Namespace, args.Name}
+	s := l.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if lri, ok := s.lockMap[key]; ok { // Only clear lock when set
+		l.recordRelease(EventForceUnlock, key, lri...)
+		delete(s.lockMap, key) // Remove the lock (irrespective of write or read lock)
+		s.notifyWaiters(key)
+		if l.wal != nil {
+			l.wal.logForce(key)
+		}
+	}
+	*reply = true
+	return nil
+}
+
+// ForceUnlockMatching - rpc handler for force unlocking all locks whose name matches
+// a prefix or glob pattern, replies with the number of names released.
+func (l *Server) ForceUnlockMatching(args *dsync.ForceUnlockArgs, reply *int) error {
+	if err := l.validateForceUnlockArgs(args); err != nil {
+		return err
+	}
+	*reply = 0
+	for _, s := range l.shards {
+		s.mutex.Lock()
+		for key, lri := range s.lockMap {
+			if key.namespace != args.Namespace {
+				continue
+			}
+			matched := args.Prefix != "" && strings.HasPrefix(key.name, args.Prefix)
+			if args.Pattern != "" {
+				matched, _ = path.Match(args.Pattern, key.name)
+			}
+			if matched {
+				l.recordRelease(EventForceUnlock, key, lri...)
+				delete(s.lockMap, key) // Remove the lock (irrespective of write or read lock)
+				s.notifyWaiters(key)
+				if l.wal != nil {
+					l.wal.logForce(key)
+				}
+				*reply++
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+// validateForceUnlockArgs takes the server mutex.
+func (l *Server) validateForceUnlockArgs(args *dsync.ForceUnlockArgs) error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if err := l.authenticate(args.Token, args.Namespace); err != nil {
+		return err
+	}
+	if err := dsync.CheckVersion(args.Version); err != nil {
+		return err
+	}
+	if err := dsync.CheckIncarnation(l.Incarnation(), args.Incarnation); err != nil {
+		return err
+	}
+	if (args.Prefix == "") == (args.Pattern == "") {
+		return errors.New("ForceUnlockMatching requires either a prefix or a pattern")
+	}
+	if _, err := path.Match(args.Pattern, ""); err != nil {
+		return fmt.Errorf("ForceUnlockMatching called with invalid pattern: %s", args.Pattern)
+	}
+	return l.checkACL(args.Token, args.Namespace, ACLForceUnlock)
+}
+
+// Expired - rpc handler for expired lock status.
+func (l *Server) Expired(args *dsync.LockArgs, reply *bool) error {
+	if err := l.authorize(args); err != nil {
+		return err
+	}
+	*reply = l.isExpired(lockKey{args.Namespace, args.Name}, args.UID)
+	return nil
+}
+
+// ExpiredBatch - rpc handler for the expired lock status of many locks at once.
+func (l *Server) ExpiredBatch(args *dsync.ExpiredBatchArgs, reply *dsync.ExpiredBatchReply) error {
+	l.mutex.RLock()
+	err := l.validateRequest(args.Token, "", args.Version, args.Incarnation, args.Epoch)
+	l.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	for i, entry := range args.Entries {
+		if l.isExpired(lockKey{entry.Namespace, entry.Name}, entry.UID) {
+			reply.SetExpired(i)
+		}
+	}
+	return nil
+}
+
+// isExpired returns whether the lock with uid is no longer held. Takes the mutex of the shard of key.
+func (l *Server) isExpired(key lockKey, uid string) bool {
+	s := l.shard(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, entry := range s.lockMap[key] {
+		if entry.uid == uid {
+			return false // When uid found, lock is still active so return not expired
+		}
+	}
+	return true
+}
+
+// ListLocks - rpc handler for listing (a page of) the locks held, sorted by name.
+func (l *Server) ListLocks(args *dsync.ListLocksArgs, reply *dsync.ListLocksReply) error {
+	l.mutex.RLock()
+	err := l.authenticate(args.Token, args.Namespace)
+	if err == nil {
+		err = dsync.CheckVersion(args.Version)
+	}
+	if err == nil {
+		err = dsync.CheckIncarnation(l.Incarnation(), args.Incarnation)
+	}
+	if err == nil {
+		err = l.checkACL(args.Token, args.Namespace, ACLLock)
+	}
+	l.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	maxEntries := args.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = dsync.DefaultListLocksMaxEntries
+	}
+
+	// Copy the matching locks shard by shard, so no single mutex is held for the whole listing
+	holders := make(map[string][]lockRequesterInfo)
+	for _, s := range l.shards {
+		s.mutex.RLock()
+		for key, lri := range s.lockMap {
+			if key.namespace == args.Namespace && strings.HasPrefix(key.name, args.Prefix) && (args.Marker == "" || key.name > args.Marker) {
+				holders[key.name] = append([]lockRequesterInfo{}, lri...)
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	names := make([]string, 0, len(holders))
+	for name := range holders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > maxEntries {
+		names = names[:maxEntries]
+		reply.Truncated = true
+		reply.NextMarker = names[len(names)-1]
+	}
+
+	reply.Locks = make([]dsync.LockInfo, 0, len(names))
+	for _, name := range names {
+		info := dsync.LockInfo{Name: name}
+		for _, lri := range holders[name] {
+			info.Holders = append(info.Holders, dsync.LockHolder{
+				Writer:     lri.writer,
+				Node:       lri.source.Node,
+				RPCPath:    lri.source.Path,
+				UID:        lri.uid,
+				Since:      lri.timestamp.UTC(),
+				Age:        l.elapsedSince(lri.timestamp),
+				LastCheck:  lri.timeLastCheck.UTC(),
+				Persistent: lri.persistent,
+			})
+		}
+		reply.Locks = append(reply.Locks, info)
+	}
+	return nil
+}
+
+// removeEntry either, based on the uid of the lock message, removes a single entry from the
+// lockRequesterInfo array or the whole array from the map (in case of a write lock or last read lock),
+// event tells why the entry is removed. Should be called with the mutex of the shard of key held.
+func (l *Server) removeEntry(key lockKey, uid string, lri *[]lockRequesterInfo, event string) bool {
+	s := l.shard(key)
+	// Find correct entry to remove based on uid
+	for index, entry := range *lri {
+		if entry.uid == uid {
+			if l.wal != nil {
+				l.wal.logRelease(key, uid)
+			}
+			l.recordRelease(event, key, entry)
+			if len(*lri) == 1 {
+				delete(s.lockMap, key) // Remove the (last) lock
+			} else {
+				// Remove the appropriate read lock
+				*lri = append((*lri)[:index], (*lri)[index+1:]...)
+				s.lockMap[key] = *lri
+			}
+			s.notifyWaiters(key)
+			return true
+		}
+	}
+	return false
+}
+
+// Similar to removeEntry but only removes an entry only if the lock entry exists in map.
+// Should be called with the mutex of the shard of key held.
+func (l *Server) removeEntryIfExists(nlrip nameLockRequesterInfoPair, event string) {
+	// Check if entry is still in map (could have been removed altogether by 'concurrent' (R)Unlock of last entry)
+	if lri, ok := l.shard(nlrip.key).lockMap[nlrip.key]; ok {
+		// Remove fails when the entry has been released concurrently, in case it is a:
+		// Reader: this can happen if multiple read locks were active and
+		// the one we are looking for has been released concurrently (so it is fine)
+		// Writer: this can happen if the name has been locked again under another uid
+		// after the release (so it is fine as well, the new lock is left alone)
+		l.removeEntry(nlrip.key, nlrip.lri.uid, &lri, event)
+	}
+}
+
+type nameLockRequesterInfoPair struct {
+	key lockKey
+	lri lockRequesterInfo
+}
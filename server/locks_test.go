@@ -0,0 +1,948 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Handlers exercised by the generated sequences, and the names they operate on
+var (
+	handlerNames = []string{"Lock", "RLock", "Unlock", "RUnlock", "ForceUnlock", "Expired"}
+	lockNames    = []string{"a", "b", "c"}
+)
+
+// handlerOp is a request to a lock server handler in a generated sequence.
+type handlerOp struct {
+	Handler string
+	Name    string
+	UID     string
+}
+
+func (op handlerOp) String() string {
+	return fmt.Sprintf("%s(%s, %q)", op.Handler, op.Name, op.UID)
+}
+
+// handlerOps is a sequence of requests as generated by testing/quick: every Lock and RLock gets a
+// fresh uid (as dsync does), the other handlers mostly pick a uid (and its name) issued before so
+// that they hit held locks, but sometimes one that was never issued.
+type handlerOps []handlerOp
+
+func (handlerOps) Generate(random *rand.Rand, size int) reflect.Value {
+	var ops handlerOps
+	var issued []handlerOp
+	for i, n := 0, 1+random.Intn(4*size); i < n; i++ {
+		op := handlerOp{Handler: handlerNames[random.Intn(len(handlerNames))], Name: lockNames[random.Intn(len(lockNames))]}
+		switch {
+		case op.Handler == "Lock" || op.Handler == "RLock":
+			op.UID = fmt.Sprintf("uid-%d", i)
+			issued = append(issued, op)
+		case op.Handler == "ForceUnlock":
+		case len(issued) > 0 && random.Intn(5) > 0:
+			prev := issued[random.Intn(len(issued))]
+			op.Name, op.UID = prev.Name, prev.UID
+		default:
+			op.UID = "uid-unknown"
+		}
+		ops = append(ops, op)
+	}
+	return reflect.ValueOf(ops)
+}
+
+// modelEntry is a lock held in the reference model.
+type modelEntry struct {
+	UID    string
+	Writer bool
+}
+
+// lockModel is the reference model of the lock server: a single map from names to the locks held,
+// along with the unlocks processed (which succeed again when retried).
+type lockModel struct {
+	locks    map[string][]modelEntry
+	unlocked map[string]bool // Keyed by handler, name and uid
+}
+
+// apply applies op to the model, returning the expected reply and whether an error is expected.
+func (m *lockModel) apply(op handlerOp) (reply bool, fails bool) {
+	entries := m.locks[op.Name]
+	writeLocked := len(entries) == 1 && entries[0].Writer
+	held := -1
+	for i, e := range entries {
+		if e.UID == op.UID {
+			held = i
+		}
+	}
+	switch op.Handler {
+	case "Lock":
+		if len(entries) > 0 {
+			return false, false
+		}
+		m.locks[op.Name] = []modelEntry{{op.UID, true}}
+		return true, false
+	case "RLock":
+		if writeLocked {
+			return false, false
+		}
+		m.locks[op.Name] = append(entries, modelEntry{op.UID, false})
+		return true, false
+	case "Unlock", "RUnlock":
+		processed := op.Handler + "/" + op.Name + "/" + op.UID
+		if m.unlocked[processed] {
+			return true, false
+		}
+		if len(entries) == 0 || writeLocked != (op.Handler == "Unlock") || held < 0 {
+			return false, true
+		}
+		if entries = append(entries[:held:held], entries[held+1:]...); len(entries) == 0 {
+			delete(m.locks, op.Name)
+		} else {
+			m.locks[op.Name] = entries
+		}
+		m.unlocked[processed] = true
+		return true, false
+	case "ForceUnlock":
+		delete(m.locks, op.Name)
+		return true, false
+	case "Expired":
+		return held < 0, false
+	}
+	panic("unknown handler " + op.Handler)
+}
+
+// lockServerState returns the locks held by the server in the form of the model.
+func lockServerState(l *Server) map[string][]modelEntry {
+	state := make(map[string][]modelEntry)
+	for _, s := range l.shards {
+		s.mutex.RLock()
+		for key, lri := range s.lockMap {
+			for _, entry := range lri {
+				state[key.name] = append(state[key.name], modelEntry{entry.uid, entry.writer})
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	for _, entries := range state {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].UID < entries[j].UID })
+	}
+	return state
+}
+
+func TestLockServerHandlersModel(t *testing.T) {
+	check := func(ops handlerOps) bool {
+		l := New(Config{})
+		m := &lockModel{locks: make(map[string][]modelEntry), unlocked: make(map[string]bool)}
+		for i, op := range ops {
+			args := lockArgs(l, op.Name, op.UID)
+			var reply bool
+			var err error
+			switch op.Handler {
+			case "Lock":
+				err = acquire(l.Lock, args, &reply)
+			case "RLock":
+				err = acquire(l.RLock, args, &reply)
+			case "Unlock":
+				err = l.Unlock(args, &reply)
+			case "RUnlock":
+				err = l.RUnlock(args, &reply)
+			case "ForceUnlock":
+				err = l.ForceUnlock(args, &reply)
+			case "Expired":
+				err = l.Expired(args, &reply)
+			}
+
+			expected, fails := m.apply(op)
+			if fails != (err != nil) || !fails && reply != expected {
+				t.Errorf("Step %d %v: got reply %v and error %v, expected reply %v (failing %v)", i, op, reply, err, expected, fails)
+				return false
+			}
+			expectedState := make(map[string][]modelEntry)
+			for name, entries := range m.locks {
+				expectedState[name] = append([]modelEntry(nil), entries...)
+				sort.Slice(expectedState[name], func(i, j int) bool { return expectedState[name][i].UID < expectedState[name][j].UID })
+			}
+			if state := lockServerState(l); !reflect.DeepEqual(state, expectedState) {
+				t.Errorf("Step %d %v: server holds %v, expected %v", i, op, state, expectedState)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(check, &quick.Config{MaxCount: 500}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockServerClock(t *testing.T) {
+	c := &fakeClock{now: time.Now()}
+	ttl := 3 * time.Minute
+	l := New(Config{Clock: c, LeaseTTL: ttl, Maintenance: MaintenanceConfig{Interval: 10 * time.Second, StaleAfter: time.Minute}})
+	args := lockArgs(l, "a", "uid-1")
+	var reply bool
+	if err := acquire(l.Lock, args, &reply); err != nil || !reply {
+		t.Fatalf("Lock failed with reply %v and error %v", reply, err)
+	}
+	lockMap := l.shard(lockKey{name: "a"}).lockMap
+
+	interval := time.Minute
+	if long := getLongLivedLocks(lockMap, interval, c.Now()); len(long) != 0 {
+		t.Fatalf("Expected no lock to be checked right after granting it, got %v", long)
+	}
+	c.advance(interval)
+	if long := getLongLivedLocks(lockMap, interval, c.Now()); len(long) != 1 {
+		t.Fatalf("Expected the lock to be checked after %v, got %v", interval, long)
+	}
+	if long := getLongLivedLocks(lockMap, interval, c.Now()); len(long) != 0 {
+		t.Fatalf("Expected no lock to be checked again right after a check, got %v", long)
+	}
+
+	c.advance(ttl - interval)
+	l.Maintenance().SweepExpiredLeases()
+	if state := lockServerState(l); len(state) != 1 {
+		t.Fatalf("Expected the lock to be held until its lease has expired, got %v", state)
+	}
+	c.advance(time.Second)
+	l.Maintenance().SweepExpiredLeases()
+	if state := lockServerState(l); len(state) != 0 {
+		t.Fatalf("Expected the lock to be removed once its lease has expired, got %v", state)
+	}
+}
+
+// eventRecorder records the kind of the lock events reported to it, with the name of the lock.
+type eventRecorder struct {
+	events []string
+}
+
+func (r *eventRecorder) OnAcquired(ev dsync.LockEvent) {
+	r.events = append(r.events, "acquired "+ev.Name)
+}
+func (r *eventRecorder) OnReleased(ev dsync.LockEvent) {
+	r.events = append(r.events, "released "+ev.Name)
+}
+func (r *eventRecorder) OnQuorumLost(ev dsync.LockEvent) {
+	r.events = append(r.events, "lost "+ev.Name)
+}
+func (r *eventRecorder) OnStalePurge(ev dsync.LockEvent) {
+	r.events = append(r.events, "purged "+ev.Name)
+}
+
+func TestLockServerEvents(t *testing.T) {
+	c := &fakeClock{now: time.Now()}
+	ttl := time.Minute
+	l := New(Config{Clock: c, LeaseTTL: ttl, Maintenance: MaintenanceConfig{Interval: time.Second, StaleAfter: 10 * time.Second}})
+	events := &eventRecorder{}
+	l.SetEvents(events)
+
+	var reply bool
+	for _, name := range []string{"a", "b"} {
+		if err := acquire(l.Lock, lockArgs(l, name, "uid-"+name), &reply); err != nil || !reply {
+			t.Fatalf("Lock failed with reply %v and error %v", reply, err)
+		}
+	}
+	if err := l.Unlock(lockArgs(l, "a", "uid-a"), &reply); err != nil || !reply {
+		t.Fatalf("Unlock failed with reply %v and error %v", reply, err)
+	}
+	c.advance(ttl + time.Second)
+	l.Maintenance().SweepExpiredLeases()
+
+	expected := "acquired a, acquired b, released a, purged b"
+	if got := strings.Join(events.events, ", "); got != expected {
+		t.Fatalf("Expected events %q, got %q", expected, got)
+	}
+}
+
+func TestUnlockRetry(t *testing.T) {
+	l := New(Config{})
+	var reply bool
+	if err := acquire(l.Lock, lockArgs(l, "a", "uid-a"), &reply); err != nil || !reply {
+		t.Fatalf("Lock failed with reply %v and error %v", reply, err)
+	}
+	if err := acquire(l.RLock, lockArgs(l, "b", "uid-b"), &reply); err != nil || !reply {
+		t.Fatalf("RLock failed with reply %v and error %v", reply, err)
+	}
+	for i := 0; i < 2; i++ { // Succeeds again when retried
+		if err := l.Unlock(lockArgs(l, "a", "uid-a"), &reply); err != nil || !reply {
+			t.Fatalf("Unlock %d failed with reply %v and error %v", i, reply, err)
+		}
+		if err := l.RUnlock(lockArgs(l, "b", "uid-b"), &reply); err != nil || !reply {
+			t.Fatalf("RUnlock %d failed with reply %v and error %v", i, reply, err)
+		}
+	}
+	if err := l.RUnlock(lockArgs(l, "a", "uid-a"), &reply); !errors.Is(err, dsync.ErrLockNotHeld) {
+		t.Fatalf("Expected the read unlock of a released write lock to fail, got %v", err)
+	}
+
+	// The unlocks remembered are bounded, the oldest are forgotten first
+	key := lockKey{name: "a"}
+	s := l.shard(key)
+	s.mutex.Lock()
+	for i := 0; i < unlockDedupMax; i++ {
+		s.recordUnlock(lockKey{name: "other"}, fmt.Sprintf("uid-%d", i), true)
+	}
+	if len(s.unlocked) != unlockDedupMax || len(s.unlocks) != unlockDedupMax {
+		t.Fatalf("Expected %d unlocks to be remembered, got %d (%d in order)", unlockDedupMax, len(s.unlocked), len(s.unlocks))
+	}
+	s.mutex.Unlock()
+	if err := l.Unlock(lockArgs(l, "a", "uid-a"), &reply); !errors.Is(err, dsync.ErrLockNotHeld) {
+		t.Fatalf("Expected the oldest unlock to be forgotten, got reply %v and error %v", reply, err)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsync-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "locks.wal")
+	open := func() *Server {
+		l := New(Config{})
+		if err := l.OpenWAL(path, false); err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	call := func(handler string, l *Server, name, uid string) {
+		if reply, err := callHandler(l, handler, lockArgs(l, name, uid)); err != nil || !reply {
+			t.Fatalf("%s(%s, %q) failed with reply %v and error %v", handler, name, uid, reply, err)
+		}
+	}
+	records := func() int {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Count(data, []byte("\n"))
+	}
+
+	l := open()
+	incarnation := l.Incarnation()
+	call("Lock", l, "a", "w1")
+	call("RLock", l, "b", "r1")
+	call("RLock", l, "b", "r2")
+	call("Unlock", l, "a", "w1")
+	call("Lock", l, "a", "w2")
+	call("Lock", l, "c", "w3")
+	call("ForceUnlock", l, "c", "")
+	l.Close()
+
+	// The locks still held are reloaded, along with the incarnation
+	l = open()
+	expected := map[string][]modelEntry{"a": {{"w2", true}}, "b": {{"r1", false}, {"r2", false}}}
+	if state := lockServerState(l); !reflect.DeepEqual(state, expected) || l.Incarnation() != incarnation {
+		t.Fatalf("Expected %v reloaded with incarnation %d, got %v with incarnation %d", expected, incarnation, state, l.Incarnation())
+	}
+	if err := checkLockMap(l); err != nil {
+		t.Fatal(err)
+	}
+
+	// A snapshot compacts the log to the locks held, to which subsequent changes are appended
+	call("RUnlock", l, "b", "r1")
+	call("Lock", l, "c", "w4")
+	if n := records(); n != 6 {
+		t.Fatalf("Expected the reloaded log to hold the incarnation and 3 locks along with 2 changes, got %d records", n)
+	}
+	if _, err := l.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if n := records(); n != 4 {
+		t.Fatalf("Expected the compacted log to hold the incarnation and 3 locks, got %d records", n)
+	}
+	call("Unlock", l, "a", "w2")
+	l.Close()
+
+	l = open()
+	defer l.Close()
+	expected = map[string][]modelEntry{"b": {{"r2", false}}, "c": {{"w4", true}}}
+	if state := lockServerState(l); !reflect.DeepEqual(state, expected) || l.Incarnation() != incarnation {
+		t.Fatalf("Expected %v reloaded with incarnation %d, got %v with incarnation %d", expected, incarnation, state, l.Incarnation())
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	l := New(Config{})
+	var reply bool
+	args := lockArgs(l, "a", "w1")
+	args.Namespace, args.Owner = "ns", "actor"
+	if err := acquire(l.Lock, args, &reply); err != nil || !reply {
+		t.Fatalf("Lock failed with reply %v and error %v", reply, err)
+	}
+	for _, uid := range []string{"r1", "r2"} {
+		if err := acquire(l.RLock, lockArgs(l, "b", uid), &reply); err != nil || !reply {
+			t.Fatalf("RLock failed with reply %v and error %v", reply, err)
+		}
+	}
+	reserve := lockArgs(l, "c", "w2")
+	reserve.Reservation = time.Second
+	if err := acquire(l.PrepareLock, reserve, &reply); err != nil || !reply {
+		t.Fatalf("PrepareLock failed with reply %v and error %v", reply, err)
+	}
+	data, err := l.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// All committed locks are restored, under the incarnation of the server they were taken from
+	restored := New(Config{})
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string][]modelEntry{"a": {{"w1", true}}, "b": {{"r1", false}, {"r2", false}}}
+	if state := lockServerState(restored); !reflect.DeepEqual(state, expected) || restored.Incarnation() != l.Incarnation() {
+		t.Fatalf("Expected %v restored with incarnation %d, got %v with incarnation %d", expected, l.Incarnation(), state, restored.Incarnation())
+	}
+	key := lockKey{"ns", "a"}
+	if lri := restored.shard(key).lockMap[key]; len(lri) != 1 || lri[0].owner != "actor" || lri[0].source != args.Source {
+		t.Fatalf("Expected the lock on ns/a to be restored with its owner and client, got %+v", lri)
+	}
+	if err := checkLockMap(restored); err != nil {
+		t.Fatal(err)
+	}
+	args.Incarnation = restored.Incarnation()
+	if err := restored.Unlock(args, &reply); err != nil || !reply {
+		t.Fatalf("Unlock of restored lock failed with reply %v and error %v", reply, err)
+	}
+
+	// Snapshots of version 1 keep the incarnation of the server, other versions are refused
+	v1 := New(Config{})
+	incarnation := v1.Incarnation()
+	if err := v1.Restore([]byte(`{"version": 1, "timestamp": "2016-10-16T12:00:00Z", "locks": [{"name": "a", "writer": true, "node": "127.0.0.1:9000", "rpcPath": "/dsync", "uid": "w1"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if state := lockServerState(v1); !reflect.DeepEqual(state, map[string][]modelEntry{"a": {{"w1", true}}}) || v1.Incarnation() != incarnation {
+		t.Fatalf("Expected the lock of the version 1 snapshot to be restored with incarnation %d, got %v with incarnation %d", incarnation, state, v1.Incarnation())
+	}
+	if err := v1.Restore([]byte(`{"version": 3, "locks": []}`)); err == nil {
+		t.Fatal("Expected a snapshot of an unknown version to be refused")
+	}
+	if err := v1.Restore([]byte(`{"version": 2, "locks": [{"name": "a", "writer": true, "uid": "w1"}, {"name": "a", "uid": "r1"}]}`)); err == nil {
+		t.Fatal("Expected a snapshot with conflicting locks to be refused")
+	}
+}
+
+func TestEventSinks(t *testing.T) {
+	received := make(chan Event, 2)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- ev
+	}))
+	defer endpoint.Close()
+	events := make(chan Event, 2)
+	l := New(Config{Sinks: []EventSink{ChannelSink(events), NewWebhookSink(endpoint.URL, nil)}})
+
+	var reply bool
+	if err := acquire(l.Lock, lockArgs(l, "a", "uid-a"), &reply); err != nil || !reply {
+		t.Fatalf("Lock failed with reply %v and error %v", reply, err)
+	}
+	if err := l.ForceUnlock(lockArgs(l, "a", ""), &reply); err != nil || !reply {
+		t.Fatalf("ForceUnlock failed with reply %v and error %v", reply, err)
+	}
+	if err := acquire(l.Lock, lockArgs(l, "b", "uid-b"), &reply); err != nil || !reply { // Dropped by the full channel
+		t.Fatalf("Lock failed with reply %v and error %v", reply, err)
+	}
+
+	for _, expected := range []string{EventGrant, EventForceUnlock} {
+		if ev := <-events; ev.Event != expected || ev.Name != "a" {
+			t.Fatalf("Expected %s of a on the channel, got %+v", expected, ev)
+		}
+	}
+	if len(events) != 0 {
+		t.Fatalf("Expected the events beyond the capacity of the channel to be dropped, got %d more", len(events))
+	}
+	for _, expected := range []string{EventGrant + " a", EventForceUnlock + " a", EventGrant + " b"} {
+		select {
+		case ev := <-received:
+			if got := ev.Event + " " + ev.Name; got != expected || ev.Node != "127.0.0.1:9000" {
+				t.Fatalf("Expected %s delivered to the webhook, got %+v", expected, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s to be delivered to the webhook", expected)
+		}
+	}
+}
+
+func TestLockServerBatch(t *testing.T) {
+	l := New(Config{})
+	var reply bool
+	lock := lockArgs(l, "b", "uid-b")
+	if err := acquire(l.Lock, lock, &reply); err != nil || !reply {
+		t.Fatalf("Lock failed with reply %v and error %v", reply, err)
+	}
+
+	batch := lockArgs(l, "", "uid-batch")
+	batch.Names = []string{"a", "b", "c"}
+	if err := acquire(l.LockBatch, batch, &reply); err != nil || reply {
+		t.Fatalf("Expected a batch overlapping a lock to be denied, got reply %v and error %v", reply, err)
+	}
+	if state := lockServerState(l); len(state) != 1 {
+		t.Fatalf("Expected no names of a denied batch to be locked, got %v", state)
+	}
+	if err := checkLockMap(l); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Unlock(lock, &reply); err != nil || !reply {
+		t.Fatalf("Unlock failed with reply %v and error %v", reply, err)
+	}
+	for i := 0; i < 2; i++ { // Granted again when retried
+		if err := acquire(l.LockBatch, batch, &reply); err != nil || !reply {
+			t.Fatalf("LockBatch failed with reply %v and error %v", reply, err)
+		}
+	}
+	if state := lockServerState(l); len(state) != 3 {
+		t.Fatalf("Expected all names of the batch to be locked, got %v", state)
+	}
+	if err := checkLockMap(l); err != nil {
+		t.Fatal(err)
+	}
+
+	batch.Names = append(batch.Names, "d")
+	if err := l.UnlockBatch(batch, &reply); !errors.Is(err, dsync.ErrLockNotHeld) || !strings.HasSuffix(err.Error(), ": d") {
+		t.Fatalf("Expected the release of a name not held to fail, got %v", err)
+	}
+	if state := lockServerState(l); len(state) != 0 {
+		t.Fatalf("Expected the names held to be released, got %v", state)
+	}
+	if err := checkLockMap(l); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// errDenied is returned by a handler step whose request was denied.
+var errDenied = errors.New("Request denied")
+
+// step is an atomic step of a goroutine in an interleaving test, such as a call of a handler.
+type step struct {
+	name string // Unique within a test
+	run  func() error
+}
+
+// exploreInterleavings runs every schedule of the steps of the goroutines returned by setup, that
+// is every interleaving preserving the order of the steps within each goroutine, on a fresh lock
+// server built by setup. After every schedule check is called with the errors returned by the steps
+// (keyed by step name). Returns the number of schedules explored.
+func exploreInterleavings(t *testing.T, setup func() (goroutines [][]step, check func(errs map[string]error) error)) int {
+	shape, _ := setup()
+	next := make([]int, len(shape))
+	schedule := []int{} // Goroutine taking every step
+	explored := 0
+	var explore func()
+	explore = func() {
+		complete := true
+		for g := range shape {
+			if next[g] < len(shape[g]) {
+				complete = false
+				next[g]++
+				schedule = append(schedule, g)
+				explore()
+				schedule = schedule[:len(schedule)-1]
+				next[g]--
+			}
+		}
+		if !complete {
+			return
+		}
+		explored++
+		goroutines, check := setup()
+		taken := make([]int, len(goroutines))
+		errs := make(map[string]error)
+		names := []string{}
+		for _, g := range schedule {
+			s := goroutines[g][taken[g]]
+			taken[g]++
+			errs[s.name] = s.run()
+			names = append(names, s.name)
+		}
+		if err := check(errs); err != nil {
+			t.Errorf("Schedule %s: %v", strings.Join(names, ", "), err)
+		}
+	}
+	explore()
+	return explored
+}
+
+// handlerStep returns a step calling handler on name for uid.
+func handlerStep(l *Server, handler, name, uid string) step {
+	return step{name: handler + "(" + uid + ")", run: func() error {
+		args := lockArgs(l, name, uid)
+		var reply bool
+		var err error
+		switch handler {
+		case "Lock":
+			err = acquire(l.Lock, args, &reply)
+		case "RLock":
+			err = acquire(l.RLock, args, &reply)
+		case "Unlock":
+			err = l.Unlock(args, &reply)
+		case "RUnlock":
+			err = l.RUnlock(args, &reply)
+		}
+		if err == nil && !reply {
+			err = errDenied
+		}
+		return err
+	}}
+}
+
+// maintenanceSteps returns the steps of lock maintenance on l, the originating servers answering that
+// the locks of uids in stale have expired. Unless purgeOnly, these are two passes (a lock is purged on
+// the second pass), each taking the long lived locks and then resolving them, between which
+// the maintenance calls the originating servers without holding any mutex. With purgeOnly, the stale
+// locks are purged right away with removeEntryIfExists instead.
+func maintenanceSteps(l *Server, stale map[string]bool, purgeOnly bool) []step {
+	var long []nameLockRequesterInfoPair
+	collect := func() error {
+		long = nil
+		for _, s := range l.shards {
+			s.mutex.Lock()
+			for _, nlrips := range getLongLivedLocks(s.lockMap, 0, l.now()) {
+				long = append(long, nlrips...)
+			}
+			s.mutex.Unlock()
+		}
+		return nil
+	}
+	resolve := func() error {
+		for _, nlrip := range long {
+			if !purgeOnly {
+				verdict := Held
+				if stale[nlrip.lri.uid] {
+					verdict = Expired
+				}
+				l.Maintenance().resolve(nlrip, verdict)
+			} else if stale[nlrip.lri.uid] {
+				s := l.shard(nlrip.key)
+				s.mutex.Lock()
+				l.removeEntryIfExists(nlrip, EventPurge)
+				s.mutex.Unlock()
+			}
+		}
+		return nil
+	}
+	if purgeOnly {
+		return []step{{"collect", collect}, {"purge", resolve}}
+	}
+	return []step{{"collect-1", collect}, {"resolve-1", resolve}, {"collect-2", collect}, {"resolve-2", resolve}}
+}
+
+// suspects returns whether the locks of l on name are marked suspect, by uid.
+func suspects(l *Server, name string) map[string]bool {
+	key := lockKey{name: name}
+	s := l.shard(key)
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	marked := make(map[string]bool)
+	for _, entry := range s.lockMap[key] {
+		marked[entry.uid] = entry.suspect
+	}
+	return marked
+}
+
+// A lock found expired is only marked suspect on the first pass, and purged on the second.
+func TestMaintenanceMarkThenPurge(t *testing.T) {
+	l := New(Config{Clock: &fakeClock{now: time.Now()}})
+	for _, s := range []step{handlerStep(l, "RLock", "a", "r1"), handlerStep(l, "RLock", "a", "r2")} {
+		if err := s.run(); err != nil {
+			t.Fatalf("%s failed: %v", s.name, err)
+		}
+	}
+	steps := maintenanceSteps(l, map[string]bool{"r1": true}, false)
+	steps[0].run()
+	steps[1].run()
+	if marked := suspects(l, "a"); !reflect.DeepEqual(marked, map[string]bool{"r1": true, "r2": false}) {
+		t.Fatalf("Expected only r1 to be marked suspect after the first pass, got %v", marked)
+	}
+	steps[2].run()
+	steps[3].run()
+	if marked := suspects(l, "a"); !reflect.DeepEqual(marked, map[string]bool{"r2": false}) {
+		t.Fatalf("Expected r1 to be purged on the second pass, got %v", marked)
+	}
+	if err := checkLockMap(l); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A lock marked suspect that its client confirms holding on the next pass is no longer suspect,
+// so that it is only purged after being found expired on two passes in a row again.
+func TestMaintenanceMarkCleared(t *testing.T) {
+	l := New(Config{Clock: &fakeClock{now: time.Now()}})
+	if s := handlerStep(l, "Lock", "a", "w1"); s.run() != nil {
+		t.Fatalf("%s failed", s.name)
+	}
+	expired := maintenanceSteps(l, map[string]bool{"w1": true}, false)
+	held := maintenanceSteps(l, map[string]bool{}, false)
+	for i, pass := range [][]step{expired[:2], held[:2], expired[2:]} {
+		for _, s := range pass {
+			s.run()
+		}
+		if marked := suspects(l, "a"); !reflect.DeepEqual(marked, map[string]bool{"w1": i != 1}) {
+			t.Fatalf("Pass %d: expected w1 to be held, marked suspect unless confirmed, got %v", i+1, marked)
+		}
+	}
+}
+
+// errorLogger records the messages logged as errors.
+type errorLogger struct {
+	errors []string
+}
+
+func (e *errorLogger) Log(level dsync.LogLevel, msg string, keysAndValues ...interface{}) {
+	if level >= dsync.LogError {
+		e.errors = append(e.errors, msg)
+	}
+}
+
+// testInterleavings explores the interleavings of a lock server starting with the locks granted by
+// initial with the goroutines, while lock maintenance purges the locks of uids in stale, failing t
+// when check fails or an error is logged.
+func testInterleavings(t *testing.T, initial func(l *Server) []step, goroutines func(l *Server) [][]step, stale map[string]bool, check func(l *Server, errs map[string]error) error) {
+	for _, purgeOnly := range []bool{false, true} {
+		explored := exploreInterleavings(t, func() ([][]step, func(map[string]error) error) {
+			errLog := &errorLogger{}
+			l := New(Config{Clock: &fakeClock{now: time.Now()}, Logger: errLog})
+			for _, s := range initial(l) {
+				if err := s.run(); err != nil {
+					t.Fatalf("Initial %s failed: %v", s.name, err)
+				}
+			}
+			return append(goroutines(l), maintenanceSteps(l, stale, purgeOnly)), func(errs map[string]error) error {
+				if len(errLog.errors) > 0 {
+					return fmt.Errorf("Logged errors %v", errLog.errors)
+				}
+				return check(l, errs)
+			}
+		})
+		t.Logf("Explored %d schedules (purging right away: %v)", explored, purgeOnly)
+	}
+}
+
+// Read lock r1 is released by its client, so reported expired, while maintenance purges it
+// concurrently: removing it fails when the release comes first, which must not affect the other
+// read locks (r2 held, r3 granted meanwhile).
+func TestInterleavingsReadUnlockPurge(t *testing.T) {
+	testInterleavings(t, func(l *Server) []step {
+		return []step{handlerStep(l, "RLock", "a", "r1"), handlerStep(l, "RLock", "a", "r2")}
+	}, func(l *Server) [][]step {
+		return [][]step{
+			{handlerStep(l, "RUnlock", "a", "r1")},
+			{handlerStep(l, "RLock", "a", "r3"), handlerStep(l, "RUnlock", "a", "r2")},
+		}
+	}, map[string]bool{"r1": true}, func(l *Server, errs map[string]error) error {
+		if errs["RLock(r3)"] != nil || errs["RUnlock(r2)"] != nil {
+			return fmt.Errorf("Live read locks affected: RLock(r3) %v, RUnlock(r2) %v", errs["RLock(r3)"], errs["RUnlock(r2)"])
+		}
+		if state := lockServerState(l); !reflect.DeepEqual(state, map[string][]modelEntry{"a": {{"r3", false}}}) {
+			return fmt.Errorf("Server holds %v, expected only r3", state)
+		}
+		return nil
+	})
+}
+
+// Write lock w1 is released by its client, so reported expired, while maintenance purges it
+// concurrently and the name is locked again (by w2 or w3): the purge must never remove the new lock.
+func TestInterleavingsWriteUnlockPurge(t *testing.T) {
+	testInterleavings(t, func(l *Server) []step {
+		return []step{handlerStep(l, "Lock", "a", "w1")}
+	}, func(l *Server) [][]step {
+		return [][]step{
+			{handlerStep(l, "Unlock", "a", "w1"), handlerStep(l, "Lock", "a", "w3")},
+			{handlerStep(l, "Lock", "a", "w2")},
+		}
+	}, map[string]bool{"w1": true}, func(l *Server, errs map[string]error) error {
+		expected := "w3"
+		if errs["Lock(w2)"] == nil {
+			expected = "w2"
+		}
+		if errs["Lock("+expected+")"] != nil {
+			return fmt.Errorf("Neither w2 nor w3 granted: %v", errs["Lock(w3)"])
+		}
+		if state := lockServerState(l); !reflect.DeepEqual(state, map[string][]modelEntry{"a": {{expected, true}}}) {
+			return fmt.Errorf("Server holds %v, expected only %s", state, expected)
+		}
+		return nil
+	})
+}
+
+// checkLockMap returns an error when the locks held by l are inconsistent: a name without locks
+// left in the map, a write lock alongside other locks, a uid holding the same name more than once,
+// or locks not counted for their clients.
+func checkLockMap(l *Server) error {
+	held := make(map[string]int)
+	for _, s := range l.shards {
+		for key, lri := range s.lockMap {
+			if len(lri) == 0 {
+				return fmt.Errorf("No locks left on %s in the map", key)
+			}
+			uids := make(map[string]bool)
+			for _, entry := range lri {
+				if entry.writer && len(lri) > 1 {
+					return fmt.Errorf("Write lock %q on %s alongside %d other locks", entry.uid, key, len(lri)-1)
+				}
+				if uids[entry.uid] {
+					return fmt.Errorf("Uid %q holds %s more than once", entry.uid, key)
+				}
+				uids[entry.uid] = true
+				held[entry.source.Node]++
+			}
+		}
+	}
+	if !reflect.DeepEqual(held, l.held) && (len(held) > 0 || len(l.held) > 0) {
+		return fmt.Errorf("Locks held per client %v, counted %v", held, l.held)
+	}
+	return nil
+}
+
+// fuzzHandlers are the handlers called by FuzzLockServerHandlers, on names and uids picked by the
+// fuzzer.
+var fuzzHandlers = []string{"Lock", "RLock", "Unlock", "RUnlock", "ForceUnlock", "Expired", "ExpiredBatch", "PrepareLock", "PrepareRLock", "Commit", "LockWait", "LockBatch", "UnlockBatch"}
+
+// callHandler calls handler of l with args, returning its reply.
+func callHandler(l *Server, handler string, args *dsync.LockArgs) (reply bool, err error) {
+	switch handler {
+	case "Lock":
+		err = acquire(l.Lock, args, &reply)
+	case "RLock":
+		err = acquire(l.RLock, args, &reply)
+	case "Unlock":
+		err = l.Unlock(args, &reply)
+	case "RUnlock":
+		err = l.RUnlock(args, &reply)
+	case "ForceUnlock":
+		err = l.ForceUnlock(args, &reply)
+	case "Expired":
+		err = l.Expired(args, &reply)
+	case "ExpiredBatch":
+		var batch dsync.ExpiredBatchReply
+		err = l.ExpiredBatch(&dsync.ExpiredBatchArgs{Entries: []dsync.ExpiredEntry{{Namespace: args.Namespace, Name: args.Name, UID: args.UID}},
+			Incarnation: args.Incarnation, Epoch: args.Epoch, Version: args.Version}, &batch)
+		reply = batch.IsExpired(0)
+	case "PrepareLock":
+		err = acquire(l.PrepareLock, args, &reply)
+	case "PrepareRLock":
+		err = acquire(l.PrepareRLock, args, &reply)
+	case "Commit":
+		err = l.Commit(args, &reply)
+	case "LockWait":
+		err = acquire(l.LockWait, args, &reply)
+	case "LockBatch", "UnlockBatch": // On the name along with a name of its own
+		batch := *args
+		batch.Names = []string{args.Name, "batch"}
+		if handler == "LockBatch" {
+			err = acquire(l.LockBatch, &batch, &reply)
+		} else {
+			err = l.UnlockBatch(&batch, &reply)
+		}
+	default:
+		panic("unknown handler " + handler)
+	}
+	return reply, err
+}
+
+// FuzzLockArgsDecoding decodes requests as the gob codec of net/rpc does and calls every handler
+// with them, which must neither panic nor leave the lock map inconsistent.
+func FuzzLockArgsDecoding(f *testing.F) {
+	for _, args := range []dsync.LockArgs{
+		{Name: "a", UID: "uid-1", Source: dsync.Identity{Node: "127.0.0.1:9000", Path: "/dsync"}, Incarnation: 1, Version: dsync.ProtocolVersion},
+		{Name: "", UID: "", Incarnation: 1, Version: dsync.ProtocolVersion},
+		{Name: strings.Repeat("x", 64*1024), UID: "uid-1", Incarnation: 1, Version: dsync.ProtocolVersion, Reservation: time.Second},
+		{Name: "a", UID: "uid-1", Incarnation: 1, Version: dsync.ProtocolVersion, Reservation: -1, WaitTimeout: -1, Timestamp: time.Now()},
+	} {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&args); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var args dsync.LockArgs
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&args); err != nil {
+			return
+		}
+		args.WaitTimeout = 0 // Do not park requests
+		l := New(Config{Incarnation: 1})
+		for _, handler := range fuzzHandlers {
+			argsCopy := args
+			callHandler(l, handler, &argsCopy)
+			if err := checkLockMap(l); err != nil {
+				t.Fatalf("After %s(%+v): %v", handler, args, err)
+			}
+		}
+	})
+}
+
+// FuzzLockServerHandlers runs sequences of requests taken from ops, three bytes each picking the
+// handler, the uid (out of a few, so that they get reused) and whether the request is for name
+// (rather than a fixed name), has a zero timestamp, comes from another node or asks for a
+// reservation. The handlers must neither panic nor leave the lock map inconsistent.
+func FuzzLockServerHandlers(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 2, 1, 0, 1, 1, 1}, "a")
+	f.Add([]byte{1, 1, 0, 1, 1, 0, 3, 1, 0, 3, 1, 0}, "")
+	f.Add([]byte{7, 1, 9, 9, 1, 9, 2, 1, 1, 4, 0, 1}, strings.Repeat("x", 4096))
+	f.Add([]byte{8, 2, 8, 1, 2, 4, 9, 2, 0, 3, 2, 4}, "a/b")
+	f.Fuzz(func(t *testing.T, ops []byte, name string) {
+		l := New(Config{})
+		for i := 0; i+2 < len(ops); i += 3 {
+			handler := fuzzHandlers[int(ops[i])%len(fuzzHandlers)]
+			args := lockArgs(l, "a", fmt.Sprintf("uid-%d", ops[i+1]%4))
+			args.Timestamp = time.Now()
+			flags := ops[i+2]
+			if flags&1 != 0 {
+				args.Name = name
+			}
+			if flags&2 != 0 {
+				args.Timestamp = time.Time{}
+			}
+			if flags&4 != 0 {
+				args.Source.Node = "127.0.0.1:9001"
+			}
+			if flags&8 != 0 {
+				args.Reservation = time.Second
+			}
+			if flags&16 != 0 {
+				args.Source.Path = "" // A plain client that serves no callbacks
+			}
+			if ops[i+1]%4 == 0 || handler == "ForceUnlock" {
+				args.UID = ""
+			}
+			reply, handlerErr := callHandler(l, handler, args)
+			if err := checkLockMap(l); err != nil {
+				t.Fatalf("Step %d %s(%q, %q) replied %v (error %v): %v", i/3, handler, args.Name, args.UID, reply, handlerErr, err)
+			}
+		}
+	})
+}
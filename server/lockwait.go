@@ -0,0 +1,182 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Maximum time a LockWait, RLockWait or Watch request is parked on the server
+const maxLockWait = 10 * time.Second
+
+// LockWait - rpc handler for a write lock operation that, instead of being denied immediately,
+// is parked on the server until the lock frees up or args.WaitTimeout has elapsed.
+func (l *Server) LockWait(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return l.lockWait(args, l.stamp(reply), false)
+}
+
+// RLockWait - rpc handler for a read lock operation that is parked like LockWait.
+func (l *Server) RLockWait(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	return l.lockWait(args, l.stamp(reply), true)
+}
+
+func (l *Server) lockWait(args *dsync.LockArgs, reply *bool, isReadLock bool) error {
+	hangup := l.hangupOf(args)
+	deadline := l.now().Add(waitTimeout(args))
+
+	key := lockKey{args.Namespace, args.Name}
+	for {
+		var err error
+		if isReadLock {
+			err = l.rlock(args, reply, 0)
+		} else {
+			err = l.lock(args, reply, 0)
+		}
+		if err != nil || *reply {
+			return err
+		}
+
+		if !l.isGranting() {
+			return nil // Shutting down or read-only, so give up
+		}
+		s := l.shard(key)
+		s.mutex.Lock()
+		if _, ok := s.lockMap[key]; !ok {
+			s.mutex.Unlock()
+			continue // Released in the mean time, so try again
+		}
+		ch := s.waitChannel(key)
+		s.mutex.Unlock()
+
+		if !l.park(key, ch, deadline, hangup) {
+			return nil // Timed out (or the connection closed), reply with lock not granted
+		}
+	}
+}
+
+// Watch - rpc handler that waits until (any lock on) args.Name is released or args.WaitTimeout
+// has elapsed, replying whether it was released, so that waiting clients can retry the moment a
+// lock frees up. When args.Name is not locked at all it replies false right away, as there is no
+// release to wait for (and the client backs off rather than retrying right away).
+func (l *Server) Watch(args *dsync.LockArgs, reply *bool) error {
+	hangup := l.hangupOf(args)
+	deadline := l.now().Add(waitTimeout(args))
+	if err := l.authorizeTo(args, ACLLock); err != nil {
+		return err
+	}
+	key := lockKey{args.Namespace, args.Name}
+	s := l.shard(key)
+	s.mutex.Lock()
+	if _, ok := s.lockMap[key]; !ok {
+		s.mutex.Unlock()
+		*reply = false // Not locked, so no release to notify of
+		return nil
+	}
+	ch := s.waitChannel(key)
+	s.mutex.Unlock()
+
+	*reply = l.park(key, ch, deadline, hangup)
+	return nil
+}
+
+// waitTimeout returns the time a request may be parked, at most maxLockWait.
+func waitTimeout(args *dsync.LockArgs) time.Duration {
+	if args.WaitTimeout > maxLockWait {
+		return maxLockWait
+	}
+	return args.WaitTimeout
+}
+
+// parkOn registers the channel closed once the connection of a request that may be parked closes,
+// to be picked up by its handler with hangupOf.
+func (l *Server) parkOn(args *dsync.LockArgs, hangup chan struct{}) {
+	l.mutex.Lock()
+	if l.hangups == nil {
+		l.hangups = make(map[*dsync.LockArgs]chan struct{})
+	}
+	l.hangups[args] = hangup
+	l.mutex.Unlock()
+}
+
+// hangupOf returns (and forgets) the channel closed once the connection of the request closes, nil
+// when the request was not served over a connection (eg. called directly).
+func (l *Server) hangupOf(args *dsync.LockArgs) chan struct{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	hangup := l.hangups[args]
+	delete(l.hangups, args)
+	return hangup
+}
+
+// park waits until ch (as obtained from waitChannel) is closed (returning true), or the deadline
+// passes or hangup is closed as the connection of the request closed (returning false), after
+// which the request no longer counts as parked.
+func (l *Server) park(key lockKey, ch chan struct{}, deadline time.Time, hangup chan struct{}) bool {
+	s := l.shard(key)
+	defer func() {
+		s.mutex.Lock()
+		if s.parked[key]--; s.parked[key] <= 0 {
+			delete(s.parked, key)
+			if s.waiters[key] == ch {
+				// Last one to give up waiting, so drop the channel rather than keeping it until the next release
+				delete(s.waiters, key)
+			}
+		}
+		s.mutex.Unlock()
+	}()
+
+	remaining := deadline.Sub(l.now())
+	if remaining <= 0 {
+		return false
+	}
+	select {
+	case <-ch:
+		return true
+	case <-hangup:
+		return false
+	case <-l.config.Clock.After(remaining):
+		return false
+	}
+}
+
+// waitChannel returns a channel that is closed upon the next release of (any lock on) key and
+// counts the request as parked, it must be passed to park. Should be called with the mutex of the shard held.
+func (s *lockShard) waitChannel(key lockKey) chan struct{} {
+	if s.parked == nil {
+		s.parked = make(map[lockKey]int)
+	}
+	s.parked[key]++
+	if s.waiters == nil {
+		s.waiters = make(map[lockKey]chan struct{})
+	}
+	ch, ok := s.waiters[key]
+	if !ok {
+		ch = make(chan struct{})
+		s.waiters[key] = ch
+	}
+	return ch
+}
+
+// notifyWaiters wakes up all requests parked on key. Should be called with the mutex of the shard held.
+func (s *lockShard) notifyWaiters(key lockKey) {
+	if ch, ok := s.waiters[key]; ok {
+		close(ch)
+		delete(s.waiters, key)
+	}
+}
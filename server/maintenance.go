@@ -0,0 +1,433 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Defaults of the lock maintenance, for production use (tests shorten them via MaintenanceConfig)
+const (
+	DefaultMaintenanceInterval = 1 * time.Minute
+	DefaultStaleAfter          = 2 * time.Minute
+	DefaultMaintenanceWorkers  = 8
+)
+
+// MaintenanceConfig - configuration of the lock maintenance of a Server, zero fields take their defaults.
+type MaintenanceConfig struct {
+	Interval      time.Duration    // Interval between passes (DefaultMaintenanceInterval when zero)
+	SweepInterval time.Duration    // Interval between sweeps of the expired leases (Interval when zero)
+	StaleAfter    time.Duration    // Time after which a lock is checked (again), the threshold for long lived locks (DefaultStaleAfter when zero)
+	Workers       int              // Clients checked concurrently (DefaultMaintenanceWorkers when zero)
+	Verifier      Verifier         // Strategy checking locks with their clients, a CallbackVerifier (confirmed by a QuorumVerifier with Config.Peers) when nil
+	Hooks         MaintenanceHooks // Receives the decisions of the maintenance (none when nil)
+}
+
+// withDefaults returns the configuration with the zero fields set to their defaults.
+func (c MaintenanceConfig) withDefaults() MaintenanceConfig {
+	if c.Interval == 0 {
+		c.Interval = DefaultMaintenanceInterval
+	}
+	if c.SweepInterval == 0 {
+		c.SweepInterval = c.Interval
+	}
+	if c.StaleAfter == 0 {
+		c.StaleAfter = DefaultStaleAfter
+		if c.StaleAfter < c.Interval {
+			c.StaleAfter = c.Interval
+		}
+	}
+	if c.Workers == 0 {
+		c.Workers = DefaultMaintenanceWorkers
+	}
+	if c.Hooks == nil {
+		c.Hooks = NopMaintenanceHooks{}
+	}
+	return c
+}
+
+// validate verifies that the timings are consistent, with leases of ttl (0 when disabled).
+func (c MaintenanceConfig) validate(ttl time.Duration) error {
+	if c.Interval < 0 || c.SweepInterval < 0 || c.StaleAfter < 0 || c.Workers < 0 {
+		return errors.New("Maintenance configuration must not be negative")
+	}
+	if c.StaleAfter < c.Interval {
+		return errors.New("StaleAfter must not be shorter than the maintenance interval")
+	}
+	if ttl > 0 && ttl <= c.StaleAfter+c.Interval {
+		// A lease is only renewed once a lock is checked, so it would lapse before its first renewal
+		return errors.New("LeaseTTL must be longer than StaleAfter plus the maintenance interval")
+	}
+	return nil
+}
+
+// StaleLock - a lock held for long, as checked by lock maintenance.
+type StaleLock struct {
+	Namespace string
+	Name      string
+	UID       string
+	Writer    bool
+	Source    dsync.Identity // Client holding the lock
+	Owner     string         // Actor on whose behalf the lock is held (empty when the node itself)
+	Since     time.Time      // Time at which the lock was granted
+	Suspect   bool           // Found expired on the previous pass
+}
+
+// Verdict - the outcome of verifying a lock with its client.
+type Verdict int
+
+const (
+	// Unverified - the lock could not be checked (eg. the client is unreachable), it is checked again on the next pass.
+	Unverified Verdict = iota
+	// Held - the lock is still held by the client, so its lease is renewed.
+	Held
+	// Expired - the lock is no longer held, it is purged when found expired on two passes in a row.
+	Expired
+	// Unconfirmed - the client reported the lock expired, but no quorum of the lock servers agreed.
+	Unconfirmed
+)
+
+func (v Verdict) String() string {
+	switch v {
+	case Held:
+		return "held"
+	case Expired:
+		return "expired"
+	case Unconfirmed:
+		return "unconfirmed"
+	}
+	return "unverified"
+}
+
+// Verifier - the strategy by which lock maintenance decides whether the long lived locks of a client
+// are still held, returning a verdict per lock. It is called concurrently for different clients.
+type Verifier interface {
+	Verify(ctx context.Context, source dsync.Identity, locks []StaleLock) []Verdict
+}
+
+// MaintenanceHooks - interface through which lock maintenance reports its decisions, to wire up
+// metrics, logging or corrective actions. The methods are called synchronously so must not block.
+type MaintenanceHooks interface {
+	OnRenewed(lock StaleLock)      // Found still held
+	OnSuspected(lock StaleLock)    // Found expired for the first time
+	OnPurged(lock StaleLock)       // Removed as found expired again
+	OnLeaseExpired(lock StaleLock) // Removed as its lease elapsed without being renewed
+}
+
+// NopMaintenanceHooks - MaintenanceHooks ignoring all decisions, to embed in implementations interested in some only.
+type NopMaintenanceHooks struct{}
+
+func (NopMaintenanceHooks) OnRenewed(lock StaleLock)      {}
+func (NopMaintenanceHooks) OnSuspected(lock StaleLock)    {}
+func (NopMaintenanceHooks) OnPurged(lock StaleLock)       {}
+func (NopMaintenanceHooks) OnLeaseExpired(lock StaleLock) {}
+
+// MaintenanceStats - statistics of the lock maintenance of a Server.
+type MaintenanceStats struct {
+	Rounds       int64     `json:"rounds"`       // Number of maintenance rounds run
+	Checked      int64     `json:"checked"`      // Number of locks checked with their client
+	Purged       int64     `json:"purged"`       // Number of stale locks removed
+	Suspected    int64     `json:"suspected"`    // Number of locks marked suspect, to be purged if still expired on the next pass
+	Renewed      int64     `json:"renewed"`      // Number of locks confirmed to be still active
+	Errors       int64     `json:"errors"`       // Number of checks that failed (and will be retried later)
+	Unconfirmed  int64     `json:"unconfirmed"`  // Number of locks reported expired that no quorum of peers agreed to purge (yet)
+	Expired      int64     `json:"expired"`      // Number of locks whose lease expired without being renewed
+	Disconnected int64     `json:"disconnected"` // Number of locks released as their connection closed (see Config.DisconnectGrace)
+	Revoked      int64     `json:"revoked"`      // Number of locks released as their clients did not release them within the grace of a revocation (see Server.RequestRelease)
+	LastRun      time.Time `json:"lastRun"`      // Time at which the last round started
+}
+
+// Maintenance - the lock maintenance of a Server. Every pass it drops lapsed reservations and
+// checks the locks that have not been checked for StaleAfter with their clients through the
+// Verifier: a lock found expired is only marked suspect at first, and purged when it is still
+// expired on the next pass, so that a transient failure cannot release a lock that is actually
+// held. Every sweep it removes the locks whose lease has expired. Server.Start runs a pass every
+// Interval and a sweep every SweepInterval, Run and SweepExpiredLeases run them on demand.
+type Maintenance struct {
+	server *Server
+	config MaintenanceConfig
+
+	mutex sync.Mutex
+	stats MaintenanceStats
+}
+
+// newMaintenance returns the lock maintenance of server, config must have its defaults set.
+func newMaintenance(server *Server, config MaintenanceConfig) *Maintenance {
+	if config.Verifier == nil {
+		config.Verifier = &CallbackVerifier{Resolver: server.config.Resolver, Epoch: server.config.Epoch}
+		if len(server.config.Peers) > 0 {
+			config.Verifier = &QuorumVerifier{Verifier: config.Verifier, Peers: server.config.Peers, Epoch: server.config.Epoch}
+		}
+	}
+	return &Maintenance{server: server, config: config}
+}
+
+// settings returns the configuration of the lock maintenance.
+func (m *Maintenance) settings() MaintenanceConfig {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.config
+}
+
+// reconfigure changes the Interval, SweepInterval, StaleAfter and Workers of the lock maintenance to those of config.
+func (m *Maintenance) reconfigure(config MaintenanceConfig) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.config.Interval, m.config.SweepInterval = config.Interval, config.SweepInterval
+	m.config.StaleAfter, m.config.Workers = config.StaleAfter, config.Workers
+}
+
+// Stats returns the statistics of the lock maintenance.
+func (m *Maintenance) Stats() MaintenanceStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.stats
+}
+
+// getLongLivedLocks returns locks that are older than a certain time and
+// have not been 'checked' for validity too soon enough, as well as all suspect locks (which are
+// rechecked on every pass), grouped by client. Persistent locks are left to their TTL.
+func getLongLivedLocks(m map[lockKey][]lockRequesterInfo, interval time.Duration, now time.Time) map[dsync.Identity][]nameLockRequesterInfoPair {
+
+	rslt := make(map[dsync.Identity][]nameLockRequesterInfoPair)
+
+	for key, lriArray := range m {
+
+		for idx := range lriArray {
+			if lriArray[idx].persistent {
+				continue
+			}
+			// Check whether enough time has gone by since last check
+			if lriArray[idx].suspect || now.Sub(lriArray[idx].timeLastCheck) >= interval {
+				source := lriArray[idx].source
+				rslt[source] = append(rslt[source], nameLockRequesterInfoPair{key: key, lri: lriArray[idx]})
+				lriArray[idx].timeLastCheck = now
+			}
+		}
+	}
+
+	return rslt
+}
+
+// Run runs a single pass of the lock maintenance, returning once all clients have been checked
+// (or ctx is done).
+//
+// Following logic inside ignores the errors generated for Dsync.Active operation.
+// - server at client down
+// - some network error (and server is up normally)
+//
+// We will ignore the error, and we will retry later to get a resolve on this lock.
+// The clients are checked concurrently by (at most) Workers goroutines.
+func (m *Maintenance) Run(ctx context.Context) {
+	l := m.server
+	config := m.settings()
+	m.mutex.Lock()
+	m.stats.Rounds++
+	m.stats.LastRun = l.now().UTC()
+	m.mutex.Unlock()
+
+	// Get list of long lived locks to check for staleness.
+	nlripLongLived := make(map[dsync.Identity][]nameLockRequesterInfoPair)
+	for _, s := range l.shards {
+		s.mutex.Lock()
+		for key := range s.lockMap {
+			l.dropExpiredReservations(key)
+		}
+		for source, nlrips := range getLongLivedLocks(s.lockMap, config.StaleAfter, l.now()) {
+			nlripLongLived[source] = append(nlripLongLived[source], nlrips...)
+		}
+		s.mutex.Unlock()
+	}
+
+	// Validate if long lived locks are indeed clean.
+	forEachSource(ctx, nlripLongLived, config.Workers, func(source dsync.Identity, nlrips []nameLockRequesterInfoPair) {
+		m.checkSource(ctx, source, nlrips)
+	})
+}
+
+// forEachSource calls f for the locks of every client in bySource, concurrently by (at most) workers
+// goroutines, returning once all clients are done (or ctx is done, skipping the remaining clients).
+func forEachSource(ctx context.Context, bySource map[dsync.Identity][]nameLockRequesterInfoPair, workers int, f func(dsync.Identity, []nameLockRequesterInfoPair)) {
+	ch := make(chan dsync.Identity)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(bySource); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range ch {
+				f(source, bySource[source])
+			}
+		}()
+	}
+	for source := range bySource {
+		if ctx.Err() != nil {
+			break
+		}
+		ch <- source
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// checkSource verifies the locks of a single client.
+func (m *Maintenance) checkSource(ctx context.Context, source dsync.Identity, nlrips []nameLockRequesterInfoPair) {
+	locks := make([]StaleLock, len(nlrips))
+	for i, nlrip := range nlrips {
+		locks[i] = nlrip.staleLock()
+	}
+	verdicts := m.config.Verifier.Verify(ctx, source, locks)
+	for i, nlrip := range nlrips {
+		verdict := Unverified
+		if i < len(verdicts) {
+			verdict = verdicts[i]
+		}
+		m.resolve(nlrip, verdict)
+	}
+}
+
+// resolve purges or renews a long lived lock based on the verdict on it.
+func (m *Maintenance) resolve(nlrip nameLockRequesterInfoPair, verdict Verdict) {
+	l := m.server
+	purged, suspected, renewed := false, false, false
+	s := l.shard(nlrip.key)
+	s.mutex.Lock()
+	switch verdict {
+	case Expired:
+		// The lock is no longer active at the client, so remove it from the map (when already suspect).
+		if purged = l.markSuspect(nlrip); purged {
+			l.removeEntryIfExists(nlrip, EventPurge) // Purge the stale entry if it exists.
+		} else {
+			suspected = true
+		}
+	case Held:
+		// The lock is confirmed to be still active, so renew its lease (and clear any suspicion)
+		renewed = l.renewLease(nlrip)
+	}
+	s.mutex.Unlock()
+
+	m.mutex.Lock()
+	m.stats.Checked++
+	switch verdict {
+	case Expired:
+		if purged {
+			m.stats.Purged++
+		} else {
+			m.stats.Suspected++
+		}
+	case Held:
+		m.stats.Renewed++
+	case Unconfirmed:
+		m.stats.Unconfirmed++
+	default:
+		m.stats.Errors++
+	}
+	m.mutex.Unlock()
+
+	switch {
+	case purged:
+		m.config.Hooks.OnPurged(nlrip.staleLock())
+	case suspected:
+		m.config.Hooks.OnSuspected(nlrip.staleLock())
+	case renewed:
+		m.config.Hooks.OnRenewed(nlrip.staleLock())
+	}
+}
+
+// SweepExpiredLeases removes all lock entries whose lease has elapsed without being renewed,
+// bounding the lifetime of orphaned locks of clients that are permanently gone (as opposed to
+// the verification of locks which relies on the client to answer that a lock has expired), also
+// when leases have been disabled since they were granted. Server.Start sweeps every SweepInterval,
+// independently of the passes of Run.
+func (m *Maintenance) SweepExpiredLeases() {
+	l := m.server
+	var expired []nameLockRequesterInfoPair
+	for _, s := range l.shards {
+		s.mutex.Lock()
+		now := l.now()
+		stale := []nameLockRequesterInfoPair{}
+		for key, lriArray := range s.lockMap {
+			for _, lri := range lriArray {
+				if !lri.leaseExpiry.IsZero() && now.After(lri.leaseExpiry) {
+					stale = append(stale, nameLockRequesterInfoPair{key: key, lri: lri})
+				}
+			}
+		}
+		for _, nlrip := range stale {
+			l.log(dsync.LogInfo, "Lease expired for lock", "namespace", nlrip.key.namespace, "name", nlrip.key.name, "uid", nlrip.lri.uid, "node", nlrip.lri.source.Node)
+			l.removeEntryIfExists(nlrip, EventExpire)
+		}
+		expired = append(expired, stale...)
+		s.mutex.Unlock()
+	}
+	m.mutex.Lock()
+	m.stats.Expired += int64(len(expired))
+	m.mutex.Unlock()
+	for _, nlrip := range expired {
+		m.config.Hooks.OnLeaseExpired(nlrip.staleLock())
+	}
+}
+
+// staleLock returns the lock as passed to the Verifier and MaintenanceHooks.
+func (nlrip nameLockRequesterInfoPair) staleLock() StaleLock {
+	return StaleLock{
+		Namespace: nlrip.key.namespace,
+		Name:      nlrip.key.name,
+		UID:       nlrip.lri.uid,
+		Writer:    nlrip.lri.writer,
+		Source:    nlrip.lri.source,
+		Owner:     nlrip.lri.owner,
+		Since:     nlrip.lri.timestamp,
+		Suspect:   nlrip.lri.suspect,
+	}
+}
+
+// markSuspect marks a lock entry (if it still exists) as suspect, returning whether it was
+// suspect already, should be called with the mutex of its shard held
+func (l *Server) markSuspect(nlrip nameLockRequesterInfoPair) bool {
+	lri := l.shard(nlrip.key).lockMap[nlrip.key]
+	for idx := range lri {
+		if lri[idx].uid == nlrip.lri.uid {
+			if lri[idx].suspect {
+				return true
+			}
+			lri[idx].suspect = true
+			return false
+		}
+	}
+	return false
+}
+
+// renewLease extends the lease of a lock entry (if it still exists) and clears its suspicion,
+// returning whether it still exists, should be called with the mutex of its shard held
+func (l *Server) renewLease(nlrip nameLockRequesterInfoPair) bool {
+	lri := l.shard(nlrip.key).lockMap[nlrip.key]
+	for idx := range lri {
+		if lri[idx].uid == nlrip.lri.uid {
+			if !lri[idx].persistent { // Held until its TTL rather than by lease
+				lri[idx].leaseExpiry = l.newLeaseExpiry()
+			}
+			lri[idx].suspect = false
+			return true
+		}
+	}
+	return false
+}
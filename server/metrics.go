@@ -0,0 +1,109 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// WriteMetrics writes the statistics of the server (see Stats) in the Prometheus text format.
+func (l *Server) WriteMetrics(w io.Writer) (int64, error) {
+	s := l.stats()
+	var buf bytes.Buffer
+	metric := func(name, kind, help string, value interface{}) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+	}
+	namespaces := s.namespaces()
+	perNamespace := func(name, help string, counts map[string]uint64) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		for _, namespace := range namespaces {
+			fmt.Fprintf(&buf, "%s{namespace=%q} %d\n", name, namespace, counts[namespace])
+		}
+	}
+	draining, readOnly := 0, 0
+	if s.Draining {
+		draining = 1
+	}
+	if s.ReadOnly {
+		readOnly = 1
+	}
+
+	metric("dsync_server_uptime_seconds", "gauge", "Time since the server started.", s.Uptime.Seconds())
+	metric("dsync_server_incarnation", "gauge", "Incarnation of the server.", s.Incarnation)
+	metric("dsync_server_epoch", "gauge", "Cluster configuration epoch of the server.", s.Epoch)
+	metric("dsync_server_draining", "gauge", "Whether the server is shutting down.", draining)
+	metric("dsync_server_read_only", "gauge", "Whether the server denies new locks while serving releases.", readOnly)
+	metric("dsync_server_names", "gauge", "Names on which locks are held.", s.Names)
+	fmt.Fprintf(&buf, "# HELP dsync_server_locks Locks held, including reservations.\n# TYPE dsync_server_locks gauge\n")
+	fmt.Fprintf(&buf, "dsync_server_locks{type=\"write\"} %d\ndsync_server_locks{type=\"read\"} %d\n", s.WriteLocks, s.ReadLocks)
+	for _, namespace := range namespaces {
+		fmt.Fprintf(&buf, "dsync_server_locks{namespace=%q} %d\n", namespace, s.Namespaces[namespace])
+	}
+	perNamespace("dsync_server_grants_total", "Locks granted per namespace.", s.Granted)
+	perNamespace("dsync_server_denials_total", "Lock requests denied per namespace.", s.Denied)
+	perNamespace("dsync_server_purges_total", "Locks purged, expired or revoked per namespace.", s.Purged)
+	metric("dsync_server_reserved_locks", "gauge", "Locks reserved and not committed yet.", s.Reserved)
+	metric("dsync_server_parked_requests", "gauge", "Requests waiting for a lock.", s.Parked)
+	metric("dsync_server_clients", "gauge", "Clients that have been granted locks.", s.Clients)
+
+	m := s.Maintenance
+	metric("dsync_server_maintenance_rounds_total", "counter", "Passes of the lock maintenance.", m.Rounds)
+	metric("dsync_server_maintenance_checked_total", "counter", "Long lived locks verified.", m.Checked)
+	metric("dsync_server_maintenance_renewed_total", "counter", "Locks found still held.", m.Renewed)
+	metric("dsync_server_maintenance_suspected_total", "counter", "Locks found expired once.", m.Suspected)
+	metric("dsync_server_maintenance_purged_total", "counter", "Locks purged as found expired twice.", m.Purged)
+	metric("dsync_server_maintenance_expired_total", "counter", "Locks whose lease expired.", m.Expired)
+	metric("dsync_server_maintenance_disconnected_total", "counter", "Locks released as their connection closed.", m.Disconnected)
+	metric("dsync_server_maintenance_revoked_total", "counter", "Locks released as their clients did not release them when asked to.", m.Revoked)
+	metric("dsync_server_maintenance_unconfirmed_total", "counter", "Expired locks not confirmed by a quorum of the peers.", m.Unconfirmed)
+	metric("dsync_server_maintenance_errors_total", "counter", "Locks that could not be verified.", m.Errors)
+	return buf.WriteTo(w)
+}
+
+// MetricsHandler returns a handler serving the statistics of the server in the Prometheus text
+// format, eg.
+//
+//	http.Handle("/metrics/dsync-server", s.MetricsHandler())
+func (l *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		l.WriteMetrics(w)
+	})
+}
+
+// namespaces returns the sorted namespaces covered by the statistics per namespace.
+func (s *Stats) namespaces() []string {
+	seen := make(map[string]bool)
+	for namespace := range s.Namespaces {
+		seen[namespace] = true
+	}
+	for _, counts := range []map[string]uint64{s.Granted, s.Denied, s.Purged} {
+		for namespace := range counts {
+			seen[namespace] = true
+		}
+	}
+	namespaces := make([]string, 0, len(seen))
+	for namespace := range seen {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
@@ -0,0 +1,285 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Maximum number of locks handed over to the replacement per ReceiveLocks call
+const migrateBatchSize = 1000
+
+// Error of requests to a server whose locks have been handed over to a replacement
+var errHandedOver = errors.New("Lock server handed its locks over to a replacement")
+
+// MigratedLock - a lock handed over by a departing server to its replacement. Times are relative
+// to the time of the hand over, so that the clocks of both servers need not agree.
+type MigratedLock struct {
+	Namespace  string
+	Name       string
+	Writer     bool
+	Source     dsync.Identity
+	Owner      string
+	UID        string
+	Age        time.Duration // Time the lock has been held for
+	SinceCheck time.Duration // Time since the last check of validity of the lock
+	Lease      time.Duration // Remaining lease, zero when leases are disabled
+	Reserved   time.Duration // Remaining reservation, zero once committed
+	Suspect    bool
+	Retainable bool
+	Persistent bool
+	Recovery   []byte // Hash of the recovery token of a persistent lock
+}
+
+// MigrateArgs - arguments for the ReceiveLocks rpc call of a replacement server, carrying a batch of
+// the locks of the departing server.
+type MigrateArgs struct {
+	Token             string
+	Timestamp         time.Time
+	Incarnation       uint64
+	Epoch             uint64
+	Version           uint32
+	Source            dsync.Identity // Departing server
+	SourceIncarnation uint64         // Incarnation of the departing server, assumed by the replacement when Done
+	First             bool           // Set on the first batch, which discards any locks of an earlier attempt
+	Done              bool           // Set on the last batch
+	Locks             []MigratedLock
+}
+
+func (m *MigrateArgs) SetToken(token string) {
+	m.Token = token
+}
+
+func (m *MigrateArgs) SetTimestamp(tstamp time.Time) {
+	m.Timestamp = tstamp
+}
+
+func (m *MigrateArgs) SetIncarnation(incarnation uint64) {
+	m.Incarnation = incarnation
+}
+
+// MigrateToArgs - arguments for the MigrateTo rpc call of a departing server.
+type MigrateToArgs struct {
+	Token       string
+	Timestamp   time.Time
+	Incarnation uint64
+	Version     uint32
+	Target      dsync.Identity // Replacement to hand the locks over to
+}
+
+func (m *MigrateToArgs) SetToken(token string) {
+	m.Token = token
+}
+
+func (m *MigrateToArgs) SetTimestamp(tstamp time.Time) {
+	m.Timestamp = tstamp
+}
+
+func (m *MigrateToArgs) SetIncarnation(incarnation uint64) {
+	m.Incarnation = incarnation
+}
+
+// Migrate hands the locks of the server over to target, a freshly started replacement (eg. on new
+// hardware) that assumes the incarnation of the server once it received them all, so that the
+// replacement takes over the locks rather than clients discovering a restart that lost them.
+// Returns the number of locks handed over.
+//
+// From the start of the hand over the server serves no lock requests anymore (releases fail and are
+// retried by the clients), so that the locks cannot change while they are sent; the replacement
+// grants no new locks until it received them all. Once done, move the address of the server over to
+// the replacement and Close the server (Drain returns right away, the clients are served by the
+// replacement).
+// When the hand over fails the server serves requests again, and the replacement should be
+// restarted before it is used.
+func (l *Server) Migrate(ctx context.Context, target dsync.RPC) (int, error) {
+	l.lockAll()
+	l.mutex.Lock()
+	if l.handedOver || l.receiving || l.closed {
+		l.mutex.Unlock()
+		l.unlockAll()
+		return 0, errors.New("Lock server cannot hand over its locks now")
+	}
+	l.handedOver = true
+	l.mutex.Unlock()
+	now := l.now()
+	var locks []MigratedLock
+	for _, s := range l.shards {
+		for key, lri := range s.lockMap {
+			for _, entry := range lri {
+				locks = append(locks, migratedLock(key, entry, now))
+			}
+			s.notifyWaiters(key) // Parked requests are denied
+		}
+	}
+	l.unlockAll()
+	l.log(dsync.LogInfo, "Handing over locks to replacement", "node", target.Node(), "locks", len(locks))
+
+	err := l.sendLocks(ctx, target, locks)
+	if err != nil {
+		l.mutex.Lock()
+		l.handedOver = false
+		l.mutex.Unlock()
+		l.log(dsync.LogWarn, "Unable to hand over locks, serving them again", "node", target.Node(), "err", err)
+		return 0, err
+	}
+	l.log(dsync.LogInfo, "Handed over locks to replacement", "node", target.Node(), "locks", len(locks))
+	return len(locks), nil
+}
+
+// sendLocks sends locks to target in batches.
+func (l *Server) sendLocks(ctx context.Context, target dsync.RPC, locks []MigratedLock) error {
+	for first := true; first || len(locks) > 0; first = false {
+		n := len(locks)
+		if n > migrateBatchSize {
+			n = migrateBatchSize
+		}
+		args := MigrateArgs{Epoch: l.config.Epoch, Version: dsync.ProtocolVersion, Source: l.config.Self, SourceIncarnation: l.Incarnation(),
+			First: first, Done: n == len(locks), Locks: locks[:n]}
+		var received bool
+		if err := dsync.CallServer(ctx, target, "Dsync.ReceiveLocks", &args, &received); err != nil {
+			return err
+		}
+		locks = locks[n:]
+	}
+	return nil
+}
+
+// migratedLock returns the lock entry on key as handed over at now.
+func migratedLock(key lockKey, entry lockRequesterInfo, now time.Time) MigratedLock {
+	m := MigratedLock{Namespace: key.namespace, Name: key.name, Writer: entry.writer, Source: entry.source, Owner: entry.owner, UID: entry.uid,
+		Age: now.Sub(entry.timestamp), SinceCheck: now.Sub(entry.timeLastCheck), Suspect: entry.suspect, Retainable: entry.retainable,
+		Persistent: entry.persistent, Recovery: entry.recovery}
+	if !entry.leaseExpiry.IsZero() {
+		m.Lease = remaining(entry.leaseExpiry, now)
+	}
+	if !entry.reservedUntil.IsZero() {
+		m.Reserved = remaining(entry.reservedUntil, now)
+	}
+	return m
+}
+
+// remaining returns the time left until t, at least a nanosecond so that it is not taken for unset.
+func remaining(t, now time.Time) time.Duration {
+	if d := t.Sub(now); d > 0 {
+		return d
+	}
+	return time.Nanosecond
+}
+
+// MigrateTo - rpc handler having the server hand its locks over to a replacement (see Migrate),
+// replies with the number of locks handed over.
+func (l *Server) MigrateTo(args *MigrateToArgs, reply *int) error {
+	l.mutex.RLock()
+	err := l.authenticate(args.Token, "")
+	if err == nil {
+		err = dsync.CheckVersion(args.Version)
+	}
+	if err == nil {
+		err = dsync.CheckIncarnation(l.Incarnation(), args.Incarnation)
+	}
+	l.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	target, err := l.config.Resolver.Resolve(args.Target)
+	if err != nil {
+		return err
+	}
+	*reply, err = l.Migrate(l.ctx, target)
+	return err
+}
+
+// ReceiveLocks - rpc handler for a batch of the locks of a departing server (see Migrate). The
+// server must hold no locks when receiving the first batch, and grants no new locks until it has
+// received the last one, upon which it assumes the incarnation of the departing server.
+func (l *Server) ReceiveLocks(args *MigrateArgs, reply *bool) error {
+	l.lockAll()
+	defer l.unlockAll()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.validateRequest(args.Token, "", args.Version, args.Incarnation, args.Epoch); err != nil {
+		return err
+	}
+	if l.handedOver || l.closed {
+		return errors.New("Lock server cannot receive locks now")
+	}
+	if args.First {
+		if !l.receiving {
+			for _, s := range l.shards {
+				if len(s.lockMap) > 0 {
+					return errors.New("Lock server holds locks already, only a freshly started server can receive locks")
+				}
+			}
+		}
+		for _, s := range l.shards {
+			if l.wal != nil {
+				for key := range s.lockMap {
+					l.wal.logForce(key) // Received by an earlier attempt
+				}
+			}
+			s.lockMap = make(map[lockKey][]lockRequesterInfo)
+		}
+		l.held = nil
+		l.receiving = true
+		l.log(dsync.LogInfo, "Receiving locks of departing server", "node", args.Source.Node, "incarnation", args.SourceIncarnation)
+	} else if !l.receiving {
+		return errors.New("Lock server is not receiving locks")
+	}
+
+	now := l.now()
+	for _, m := range args.Locks {
+		key := lockKey{m.Namespace, m.Name}
+		entry := lockRequesterInfo{writer: m.Writer, source: m.Source, owner: m.Owner, uid: m.UID, timestamp: now.Add(-m.Age),
+			timeLastCheck: now.Add(-m.SinceCheck), suspect: m.Suspect, retainable: m.Retainable,
+			persistent: m.Persistent, recovery: m.Recovery}
+		if m.Lease > 0 {
+			entry.leaseExpiry = now.Add(m.Lease)
+		}
+		if m.Reserved > 0 {
+			entry.reservedUntil = now.Add(m.Reserved)
+		}
+		s := l.shard(key)
+		s.lockMap[key] = append(s.lockMap[key], entry)
+		if l.wal != nil && m.Reserved == 0 { // Reservations are logged once committed
+			l.wal.logGrant(key, entry)
+		}
+		l.trackGrant(m.Source.Node)
+		l.registerClient(m.Source)
+	}
+
+	if args.Done {
+		if l.config.Assume != nil {
+			if err := l.config.Assume(args.SourceIncarnation); err != nil {
+				return fmt.Errorf("Unable to assume incarnation %d: %v", args.SourceIncarnation, err)
+			}
+		}
+		atomic.StoreUint64(&l.incarnation, args.SourceIncarnation)
+		if l.wal != nil {
+			l.wal.logIncarnation(args.SourceIncarnation)
+		}
+		l.receiving = false
+		l.log(dsync.LogInfo, "Received locks of departing server, assumed its incarnation", "node", args.Source.Node, "incarnation", args.SourceIncarnation)
+	}
+	*reply = true
+	return nil
+}
@@ -0,0 +1,86 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+
+	"github.com/minio/dsync"
+)
+
+// recoveryHash returns the hash of a recovery token, as kept with a persistent lock.
+func recoveryHash(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+// LockPersistent - rpc handler for a persistent write lock (see dsync.PersistentLock), which is
+// not checked with its client by the lock maintenance nor released when its connection closes, but
+// held until args.Persist has passed (unless unlocked or taken over before).
+func (l *Server) LockPersistent(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	granted := l.stamp(reply)
+	if args.Persist <= 0 || args.RecoveryToken == "" {
+		*granted = false
+		return errors.New("Persistent lock requires a TTL and a recovery token")
+	}
+	return l.lock(args, granted, 0)
+}
+
+// TakeOver - rpc handler having the client of args take over the persistent lock of args.UID on
+// args.Name, presenting the recovery token it was granted with, so that it is held for args.Persist
+// from now on (keeping its expiry when zero).
+func (l *Server) TakeOver(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	granted := l.stamp(reply)
+	*granted = false
+	if err := l.authorizeTo(args, ACLLock); err != nil {
+		return err
+	}
+	key := lockKey{args.Namespace, args.Name}
+	s := l.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lri := s.lockMap[key]
+	for idx := range lri {
+		if lri[idx].uid != args.UID {
+			continue
+		}
+		if !lri[idx].persistent || subtle.ConstantTimeCompare(lri[idx].recovery, recoveryHash(args.RecoveryToken)) != 1 {
+			return dsync.AccessDeniedError{Identity: args.Source.Node, Operation: "takeover", Namespace: args.Namespace}
+		}
+		previous := lri[idx].source
+		lri[idx].source, lri[idx].owner = args.Source, args.Owner
+		lri[idx].suspect = false
+		if args.Persist > 0 {
+			lri[idx].leaseExpiry = l.now().Add(args.Persist)
+		}
+		if l.wal != nil {
+			l.wal.logRelease(key, args.UID)
+			l.wal.logGrant(key, lri[idx])
+		}
+		l.log(dsync.LogInfo, "Persistent lock taken over", "namespace", args.Namespace, "name", args.Name, "uid", args.UID, "node", args.Source.Node)
+		l.mutex.Lock()
+		l.untrackGrant(previous.Node)
+		l.trackGrant(args.Source.Node)
+		l.registerClient(args.Source)
+		l.mutex.Unlock()
+		*granted = true
+		return nil
+	}
+	return dsync.LockServerError(dsync.ErrLockNotHeld, "Take over attempted of a lock not held: "+args.Name)
+}
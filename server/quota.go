@@ -0,0 +1,67 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import "github.com/minio/dsync"
+
+// checkQuota returns a QuotaExceededError when the client already holds the maximum
+// number of locks, protecting the memory of the server from a client that leaks locks.
+// Must be called with the server mutex held.
+func (l *Server) checkQuota(node string) error {
+	if quota := l.tuned().quota; quota > 0 && l.held[node] >= quota {
+		return dsync.QuotaExceededError{Node: node, Quota: quota}
+	}
+	return nil
+}
+
+// trackGrant counts a lock granted to a client. Must be called with the server mutex held.
+func (l *Server) trackGrant(node string) {
+	if l.held == nil {
+		l.held = make(map[string]int)
+	}
+	l.held[node]++
+}
+
+// untrackGrant uncounts a lock from a client. Must be called with the server mutex held.
+func (l *Server) untrackGrant(node string) {
+	if l.held[node] <= 1 {
+		delete(l.held, node)
+	} else {
+		l.held[node]--
+	}
+}
+
+// trackRelease uncounts all given locks from the clients holding them. Must be called with the
+// server mutex held.
+func (l *Server) trackRelease(lri ...lockRequesterInfo) {
+	for _, entry := range lri {
+		l.untrackGrant(entry.source.Node)
+	}
+}
+
+// recountHeld recomputes the number of locks held per client, after the lock map has been replaced.
+// Must be called with all shards locked and the server mutex held.
+func (l *Server) recountHeld() {
+	l.held = make(map[string]int)
+	for _, s := range l.shards {
+		for _, lri := range s.lockMap {
+			for _, entry := range lri {
+				l.held[entry.source.Node]++
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Number of buckets above which buckets of idle clients are pruned
+const rateLimitPruneThreshold = 1024
+
+type tokenBucket struct {
+	tokens float64   // Tokens currently available
+	last   time.Time // Time at which tokens was last updated
+}
+
+// rateLimiter is a token bucket rate limiter keyed by client node, so that a single client
+// in a tight retry loop cannot monopolize the server at the expense of the other clients.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64 // Tokens added per second
+	burst   float64 // Maximum number of tokens in a bucket
+	buckets map[string]*tokenBucket
+}
+
+// newRateLimiter returns a rate limiter, or nil when rate is not positive (unlimited).
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of the client, returning false when none is available.
+func (r *rateLimiter) allow(client string, now time.Time) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if len(r.buckets) > rateLimitPruneThreshold {
+		r.prune(now)
+	}
+	b, ok := r.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: r.burst, last: now}
+		r.buckets[client] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * r.rate
+	}
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes the buckets that have filled up completely (idle clients).
+func (r *rateLimiter) prune(now time.Time) {
+	for client, b := range r.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, client)
+		}
+	}
+}
+
+// checkRateLimit returns an error when the client has exceeded its request rate.
+func (l *Server) checkRateLimit(client string) error {
+	if limiter := l.tuned().limiter; limiter != nil && !limiter.allow(client, l.now()) {
+		return fmt.Errorf("Rate limit exceeded for client: %s", client)
+	}
+	return nil
+}
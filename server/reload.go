@@ -0,0 +1,109 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// tunables - the settings of the configuration of a Server that Reconfigure changes while it runs.
+type tunables struct {
+	leaseTTL   time.Duration
+	maxReaders int
+	tokens     []string
+	rateLimit  float64
+	rateBurst  int
+	limiter    *rateLimiter // nil when lock requests are not rate limited
+	logger     dsync.Logger
+	quota      int
+	acl        *ACL
+}
+
+// newTunables returns the tunables of config, keeping the rate limiter of previous (if any) when
+// the rate limits have not changed, so that clients do not get a fresh burst on every reload.
+func newTunables(config Config, previous *tunables) *tunables {
+	t := &tunables{
+		leaseTTL:   config.LeaseTTL,
+		maxReaders: config.MaxReaders,
+		tokens:     append([]string(nil), config.Tokens...),
+		rateLimit:  config.RateLimit,
+		rateBurst:  config.RateBurst,
+		logger:     config.Logger,
+		quota:      config.Quota,
+		acl:        config.ACL,
+	}
+	if previous != nil && previous.rateLimit == t.rateLimit && previous.rateBurst == t.rateBurst {
+		t.limiter = previous.limiter
+	} else {
+		t.limiter = newRateLimiter(t.rateLimit, t.rateBurst)
+	}
+	return t
+}
+
+// tuned returns the current tunables of the server.
+func (l *Server) tuned() *tunables {
+	return l.tunables.Load().(*tunables)
+}
+
+// Reconfigure changes the tunables of the running server to those of config, keeping all locks
+// held: LeaseTTL, MaxReaders, Tokens, RateLimit, RateBurst, Logger, Quota and ACL, and the
+// Interval, SweepInterval, StaleAfter and Workers of Maintenance. Zero fields take their defaults, the other
+// fields of config are ignored (they only take effect on a restart). Leases already granted keep
+// their expiry, clients holding more locks than a lowered Quota keep them.
+func (l *Server) Reconfigure(config Config) error {
+	if config.Logger == nil {
+		config.Logger = discardLogger{}
+	}
+	config.Maintenance = config.Maintenance.withDefaults()
+	if err := config.validate(); err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	l.tunables.Store(newTunables(config, l.tuned()))
+	l.mutex.Unlock()
+	l.maintenance.reconfigure(config.Maintenance)
+
+	// Wake up the maintenance and sweep loops to wait for the new intervals
+	for _, ch := range []chan struct{}{l.reconfigured, l.resweep} {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	l.log(dsync.LogInfo, "Reconfigured", "leaseTTL", config.LeaseTTL, "maxReaders", config.MaxReaders, "rateLimit", config.RateLimit,
+		"maintenanceInterval", config.Maintenance.Interval, "sweepInterval", config.Maintenance.SweepInterval, "staleAfter", config.Maintenance.StaleAfter)
+	return nil
+}
+
+// Reload - rpc handler for reloading the configuration of the server with Config.Reloader, eg.
+// from its configuration file (see dsyncctl reload).
+func (l *Server) Reload(args *StatsArgs, reply *bool) error {
+	if err := l.validateAdminArgs(args); err != nil {
+		return err
+	}
+	if l.config.Reloader == nil {
+		return errors.New("Lock server does not support reloading its configuration")
+	}
+	if err := l.config.Reloader(); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Maximum time a reservation by PrepareLock or PrepareRLock is held unless committed
+const maxReservation = 10 * time.Second
+
+// PrepareLock - rpc handler for reserving a write lock, which conflicts with other locks like a
+// granted lock but lapses after args.Reservation unless committed with Commit.
+func (l *Server) PrepareLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	granted := l.stamp(reply)
+	reservation, err := reservationOf(args)
+	if err != nil {
+		return err
+	}
+	return l.lock(args, granted, reservation)
+}
+
+// PrepareRLock - rpc handler for reserving a read lock like PrepareLock.
+func (l *Server) PrepareRLock(args *dsync.LockArgs, reply *dsync.LockReply) error {
+	granted := l.stamp(reply)
+	reservation, err := reservationOf(args)
+	if err != nil {
+		return err
+	}
+	return l.rlock(args, granted, reservation)
+}
+
+func reservationOf(args *dsync.LockArgs) (time.Duration, error) {
+	if args.Reservation <= 0 {
+		return 0, fmt.Errorf("Reservation of lock requested without duration: %s", args.Name)
+	}
+	if args.Reservation > maxReservation {
+		return maxReservation, nil
+	}
+	return args.Reservation, nil
+}
+
+// Commit - rpc handler that turns the reservation with args.UID into a lock, replying false when
+// the reservation has lapsed (or was released) in the mean time.
+func (l *Server) Commit(args *dsync.LockArgs, reply *bool) error {
+	if err := l.authorizeTo(args, ACLLock); err != nil {
+		return err
+	}
+	key := lockKey{args.Namespace, args.Name}
+	s := l.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l.dropExpiredReservations(key)
+	lri := s.lockMap[key]
+	for idx := range lri {
+		if lri[idx].uid == args.UID {
+			if !lri[idx].reservedUntil.IsZero() { // Committing again (after a lost reply) is fine
+				lri[idx].reservedUntil = time.Time{}
+				lri[idx].leaseExpiry = l.newLeaseExpiry()
+				if l.wal != nil {
+					l.wal.logGrant(key, lri[idx])
+				}
+			}
+			*reply = true
+			return nil
+		}
+	}
+	*reply = false
+	return nil
+}
+
+// dropExpiredReservations releases the reservations on key that have lapsed without being
+// committed. Should be called with the mutex of the shard of key held.
+func (l *Server) dropExpiredReservations(key lockKey) {
+	s := l.shard(key)
+	now := l.now()
+	expired := []string{}
+	for _, entry := range s.lockMap[key] {
+		if !entry.reservedUntil.IsZero() && now.After(entry.reservedUntil) {
+			expired = append(expired, entry.uid)
+		}
+	}
+	for _, uid := range expired {
+		lri := s.lockMap[key]
+		l.removeEntry(key, uid, &lri, EventExpire)
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// RequestRevocation - rpc handler for a lock server of another node asking a client of this node to
+// release a lock within args.Grace (see dsync.RequestRevocation).
+func (l *Server) RequestRevocation(args *dsync.LockArgs, reply *bool) error {
+	if err := l.authorize(args); err != nil {
+		return err
+	}
+	*reply = dsync.RequestRevocation(args.Source, args.Namespace, args.Name, args.UID, args.Grace)
+	return nil
+}
+
+// RequestRelease asks the clients holding locks on name to release them within grace (through the
+// RequestRevocation handler of their node), releasing the locks that are still held forcibly once
+// grace has passed. Returns the number of locks that the clients are asked to release. Drain revokes
+// all locks this way, and policies preempting locks (eg. in favor of more important clients) call it.
+func (l *Server) RequestRelease(namespace, name string, grace time.Duration) int {
+	key := lockKey{namespace, name}
+	s := l.shard(key)
+	s.mutex.RLock()
+	var nlrips []nameLockRequesterInfoPair
+	for _, lri := range s.lockMap[key] {
+		nlrips = append(nlrips, nameLockRequesterInfoPair{key: key, lri: lri})
+	}
+	s.mutex.RUnlock()
+	l.revoke(nlrips, grace)
+	return len(nlrips)
+}
+
+// requestReleaseAll asks the clients holding locks to release them within grace, see RequestRelease.
+func (l *Server) requestReleaseAll(grace time.Duration) int {
+	var nlrips []nameLockRequesterInfoPair
+	for _, s := range l.shards {
+		s.mutex.RLock()
+		for key, lri := range s.lockMap {
+			for _, entry := range lri {
+				nlrips = append(nlrips, nameLockRequesterInfoPair{key: key, lri: entry})
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	l.revoke(nlrips, grace)
+	return len(nlrips)
+}
+
+// revoke asks the clients of the locks nlrips to release them within grace, and releases those that
+// are still held once grace has passed since all clients have been asked, in the background (until
+// Close is called). The clients are asked concurrently by (at most) as many goroutines as the lock
+// maintenance uses, each asking a single client for all of its locks.
+func (l *Server) revoke(nlrips []nameLockRequesterInfoPair, grace time.Duration) {
+	if len(nlrips) == 0 {
+		return
+	}
+	bySource := make(map[dsync.Identity][]nameLockRequesterInfoPair)
+	for _, nlrip := range nlrips {
+		bySource[nlrip.lri.source] = append(bySource[nlrip.lri.source], nlrip)
+	}
+	go func() {
+		forEachSource(l.ctx, bySource, l.maintenance.settings().Workers, func(source dsync.Identity, nlrips []nameLockRequesterInfoPair) {
+			l.askRelease(source, nlrips, grace)
+		})
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-l.config.Clock.After(grace):
+		}
+		for _, nlrip := range nlrips {
+			l.releaseRevoked(nlrip)
+		}
+	}()
+}
+
+// askRelease asks a single client to release its locks nlrips within grace, giving up on the
+// client on the first failure (its locks are released once grace has passed all the same).
+func (l *Server) askRelease(source dsync.Identity, nlrips []nameLockRequesterInfoPair, grace time.Duration) {
+	c, err := l.config.Resolver.Resolve(source)
+	for i := 0; err == nil && i < len(nlrips); i++ {
+		ctx, cancel := context.WithTimeout(l.ctx, drainNotifyTimeout)
+		args := dsync.LockArgs{Namespace: nlrips[i].key.namespace, Name: nlrips[i].key.name, UID: nlrips[i].lri.uid, Source: l.config.Self,
+			Epoch: l.config.Epoch, Version: dsync.ProtocolVersion, Grace: grace}
+		var asked bool
+		err = dsync.CallServer(ctx, c, "Dsync.RequestRevocation", &args, &asked)
+		cancel()
+	}
+	if err != nil {
+		l.log(dsync.LogWarn, "Unable to ask client to release locks", "node", source.Node, "locks", len(nlrips), "err", err)
+	}
+}
+
+// releaseRevoked releases a revoked lock unless its client released it in time.
+func (l *Server) releaseRevoked(nlrip nameLockRequesterInfoPair) {
+	s := l.shard(nlrip.key)
+	s.mutex.Lock()
+	lri, ok := s.lockMap[nlrip.key]
+	released := ok && l.removeEntry(nlrip.key, nlrip.lri.uid, &lri, EventRevoke)
+	s.mutex.Unlock()
+	if !released {
+		return // Released by its client in time
+	}
+	l.log(dsync.LogWarn, "Revoked lock not released in time, releasing it", "namespace", nlrip.key.namespace, "name", nlrip.key.name, "uid", nlrip.lri.uid, "node", nlrip.lri.source.Node)
+	m := l.maintenance
+	m.mutex.Lock()
+	m.stats.Revoked++
+	m.mutex.Unlock()
+	m.config.Hooks.OnPurged(nlrip.staleLock())
+}
@@ -0,0 +1,449 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package server implements a dsync lock server to embed into an application, serving the lock
+// handlers over net/rpc next to the application's own handlers:
+//
+//	s := server.New(server.Config{Self: dsync.Identity{Node: "10.0.0.1:9000", Path: dsync.RpcPath}})
+//	s.HandleHTTP(http.DefaultServeMux, dsync.RpcPath)
+//	s.Start()
+//	defer s.Close()
+//
+// It keeps the locks in memory (so they are lost on restart, which clients detect through the
+// incarnation of the server, unless persisted by OpenWAL), checks back with the clients holding
+// long lived locks whether they still hold them, and expires the leases of locks that are not
+// renewed (see Config).
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Config - configuration of a Server, zero fields take their defaults.
+//
+// MaxReaders is enforced by every server on its own, while a client holds a read lock once a read
+// quorum of the servers granted it: with n servers and a read quorum of r, up to MaxReaders*n/r
+// clients (twice MaxReaders with the default quorums of an even n) may hold read locks on a name at
+// once. To bound the readers of a name across the cluster to R, set MaxReaders to R*r/n rounded down,
+// which takes R to be at least n/r.
+type Config struct {
+	Self            dsync.Identity     // Identity of the server itself, announced to clients when draining
+	Incarnation     uint64             // Incarnation of this start of the server, time based when zero (see NextIncarnation)
+	Epoch           uint64             // Cluster configuration epoch, requests for any other epoch are rejected
+	LeaseTTL        time.Duration      // Lease for granted locks, renewed by lock maintenance (0 disables leases)
+	MaxReaders      int                // Maximum number of read locks held simultaneously per name on this server (0 is unlimited)
+	Tokens          []string           // Tokens that requests must carry, denied with a dsync.AccessDeniedError otherwise (any request when empty)
+	RateLimit       float64            // Lock requests per second granted to every client node (0 is unlimited)
+	RateBurst       int                // Lock requests a client node may make at once beyond RateLimit (1 when zero)
+	Maintenance     MaintenanceConfig  // Lock maintenance, checking long lived locks with their clients
+	Resolver        dsync.Resolver     // Resolves clients to call them back, a ClientPool dialing them over net/rpc when nil
+	Peers           []dsync.RPC        // The other lock servers, a quorum of which must agree before a stale lock is purged (none to purge right away)
+	Clock           dsync.Clock        // Source of the timestamps, leases and staleness checks of locks (the wall clock when nil)
+	Logger          dsync.Logger       // Receives the messages of the server (discarded when nil)
+	Reloader        func() error       // Reloads the configuration (see Reconfigure) when asked by the Reload handler, unsupported when nil
+	DisconnectGrace time.Duration      // Time after the connection a lock was granted over closes until the lock is released, unless its client confirms holding it (0 leaves it to lock maintenance)
+	Assume          func(uint64) error // Called with the incarnation of a departing server before assuming it (see ReceiveLocks), eg. to persist it
+	Quota           int                // Maximum number of locks held simultaneously per client node, denied with a dsync.QuotaExceededError beyond (0 is unlimited)
+	ACL             *ACL               // Access control per namespace, on top of Tokens (none when nil)
+	Sinks           []EventSink        // Receive all lock lifecycle events, eg. an AuditLog or a WebhookSink (see AddEventSink)
+}
+
+// validate verifies that the configuration is consistent.
+func (c Config) validate() error {
+	if c.LeaseTTL < 0 || c.MaxReaders < 0 || c.RateLimit < 0 || c.RateBurst < 0 || c.DisconnectGrace < 0 || c.Quota < 0 {
+		return errors.New("Server configuration must not be negative")
+	}
+	return c.Maintenance.validate(c.LeaseTTL)
+}
+
+// withDefaults returns the configuration with the zero fields set to their defaults.
+func (c Config) withDefaults() Config {
+	if c.Incarnation == 0 {
+		c.Incarnation = uint64(time.Now().UnixNano())
+	}
+	c.Maintenance = c.Maintenance.withDefaults()
+	if c.Resolver == nil {
+		c.Resolver = &ClientPool{}
+	}
+	if c.Clock == nil {
+		c.Clock = wallClock{}
+	}
+	if c.Logger == nil {
+		c.Logger = discardLogger{}
+	}
+	return c
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Log(level dsync.LogLevel, msg string, keysAndValues ...interface{}) {}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time                         { return time.Now() }
+func (wallClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (wallClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// Server - a lock server, whose exported methods with the signature of net/rpc handlers are the
+// lock handlers (see Register) and whose other exported methods control its lifecycle.
+type Server struct {
+	incarnation uint64       // Config.Incarnation, or the incarnation of the departing server assumed by ReceiveLocks (accessed atomically)
+	config      Config       // As passed to New, see tunables for the settings changed by Reconfigure
+	tunables    atomic.Value // *tunables
+
+	mutex       sync.RWMutex         // Guards the state of the server other than the locks themselves (see lockShard).
+	shards      []*lockShard         // Locks held, split by hash of their key.
+	draining    bool                 // Set when shutting down, no new locks are granted anymore.
+	readOnly    bool                 // Set by SetReadOnly, no new locks are granted while set.
+	handedOver  bool                 // Set while (and once) the locks are handed over to a replacement by Migrate, no requests are served.
+	receiving   bool                 // Set while receiving the locks of a departing server, no new locks are granted until done.
+	clients     map[string]string    // Rpc paths of all clients that have been granted locks, keyed by node.
+	held        map[string]int       // Number of locks currently held per client, keyed by node (see Config.Quota).
+	sinks       []EventSink          // Receivers of all lock lifecycle events.
+	granted     map[string]uint64    // Number of locks granted per namespace.
+	denied      map[string]uint64    // Number of admitted lock requests denied per namespace.
+	purged      map[string]uint64    // Number of locks purged, expired or revoked by the server per namespace.
+	wal         *lockWAL             // Write-ahead log of all changes to the lock map (nil when not persisted), set with all shards locked.
+	waiting     map[waiter]*waitInfo // Owners whose requests have been denied, for deadlock detection.
+	aborted     map[waiter]time.Time // Owners whose next request is aborted to break a deadlock.
+	maintenance *Maintenance
+	startTime   time.Time // Time at which the server was created.
+
+	ctx          context.Context // Done once Close is called, to stop the background goroutines
+	cancel       context.CancelFunc
+	stopped      sync.WaitGroup
+	started      bool
+	closed       bool
+	reconfigured chan struct{} // Wakes up the maintenance loop when its interval may have changed
+	resweep      chan struct{} // Wakes up the sweep loop when its interval may have changed
+
+	hangups map[*dsync.LockArgs]chan struct{} // Closed once the connection of a request that may be parked closes (see park).
+}
+
+// New returns a server without locks, it panics when the configuration is inconsistent.
+func New(config Config) *Server {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		panic(err)
+	}
+	l := &Server{
+		incarnation:  config.Incarnation,
+		config:       config,
+		shards:       newLockShards(),
+		startTime:    config.Clock.Now(),
+		sinks:        append([]EventSink(nil), config.Sinks...),
+		reconfigured: make(chan struct{}, 1),
+		resweep:      make(chan struct{}, 1),
+	}
+	l.tunables.Store(newTunables(config, nil))
+	l.ctx, l.cancel = context.WithCancel(context.Background())
+	l.maintenance = newMaintenance(l, config.Maintenance)
+	return l
+}
+
+// Incarnation returns the incarnation of the server, which clients pass with every request.
+func (l *Server) Incarnation() uint64 {
+	return atomic.LoadUint64(&l.incarnation)
+}
+
+// Maintenance returns the lock maintenance of the server.
+func (l *Server) Maintenance() *Maintenance {
+	return l.maintenance
+}
+
+// Register registers the lock handlers with server under the service name of dsync.
+func (l *Server) Register(server *rpc.Server) error {
+	return server.RegisterName("Dsync", l)
+}
+
+// HandleHTTP serves the lock handlers on mux at rpcPath, as dialed by dsync clients over net/rpc
+// (keeping track of the requests parked over every connection, and of the locks granted over it
+// when Config.DisconnectGrace is set).
+func (l *Server) HandleHTTP(mux *http.ServeMux, rpcPath string) error {
+	server := rpc.NewServer()
+	if err := l.Register(server); err != nil {
+		return err
+	}
+	mux.Handle(rpcPath, sessionHandler{l: l, server: server})
+	return nil
+}
+
+// Start runs a pass of the lock maintenance every Interval and a sweep of the expired leases every
+// SweepInterval in the background, until Close is called.
+func (l *Server) Start() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.started || l.closed {
+		return
+	}
+	l.started = true
+	l.stopped.Add(2)
+	go func() {
+		defer l.stopped.Done()
+		for {
+			select {
+			case <-l.ctx.Done():
+				return
+			case <-l.reconfigured:
+			case <-l.config.Clock.After(l.maintenance.settings().Interval):
+				l.maintenance.Run(l.ctx)
+			}
+		}
+	}()
+	go func() {
+		defer l.stopped.Done()
+		for {
+			select {
+			case <-l.ctx.Done():
+				return
+			case <-l.resweep:
+			case <-l.config.Clock.After(l.maintenance.settings().SweepInterval):
+				l.maintenance.SweepExpiredLeases()
+			}
+		}
+	}()
+}
+
+// Close stops the background goroutines and releases all locks, without notifying the clients
+// (see Drain). The locks remain in the write-ahead log (if any), to be reloaded on the next start.
+func (l *Server) Close() error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed, l.draining = true, true
+	l.cancel()
+	l.mutex.Unlock()
+	l.stopped.Wait()
+
+	l.lockAll()
+	for _, s := range l.shards {
+		for key := range s.lockMap {
+			s.notifyWaiters(key)
+		}
+		s.lockMap = make(map[lockKey][]lockRequesterInfo)
+	}
+	l.mutex.Lock()
+	l.held = nil
+	wal := l.wal
+	l.wal = nil
+	l.mutex.Unlock()
+	l.unlockAll()
+	if wal != nil {
+		return wal.Close()
+	}
+	return nil
+}
+
+// validateLockArgs must be called with the server mutex held.
+func (l *Server) validateLockArgs(args *dsync.LockArgs) error {
+	if l.handedOver {
+		return errHandedOver
+	}
+	if err := l.validateRequest(args.Token, args.Namespace, args.Version, args.Incarnation, args.Epoch); err != nil {
+		return err
+	}
+	args.Upgrade()
+	return nil
+}
+
+// validateRequest checks the token of a request and the protocol version, incarnation and epoch it
+// is addressed to.
+func (l *Server) validateRequest(token, namespace string, version uint32, incarnation, epoch uint64) error {
+	if err := l.authenticate(token, namespace); err != nil {
+		return err
+	}
+	if err := dsync.CheckVersion(version); err != nil {
+		return err
+	}
+	if err := dsync.CheckIncarnation(l.Incarnation(), incarnation); err != nil {
+		return err
+	}
+	if l.config.Epoch != epoch {
+		return dsync.EpochMismatchError{ServerEpoch: l.config.Epoch, ClientEpoch: epoch}
+	}
+	return nil
+}
+
+// stamp stamps the reply to a request acquiring a lock with the epoch of the server, returning
+// the flag to set to whether the lock was granted.
+func (l *Server) stamp(reply *dsync.LockReply) *bool {
+	reply.Epoch = l.config.Epoch
+	return &reply.Granted
+}
+
+// authenticate checks that a request carries one of the tokens of the configuration.
+func (l *Server) authenticate(token, namespace string) error {
+	tokens := l.tuned().tokens
+	if len(tokens) == 0 {
+		return nil
+	}
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return dsync.AccessDeniedError{Operation: "use the lock server", Namespace: namespace}
+}
+
+// authorize validates a request. Takes the server mutex.
+func (l *Server) authorize(args *dsync.LockArgs) error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.validateLockArgs(args)
+}
+
+// authorizeTo validates a request and checks that the ACL allows it to perform operation. Takes
+// the server mutex.
+func (l *Server) authorizeTo(args *dsync.LockArgs, operation string) error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if err := l.validateLockArgs(args); err != nil {
+		return err
+	}
+	return l.checkACL(args.Token, args.Namespace, operation)
+}
+
+// admit checks whether a lock request for keys may be considered at all, returning false (without
+// an error) when shutting down, read-only or receiving the locks of a departing server. An admitted
+// request counts against the quota of the client for every key until recordRequest (or
+// recordRegrant) is called for it. Takes the server mutex.
+func (l *Server) admit(args *dsync.LockArgs, keys ...lockKey) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err := l.validateLockArgs(args); err != nil {
+		return false, err
+	}
+	if err := l.checkACL(args.Token, args.Namespace, ACLLock); err != nil {
+		return false, err
+	}
+	if err := l.checkRateLimit(args.Source.Node); err != nil {
+		return false, err
+	}
+	if !l.granting() {
+		return false, nil
+	}
+	for i, key := range keys {
+		err := l.checkQuota(args.Source.Node)
+		if err == nil {
+			err = l.checkAborted(ownerOf(args), key)
+		}
+		if err != nil {
+			for range keys[:i] {
+				l.untrackGrant(args.Source.Node)
+			}
+			return false, err
+		}
+		l.trackGrant(args.Source.Node) // Reserve quota, so concurrent requests on other shards cannot exceed it
+	}
+	return true, nil
+}
+
+// recordRequest records the outcome of an admitted lock request for key: a grant is reported and
+// the client remembered, a denial releases the quota reserved by admit. Takes the server mutex.
+func (l *Server) recordRequest(args *dsync.LockArgs, key lockKey, lri lockRequesterInfo, granted bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if granted {
+		l.recordEvent(EventGrant, key, lri)
+		l.registerClient(args.Source)
+	} else {
+		l.trackRelease(lri)
+		l.denied = countNamespace(l.denied, key.namespace)
+	}
+	l.trackWait(ownerOf(args), key, granted)
+}
+
+// recordRegrant records the outcome of an admitted retry of a lock request granted before,
+// releasing the quota reserved by admit as the lock is held already. Takes the server mutex.
+func (l *Server) recordRegrant(args *dsync.LockArgs, key lockKey, lri lockRequesterInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.trackRelease(lri)
+	l.trackWait(ownerOf(args), key, true)
+}
+
+// recordRelease reports released locks and uncounts them from their clients. Takes the server mutex.
+func (l *Server) recordRelease(event string, key lockKey, lri ...lockRequesterInfo) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, entry := range lri {
+		l.recordEvent(event, key, entry)
+	}
+	l.trackRelease(lri...)
+}
+
+// isGranting returns whether the server grants new locks, that is it is neither shutting down nor
+// read-only nor migrating its locks. Takes the server mutex.
+func (l *Server) isGranting() bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.granting()
+}
+
+// granting must be called with the server mutex held, see isGranting.
+func (l *Server) granting() bool {
+	return !l.draining && !l.readOnly && !l.handedOver && !l.receiving
+}
+
+// registerClient remembers a client that has been granted a lock, so it can be notified on shutdown.
+// Must be called with the server mutex held.
+func (l *Server) registerClient(source dsync.Identity) {
+	if source.Node == "" {
+		return
+	}
+	if l.clients == nil {
+		l.clients = make(map[string]string)
+	}
+	l.clients[source.Node] = source.Path
+}
+
+// now returns the time of the clock of the server.
+func (l *Server) now() time.Time {
+	return l.config.Clock.Now()
+}
+
+// elapsedSince returns the time elapsed since t, zero rather than a negative duration when the
+// clock has been set back.
+func (l *Server) elapsedSince(t time.Time) time.Duration {
+	if d := l.now().Sub(t); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// newLeaseExpiry returns the expiry time for a lease granted now (zero when leases are disabled)
+func (l *Server) newLeaseExpiry() time.Time {
+	ttl := l.tuned().leaseTTL
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return l.now().Add(ttl)
+}
+
+func (l *Server) log(level dsync.LogLevel, msg string, keysAndValues ...interface{}) {
+	l.tuned().logger.Log(level, msg, keysAndValues...)
+}
@@ -0,0 +1,322 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/gob"
+	"io"
+	"net/http"
+	"net/rpc"
+	"sync"
+
+	"github.com/minio/dsync"
+)
+
+// Handlers granting a lock when replying true (true) or releasing one (false), under the uid of the request
+var sessionMethods = map[string]bool{
+	"Dsync.Lock":         true,
+	"Dsync.RLock":        true,
+	"Dsync.LockWait":     true,
+	"Dsync.RLockWait":    true,
+	"Dsync.PrepareLock":  true,
+	"Dsync.PrepareRLock": true,
+	"Dsync.Unlock":       false,
+	"Dsync.RUnlock":      false,
+}
+
+// Handlers parking a request until a lock is released (see park), which give up once the
+// connection of the request closes
+var parkingMethods = map[string]bool{
+	"Dsync.LockWait":  true,
+	"Dsync.RLockWait": true,
+	"Dsync.Watch":     true,
+}
+
+// Number of locks granted over a connection above which those no longer held are forgotten
+const sessionCompactSize = 1024
+
+// sessionLock identifies a lock granted over a connection.
+type sessionLock struct {
+	key lockKey
+	uid string
+}
+
+// sessionRequest is a request granting or releasing a lock that is being served.
+type sessionRequest struct {
+	args     *dsync.LockArgs // As upgraded by the handler once served (see dsync.LockArgs.Upgrade)
+	granting bool
+}
+
+// sessionCodec is the gob codec of net/rpc that keeps track of the requests parked over the
+// connection, so that they give up waiting once the connection closes, and of the locks granted
+// over it, so that they can be checked once the connection closes (see Config.DisconnectGrace).
+type sessionCodec struct {
+	server *Server
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+
+	mutex     sync.Mutex
+	header    rpc.Request                    // Header of the request whose body is read next
+	pending   map[uint64]sessionRequest      // Requests granting or releasing a lock being served, by sequence number
+	granted   map[sessionLock]dsync.Identity // Clients of the locks granted over the connection (and not released over it)
+	compactAt int                            // Number of granted locks at which those no longer held are forgotten
+	hangup    chan struct{}                  // Closed once the connection closes, waking up the requests parked over it
+	hungUp    bool
+	closed    bool
+}
+
+func newSessionCodec(server *Server, rwc io.ReadWriteCloser) *sessionCodec {
+	buf := bufio.NewWriter(rwc)
+	return &sessionCodec{
+		server:    server,
+		rwc:       rwc,
+		dec:       gob.NewDecoder(rwc),
+		enc:       gob.NewEncoder(buf),
+		encBuf:    buf,
+		pending:   make(map[uint64]sessionRequest),
+		granted:   make(map[sessionLock]dsync.Identity),
+		compactAt: sessionCompactSize,
+		hangup:    make(chan struct{}),
+	}
+}
+
+func (c *sessionCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		// The connection closed (or broke), net/rpc only closes the codec once the requests being
+		// served have returned, so wake up those parked first
+		c.hangUp()
+		return err
+	}
+	c.mutex.Lock()
+	c.header = *r
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *sessionCodec) ReadRequestBody(body interface{}) error {
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	// net/rpc reads the body of a request right after its header, before serving it
+	if args, ok := body.(*dsync.LockArgs); ok {
+		c.mutex.Lock()
+		if granting, ok := sessionMethods[c.header.ServiceMethod]; ok && c.server.config.DisconnectGrace > 0 {
+			c.pending[c.header.Seq] = sessionRequest{args: args, granting: granting}
+		}
+		if parkingMethods[c.header.ServiceMethod] {
+			c.server.parkOn(args, c.hangup)
+		}
+		c.mutex.Unlock()
+	}
+	return nil
+}
+
+func (c *sessionCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	c.mutex.Lock()
+	if req, ok := c.pending[r.Seq]; ok {
+		delete(c.pending, r.Seq)
+		lock := sessionLock{key: lockKey{req.args.Namespace, req.args.Name}, uid: req.args.UID}
+		ok, _ := body.(*bool)
+		if reply, _ := body.(*dsync.LockReply); reply != nil {
+			ok = &reply.Granted
+		}
+		if ok != nil && *ok && r.Error == "" {
+			if c.closed && req.granting {
+				// Granted while the connection closed, so check it like the others
+				c.server.disconnected(map[sessionLock]dsync.Identity{lock: req.args.Source})
+			} else if req.granting {
+				c.granted[lock] = req.args.Source
+			} else {
+				delete(c.granted, lock)
+			}
+		}
+		if len(c.granted) >= c.compactAt {
+			c.compact()
+		}
+	}
+	c.mutex.Unlock()
+
+	if err := c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close() // Gob could not encode the header, should not happen
+		}
+		return err
+	}
+	if err := c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close() // Gob could not encode the body, should not happen
+		}
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+// compact forgets the granted locks that are no longer held (eg. purged by lock maintenance), must
+// be called with the mutex of the codec held.
+func (c *sessionCodec) compact() {
+	for lock, source := range c.granted {
+		if len(c.server.heldEntries(map[sessionLock]dsync.Identity{lock: source})) == 0 {
+			delete(c.granted, lock)
+		}
+	}
+	c.compactAt = 2 * len(c.granted)
+	if c.compactAt < sessionCompactSize {
+		c.compactAt = sessionCompactSize
+	}
+}
+
+// hangUp wakes up the requests parked over the connection, as it has closed.
+func (c *sessionCodec) hangUp() {
+	c.mutex.Lock()
+	if !c.hungUp {
+		c.hungUp = true
+		close(c.hangup)
+	}
+	c.mutex.Unlock()
+}
+
+func (c *sessionCodec) Close() error {
+	c.hangUp()
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	granted := c.granted
+	c.granted = nil
+	c.mutex.Unlock()
+	c.server.disconnected(granted)
+	return c.rwc.Close()
+}
+
+// ServeConn serves the lock handlers on a single connection (eg. accepted by a listener of the
+// application), like rpc.ServeConn but keeping track of the requests parked over the connection,
+// and of the locks granted over it when Config.DisconnectGrace is set.
+func (l *Server) ServeConn(conn io.ReadWriteCloser) {
+	server := rpc.NewServer()
+	if err := l.Register(server); err != nil {
+		conn.Close()
+		return
+	}
+	l.serveConn(server, conn)
+}
+
+func (l *Server) serveConn(server *rpc.Server, conn io.ReadWriteCloser) {
+	server.ServeCodec(newSessionCodec(l, conn))
+}
+
+// sessionHandler serves the lock handlers over connections hijacked from HTTP CONNECT requests,
+// as rpc.Server does but keeping track of the requests parked and locks granted over every connection.
+type sessionHandler struct {
+	l      *Server
+	server *rpc.Server
+}
+
+func (h sessionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection cannot be hijacked", http.StatusInternalServerError)
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		h.l.log(dsync.LogWarn, "Unable to hijack connection", "remote", req.RemoteAddr, "err", err)
+		return
+	}
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	h.l.serveConn(h.server, conn)
+}
+
+// heldEntries returns the entries of the locks that are still held, other than persistent locks
+// (which outlive their client by design). Takes the mutexes of the shards.
+func (l *Server) heldEntries(locks map[sessionLock]dsync.Identity) []nameLockRequesterInfoPair {
+	var held []nameLockRequesterInfoPair
+	for lock, source := range locks {
+		s := l.shard(lock.key)
+		s.mutex.RLock()
+		for _, lri := range s.lockMap[lock.key] {
+			if lri.uid == lock.uid && lri.source == source && !lri.persistent {
+				held = append(held, nameLockRequesterInfoPair{key: lock.key, lri: lri})
+			}
+		}
+		s.mutex.RUnlock()
+	}
+	return held
+}
+
+// disconnected checks the locks granted over a connection that closed with their clients after
+// Config.DisconnectGrace, releasing those that the clients do not confirm to hold (rather than
+// leaving them to the lock maintenance, which only checks them once they are StaleAfter old).
+func (l *Server) disconnected(granted map[sessionLock]dsync.Identity) {
+	if len(granted) == 0 {
+		return
+	}
+	go func() {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-l.config.Clock.After(l.config.DisconnectGrace):
+		}
+		bySource := make(map[dsync.Identity][]nameLockRequesterInfoPair)
+		for _, nlrip := range l.heldEntries(granted) {
+			bySource[nlrip.lri.source] = append(bySource[nlrip.lri.source], nlrip)
+		}
+		for source, nlrips := range bySource {
+			l.checkDisconnected(l.ctx, source, nlrips)
+		}
+	}()
+}
+
+// checkDisconnected releases the locks of a client whose connection closed, unless the client
+// confirms holding them.
+func (l *Server) checkDisconnected(ctx context.Context, source dsync.Identity, nlrips []nameLockRequesterInfoPair) {
+	m := l.maintenance
+	locks := make([]StaleLock, len(nlrips))
+	for i, nlrip := range nlrips {
+		locks[i] = nlrip.staleLock()
+	}
+	verdicts := m.settings().Verifier.Verify(ctx, source, locks)
+	var released []nameLockRequesterInfoPair
+	for i, nlrip := range nlrips {
+		s := l.shard(nlrip.key)
+		s.mutex.Lock()
+		if i < len(verdicts) && verdicts[i] == Held {
+			l.renewLease(nlrip)
+		} else if lri, ok := s.lockMap[nlrip.key]; ok && l.removeEntry(nlrip.key, nlrip.lri.uid, &lri, EventPurge) {
+			l.log(dsync.LogInfo, "Released lock of closed connection", "namespace", nlrip.key.namespace, "name", nlrip.key.name, "uid", nlrip.lri.uid, "node", source.Node)
+			released = append(released, nlrip)
+		}
+		s.mutex.Unlock()
+	}
+	m.mutex.Lock()
+	m.stats.Disconnected += int64(len(released))
+	m.mutex.Unlock()
+	for _, nlrip := range released {
+		m.config.Hooks.OnPurged(nlrip.staleLock())
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Number of shards the lock map is split into
+const lockShardCount = 32
+
+// Time during which a processed unlock is remembered, covering the first retries of a client
+// whose reply to the unlock was lost
+const unlockDedupWindow = 5 * time.Minute
+
+// Maximum number of processed unlocks remembered per shard, the oldest are forgotten beyond (before
+// unlockDedupWindow has passed) so that a burst of unlocks cannot grow the memory of the server
+const unlockDedupMax = 4096
+
+// lockShard holds the locks (and parked requests) for the subset of keys that hash to it, so
+// that requests for unrelated keys do not serialize on a single mutex. When both are needed,
+// the mutex of a shard is taken before (never after) the server mutex. Requests that only inspect
+// the locks take read locks, so they do not hold up requests granting or releasing locks.
+type lockShard struct {
+	mutex   sync.RWMutex
+	lockMap map[lockKey][]lockRequesterInfo
+	waiters map[lockKey]chan struct{} // Channels closed upon the next release of a lock, for parked requests.
+	parked  map[lockKey]int           // Number of requests currently parked per lock.
+
+	unlocked map[processedUnlock]time.Time // Unlocks processed recently, so that retries of them succeed.
+	unlocks  []recordedUnlock              // Unlocks in the order processed, to forget the oldest first.
+}
+
+func newLockShards() []*lockShard {
+	shards := make([]*lockShard, lockShardCount)
+	for i := range shards {
+		shards[i] = &lockShard{lockMap: make(map[lockKey][]lockRequesterInfo)}
+	}
+	return shards
+}
+
+// shard returns the shard holding the locks for key.
+func (l *Server) shard(key lockKey) *lockShard {
+	return l.shards[l.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard holding the locks for key.
+func (l *Server) shardIndex(key lockKey) int {
+	h := fnv.New32a()
+	h.Write([]byte(key.namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(key.name))
+	return int(h.Sum32() % uint32(len(l.shards)))
+}
+
+// lockAll takes the mutexes of all shards (in order), for operations on the lock map as a whole.
+func (l *Server) lockAll() {
+	for _, s := range l.shards {
+		s.mutex.Lock()
+	}
+}
+
+func (l *Server) unlockAll() {
+	for _, s := range l.shards {
+		s.mutex.Unlock()
+	}
+}
+
+// rlockAll takes the read mutexes of all shards (in order), for consistent reads of the lock map as a whole.
+func (l *Server) rlockAll() {
+	for _, s := range l.shards {
+		s.mutex.RLock()
+	}
+}
+
+func (l *Server) runlockAll() {
+	for _, s := range l.shards {
+		s.mutex.RUnlock()
+	}
+}
+
+// replaceLockMap distributes the locks of lockMap over the shards, replacing all locks held. Must
+// be called with all shards locked.
+func (l *Server) replaceLockMap(lockMap map[lockKey][]lockRequesterInfo) {
+	for _, s := range l.shards {
+		s.lockMap = make(map[lockKey][]lockRequesterInfo)
+	}
+	for key, lri := range lockMap {
+		l.shard(key).lockMap[key] = lri
+	}
+}
+
+// countLockedNames returns the number of names on which locks are held.
+func (l *Server) countLockedNames() int {
+	count := 0
+	for _, s := range l.shards {
+		s.mutex.RLock()
+		count += len(s.lockMap)
+		s.mutex.RUnlock()
+	}
+	return count
+}
+
+// processedUnlock identifies an unlock (or read unlock) request by the lock and uid it released.
+type processedUnlock struct {
+	key    lockKey
+	uid    string
+	writer bool
+}
+
+// recordedUnlock is an unlock along with the time at which it was processed.
+type recordedUnlock struct {
+	unlock processedUnlock
+	time   time.Time
+}
+
+// unlockProcessed returns whether the unlock of uid has been processed recently, in which case
+// a repeated request is a retry that should succeed again rather than fail on the lock being
+// gone. Should be called with the mutex of the shard held.
+func (s *lockShard) unlockProcessed(key lockKey, uid string, writer bool) bool {
+	t, ok := s.unlocked[processedUnlock{key, uid, writer}]
+	return ok && time.Since(t) < unlockDedupWindow
+}
+
+// recordUnlock remembers that the unlock of uid has been processed, forgetting about unlocks
+// that are older than unlockDedupWindow or beyond the unlockDedupMax most recent ones. Should be
+// called with the mutex of the shard held.
+func (s *lockShard) recordUnlock(key lockKey, uid string, writer bool) {
+	now := time.Now()
+	if s.unlocked == nil {
+		s.unlocked = make(map[processedUnlock]time.Time)
+	}
+	p := processedUnlock{key, uid, writer}
+	s.unlocked[p] = now
+	s.unlocks = append(s.unlocks, recordedUnlock{p, now})
+	for len(s.unlocks) > unlockDedupMax || len(s.unlocks) > 0 && now.Sub(s.unlocks[0].time) >= unlockDedupWindow {
+		oldest := s.unlocks[0]
+		if s.unlocked[oldest.unlock] == oldest.time { // Unless processed again since
+			delete(s.unlocked, oldest.unlock)
+		}
+		s.unlocks[0] = recordedUnlock{}
+		s.unlocks = s.unlocks[1:]
+	}
+}
+
+// holds returns whether uid holds a lock (a write lock when writer) on key already, in which
+// case a repeated lock request is a retry whose reply was lost that should be granted again
+// rather than hold the name twice. Should be called with the mutex of the shard held.
+func (s *lockShard) holds(key lockKey, uid string, writer bool) bool {
+	for _, entry := range s.lockMap[key] {
+		if entry.uid == uid && entry.writer == writer {
+			return true
+		}
+	}
+	return false
+}
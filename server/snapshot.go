@@ -0,0 +1,182 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Version of the serialized form of a snapshot, to be raised on any incompatible change.
+const lockSnapshotVersion = 2
+
+// lockSnapshot is the serialized form of the state of a lock server.
+type lockSnapshot struct {
+	Version     int            `json:"version"`
+	Incarnation uint64         `json:"incarnation"` // Incarnation of the server the snapshot was taken from
+	Taken       time.Time      `json:"taken"`       // Time at which the snapshot was taken
+	Locks       []snapshotLock `json:"locks"`
+}
+
+type snapshotLock struct {
+	Namespace  string     `json:"namespace,omitempty"`
+	Name       string     `json:"name"`
+	Writer     bool       `json:"writer"`
+	Node       string     `json:"node"`
+	RPCPath    string     `json:"rpcPath"`
+	Owner      string     `json:"owner,omitempty"`
+	UID        string     `json:"uid"`
+	Timestamp  time.Time  `json:"timestamp"`
+	Retainable bool       `json:"retainable,omitempty"`
+	Persistent bool       `json:"persistent,omitempty"`
+	Recovery   []byte     `json:"recovery,omitempty"` // Hash of the recovery token of a persistent lock
+	Expiry     *time.Time `json:"expiry,omitempty"`   // Expiry of a persistent lock, the leases of other locks start afresh on restore
+}
+
+// Snapshot returns a point-in-time serialized copy of the lock map (and server incarnation), to
+// back up the server or to Restore on a replacement. Reservations that have not been committed
+// are left out. The write-ahead log (if any) is compacted to the locks of the snapshot.
+func (l *Server) Snapshot() ([]byte, error) {
+	l.rlockAll()
+	snap := lockSnapshot{
+		Version:     lockSnapshotVersion,
+		Incarnation: l.Incarnation(),
+		Taken:       l.now().UTC(),
+		Locks:       []snapshotLock{},
+	}
+	for _, s := range l.shards {
+		for key, lri := range s.lockMap {
+			for _, entry := range lri {
+				if !entry.reservedUntil.IsZero() {
+					continue // Not committed (yet)
+				}
+				sl := snapshotLock{
+					Namespace:  key.namespace,
+					Name:       key.name,
+					Writer:     entry.writer,
+					Node:       entry.source.Node,
+					RPCPath:    entry.source.Path,
+					Owner:      entry.owner,
+					UID:        entry.uid,
+					Timestamp:  entry.timestamp.UTC(),
+					Retainable: entry.retainable,
+					Persistent: entry.persistent,
+					Recovery:   entry.recovery,
+				}
+				if entry.persistent {
+					expiry := entry.leaseExpiry.UTC()
+					sl.Expiry = &expiry
+				}
+				snap.Locks = append(snap.Locks, sl)
+			}
+		}
+	}
+	if l.wal != nil {
+		// No records are appended meanwhile, as they are only appended with the mutex of a shard held
+		lockMap := make(map[lockKey][]lockRequesterInfo)
+		for _, s := range l.shards {
+			for key, lri := range s.lockMap {
+				lockMap[key] = lri
+			}
+		}
+		if err := l.wal.rewrite(snap.Incarnation, lockMap); err != nil {
+			l.log(dsync.LogError, "Unable to compact write-ahead log", "err", err)
+		}
+	}
+	l.runlockAll()
+
+	return json.MarshalIndent(&snap, "", "  ")
+}
+
+// Restore replaces the lock map (and server incarnation) with the contents of a snapshot,
+// so that a replacement server can take over the locks of the server it replaces. Snapshots of
+// version 1 (without an incarnation) keep the incarnation of this server. The restored
+// locks are written to the write-ahead log (if any).
+func (l *Server) Restore(data []byte) error {
+	var snap lockSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	switch snap.Version {
+	case lockSnapshotVersion:
+	case 1:
+		// Taken before servers had incarnations, so its clients cannot tell this server from the one
+		// the snapshot was taken from anyway: the locks are restored under the incarnation of this server
+		snap.Incarnation = l.Incarnation()
+		l.log(dsync.LogWarn, "Restoring snapshot of version 1 under the incarnation of this server")
+	default:
+		return fmt.Errorf("Unsupported snapshot version %d (expected %d)", snap.Version, lockSnapshotVersion)
+	}
+
+	now := l.now()
+	lockMap := make(map[lockKey][]lockRequesterInfo)
+	for _, sl := range snap.Locks {
+		key := lockKey{sl.Namespace, sl.Name}
+		entry := lockRequesterInfo{
+			writer:        sl.Writer,
+			source:        dsync.Identity{Node: sl.Node, Path: sl.RPCPath},
+			owner:         sl.Owner,
+			uid:           sl.UID,
+			timestamp:     sl.Timestamp,
+			timeLastCheck: now,
+			leaseExpiry:   l.newLeaseExpiry(),
+			retainable:    sl.Retainable,
+			persistent:    sl.Persistent,
+			recovery:      sl.Recovery,
+		}
+		if sl.Expiry != nil {
+			entry.leaseExpiry = *sl.Expiry
+		}
+		if entry.writer && len(lockMap[key]) > 0 || !entry.writer && isWriteLock(lockMap[key]) {
+			return fmt.Errorf("Snapshot holds conflicting locks for: %s", key)
+		}
+		lockMap[key] = append(lockMap[key], entry)
+	}
+
+	l.lockAll()
+	defer l.unlockAll()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.wal != nil {
+		l.wal.logIncarnation(snap.Incarnation)
+	}
+	for _, s := range l.shards {
+		for key := range s.lockMap {
+			if l.wal != nil {
+				l.wal.logForce(key)
+			}
+			s.notifyWaiters(key)
+		}
+	}
+	for key, lri := range lockMap {
+		for _, entry := range lri {
+			if l.wal != nil {
+				l.wal.logGrant(key, entry)
+			}
+			l.registerClient(entry.source)
+		}
+	}
+	l.replaceLockMap(lockMap)
+	l.recountHeld()
+	atomic.StoreUint64(&l.incarnation, snap.Incarnation)
+	l.log(dsync.LogInfo, "Restored locks from snapshot", "locks", len(snap.Locks), "incarnation", snap.Incarnation, "taken", snap.Taken)
+	return nil
+}
@@ -0,0 +1,194 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/minio/dsync"
+)
+
+// CallbackVerifier - a Verifier asking the client itself whether its locks are still held, with
+// the ExpiredBatch handler of the client (in batches of at most dsync.MaxExpiredBatchEntries locks)
+// or lock by lock with its Expired handler when it predates batching.
+type CallbackVerifier struct {
+	Resolver dsync.Resolver // Resolves the client to call it back
+	Epoch    uint64         // Cluster configuration epoch of the requests
+}
+
+// Verify returns the verdicts of the client, Unverified for all locks of a client that serves no
+// callbacks (whose locks are only freed once their lease expires).
+func (v *CallbackVerifier) Verify(ctx context.Context, source dsync.Identity, locks []StaleLock) []Verdict {
+	verdicts := make([]Verdict, len(locks))
+	c, err := v.Resolver.Resolve(source)
+	if err != nil {
+		return verdicts
+	}
+	for start := 0; start < len(locks); start += dsync.MaxExpiredBatchEntries {
+		end := start + dsync.MaxExpiredBatchEntries
+		if end > len(locks) {
+			end = len(locks)
+		}
+		v.verifyBatch(ctx, c, locks[start:end], verdicts[start:end])
+	}
+	return verdicts
+}
+
+// verifyBatch checks a batch of locks with the client c, setting their verdicts.
+func (v *CallbackVerifier) verifyBatch(ctx context.Context, c dsync.RPC, locks []StaleLock, verdicts []Verdict) {
+	args := dsync.ExpiredBatchArgs{Epoch: v.Epoch, Version: dsync.ProtocolVersion}
+	for _, lock := range locks {
+		args.Entries = append(args.Entries, dsync.ExpiredEntry{Namespace: lock.Namespace, Name: lock.Name, UID: lock.UID})
+	}
+	var reply dsync.ExpiredBatchReply
+	if err := dsync.CallServer(ctx, c, "Dsync.ExpiredBatch", &args, &reply); err == nil {
+		for i := range locks {
+			verdicts[i] = Held
+			if reply.IsExpired(i) {
+				verdicts[i] = Expired
+			}
+		}
+		return
+	}
+
+	// The client may predate batching, so fall back to checking lock by lock
+	for i, lock := range locks {
+		var expired bool
+		err := dsync.CallServer(ctx, c, "Dsync.Expired", &dsync.LockArgs{
+			Namespace: lock.Namespace,
+			Name:      lock.Name,
+			UID:       lock.UID,
+			Epoch:     v.Epoch,
+			Version:   dsync.ProtocolVersion,
+		}, &expired)
+		switch {
+		case err != nil:
+			verdicts[i] = Unverified // Retried on the next pass
+		case expired:
+			verdicts[i] = Expired
+		default:
+			verdicts[i] = Held
+		}
+	}
+}
+
+// QuorumVerifier - a Verifier confirming the locks that another Verifier finds expired with the
+// other lock servers, through their ConfirmExpired handler, rather than trusting a single answer.
+// Only the lock servers holding a lock vote on it, each on what it found itself, and only the locks
+// that a quorum of them (including this one) agrees upon are Expired, the others are Unconfirmed.
+// A lock found expired for the first time is Expired without confirmation, as it is only marked
+// suspect, so that the peers get to find it expired by themselves before it is purged.
+type QuorumVerifier struct {
+	Verifier Verifier    // Verifies the locks in the first place
+	Peers    []dsync.RPC // The other lock servers (every lock is confirmed right away without any)
+	Epoch    uint64      // Cluster configuration epoch of the requests
+}
+
+func (v *QuorumVerifier) Verify(ctx context.Context, source dsync.Identity, locks []StaleLock) []Verdict {
+	verdicts := v.Verifier.Verify(ctx, source, locks)
+	var expired []int // Index into locks of the suspect locks found expired again, to be purged
+	for i, verdict := range verdicts {
+		if verdict == Expired && locks[i].Suspect {
+			expired = append(expired, i)
+		}
+	}
+	if len(expired) == 0 || len(v.Peers) == 0 {
+		return verdicts
+	}
+
+	args := dsync.ConfirmExpiredArgs{Source: source, Epoch: v.Epoch, Version: dsync.ProtocolVersion}
+	for _, i := range expired {
+		args.Entries = append(args.Entries, dsync.ExpiredEntry{Namespace: locks[i].Namespace, Name: locks[i].Name})
+	}
+	votes := make([]int, len(expired))
+	holders := make([]int, len(expired))
+	for j := range holders {
+		holders[j] = len(v.Peers) + 1
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range v.Peers {
+		wg.Add(1)
+		go func(c dsync.RPC) {
+			defer wg.Done()
+			// Copy the arguments as they are stamped per call
+			peerArgs := args
+			var reply dsync.ConfirmExpiredReply
+			if err := dsync.CallServer(ctx, c, "Dsync.ConfirmExpired", &peerArgs, &reply); err != nil {
+				return // An unreachable peer counts as a holder that does not agree
+			}
+			mutex.Lock()
+			for j := range votes {
+				if reply.IsNotHeld(j) {
+					holders[j]--
+				} else if reply.IsExpired(j) {
+					votes[j]++
+				}
+			}
+			mutex.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	for j, i := range expired {
+		if votes[j]+1 < holders[j]/2+1 { // This server agrees, having found the lock expired twice
+			verdicts[i] = Unconfirmed
+		}
+	}
+	return verdicts
+}
+
+// ConfirmExpired - rpc handler by which a peer asks whether this server agrees that locks of a
+// client are stale (see QuorumVerifier). The vote is based on what this server found by itself,
+// without asking the client again: an entry is agreed upon when all of the locks this server holds
+// on the name for the client have been found expired by its lock maintenance (are suspect) or have
+// an expired lease. This server abstains on the entries for which it holds no such lock.
+func (l *Server) ConfirmExpired(args *dsync.ConfirmExpiredArgs, reply *dsync.ConfirmExpiredReply) error {
+	l.mutex.RLock()
+	err := l.validateRequest(args.Token, "", args.Version, args.Incarnation, args.Epoch)
+	l.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+	args.Upgrade()
+
+	now := l.now()
+	for i, entry := range args.Entries {
+		key := lockKey{entry.Namespace, entry.Name}
+		s := l.shard(key)
+		s.mutex.RLock()
+		held, active := false, false
+		for _, lri := range s.lockMap[key] {
+			if lri.source == args.Source {
+				held = true
+				leaseExpired := !lri.leaseExpiry.IsZero() && !now.Before(lri.leaseExpiry)
+				if !lri.suspect && !leaseExpired {
+					active = true
+				}
+			}
+		}
+		s.mutex.RUnlock()
+		switch {
+		case !held:
+			reply.SetNotHeld(i) // Never granted, or released (or purged) here already
+		case !active:
+			reply.SetExpired(i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Operations recorded in the write-ahead log
+const (
+	walOpIncarnation = "incarnation" // Incarnation of the server (first record)
+	walOpGrant       = "grant"       // Lock granted
+	walOpRelease     = "release"     // Single lock released (unlock, stale purge or expired lease)
+	walOpForce       = "force"       // All locks on a name released
+)
+
+// walRecord is a single entry in the write-ahead log, stored as a line of JSON.
+type walRecord struct {
+	Op          string     `json:"op"`
+	Incarnation uint64     `json:"incarnation,omitempty"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Name        string     `json:"name,omitempty"`
+	Writer      bool       `json:"writer,omitempty"`
+	Node        string     `json:"node,omitempty"`
+	RPCPath     string     `json:"rpcPath,omitempty"`
+	Owner       string     `json:"owner,omitempty"`
+	UID         string     `json:"uid,omitempty"`
+	Timestamp   time.Time  `json:"timestamp"`
+	Retainable  bool       `json:"retainable,omitempty"`
+	Persistent  bool       `json:"persistent,omitempty"`
+	Recovery    []byte     `json:"recovery,omitempty"` // Hash of the recovery token of a persistent lock
+	Expiry      *time.Time `json:"expiry,omitempty"`   // Expiry of a persistent lock, the leases of other locks start afresh on reload
+}
+
+// lockWAL persists all changes to the lock map, so that a restarted lock server can
+// reload its locks (and incarnation) instead of starting empty.
+type lockWAL struct {
+	mutex sync.Mutex // Serializes records appended for locks on different shards
+	path  string
+	file  *os.File
+	enc   *json.Encoder
+	sync  bool // Whether to fsync after every record
+	now   func() time.Time
+	log   func(level dsync.LogLevel, msg string, keysAndValues ...interface{})
+}
+
+// OpenWAL reloads the locks (and incarnation) of the server from the write-ahead log at path, as
+// written before a restart, and persists all subsequent changes to the lock map to it, with an
+// fsync after every change when sync is set. The log is compacted to just the locks still held
+// while opening it and on every Snapshot, so take snapshots periodically to bound its size.
+// Without a log at path, a new one recording the incarnation of the server is created. Must be
+// called before the server serves any requests.
+func (l *Server) OpenWAL(path string, sync bool) error {
+	lockMap := make(map[lockKey][]lockRequesterInfo)
+	incarnation := l.Incarnation()
+	f, err := os.Open(path)
+	if err == nil {
+		incarnation, err = l.replayWAL(f, lockMap, incarnation)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	for _, lri := range lockMap {
+		for idx := range lri {
+			if !lri[idx].persistent {
+				lri[idx].leaseExpiry = l.newLeaseExpiry()
+			}
+		}
+	}
+
+	w, err := l.compactWAL(path, sync, incarnation, lockMap)
+	if err != nil {
+		return err
+	}
+	l.lockAll()
+	defer l.unlockAll()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.wal != nil {
+		w.Close()
+		return errors.New("Write-ahead log is open already")
+	}
+	l.replaceLockMap(lockMap)
+	l.wal = w
+	atomic.StoreUint64(&l.incarnation, incarnation)
+	l.recountHeld()
+	for _, lri := range lockMap {
+		for _, entry := range lri {
+			l.registerClient(entry.source)
+		}
+	}
+	l.log(dsync.LogInfo, "Reloaded locks from write-ahead log", "locks", len(lockMap), "path", path, "incarnation", incarnation)
+	return nil
+}
+
+// compactWAL writes out the incarnation and the locks of lockMap to a new log that replaces the
+// one at path, returning it to append new records to.
+func (l *Server) compactWAL(path string, sync bool, incarnation uint64, lockMap map[lockKey][]lockRequesterInfo) (*lockWAL, error) {
+	w := &lockWAL{path: path, sync: sync, now: l.now, log: l.log}
+	if err := w.rewrite(incarnation, lockMap); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// replayWAL applies all records in r to lockMap, returning the recorded incarnation.
+func (l *Server) replayWAL(r io.Reader, lockMap map[lockKey][]lockRequesterInfo, incarnation uint64) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Most likely a torn write of the last record while crashing, ignore the rest
+			l.log(dsync.LogWarn, "Ignoring remainder of write-ahead log after corrupt record", "err", err)
+			break
+		}
+		key := lockKey{rec.Namespace, rec.Name}
+		switch rec.Op {
+		case walOpIncarnation:
+			incarnation = rec.Incarnation
+		case walOpGrant:
+			entry := lockRequesterInfo{
+				writer:        rec.Writer,
+				source:        dsync.Identity{Node: rec.Node, Path: rec.RPCPath},
+				owner:         rec.Owner,
+				uid:           rec.UID,
+				timestamp:     rec.Timestamp,
+				timeLastCheck: l.now(),
+				retainable:    rec.Retainable,
+				persistent:    rec.Persistent,
+				recovery:      rec.Recovery,
+			}
+			if rec.Expiry != nil {
+				entry.leaseExpiry = *rec.Expiry
+			}
+			lockMap[key] = append(lockMap[key], entry)
+		case walOpRelease:
+			lri := lockMap[key]
+			for idx := range lri {
+				if lri[idx].uid == rec.UID {
+					lri = append(lri[:idx], lri[idx+1:]...)
+					break
+				}
+			}
+			if len(lri) == 0 {
+				delete(lockMap, key)
+			} else {
+				lockMap[key] = lri
+			}
+		case walOpForce:
+			delete(lockMap, key)
+		}
+	}
+	return incarnation, scanner.Err()
+}
+
+func (w *lockWAL) logIncarnation(incarnation uint64) {
+	w.append(walRecord{Op: walOpIncarnation, Incarnation: incarnation, Timestamp: w.now().UTC()})
+}
+
+func (w *lockWAL) logGrant(key lockKey, lri lockRequesterInfo) {
+	w.append(grantRecord(key, lri))
+}
+
+func grantRecord(key lockKey, lri lockRequesterInfo) walRecord {
+	rec := walRecord{Op: walOpGrant, Namespace: key.namespace, Name: key.name, Writer: lri.writer, Node: lri.source.Node, RPCPath: lri.source.Path,
+		Owner: lri.owner, UID: lri.uid, Timestamp: lri.timestamp.UTC(), Retainable: lri.retainable, Persistent: lri.persistent, Recovery: lri.recovery}
+	if lri.persistent {
+		expiry := lri.leaseExpiry.UTC()
+		rec.Expiry = &expiry
+	}
+	return rec
+}
+
+func (w *lockWAL) logRelease(key lockKey, uid string) {
+	w.append(walRecord{Op: walOpRelease, Namespace: key.namespace, Name: key.name, UID: uid, Timestamp: w.now().UTC()})
+}
+
+func (w *lockWAL) logForce(key lockKey) {
+	w.append(walRecord{Op: walOpForce, Namespace: key.namespace, Name: key.name, Timestamp: w.now().UTC()})
+}
+
+// append writes a record to the log, failures are logged but do not fail the lock operation.
+func (w *lockWAL) append(rec walRecord) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.enc.Encode(&rec); err != nil {
+		w.log(dsync.LogError, "Unable to write to write-ahead log", "err", err)
+		return
+	}
+	if w.sync {
+		if err := w.file.Sync(); err != nil {
+			w.log(dsync.LogError, "Unable to sync write-ahead log", "err", err)
+		}
+	}
+}
+
+// rewrite replaces the log with one holding just the incarnation and the locks of lockMap (leaving
+// out reservations, which are logged once committed), to which subsequent records are appended.
+// The log is left as is on failure.
+func (w *lockWAL) rewrite(incarnation uint64, lockMap map[lockKey][]lockRequesterInfo) error {
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	err = enc.Encode(&walRecord{Op: walOpIncarnation, Incarnation: incarnation, Timestamp: w.now().UTC()})
+	for key, lri := range lockMap {
+		for _, entry := range lri {
+			if err == nil && entry.reservedUntil.IsZero() {
+				rec := grantRecord(key, entry)
+				err = enc.Encode(&rec)
+			}
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, w.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	w.mutex.Lock()
+	previous := w.file
+	w.file, w.enc = f, enc
+	w.mutex.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+// Close closes the underlying file.
+func (w *lockWAL) Close() error {
+	return w.file.Close()
+}
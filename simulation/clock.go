@@ -0,0 +1,128 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package simulation
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of consecutive times the scheduler is yielded to without the clock being used before the
+// simulation counts as settled
+const settleRounds = 20
+
+// virtualTimer is a pending After (or Sleep) on the virtual clock.
+type virtualTimer struct {
+	at  time.Time
+	seq uint64 // Timers at the same time fire in the order they were set
+	ch  chan time.Time
+}
+
+// VirtualClock - a dsync.Clock whose time only moves when advanced, firing the timers that
+// fall due in order of their time.
+type VirtualClock struct {
+	mutex    sync.Mutex
+	now      time.Time
+	timers   []*virtualTimer // Sorted by time and sequence
+	seq      uint64
+	activity uint64 // Raised on every use of the clock, to tell when the simulation has settled
+}
+
+// NewVirtualClock returns a VirtualClock starting at start.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+// Now returns the virtual time.
+func (c *VirtualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.activity++
+	return c.now
+}
+
+// After returns a channel on which the virtual time is sent once the clock is advanced by d.
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.activity++
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.seq++
+	t := &virtualTimer{at: c.now.Add(d), seq: c.seq, ch: ch}
+	i := sort.Search(len(c.timers), func(i int) bool { return c.timers[i].at.After(t.at) })
+	c.timers = append(c.timers, nil)
+	copy(c.timers[i+1:], c.timers[i:])
+	c.timers[i] = t
+	return ch
+}
+
+// Sleep blocks until the clock is advanced by d.
+func (c *VirtualClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Advance moves the clock forward by d, firing every timer that falls due on the way (in order,
+// letting the simulation settle after each), and returns once the simulation has settled.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	end := c.now.Add(d)
+	c.mutex.Unlock()
+
+	c.settle()
+	for {
+		c.mutex.Lock()
+		if len(c.timers) == 0 || c.timers[0].at.After(end) {
+			c.now = end
+			c.mutex.Unlock()
+			break
+		}
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.at
+		c.mutex.Unlock()
+
+		t.ch <- t.at
+		c.settle()
+	}
+	c.settle()
+}
+
+// settle yields to the other goroutines until the clock has not been used for a number of rounds,
+// ie. until the goroutines of the simulation are blocked waiting for time to pass.
+func (c *VirtualClock) settle() {
+	for quiet := 0; quiet < settleRounds; {
+		c.mutex.Lock()
+		before := c.activity
+		c.mutex.Unlock()
+
+		runtime.Gosched()
+
+		c.mutex.Lock()
+		if c.activity == before {
+			quiet++
+		} else {
+			quiet = 0
+		}
+		c.mutex.Unlock()
+	}
+}
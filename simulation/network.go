@@ -0,0 +1,193 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package simulation runs dsync lock servers and clients in a single process, over an in-memory
+// network and on a virtual clock, so that timeouts, back-offs, restarts and partitions can be
+// tested in (real) milliseconds rather than by sleeping through them.
+//
+// Every lock server is a dsync.LocalLocker. Requests to a server are delayed by a latency drawn
+// from a seeded source, fail right away while the server is down and are held (in virtual time)
+// and then failed while it is partitioned. A restarted server comes back without any locks. The
+// virtual clock only moves when advanced by the test:
+//
+//	sim, _ := simulation.New(4, 1)
+//	dm := dsync.NewDRWMutex("test")
+//	go dm.Lock()
+//	sim.Clock.Advance(10 * time.Second)
+//
+// Runs are reproducible as far as time and the network are concerned, the order in which
+// concurrent goroutines run is still up to the Go scheduler.
+package simulation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// Time a request to a partitioned server is held before failing (in virtual time)
+const DropTimeout = 30 * time.Second
+
+var (
+	errServerDown = errors.New("Connection refused: lock server is down")
+	errDropped    = errors.New("Request dropped: lock server is partitioned")
+	errRestarted  = errors.New("Connection reset: lock server restarted")
+)
+
+// server is a simulated lock server, its locker being replaced on every restart.
+type server struct {
+	locker      *dsync.LocalLocker
+	down        bool
+	partitioned bool
+}
+
+// Network - an in-memory network of lock servers on a virtual clock. As dsync is configured per
+// process, there can only be a single Network in a process.
+type Network struct {
+	Clock *VirtualClock
+
+	mutex      sync.Mutex
+	rand       *rand.Rand
+	servers    []*server
+	minLatency time.Duration
+	maxLatency time.Duration
+}
+
+// New starts a Network of nodes lock servers with a latency drawn from seed, and configures dsync
+// to use it (and its clock), the first node being the own node.
+func New(nodes int, seed int64) (*Network, error) {
+	if nodes < 2 {
+		return nil, fmt.Errorf("Simulation needs at least 2 nodes, got %d", nodes)
+	}
+	n := &Network{Clock: NewVirtualClock(time.Unix(0, 0).UTC()), rand: rand.New(rand.NewSource(seed))}
+	var clnts []dsync.RPC
+	for i := 0; i < nodes; i++ {
+		n.servers = append(n.servers, &server{locker: dsync.NewLocalLocker(node(i), dsync.DefaultPath)})
+		clnts = append(clnts, &client{network: n, index: i})
+	}
+	if err := dsync.SetNodesWithClients(clnts, 0); err != nil {
+		return nil, err
+	}
+	dsync.SetClock(n.Clock)
+	return n, nil
+}
+
+func node(index int) string {
+	return fmt.Sprintf("node-%d:9000", index)
+}
+
+// SetLatency sets the range from which the latency of every request is drawn uniformly (zero by default).
+func (n *Network) SetLatency(min, max time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.minLatency, n.maxLatency = min, max
+}
+
+// Kill stops a server, losing its locks.
+func (n *Network) Kill(index int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.servers[index].down = true
+	n.servers[index].locker = dsync.NewLocalLocker(node(index), dsync.DefaultPath)
+}
+
+// Start starts a server that was killed.
+func (n *Network) Start(index int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.servers[index].down = false
+}
+
+// Restart kills and starts a server, so it comes back without any locks.
+func (n *Network) Restart(index int) {
+	n.Kill(index)
+	n.Start(index)
+}
+
+// Partition cuts a server off from the network (or reconnects it), all requests to it are dropped
+// while partitioned.
+func (n *Network) Partition(index int, partitioned bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.servers[index].partitioned = partitioned
+}
+
+// latency draws the latency of a request, should be called with the mutex held.
+func (n *Network) latency() time.Duration {
+	if n.maxLatency <= n.minLatency {
+		return n.minLatency
+	}
+	return n.minLatency + time.Duration(n.rand.Int63n(int64(n.maxLatency-n.minLatency)))
+}
+
+// client - a dsync.RPC that sends requests to a server of the network.
+type client struct {
+	network *Network
+	index   int
+}
+
+func (c *client) Node() string {
+	return node(c.index)
+}
+
+func (c *client) RPCPath() string {
+	return dsync.DefaultPath
+}
+
+func (c *client) Close() error {
+	return nil
+}
+
+// Call delivers a request to the server after the latency of the network, and fails it when
+// the server is down, partitioned, or restarts while handling it.
+func (c *client) Call(ctx context.Context, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	n := c.network
+	n.mutex.Lock()
+	latency := n.latency()
+	n.mutex.Unlock()
+	n.Clock.Sleep(latency)
+
+	n.mutex.Lock()
+	s := n.servers[c.index]
+	locker, down, partitioned := s.locker, s.down, s.partitioned
+	n.mutex.Unlock()
+	if down {
+		return errServerDown
+	}
+	if partitioned {
+		n.Clock.Sleep(DropTimeout)
+		return errDropped
+	}
+
+	args.SetTimestamp(n.Clock.Now())
+	err := locker.Call(ctx, serviceMethod, args, reply)
+
+	n.mutex.Lock()
+	restarted := s.locker != locker
+	n.mutex.Unlock()
+	if restarted {
+		return errRestarted
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package simulation
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// lockAsync acquires a write lock in the background, closing the returned channel once granted.
+func lockAsync(dm *dsync.DRWMutex) chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		dm.Lock()
+		close(ch)
+	}()
+	return ch
+}
+
+func granted(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// As dsync can only be configured once per process, all simulations share a single network
+var (
+	sim     *Network
+	simErr  error
+	simOnce sync.Once
+)
+
+func TestSimulation(t *testing.T) {
+	simOnce.Do(func() { sim, simErr = New(4, 1) })
+	if simErr != nil {
+		t.Fatal(simErr)
+	}
+	sim.SetLatency(time.Millisecond, 5*time.Millisecond)
+	start := time.Now()
+
+	// A lock waits while a partition leaves too few servers for quorum
+	sim.Partition(2, true)
+	sim.Partition(3, true)
+	dm := dsync.NewDRWMutex("partition")
+	ch := lockAsync(dm)
+	sim.Clock.Advance(time.Minute)
+	if granted(ch) {
+		t.Fatal("Lock granted without quorum")
+	}
+	sim.Partition(2, false)
+	sim.Partition(3, false)
+	sim.Clock.Advance(time.Minute)
+	if !granted(ch) {
+		t.Fatal("Lock not granted after the partition healed")
+	}
+	dm.Unlock()
+
+	// A lock held on just a minority of servers after a restart keeps blocking a new lock
+	dm = dsync.NewDRWMutex("restart")
+	ch = lockAsync(dm)
+	sim.Clock.Advance(time.Second)
+	if !granted(ch) {
+		t.Fatal("Lock not granted")
+	}
+	sim.Restart(2)
+	sim.Restart(3)
+	dm2 := dsync.NewDRWMutex("restart")
+	ch2 := lockAsync(dm2)
+	sim.Clock.Advance(time.Minute)
+	if granted(ch2) {
+		t.Fatal("Second lock granted while the first lock is still held on two servers")
+	}
+	dm.Unlock()
+	sim.Clock.Advance(time.Minute)
+	if !granted(ch2) {
+		t.Fatal("Second lock not granted after the first lock was released")
+	}
+	dm2.Unlock()
+
+	// A lock waits for a server that was down to come back
+	sim.Kill(1)
+	sim.Kill(2)
+	dm = dsync.NewDRWMutex("down")
+	ch = lockAsync(dm)
+	sim.Clock.Advance(time.Hour)
+	if granted(ch) {
+		t.Fatal("Lock granted with two servers down")
+	}
+	sim.Start(1)
+	sim.Clock.Advance(time.Minute)
+	if !granted(ch) {
+		t.Fatal("Lock not granted after a server came back")
+	}
+	dm.Unlock()
+	sim.Start(2)
+
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("Simulating over an hour took %v", elapsed)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"sync"
+	"time"
+)
+
+// NodeStats - the outcome of the lock requests to a single node.
+type NodeStats struct {
+	Granted       uint64
+	Denied        uint64 // Requests denied as the lock is held by someone else
+	Errors        uint64 // Requests that failed
+	LastError     error  // Error of the most recent request that failed (nil if none)
+	LastErrorTime time.Time
+}
+
+// ClientStats - statistics of the locking by the client (see Stats) or by a single DRWMutex
+// (see DRWMutex.Stats), for embedders that do not scrape the metrics of MetricsCollector.
+type ClientStats struct {
+	Acquired  LockCounts           // Locks acquired
+	Attempts  uint64               // Attempts to acquire a lock (every round of requests to the nodes)
+	AvgRounds float64              // Average number of attempts taken to acquire a lock (zero until one is acquired)
+	Nodes     map[string]NodeStats // Outcome of the lock requests per node
+}
+
+// statsCollector keeps track of the statistics of the client or of a DRWMutex.
+type statsCollector struct {
+	mutex    sync.Mutex
+	locks    LockCounts // Locks acquired
+	attempts uint64
+	rounds   uint64 // Attempts taken by the locks acquired
+	nodes    map[string]*NodeStats
+}
+
+// Statistics of the client
+var dstats statsCollector
+
+// Stats returns the statistics of the locking by the client.
+func Stats() ClientStats {
+	return dstats.snapshot()
+}
+
+// Stats returns the statistics of the locking by dm.
+func (dm *DRWMutex) Stats() ClientStats {
+	return dm.stats.snapshot()
+}
+
+func (s *statsCollector) attempted() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attempts++
+}
+
+func (s *statsCollector) acquired(isReadLock bool, attempts int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	*lockCount(&s.locks, isReadLock)++
+	s.rounds += uint64(attempts)
+}
+
+// answered records the answer of a node to a lock request.
+func (s *statsCollector) answered(node string, locked bool, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nodes == nil {
+		s.nodes = make(map[string]*NodeStats)
+	}
+	ns, ok := s.nodes[node]
+	if !ok {
+		ns = &NodeStats{}
+		s.nodes[node] = ns
+	}
+	if err != nil {
+		ns.Errors++
+		ns.LastError, ns.LastErrorTime = err, getClock().Now()
+	} else if locked {
+		ns.Granted++
+	} else {
+		ns.Denied++
+	}
+}
+
+func (s *statsCollector) snapshot() ClientStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := ClientStats{Acquired: s.locks, Attempts: s.attempts, Nodes: make(map[string]NodeStats, len(s.nodes))}
+	if acquired := s.locks.Write + s.locks.Read; acquired > 0 {
+		stats.AvgRounds = float64(s.rounds) / float64(acquired)
+	}
+	for node, ns := range s.nodes {
+		stats.Nodes[node] = *ns
+	}
+	return stats
+}
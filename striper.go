@@ -0,0 +1,84 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Points per stripe on the hash ring of a LockStriper, so that keys spread evenly over the stripes
+const stripeReplicas = 64
+
+// LockStriper - maps an unbounded set of keys (eg. millions of object names) onto a fixed number of
+// DRWMutexes, so that callers do not create a mutex per key at the client nor a lock per key at the
+// lock servers. Keys that map onto the same stripe share its lock, so the number of stripes trades
+// memory for false contention. The stripes are placed on a consistent hash ring: a LockStriper with
+// more (or fewer) stripes maps most keys onto a stripe of the same name, so that processes using a
+// different number of stripes during a rollout mostly lock the same names.
+type LockStriper struct {
+	stripes []*DRWMutex
+	ring    []stripePoint // Sorted by hash
+}
+
+type stripePoint struct {
+	hash   uint64
+	stripe int
+}
+
+// NewLockStriper returns a LockStriper of n stripes, locking the names prefix/0 to prefix/n-1.
+func NewLockStriper(prefix string, n int) *LockStriper {
+	if n < 1 {
+		panic("dsync: a LockStriper needs at least one stripe")
+	}
+	ls := &LockStriper{stripes: make([]*DRWMutex, n), ring: make([]stripePoint, 0, n*stripeReplicas)}
+	for i := range ls.stripes {
+		name := prefix + "/" + strconv.Itoa(i)
+		ls.stripes[i] = NewDRWMutex(name)
+		for r := 0; r < stripeReplicas; r++ {
+			ls.ring = append(ls.ring, stripePoint{hash: stripeHash(name + "#" + strconv.Itoa(r)), stripe: i})
+		}
+	}
+	sort.Slice(ls.ring, func(i, j int) bool { return ls.ring[i].hash < ls.ring[j].hash })
+	return ls
+}
+
+func stripeHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// Mix the bits (as in splitmix64), FNV alone clusters keys that differ only in their last bytes
+	x := h.Sum64()
+	x = (x ^ x>>30) * 0xbf58476d1ce4e5b9
+	x = (x ^ x>>27) * 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+// Get returns the DRWMutex of the stripe that key maps onto, which is shared by all keys of the stripe.
+func (ls *LockStriper) Get(key string) *DRWMutex {
+	hash := stripeHash(key)
+	i := sort.Search(len(ls.ring), func(i int) bool { return ls.ring[i].hash >= hash })
+	if i == len(ls.ring) {
+		i = 0 // Wrap around the ring
+	}
+	return ls.stripes[ls.ring[i].stripe]
+}
+
+// Stripes returns the number of stripes of ls.
+func (ls *LockStriper) Stripes() int {
+	return len(ls.stripes)
+}
@@ -0,0 +1,83 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import "sync/atomic"
+
+// Tracer - interface through which dsync reports spans of work, to be implemented by the embedding
+// application on top of its tracing library (eg. OpenTelemetry) so that locking shows up in its traces.
+//
+// Spans are linked by their context in the W3C traceparent format ("00-<trace id>-<span id>-<flags>"),
+// which is how the context of a lock request is propagated to the lock servers (in LockArgs.TraceContext).
+type Tracer interface {
+	// Start starts a span named name as child of the span with context parent (a root span when empty),
+	// keysAndValues holding alternating keys and values of its attributes.
+	Start(parent, name string, keysAndValues ...interface{}) Span
+}
+
+// Span - a span of work started by a Tracer.
+type Span interface {
+	// Context returns the context of the span in the W3C traceparent format (empty when not traced).
+	Context() string
+	// SetAttributes adds attributes (alternating keys and values) to the span.
+	SetAttributes(keysAndValues ...interface{})
+	// End ends the span, err being the error the work failed with (nil when it succeeded).
+	End(err error)
+}
+
+type noopTracer struct{}
+
+func (noopTracer) Start(parent, name string, keysAndValues ...interface{}) Span { return noopSpan{} }
+
+type noopSpan struct{}
+
+func (noopSpan) Context() string                            { return "" }
+func (noopSpan) SetAttributes(keysAndValues ...interface{}) {}
+func (noopSpan) End(err error)                              {}
+
+type tracerHolder struct {
+	tracer Tracer
+}
+
+// Tracer used by the client and the lock servers, set via SetTracer.
+var dtracer atomic.Value
+
+func init() {
+	dtracer.Store(tracerHolder{tracer: noopTracer{}})
+}
+
+// SetTracer - installs the tracer through which dsync reports a span per lock acquisition, with a
+// child span per request to a node (for every attempt), nil stops tracing.
+func SetTracer(tracer Tracer) {
+	if tracer == nil {
+		tracer = noopTracer{}
+	}
+	dtracer.Store(tracerHolder{tracer: tracer})
+}
+
+// tracing returns whether a tracer has been set, so that the hot path can skip building spans.
+func tracing() bool {
+	_, noop := dtracer.Load().(tracerHolder).tracer.(noopTracer)
+	return !noop
+}
+
+// StartSpan starts a span with the tracer set via SetTracer, as child of the span with context
+// parent. Lock servers call it with the LockArgs.TraceContext of a request, so that the spans of
+// their handlers link to the span of the client.
+func StartSpan(parent, name string, keysAndValues ...interface{}) Span {
+	return dtracer.Load().(tracerHolder).tracer.Start(parent, name, keysAndValues...)
+}
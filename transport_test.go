@@ -0,0 +1,250 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Benchmarks comparing the codecs and transports for the lock round trip (a lock and an unlock
+// request), run with eg.
+//
+//	go test -run NONE -bench 'Transport|Codec' -count 10 | tee new.txt
+//
+// and compare runs (or releases) with benchstat. Every benchmark reports the bytes sent and received
+// over the connection per round trip as wire-B/op. Only transports of the standard library are
+// compared, as dsync has no dependencies: a transport such as gRPC is added as another entry of
+// transports, dialing a client for the same lock service.
+
+package dsync_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/minio/dsync"
+)
+
+// Sizes of the lock names that the benchmarks are run for
+var benchmarkPayloads = []int{16, 1024}
+
+// lockService serves the lock handlers of an in-memory LocalLocker, so that the benchmarks measure
+// the codec and transport rather than a lock server.
+type lockService struct {
+	locker *LocalLocker
+}
+
+func (s *lockService) Lock(args *LockArgs, reply *LockReply) error {
+	return s.locker.Call(context.Background(), "Dsync.Lock", args, reply)
+}
+
+func (s *lockService) Unlock(args *LockArgs, reply *bool) error {
+	return s.locker.Call(context.Background(), "Dsync.Unlock", args, reply)
+}
+
+// countingConn counts the bytes sent and received over a connection.
+type countingConn struct {
+	net.Conn
+	bytes *int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(c.bytes, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(c.bytes, int64(n))
+	return n, err
+}
+
+// A transport serves the lock service on a listener and dials a client for it over a connection.
+type transport struct {
+	name  string
+	serve func(ln net.Listener, server *rpc.Server)
+	dial  func(conn net.Conn) (*rpc.Client, error)
+}
+
+// serveConns serves every connection accepted by ln with serveConn, until ln is closed.
+func serveConns(ln net.Listener, serveConn func(conn net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go serveConn(conn)
+	}
+}
+
+var transports = []transport{
+	{
+		// As set up by the lock servers of the tests and the chaos tests (see rpc-client-impl_test.go)
+		name: "GobHTTP",
+		serve: func(ln net.Listener, server *rpc.Server) {
+			mux := http.NewServeMux()
+			mux.Handle(RpcPath, server)
+			http.Serve(ln, mux)
+		},
+		dial: func(conn net.Conn) (*rpc.Client, error) {
+			io.WriteString(conn, "CONNECT "+RpcPath+" HTTP/1.0\n\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+			if err != nil {
+				return nil, err
+			}
+			resp.Body.Close()
+			return rpc.NewClient(conn), nil
+		},
+	},
+	{
+		name: "GobTCP",
+		serve: func(ln net.Listener, server *rpc.Server) {
+			serveConns(ln, func(conn net.Conn) { server.ServeConn(conn) })
+		},
+		dial: func(conn net.Conn) (*rpc.Client, error) {
+			return rpc.NewClient(conn), nil
+		},
+	},
+	{
+		name: "JSONTCP",
+		serve: func(ln net.Listener, server *rpc.Server) {
+			serveConns(ln, func(conn net.Conn) { server.ServeCodec(jsonrpc.NewServerCodec(conn)) })
+		},
+		dial: func(conn net.Conn) (*rpc.Client, error) {
+			return jsonrpc.NewClient(conn), nil
+		},
+	},
+}
+
+// benchmarkRoundTrips runs lock round trips on a lock name of the given size via call.
+func benchmarkRoundTrips(b *testing.B, payload int, call func(method string, args *LockArgs, reply *bool) error) {
+	name := strings.Repeat("n", payload)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var reply bool
+		args := LockArgs{Name: name, Source: Identity{Node: "127.0.0.1:9000", Path: RpcPath}, UID: strconv.Itoa(i), Version: ProtocolVersion}
+		if err := call("Dsync.Lock", &args, &reply); err != nil || !reply {
+			b.Fatalf("Lock failed with reply %v and error %v", reply, err)
+		}
+		if err := call("Dsync.Unlock", &args, &reply); err != nil || !reply {
+			b.Fatalf("Unlock failed with reply %v and error %v", reply, err)
+		}
+	}
+}
+
+// Baseline without codec and transport
+func BenchmarkTransportInProcess(b *testing.B) {
+	for _, payload := range benchmarkPayloads {
+		b.Run(strconv.Itoa(payload), func(b *testing.B) {
+			locker := NewLocalLocker("127.0.0.1:9000", RpcPath)
+			benchmarkRoundTrips(b, payload, func(method string, args *LockArgs, reply *bool) error {
+				return locker.Call(context.Background(), method, args, reply)
+			})
+		})
+	}
+}
+
+func BenchmarkTransport(b *testing.B) {
+	for _, t := range transports {
+		for _, payload := range benchmarkPayloads {
+			b.Run(t.name+"/"+strconv.Itoa(payload), func(b *testing.B) {
+				server := rpc.NewServer()
+				server.RegisterName("Dsync", &lockService{locker: NewLocalLocker("127.0.0.1:9000", RpcPath)})
+				ln, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer ln.Close()
+				go t.serve(ln, server)
+
+				conn, err := net.Dial("tcp", ln.Addr().String())
+				if err != nil {
+					b.Fatal(err)
+				}
+				var wire int64
+				client, err := t.dial(countingConn{Conn: conn, bytes: &wire})
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer client.Close()
+
+				benchmarkRoundTrips(b, payload, func(method string, args *LockArgs, reply *bool) error {
+					return client.Call(method, args, reply)
+				})
+				b.ReportMetric(float64(atomic.LoadInt64(&wire))/float64(b.N), "wire-B/op")
+			})
+		}
+	}
+}
+
+// A codec encodes and decodes a stream of lock requests.
+type codec struct {
+	name      string
+	newStream func(w io.Writer, r io.Reader) (encode func(args *LockArgs) error, decode func(args *LockArgs) error)
+}
+
+var codecs = []codec{
+	{
+		name: "Gob",
+		newStream: func(w io.Writer, r io.Reader) (func(*LockArgs) error, func(*LockArgs) error) {
+			enc, dec := gob.NewEncoder(w), gob.NewDecoder(r)
+			return func(args *LockArgs) error { return enc.Encode(args) }, func(args *LockArgs) error { return dec.Decode(args) }
+		},
+	},
+	{
+		name: "JSON",
+		newStream: func(w io.Writer, r io.Reader) (func(*LockArgs) error, func(*LockArgs) error) {
+			enc, dec := json.NewEncoder(w), json.NewDecoder(r)
+			return func(args *LockArgs) error { return enc.Encode(args) }, func(args *LockArgs) error { return dec.Decode(args) }
+		},
+	},
+}
+
+// Cost of encoding and decoding a lock request on a stream (as a connection carries many), without transport
+func BenchmarkCodec(b *testing.B) {
+	for _, c := range codecs {
+		for _, payload := range benchmarkPayloads {
+			b.Run(c.name+"/"+strconv.Itoa(payload), func(b *testing.B) {
+				var buf bytes.Buffer
+				encode, decode := c.newStream(&buf, &buf)
+				args := LockArgs{Name: strings.Repeat("n", payload), Source: Identity{Node: "127.0.0.1:9000", Path: RpcPath}, UID: "0123456789ABCDEF0123456789ABCDEF", Version: ProtocolVersion}
+				var wire int64
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := encode(&args); err != nil {
+						b.Fatal(err)
+					}
+					wire += int64(buf.Len())
+					var decoded LockArgs
+					if err := decode(&decoded); err != nil || decoded.Name != args.Name {
+						b.Fatalf("Decoding failed with %v", err)
+					}
+				}
+				b.ReportMetric(float64(wire)/float64(b.N), "wire-B/op")
+			})
+		}
+	}
+}
@@ -0,0 +1,216 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Shortest interval at which the lock validator checks the locks held
+const minLockValidatorInterval = 10 * time.Millisecond
+
+// State of the lock validator
+var validator struct {
+	sync.Mutex
+	stop chan struct{}
+}
+
+// SetLockValidator - checks every interval that the locks held by this client are still held by
+// the nodes that granted them (as lock maintenance may purge a lock that its client holds, or a
+// lock server may restart), re-asserting them at the nodes that lost them and reporting the locks
+// that are thereby no longer held by a quorum of the nodes (see DRWMutex.Lost and Events). Zero
+// (the default) disables the validator.
+func SetLockValidator(interval time.Duration) {
+	validator.Lock()
+	defer validator.Unlock()
+	if validator.stop != nil {
+		close(validator.stop)
+		validator.stop = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	if interval < minLockValidatorInterval {
+		interval = minLockValidatorInterval
+	}
+	validator.stop = make(chan struct{})
+	go runLockValidator(validator.stop, interval)
+}
+
+// runLockValidator validates the locks held every interval until stop is closed.
+func runLockValidator(stop chan struct{}, interval time.Duration) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-getClock().After(interval):
+		}
+		validateHeldLocks(ctx)
+	}
+}
+
+// heldAt is a lock held by this client at a node, under uid.
+type heldAt struct {
+	h   *heldLock
+	uid string
+}
+
+// reassertion is a lock to acquire again at the node at index, which lost it.
+type reassertion struct {
+	h     *heldLock
+	index int
+}
+
+// validateHeldLocks checks once that the locks held by this client are still held by the nodes
+// that granted them, re-asserting them at the nodes that lost them.
+func validateHeldLocks(ctx context.Context) {
+	if dlocal != nil {
+		return // Held in memory, so never lost
+	}
+
+	checks := make([][]heldAt, dnodeCount)
+	held.Lock()
+	for _, h := range held.locks {
+		if h.lost || isLocalOnly(h.uid) {
+			continue
+		}
+		for index, uid := range h.locks {
+			if isLocked(uid) {
+				checks[index] = append(checks[index], heldAt{h: h, uid: uid})
+			}
+		}
+	}
+	held.Unlock()
+
+	expired := make([][]bool, dnodeCount)
+	var wg sync.WaitGroup
+	for index, c := range clnts {
+		if len(checks[index]) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(index int, c RPC) {
+			defer wg.Done()
+			expired[index] = expiredAt(ctx, c, checks[index])
+		}(index, c)
+	}
+	wg.Wait()
+
+	var lost []LockEvent
+	var reassert []reassertion
+	held.Lock()
+	lostAt := make(map[*heldLock]string)
+	for index, nodeExpired := range expired {
+		for i, isExpired := range nodeExpired {
+			if check := checks[index][i]; isExpired && check.h.locks[index] == check.uid {
+				check.h.drop(index)
+				lostAt[check.h] = clnts[index].Node()
+			}
+		}
+	}
+	for _, h := range held.locks {
+		if h.lost || isLocalOnly(h.uid) {
+			continue
+		}
+		if !quorumMet(&h.locks, h.ReadLock) {
+			if h.markLost() {
+				lost = append(lost, h.event(lostAt[h]))
+			}
+			continue
+		}
+		for index, dropped := range h.dropped {
+			if dropped {
+				reassert = append(reassert, reassertion{h: h, index: index})
+			}
+		}
+	}
+	held.Unlock()
+
+	for _, ev := range lost {
+		logf(LogWarn, "Lock no longer held by a quorum, lock servers lost it", "name", ev.Name, "node", ev.Node)
+		getEvents().OnQuorumLost(ev)
+	}
+	for _, r := range reassert {
+		reassertLock(ctx, r.h, r.index)
+	}
+}
+
+// expiredAt returns which of the locks held at the node c it no longer holds (nil when unknown).
+func expiredAt(ctx context.Context, c RPC, checks []heldAt) []bool {
+	expired := make([]bool, len(checks))
+	for start := 0; start < len(checks); start += MaxExpiredBatchEntries {
+		end := start + MaxExpiredBatchEntries
+		if end > len(checks) {
+			end = len(checks)
+		}
+		args := ExpiredBatchArgs{Epoch: getEpoch(), Version: ProtocolVersion}
+		for _, check := range checks[start:end] {
+			args.Entries = append(args.Entries, ExpiredEntry{Namespace: check.h.Namespace, Name: check.h.Name, UID: check.uid})
+		}
+		var reply ExpiredBatchReply
+		if err := CallServer(ctx, c, "Dsync.ExpiredBatch", &args, &reply); err == nil {
+			for i := start; i < end; i++ {
+				expired[i] = reply.IsExpired(i - start)
+			}
+			continue
+		}
+
+		// The lock server may predate batching, so fall back to checking lock by lock
+		for i, check := range checks[start:end] {
+			args := LockArgs{Namespace: check.h.Namespace, Name: check.h.Name, UID: check.uid, Epoch: getEpoch(), Version: ProtocolVersion}
+			if err := CallServer(ctx, c, "Dsync.Expired", &args, &expired[start+i]); err != nil {
+				logf(LogWarn, "Unable to validate lock", "name", check.h.Name, "node", c.Node(), "err", err)
+				return nil
+			}
+		}
+	}
+	return expired
+}
+
+// reassertLock acquires the lock h again at the node at index, which lost it.
+func reassertLock(ctx context.Context, h *heldLock, index int) {
+	method := "Dsync.Lock"
+	if h.ReadLock {
+		method = "Dsync.RLock"
+	}
+	var locked bool
+	args := LockArgs{Namespace: h.Namespace, Name: h.Name, Source: ownIdentity(), Owner: h.owner, UID: newUID(), Epoch: getEpoch(), Version: ProtocolVersion}
+	if err := CallServer(ctx, clnts[index], method, &args, &locked); err != nil || !locked {
+		logf(LogDebug, "Unable to re-assert lock", "name", h.Name, "node", clnts[index].Node(), "err", err)
+		return
+	}
+
+	held.Lock()
+	stillHeld := held.locks[h.uid] == h && !h.lost
+	if stillHeld {
+		h.locks[index], h.dropped[index] = args.UID, false
+	}
+	held.Unlock()
+	if !stillHeld { // Released (or lost) meanwhile
+		sendRelease(clnts[index], h.Name, args.UID, h.ReadLock)
+		return
+	}
+	logf(LogInfo, "Re-asserted lock", "name", h.Name, "node", clnts[index].Node())
+}
@@ -0,0 +1,121 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Version of the lock protocol spoken by this client, sent along in LockArgs.
+//
+// Compatibility rules:
+// - a server accepts requests of any version from MinProtocolVersion up to and including its own ProtocolVersion
+// - any other version (including 0 for clients that predate versioning) is rejected with a VersionMismatchError
+// - ProtocolVersion is raised for every change to the request/response format or to the lock semantics,
+//   MinProtocolVersion only when support for an older format is dropped
+// - MinProtocolVersion is kept at (most) the version preceding ProtocolVersion, so that a cluster can be
+//   upgraded server by server: servers accept requests of both versions, and clients speak the older one
+//   to servers that have not been upgraded yet (see VersionedArgs)
+const ProtocolVersion = 4
+
+// Oldest version of the lock protocol that is still accepted by servers, and spoken by clients to
+// servers that do not accept ProtocolVersion yet.
+const MinProtocolVersion = 2
+
+// VersionedArgs - arguments of rpc calls whose format depends on the protocol version, which
+// CallServer sets to the version negotiated with the lock server.
+type VersionedArgs interface {
+	SetVersion(version uint32)
+}
+
+// VersionMismatchError - returned by a lock server for a request of a protocol version it does not support.
+type VersionMismatchError struct {
+	ServerMinVersion uint32
+	ServerVersion    uint32
+	ClientVersion    uint32
+}
+
+const versionMismatchFormat = "Protocol version mismatch: server supports versions %d through %d, client at version %d"
+
+func (e VersionMismatchError) Error() string {
+	return fmt.Sprintf(versionMismatchFormat, e.ServerMinVersion, e.ServerVersion, e.ClientVersion)
+}
+
+// CheckVersion - verifies that a request of the given protocol version is supported, for use by lock servers.
+func CheckVersion(clientVersion uint32) error {
+	if clientVersion < MinProtocolVersion || clientVersion > ProtocolVersion {
+		return VersionMismatchError{ServerMinVersion: MinProtocolVersion, ServerVersion: ProtocolVersion, ClientVersion: clientVersion}
+	}
+	return nil
+}
+
+// toVersionMismatchError returns the version mismatch carried by err (also when transported
+// as a plain error string by net/rpc), or nil if err is not a version mismatch.
+func toVersionMismatchError(err error) *VersionMismatchError {
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(VersionMismatchError); ok {
+		return &e
+	}
+	var e VersionMismatchError
+	if n, _ := fmt.Sscanf(err.Error(), versionMismatchFormat, &e.ServerMinVersion, &e.ServerVersion, &e.ClientVersion); n != 3 {
+		return nil
+	}
+	return &e
+}
+
+// Protocol versions negotiated with lock servers that do not accept ProtocolVersion, keyed by node
+// and rpc path (ProtocolVersion for all others)
+var serverVersions = struct {
+	sync.Mutex
+	m map[string]uint32
+}{m: make(map[string]uint32)}
+
+func getServerVersion(c RPC) uint32 {
+	serverVersions.Lock()
+	defer serverVersions.Unlock()
+	if version, ok := serverVersions.m[c.Node()+c.RPCPath()]; ok {
+		return version
+	}
+	return ProtocolVersion
+}
+
+func setServerVersion(c RPC, version uint32) {
+	serverVersions.Lock()
+	defer serverVersions.Unlock()
+	if version == ProtocolVersion {
+		delete(serverVersions.m, c.Node()+c.RPCPath())
+	} else {
+		serverVersions.m[c.Node()+c.RPCPath()] = version
+	}
+}
+
+// negotiateVersion returns the version to speak to a server that rejected a request with e, that is
+// the newest version both the client and the server support, or false when there is none (or when
+// the request was of that version already).
+func negotiateVersion(e VersionMismatchError) (uint32, bool) {
+	version := e.ServerVersion
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version < MinProtocolVersion || version < e.ServerMinVersion || version == e.ClientVersion {
+		return 0, false
+	}
+	return version, true
+}
@@ -0,0 +1,126 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package dsync
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shortest interval at which the hold watchdog checks the locks held
+const minHoldWatchdogInterval = 10 * time.Millisecond
+
+// HeldLock - a lock held by this client for longer than the threshold of the hold watchdog.
+type HeldLock struct {
+	Namespace string
+	Name      string
+	ReadLock  bool
+	Since     time.Time     // Time at which the lock was granted
+	Held      time.Duration // Time the lock has been held for
+	Source    string        // Caller that acquired the lock, as "function (file:line)"
+}
+
+// State of the hold watchdog
+var watchdog struct {
+	sync.Mutex
+	threshold time.Duration
+	report    func(HeldLock)
+	stop      chan struct{}
+}
+
+// SetHoldWatchdog - reports every lock held by this client for longer than threshold (once), along
+// with the caller that acquired it, to catch forgotten Unlocks early. Locks are reported to report,
+// or logged as a warning when report is nil. Zero disables the watchdog.
+// N B - Only locks acquired while the watchdog is enabled are watched.
+func SetHoldWatchdog(threshold time.Duration, report func(HeldLock)) {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	if watchdog.stop != nil {
+		close(watchdog.stop)
+		watchdog.stop = nil
+	}
+	watchdog.threshold, watchdog.report = threshold, report
+	if threshold <= 0 {
+		return
+	}
+	interval := threshold / 4
+	if interval < minHoldWatchdogInterval {
+		interval = minHoldWatchdogInterval
+	}
+	watchdog.stop = make(chan struct{})
+	go runHoldWatchdog(watchdog.stop, interval)
+}
+
+// runHoldWatchdog checks the locks held every interval until stop is closed.
+func runHoldWatchdog(stop chan struct{}, interval time.Duration) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-getClock().After(interval):
+		}
+
+		watchdog.Lock()
+		threshold, report := watchdog.threshold, watchdog.report
+		watchdog.Unlock()
+
+		now := getClock().Now()
+		var stalled []HeldLock
+		held.Lock()
+		for _, l := range held.locks {
+			// Locks acquired before the watchdog was enabled have no source, and are not watched
+			if l.Held = now.Sub(l.Since); l.Source != "" && !l.reported && l.Held >= threshold {
+				l.reported = true
+				stalled = append(stalled, l.HeldLock)
+			}
+		}
+		held.Unlock()
+
+		for _, l := range stalled {
+			if report != nil {
+				report(l)
+			} else {
+				logf(LogWarn, "Lock held longer than expected, possibly a forgotten Unlock", "name", l.Name, "held", l.Held, "source", l.Source)
+			}
+		}
+	}
+}
+
+// holdWatchdogEnabled returns whether the locks acquired are watched by the hold watchdog.
+func holdWatchdogEnabled() bool {
+	watchdog.Lock()
+	defer watchdog.Unlock()
+	return watchdog.threshold > 0
+}
+
+// acquisitionSource returns the first caller outside of this package.
+func acquisitionSource() string {
+	pc := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(2, pc)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "github.com/minio/dsync.") {
+			return fmt.Sprintf("%s (%s:%d)", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zookeeper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Operations of the ZooKeeper protocol (as far as used)
+const (
+	opCreate          = 1
+	opDelete          = 2
+	opExists          = 3
+	opGetChildren     = 8
+	opPing            = 11
+	opCreateContainer = 19
+	opClose           = -11
+)
+
+// Flags of created znodes
+const (
+	flagEphemeral = 1
+	flagSequence  = 2
+	flagContainer = 4
+)
+
+// Xid of ping requests (and their replies)
+const pingXid = -2
+
+// Error codes of the ZooKeeper protocol (as far as distinguished)
+const (
+	errCodeNoNode     = -101
+	errCodeNodeExists = -110
+	errCodeNotEmpty   = -111
+)
+
+// Errors for error codes returned by ZooKeeper
+var (
+	ErrNoNode     = errors.New("zookeeper: node does not exist")
+	ErrNodeExists = errors.New("zookeeper: node already exists")
+	ErrNotEmpty   = errors.New("zookeeper: node has children")
+)
+
+func codeToError(code int32) error {
+	switch code {
+	case 0:
+		return nil
+	case errCodeNoNode:
+		return ErrNoNode
+	case errCodeNodeExists:
+		return ErrNodeExists
+	case errCodeNotEmpty:
+		return ErrNotEmpty
+	}
+	return fmt.Errorf("zookeeper: error code %d", code)
+}
+
+// encoder appends values in the jute serialization used by ZooKeeper.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int32(v int32) {
+	e.buf = append(e.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(e.buf[len(e.buf)-4:], uint32(v))
+}
+
+func (e *encoder) int64(v int64) {
+	e.buf = append(e.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(e.buf[len(e.buf)-8:], uint64(v))
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.buf = append(e.buf, 1)
+	} else {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) string(v string) {
+	e.bytes([]byte(v))
+}
+
+// worldACL appends an ACL vector granting all permissions to anyone.
+func (e *encoder) worldACL() {
+	e.int32(1)  // Number of ACLs
+	e.int32(31) // All permissions
+	e.string("world")
+	e.string("anyone")
+}
+
+// decoder reads values in the jute serialization, recording the first error (running out of data).
+type decoder struct {
+	buf []byte
+	err error
+}
+
+var errShortPacket = errors.New("zookeeper: packet too short")
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.buf) < n {
+		if d.err == nil {
+			d.err = errShortPacket
+		}
+		return make([]byte, 8) // Enough to decode any integer from
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int32() int32 {
+	return int32(binary.BigEndian.Uint32(d.next(4)))
+}
+
+func (d *decoder) int64() int64 {
+	return int64(binary.BigEndian.Uint64(d.next(8)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) strings() []string {
+	n := d.int32()
+	if n < 0 || d.err != nil {
+		return nil
+	}
+	v := make([]string, 0, n)
+	for i := int32(0); i < n && d.err == nil; i++ {
+		v = append(v, d.string())
+	}
+	return v
+}
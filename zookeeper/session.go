@@ -0,0 +1,214 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zookeeper
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Maximum size of a packet accepted from ZooKeeper
+const maxPacketSize = 4 << 20
+
+// ErrSessionExpired - returned when the session (and thereby all ephemeral znodes of the locks
+// held in it) has expired, eg. after a partition from ZooKeeper longer than the session timeout.
+var ErrSessionExpired = errors.New("zookeeper: session expired")
+
+// session is a ZooKeeper session over a single connection, on which requests are sent one at a
+// time (there are no watches, so no reply arrives unrequested). After a connection failure the
+// session is resumed on a new connection, unless it has expired in the mean time.
+type session struct {
+	mutex     sync.Mutex
+	addr      string
+	timeout   time.Duration
+	c         net.Conn
+	id        int64
+	passwd    []byte
+	xid       int32
+	lastZxid  int64
+	stop      chan bool // Stops the pinger (nil when not running)
+	onExpired func()    // Called (with the mutex held) when the session turns out to have expired
+}
+
+// connect (re)establishes the connection, resuming the session if there is one. Should be
+// called with the mutex held.
+func (s *session) connect() error {
+	c, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return err
+	}
+	c.SetDeadline(time.Now().Add(s.timeout))
+
+	var e encoder
+	e.int32(0) // Protocol version
+	e.int64(s.lastZxid)
+	e.int32(int32(s.timeout / time.Millisecond))
+	e.int64(s.id)
+	passwd := s.passwd
+	if passwd == nil {
+		passwd = make([]byte, 16)
+	}
+	e.bytes(passwd)
+	if err := writePacket(c, e.buf); err != nil {
+		c.Close()
+		return err
+	}
+	buf, err := readPacket(c)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	d := decoder{buf: buf}
+	d.int32() // Protocol version
+	timeout := d.int32()
+	id := d.int64()
+	passwd = d.bytes()
+	if d.err != nil {
+		c.Close()
+		return d.err
+	}
+	if timeout <= 0 {
+		// The session that was resumed has expired, start over with a new one on next use
+		c.Close()
+		s.id, s.passwd, s.lastZxid = 0, nil, 0
+		if s.onExpired != nil {
+			s.onExpired()
+		}
+		return ErrSessionExpired
+	}
+	s.c, s.id, s.passwd = c, id, passwd
+	s.timeout = time.Duration(timeout) * time.Millisecond // As negotiated by the server
+	if s.stop == nil {
+		s.stop = make(chan bool)
+		go s.ping(s.stop)
+	}
+	return nil
+}
+
+// do sends a request and returns the body of its reply.
+func (s *session) do(op int32, body []byte) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.c == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+	s.xid++
+	xid := s.xid
+	if op == opPing {
+		xid = pingXid
+	}
+	var e encoder
+	e.int32(xid)
+	e.int32(op)
+	e.buf = append(e.buf, body...)
+
+	s.c.SetDeadline(time.Now().Add(s.timeout))
+	err := writePacket(s.c, e.buf)
+	var buf []byte
+	if err == nil {
+		buf, err = readPacket(s.c)
+	}
+	if err != nil {
+		// The connection is in an unknown state, so resume the session on a new one
+		s.c.Close()
+		s.c = nil
+		return nil, err
+	}
+	d := decoder{buf: buf}
+	if d.int32() != xid {
+		s.c.Close()
+		s.c = nil
+		return nil, errors.New("zookeeper: reply out of order")
+	}
+	if zxid := d.int64(); zxid > 0 {
+		s.lastZxid = zxid
+	}
+	code := d.int32()
+	if d.err != nil {
+		return nil, d.err
+	}
+	return d.buf, codeToError(code)
+}
+
+// ping keeps the session alive (when idle) until stopped.
+func (s *session) ping(stop chan bool) {
+	for {
+		s.mutex.Lock()
+		interval := s.timeout / 3
+		s.mutex.Unlock()
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+		s.do(opPing, nil)
+	}
+}
+
+// close ends the session, deleting all its ephemeral znodes.
+func (s *session) close() error {
+	s.mutex.Lock()
+	stop := s.stop
+	s.stop = nil
+	connected := s.c != nil
+	s.mutex.Unlock()
+	if stop != nil {
+		close(stop)
+	}
+	if !connected {
+		return nil
+	}
+	_, err := s.do(opClose, nil)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.c != nil {
+		s.c.Close()
+		s.c = nil
+	}
+	s.id, s.passwd, s.lastZxid = 0, nil, 0
+	return err
+}
+
+func writePacket(w io.Writer, buf []byte) error {
+	packet := make([]byte, 4+len(buf))
+	binary.BigEndian.PutUint32(packet, uint32(len(buf)))
+	copy(packet[4:], buf)
+	_, err := w.Write(packet)
+	return err
+}
+
+func readPacket(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxPacketSize {
+		return nil, errors.New("zookeeper: packet too large")
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
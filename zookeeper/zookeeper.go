@@ -0,0 +1,288 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package zookeeper provides a dsync.RPC that keeps locks in ZooKeeper rather than in dsync lock
+// servers, following the lock recipes of ZooKeeper.
+//
+// Every lock is a container znode under which a holder creates an ephemeral sequential child,
+// write-<seq> for a write lock and read-<seq> for a read lock. A write lock is granted when its
+// child has the lowest sequence number, a read lock when no write- child has a lower one. As
+// dsync retries lock attempts itself, a child that is not granted is deleted again rather than
+// watching its predecessor. The children are ephemeral, so the locks of a crashed process are
+// released by ZooKeeper itself once its session expires (no lock maintenance is needed).
+package zookeeper
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+// DefaultSessionTimeout is the session timeout requested from ZooKeeper, after which the locks of
+// a process that stopped pinging are released.
+const DefaultSessionTimeout = 10 * time.Second
+
+// Number of digits ZooKeeper appends to the name of a sequential znode
+const sequenceDigits = 10
+
+// Locker - a dsync.RPC that implements the lock handlers on a ZooKeeper ensemble.
+type Locker struct {
+	addr    string // Address of a ZooKeeper server
+	prefix  string // Path of the znode under which all locks of this locker are kept, eg. /dsync
+	session *session
+
+	mutex sync.Mutex
+	held  map[string]string // Paths of the znodes of the locks held through this locker, keyed by uid
+}
+
+// New returns a Locker that keeps its locks under the znode at prefix in ZooKeeper at addr.
+func New(addr, prefix string) *Locker {
+	l := &Locker{
+		addr:    addr,
+		prefix:  strings.TrimSuffix(prefix, "/"),
+		session: &session{addr: addr, timeout: DefaultSessionTimeout},
+		held:    make(map[string]string),
+	}
+	l.session.onExpired = l.expire
+	return l
+}
+
+// SetSessionTimeout sets the session timeout requested from ZooKeeper (DefaultSessionTimeout
+// unless set), effective from the next session.
+func (l *Locker) SetSessionTimeout(timeout time.Duration) {
+	l.session.mutex.Lock()
+	defer l.session.mutex.Unlock()
+	l.session.timeout = timeout
+}
+
+// Node returns the address of the ZooKeeper server.
+func (l *Locker) Node() string {
+	return l.addr
+}
+
+// RPCPath returns the path of the znode under which the locks are kept.
+func (l *Locker) RPCPath() string {
+	return l.prefix
+}
+
+// Close ends the session, releasing all locks held through l.
+func (l *Locker) Close() error {
+	l.expire()
+	return l.session.close()
+}
+
+// Call performs the lock handler serviceMethod (eg. "Dsync.Lock") against ZooKeeper, unless ctx is done
+// already. Once sent, a command is not interrupted, as it shares the connection with all other calls.
+func (l *Locker) Call(ctx context.Context, serviceMethod string, args interface {
+	SetToken(token string)
+	SetTimestamp(tstamp time.Time)
+}, reply interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lockArgs, ok := args.(*dsync.LockArgs)
+	if !ok {
+		return fmt.Errorf("Unsupported arguments for %s: %T", serviceMethod, args)
+	}
+	result, ok := dsync.GrantedReply(reply, lockArgs)
+	if !ok {
+		return fmt.Errorf("Unsupported reply for %s: %T", serviceMethod, reply)
+	}
+
+	switch serviceMethod {
+	case "Dsync.Lock":
+		return l.lock(lockArgs, "write-", result)
+	case "Dsync.RLock":
+		return l.lock(lockArgs, "read-", result)
+	case "Dsync.Unlock":
+		return l.unlock(lockArgs, "Unlock", result)
+	case "Dsync.RUnlock":
+		return l.unlock(lockArgs, "RUnlock", result)
+	case "Dsync.ForceUnlock":
+		return l.forceUnlock(lockArgs, result)
+	case "Dsync.Expired":
+		return l.expired(lockArgs, result)
+	}
+	return fmt.Errorf("Unsupported method for ZooKeeper: %s", serviceMethod)
+}
+
+// Path of the znode of a lock: <prefix>/<namespace>:<name>, with namespace and name escaped so
+// that they cannot contain a slash (or a colon).
+func (l *Locker) lockPath(args *dsync.LockArgs) string {
+	return l.prefix + "/" + url.QueryEscape(args.Namespace) + ":" + url.QueryEscape(args.Name)
+}
+
+// lock creates a child for uid of the given kind and keeps it when the lock is granted.
+func (l *Locker) lock(args *dsync.LockArgs, kind string, reply *bool) error {
+	base := l.lockPath(args)
+	path, err := l.createChild(base+"/"+kind, args.UID)
+	if err != nil {
+		return err
+	}
+	children, err := l.getChildren(base)
+	if err != nil {
+		l.delete(path)
+		return err
+	}
+
+	seq := sequence(path)
+	*reply = true
+	for _, child := range children {
+		if sequence(child) < seq && (kind == "write-" || strings.HasPrefix(child, "write-")) {
+			*reply = false
+			break
+		}
+	}
+	if !*reply {
+		return l.delete(path)
+	}
+	l.mutex.Lock()
+	l.held[args.UID] = path
+	l.mutex.Unlock()
+	return nil
+}
+
+func (l *Locker) unlock(args *dsync.LockArgs, method string, reply *bool) error {
+	l.mutex.Lock()
+	path, ok := l.held[args.UID]
+	delete(l.held, args.UID)
+	l.mutex.Unlock()
+	if !ok {
+		return dsync.LockServerError(dsync.ErrLockNotHeld, method+" unable to find corresponding lock for uid: "+args.UID)
+	}
+	if err := l.delete(path); err != nil && err != ErrNoNode {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+func (l *Locker) forceUnlock(args *dsync.LockArgs, reply *bool) error {
+	if len(args.UID) != 0 {
+		return fmt.Errorf("ForceUnlock called with non-empty UID: %s", args.UID)
+	}
+	base := l.lockPath(args)
+	children, err := l.getChildren(base)
+	if err != nil && err != ErrNoNode {
+		return err
+	}
+	for _, child := range children {
+		if err := l.delete(base + "/" + child); err != nil && err != ErrNoNode {
+			return err
+		}
+	}
+	*reply = true
+	return nil
+}
+
+// expired reports whether the lock of uid is no longer held, eg. because the session in which
+// it was created expired.
+func (l *Locker) expired(args *dsync.LockArgs, reply *bool) error {
+	l.mutex.Lock()
+	path, ok := l.held[args.UID]
+	l.mutex.Unlock()
+	if !ok {
+		*reply = true
+		return nil
+	}
+	var e encoder
+	e.string(path)
+	e.bool(false) // No watch
+	_, err := l.session.do(opExists, e.buf)
+	if err == ErrNoNode {
+		*reply = true
+		return nil
+	}
+	*reply = false
+	return err
+}
+
+// expire forgets all locks held through l, as their znodes are gone with the session.
+func (l *Locker) expire() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.held = make(map[string]string)
+}
+
+// createChild creates an ephemeral sequential znode named prefix<seq> holding uid, creating the
+// container znodes above it first when needed, and returns its path.
+func (l *Locker) createChild(prefix, uid string) (string, error) {
+	for attempt := 0; ; attempt++ {
+		path, err := l.create(prefix, []byte(uid), opCreate, flagEphemeral|flagSequence)
+		if err != ErrNoNode || attempt == 2 {
+			return path, err
+		}
+		// A parent is missing (or was just removed as an empty container), so create the parents
+		for i := 1; i < len(prefix); i++ {
+			if prefix[i] != '/' {
+				continue
+			}
+			if _, err := l.create(prefix[:i], nil, opCreateContainer, flagContainer); err != nil && err != ErrNodeExists {
+				return "", err
+			}
+		}
+	}
+}
+
+func (l *Locker) create(path string, data []byte, op int32, flags int32) (string, error) {
+	var e encoder
+	e.string(path)
+	e.bytes(data)
+	e.worldACL()
+	e.int32(flags)
+	buf, err := l.session.do(op, e.buf)
+	if err != nil {
+		return "", err
+	}
+	d := decoder{buf: buf}
+	created := d.string()
+	return created, d.err
+}
+
+func (l *Locker) getChildren(path string) ([]string, error) {
+	var e encoder
+	e.string(path)
+	e.bool(false) // No watch
+	buf, err := l.session.do(opGetChildren, e.buf)
+	if err != nil {
+		return nil, err
+	}
+	d := decoder{buf: buf}
+	children := d.strings()
+	return children, d.err
+}
+
+func (l *Locker) delete(path string) error {
+	var e encoder
+	e.string(path)
+	e.int32(-1) // Any version
+	_, err := l.session.do(opDelete, e.buf)
+	return err
+}
+
+// sequence returns the sequence number ZooKeeper appended to the name (or path) of a znode, which
+// compares as a string as it is zero padded.
+func sequence(name string) string {
+	if len(name) < sequenceDigits {
+		return ""
+	}
+	return name[len(name)-sequenceDigits:]
+}
@@ -0,0 +1,211 @@
+/*
+ * Minio Cloud Storage, (C) 2016 Minio, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zookeeper
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/dsync"
+)
+
+type fakeZnode struct {
+	owner    int64 // Session of an ephemeral znode (0 otherwise)
+	sequence int   // Next sequence number of a child
+}
+
+// fakeZooKeeper serves the requests sent by the Locker on a tree of znodes (without expiry).
+type fakeZooKeeper struct {
+	mutex    sync.Mutex
+	znodes   map[string]*fakeZnode
+	sessions int64
+}
+
+func (f *fakeZooKeeper) exec(session int64, op int32, d *decoder) (int32, []byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var e encoder
+	switch op {
+	case opCreate, opCreateContainer:
+		name := d.string()
+		d.bytes()
+		d.int32()  // Number of ACLs
+		d.int32()  // Permissions
+		d.string() // Scheme
+		d.string() // Id
+		flags := d.int32()
+		parent, ok := f.znodes[path.Dir(name)]
+		if !ok {
+			return errCodeNoNode, nil
+		}
+		if flags&flagSequence != 0 {
+			name += fmt.Sprintf("%010d", parent.sequence)
+			parent.sequence++
+		}
+		if _, ok := f.znodes[name]; ok {
+			return errCodeNodeExists, nil
+		}
+		znode := &fakeZnode{}
+		if flags&flagEphemeral != 0 {
+			znode.owner = session
+		}
+		f.znodes[name] = znode
+		e.string(name)
+	case opDelete:
+		name := d.string()
+		if _, ok := f.znodes[name]; !ok {
+			return errCodeNoNode, nil
+		}
+		if len(f.children(name)) > 0 {
+			return errCodeNotEmpty, nil
+		}
+		delete(f.znodes, name)
+	case opExists:
+		if _, ok := f.znodes[d.string()]; !ok {
+			return errCodeNoNode, nil
+		}
+	case opGetChildren:
+		name := d.string()
+		if _, ok := f.znodes[name]; !ok {
+			return errCodeNoNode, nil
+		}
+		children := f.children(name)
+		e.int32(int32(len(children)))
+		for _, child := range children {
+			e.string(child)
+		}
+	case opClose:
+		for name, znode := range f.znodes {
+			if znode.owner == session {
+				delete(f.znodes, name)
+			}
+		}
+	}
+	return 0, e.buf
+}
+
+func (f *fakeZooKeeper) children(name string) (children []string) {
+	for child := range f.znodes {
+		if path.Dir(child) == name && child != name {
+			children = append(children, strings.TrimPrefix(child, name+"/"))
+		}
+	}
+	return children
+}
+
+func (f *fakeZooKeeper) serve(c net.Conn) {
+	defer c.Close()
+	if _, err := readPacket(c); err != nil {
+		return
+	}
+	f.mutex.Lock()
+	f.sessions++
+	session := f.sessions
+	f.mutex.Unlock()
+
+	var e encoder
+	e.int32(0)     // Protocol version
+	e.int32(10000) // Session timeout
+	e.int64(session)
+	e.bytes(make([]byte, 16))
+	if err := writePacket(c, e.buf); err != nil {
+		return
+	}
+	for {
+		buf, err := readPacket(c)
+		if err != nil {
+			return
+		}
+		d := decoder{buf: buf}
+		xid, op := d.int32(), d.int32()
+		code, body := f.exec(session, op, &d)
+		var e encoder
+		e.int32(xid)
+		e.int64(1) // Zxid
+		e.int32(code)
+		e.buf = append(e.buf, body...)
+		if err := writePacket(c, e.buf); err != nil || op == opClose {
+			return
+		}
+	}
+}
+
+func TestLocker(t *testing.T) {
+	fake := &fakeZooKeeper{znodes: map[string]*fakeZnode{"/": {}}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(c)
+		}
+	}()
+
+	// Two lockers on the same (fake) ensemble, so that dsync has the minimum of two nodes
+	lockers := []*Locker{New(ln.Addr().String(), "/dsync/0"), New(ln.Addr().String(), "/dsync/1")}
+	if err := dsync.SetNodesWithClients([]dsync.RPC{lockers[0], lockers[1]}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	dm := dsync.NewDRWMutex("test")
+	dm.Lock()
+
+	ch := make(chan struct{})
+	go func() {
+		dm := dsync.NewDRWMutex("test")
+		dm.RLock()
+		dm.RLock()
+		dm.RUnlock()
+		dm.RUnlock()
+		close(ch)
+	}()
+	select {
+	case <-ch:
+		t.Fatal("Read lock granted while write lock held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	dm.Unlock()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for read locks")
+	}
+
+	// Ending the session releases the locks held in it
+	dm.Lock()
+	for _, l := range lockers {
+		l.Close()
+	}
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	for name := range fake.znodes {
+		if strings.Contains(name, "/write-") {
+			t.Fatalf("Expected %s to be deleted with the session", name)
+		}
+	}
+}